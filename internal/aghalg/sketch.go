@@ -0,0 +1,111 @@
+package aghalg
+
+import (
+	"cmp"
+	"math"
+	"slices"
+
+	"golang.org/x/exp/maps"
+)
+
+// SketchRelAcc is the relative accuracy of the quantiles computed from a
+// [Sketch].
+const SketchRelAcc = 0.02
+
+// sketchLogGamma is the natural logarithm of the ratio between the bounds of a
+// single bin of a sketch.
+var sketchLogGamma = math.Log((1 + SketchRelAcc) / (1 - SketchRelAcc))
+
+// Sketch is a mergeable distribution of durations in microseconds.  The
+// durations are counted in bins with logarithmically growing bounds, so that
+// any quantile computed from it is within [SketchRelAcc] of the actual value.
+// The key is the index of the bin, see [SketchBin].
+type Sketch map[int32]uint64
+
+// SketchBin is a single bin of a [Sketch].
+//
+// NOTE: Do not change the names or types of fields, as this structure is used
+// for GOB encoding of the statistics data.
+type SketchBin struct {
+	// Index is the index of the bin.  The bin with index i contains the
+	// durations in the range of (γ^(i-1), γ^i] microseconds, and the durations
+	// of at most a microsecond are in the bin with index 0.
+	Index int32
+
+	// Count is the number of the durations in the bin.
+	Count uint64
+}
+
+// sketchIndex returns the index of the bin for the duration us in
+// microseconds.
+func sketchIndex(us uint64) (i int32) {
+	if us <= 1 {
+		return 0
+	}
+
+	return int32(math.Ceil(math.Log(float64(us)) / sketchLogGamma))
+}
+
+// sketchValue returns the duration in microseconds representing the bin with
+// index i, which is within [SketchRelAcc] of any duration in it.
+func sketchValue(i int32) (us float64) {
+	return 2 * math.Exp(float64(i)*sketchLogGamma) / (1 + math.Exp(sketchLogGamma))
+}
+
+// Add counts the duration us in microseconds.
+func (s Sketch) Add(us uint64) {
+	s[sketchIndex(us)]++
+}
+
+// Merge adds the bins to s.
+func (s Sketch) Merge(bins []SketchBin) {
+	for _, b := range bins {
+		s[b.Index] += b.Count
+	}
+}
+
+// Bins returns the bins of s sorted by index.
+func (s Sketch) Bins() (bins []SketchBin) {
+	bins = make([]SketchBin, 0, len(s))
+	for i, n := range s {
+		bins = append(bins, SketchBin{Index: i, Count: n})
+	}
+
+	slices.SortFunc(bins, func(a, b SketchBin) (res int) {
+		return cmp.Compare(a.Index, b.Index)
+	})
+
+	return bins
+}
+
+// Quantiles returns the durations in microseconds for each of qs, which must
+// be sorted and within [0, 1].  us is nil if s is empty.
+func (s Sketch) Quantiles(qs ...float64) (us []float64) {
+	var total uint64
+	for _, n := range s {
+		total += n
+	}
+
+	if total == 0 {
+		return nil
+	}
+
+	idxs := maps.Keys(s)
+	slices.Sort(idxs)
+
+	us = make([]float64, 0, len(qs))
+
+	var seen uint64
+	for _, i := range idxs {
+		seen += s[i]
+		for len(us) < len(qs) && float64(seen) > qs[len(us)]*float64(total-1) {
+			us = append(us, sketchValue(i))
+		}
+	}
+
+	for len(us) < len(qs) {
+		us = append(us, sketchValue(idxs[len(idxs)-1]))
+	}
+
+	return us
+}
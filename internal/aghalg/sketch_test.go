@@ -0,0 +1,34 @@
+package aghalg_test
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSketch_Quantiles(t *testing.T) {
+	assert.Nil(t, aghalg.Sketch{}.Quantiles(0.5))
+
+	sk := aghalg.Sketch{}
+	for us := uint64(1); us <= 10_000; us++ {
+		sk.Add(us)
+	}
+
+	got := sk.Quantiles(0, 0.5, 0.9, 0.99, 1)
+	require.Len(t, got, 5)
+
+	// Allow for the floating-point errors.
+	const epsilon = aghalg.SketchRelAcc * 1.001
+
+	for i, want := range []float64{1, 5_000, 9_000, 9_900, 10_000} {
+		assert.InEpsilon(t, want, got[i], epsilon)
+	}
+
+	merged := aghalg.Sketch{}
+	merged.Merge(sk.Bins())
+	merged.Merge(sk.Bins())
+
+	assert.Equal(t, got, merged.Quantiles(0, 0.5, 0.9, 0.99, 1))
+}
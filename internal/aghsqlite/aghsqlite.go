@@ -0,0 +1,93 @@
+// Package aghsqlite contains utilities for the SQLite databases used to store
+// the statistics and the query log.
+package aghsqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	"github.com/AdguardTeam/golibs/errors"
+
+	// Register the pure-Go SQLite driver.
+	_ "modernc.org/sqlite"
+)
+
+// busyTimeoutMs is the time in milliseconds a connection waits for a lock held
+// by another connection before failing.
+const busyTimeoutMs = 5_000
+
+// Open opens the SQLite database in the file at path, creating it if needed,
+// and applies schema to it.  The database uses write-ahead logging, so that
+// reading it, for example with the sqlite3 command-line tool, doesn't block
+// writing, and the transactions acquire the write lock immediately.
+func Open(path, schema string) (db *sql.DB, err error) {
+	q := url.Values{}
+	q.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", busyTimeoutMs))
+	q.Add("_pragma", "journal_mode(WAL)")
+	q.Add("_pragma", "synchronous(NORMAL)")
+	q.Set("_txlock", "immediate")
+
+	dsn := (&url.URL{Scheme: "file", Opaque: path, RawQuery: q.Encode()}).String()
+	db, err = sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("opening %q: %w", path, err)
+	}
+
+	_, err = db.Exec(schema)
+	if err != nil {
+		err = fmt.Errorf("applying schema to %q: %w", path, err)
+
+		return nil, errors.WithDeferred(err, db.Close())
+	}
+
+	return db, nil
+}
+
+// Finish commits tx if commit is true and rolls it back otherwise.
+func Finish(tx *sql.Tx, commit bool) (err error) {
+	if commit {
+		return errors.Annotate(tx.Commit(), "committing: %w")
+	}
+
+	return errors.Annotate(tx.Rollback(), "rolling back: %w")
+}
+
+// MetaSchema is the schema of the table containing the metadata of a database,
+// such as the completed migrations, which is required by [IsDone] and
+// [SetDone].
+const MetaSchema = `
+CREATE TABLE IF NOT EXISTS meta (
+	key   TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);`
+
+// IsDone returns true if the step with the given name, for example a
+// migration, is recorded as done in the metadata table.
+func IsDone(q querier, name string) (ok bool, err error) {
+	var v string
+	err = q.QueryRow(`SELECT value FROM meta WHERE key = ?`, name).Scan(&v)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("reading %q: %w", name, err)
+	}
+
+	return true, nil
+}
+
+// SetDone records the step with the given name as done in the metadata table.
+func SetDone(tx *sql.Tx, name, value string) (err error) {
+	_, err = tx.Exec(`INSERT OR REPLACE INTO meta (key, value) VALUES (?, ?)`, name, value)
+	if err != nil {
+		return fmt.Errorf("writing %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// querier is the common interface of [*sql.DB] and [*sql.Tx] used to query a
+// single row.
+type querier interface {
+	QueryRow(query string, args ...any) (row *sql.Row)
+}
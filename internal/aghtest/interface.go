@@ -131,7 +131,9 @@ type ClientsContainer struct {
 	OnUpstreamConfigByID func(
 		id string,
 		boot upstream.Resolver,
+		wrap func(uc *proxy.UpstreamConfig),
 	) (conf *proxy.CustomUpstreamConfig, err error)
+	OnObserveClient func(ip netip.Addr, clientID string)
 }
 
 // UpstreamConfigByID implements the [dnsforward.ClientsContainer] interface
@@ -139,8 +141,15 @@ type ClientsContainer struct {
 func (c *ClientsContainer) UpstreamConfigByID(
 	id string,
 	boot upstream.Resolver,
+	wrap func(uc *proxy.UpstreamConfig),
 ) (conf *proxy.CustomUpstreamConfig, err error) {
-	return c.OnUpstreamConfigByID(id, boot)
+	return c.OnUpstreamConfigByID(id, boot, wrap)
+}
+
+// ObserveClient implements the [dnsforward.ClientsContainer] interface for
+// *ClientsContainer.
+func (c *ClientsContainer) ObserveClient(ip netip.Addr, clientID string) {
+	c.OnObserveClient(ip, clientID)
 }
 
 // Package filtering
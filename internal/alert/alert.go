@@ -0,0 +1,472 @@
+// Package alert evaluates the alert rules on the processed DNS requests and
+// sends the notifications about the detected anomalies.
+package alert
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+)
+
+// Default values of the configuration.
+const (
+	defaultInterval    = 1 * time.Minute
+	defaultHistorySize = 100
+)
+
+// notifyTimeout is the timeout of sending a single notification.
+const notifyTimeout = 30 * time.Second
+
+// Config is the configuration of the alerts.
+type Config struct {
+	// HTTPClient is used to send the notifications to the HTTP channels.  If
+	// it's nil, [http.DefaultClient] is used.
+	HTTPClient *http.Client `yaml:"-"`
+
+	// HTTPRegister registers an HTTP handler.
+	HTTPRegister aghhttp.RegisterFunc `yaml:"-"`
+
+	// Filename is the path to the file the history of alerts is stored in.  If
+	// empty, it's only stored in memory.
+	Filename string `yaml:"-"`
+
+	// Rules are the alert rules.
+	Rules []*RuleConfig `yaml:"rules"`
+
+	// Channels are the notification channels.
+	Channels []*ChannelConfig `yaml:"channels"`
+
+	// Interval is the period of evaluating the rules.  If zero, one minute is
+	// used.
+	Interval timeutil.Duration `yaml:"interval"`
+
+	// HistorySize is the maximum number of the last alerts kept in the
+	// history.  If zero, the default value is used.
+	HistorySize uint `yaml:"history_size"`
+
+	// Enabled defines if the rules are evaluated.
+	Enabled bool `yaml:"enabled"`
+}
+
+// validate returns an error if c is invalid.
+func (c *Config) validate() (err error) {
+	if c.Interval.Duration < 0 {
+		return fmt.Errorf("negative interval %s", c.Interval)
+	}
+
+	var errs []error
+	channels := map[string]struct{}{}
+	for i, ch := range c.Channels {
+		err = ch.validate()
+		if err == nil {
+			if _, ok := channels[ch.Name]; ok {
+				err = fmt.Errorf("duplicate name %q", ch.Name)
+			}
+
+			channels[ch.Name] = struct{}{}
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("channel at index %d: %w", i, err))
+		}
+	}
+
+	rules := map[string]struct{}{}
+	for i, r := range c.Rules {
+		err = r.validate(channels)
+		if err == nil {
+			if _, ok := rules[r.Name]; ok {
+				err = fmt.Errorf("duplicate name %q", r.Name)
+			}
+
+			rules[r.Name] = struct{}{}
+		}
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("rule at index %d: %w", i, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Entry is a processed DNS request.
+type Entry struct {
+	// Client is the ClientID or the IP address of the client.
+	Client string
+
+	// Domain is the requested domain name.
+	Domain string
+
+	// Upstream is the address of the upstream that has answered the request,
+	// if any.
+	Upstream string
+
+	// Threat is the name of the reason of blocking the request as a malware
+	// or a phishing domain, for example "FilteredSafeBrowsing".  It's empty
+	// if the domain isn't a known threat.
+	Threat string
+
+	// Blocked is true if the request has been blocked by any filter.
+	Blocked bool
+}
+
+// Device is a device on the local network sending requests for the first
+// time.
+type Device struct {
+	// Name is the hostname of the device, if known.
+	Name string
+
+	// MAC is the hardware address of the device, if known.
+	MAC net.HardwareAddr
+
+	// ClientID is the ClientID the device has sent the request with, if any.
+	ClientID string
+
+	// IP is the IP address of the device.
+	IP netip.Addr
+}
+
+// ID returns the identifier of d:  its hardware address, if known, its
+// ClientID, if any, or its IP address.
+func (d *Device) ID() (id string) {
+	if len(d.MAC) > 0 {
+		return d.MAC.String()
+	} else if d.ClientID != "" {
+		return d.ClientID
+	}
+
+	return d.IP.String()
+}
+
+// String implements the [fmt.Stringer] interface for *Device.
+func (d *Device) String() (s string) {
+	s = d.IP.String()
+	if len(d.MAC) > 0 {
+		s = fmt.Sprintf("%s (%s)", d.MAC, s)
+	}
+
+	if d.Name != "" {
+		s = fmt.Sprintf("%s %s", d.Name, s)
+	}
+
+	return s
+}
+
+// Interface is the alerts module interface.
+type Interface interface {
+	// Start begins evaluating the rules.
+	Start()
+
+	// Close stops evaluating the rules and saves the history.
+	Close() (err error)
+
+	// Observe records the processed request.
+	Observe(e *Entry)
+
+	// ObserveUpstreamFailure records the failed exchange with the upstream.
+	ObserveUpstreamFailure(upstream string)
+}
+
+// Alert is a single fired alert.
+type Alert struct {
+	// Time is the time the alert has been fired.
+	Time time.Time `json:"time"`
+
+	// Rule is the name of the rule.
+	Rule string `json:"rule"`
+
+	// Type is the type of the rule.
+	Type RuleType `json:"type"`
+
+	// Subject is the client, the upstream, or the domain the alert is about.
+	// It's empty if the alert is about all the requests.
+	Subject string `json:"subject,omitempty"`
+
+	// Domain is the requested domain the alert is about, if any.
+	Domain string `json:"domain,omitempty"`
+
+	// Message is the human-readable description of the alert.
+	Message string `json:"message"`
+
+	// Value is the measured value that has exceeded the threshold of the rule,
+	// if any.
+	Value float64 `json:"value,omitempty"`
+}
+
+// Alerts evaluates the alert rules and sends the notifications.  It
+// implements [Interface].
+type Alerts struct {
+	// mu protects cur, buckets, cooldowns, and history.
+	mu *sync.Mutex
+
+	// cur is the bucket of the current evaluation interval.
+	cur *bucket
+
+	// buckets are the completed buckets from the oldest to the newest.
+	buckets []*bucket
+
+	// cooldowns are the times, before which the rules don't fire for the
+	// same subjects again, by the keys returned by [cooldownKey].
+	cooldowns map[string]time.Time
+
+	// history are the last fired alerts.
+	history *aghalg.RingBuffer[*Alert]
+
+	// done is closed when the evaluation must stop.
+	done chan struct{}
+
+	// wg waits for the evaluation goroutine to stop.
+	wg *sync.WaitGroup
+
+	rules    []*RuleConfig
+	channels map[string]notifier
+
+	filename string
+
+	interval time.Duration
+
+	// maxBuckets is the number of the completed buckets needed by the rules.
+	maxBuckets int
+
+	enabled bool
+}
+
+// type check
+var _ Interface = (*Alerts)(nil)
+
+// New returns the new properly initialized *Alerts.
+func New(conf *Config) (a *Alerts, err error) {
+	err = conf.validate()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	cli := conf.HTTPClient
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+
+	interval := conf.Interval.Duration
+	if interval == 0 {
+		interval = defaultInterval
+	}
+
+	historySize := conf.HistorySize
+	if historySize == 0 {
+		historySize = defaultHistorySize
+	}
+
+	a = &Alerts{
+		mu:        &sync.Mutex{},
+		cur:       newBucket(),
+		cooldowns: map[string]time.Time{},
+		history:   aghalg.NewRingBuffer[*Alert](historySize),
+		done:      make(chan struct{}),
+		wg:        &sync.WaitGroup{},
+		channels:  make(map[string]notifier, len(conf.Channels)),
+		filename:  conf.Filename,
+		interval:  interval,
+		enabled:   conf.Enabled,
+	}
+
+	for _, ch := range conf.Channels {
+		if ch.Enabled {
+			a.channels[ch.Name] = newNotifier(ch, cli)
+		}
+	}
+
+	for _, r := range conf.Rules {
+		if !r.Enabled {
+			continue
+		}
+
+		a.rules = append(a.rules, r)
+		a.maxBuckets = max(a.maxBuckets, r.bucketsNeeded(interval))
+	}
+
+	err = a.loadState()
+	if err != nil {
+		return nil, fmt.Errorf("loading state: %w", err)
+	}
+
+	if conf.HTTPRegister != nil {
+		conf.HTTPRegister(http.MethodGet, "/control/alerts/history", a.handleHistory)
+	}
+
+	return a, nil
+}
+
+// Start implements the [Interface] interface for *Alerts.
+func (a *Alerts) Start() {
+	if !a.enabled || len(a.rules) == 0 {
+		return
+	}
+
+	a.wg.Add(1)
+	go a.evaluateLoop()
+}
+
+// Close implements the [Interface] interface for *Alerts.
+func (a *Alerts) Close() (err error) {
+	close(a.done)
+	a.wg.Wait()
+
+	a.mu.Lock()
+	st := a.snapshot()
+	a.mu.Unlock()
+
+	return st.write(a.filename)
+}
+
+// Observe implements the [Interface] interface for *Alerts.
+func (a *Alerts) Observe(e *Entry) {
+	if !a.enabled || len(a.rules) == 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.cur.add(e)
+}
+
+// ObserveUpstreamFailure implements the [Interface] interface for *Alerts.
+func (a *Alerts) ObserveUpstreamFailure(upstream string) {
+	if !a.enabled || len(a.rules) == 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.cur.upstreamFailures[upstream]++
+}
+
+// ObserveNewClient records the device, which isn't a persistent client,
+// sending requests for the first time.  The rules of type [RuleTypeNewClient]
+// fire for it.
+func (a *Alerts) ObserveNewClient(d *Device) {
+	if !a.enabled || len(a.rules) == 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.cur.addNewClient(d)
+}
+
+// evaluateLoop evaluates the rules every interval until a.done is closed.  It
+// is intended to be used as a goroutine.
+func (a *Alerts) evaluateLoop() {
+	defer a.wg.Done()
+	defer log.OnPanic("alert: evaluating")
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case now := <-ticker.C:
+			fired, st := a.evaluate(now)
+			if st != nil {
+				err := st.write(a.filename)
+				if err != nil {
+					log.Error("alert: saving state: %s", err)
+				}
+			}
+
+			for _, al := range fired {
+				a.notify(al)
+			}
+		}
+	}
+}
+
+// evaluate completes the current bucket and returns the alerts fired by the
+// rules.  The alerts are added to the history.  st is the state to save, if it
+// has changed.
+func (a *Alerts) evaluate(now time.Time) (fired []*Alert, st *state) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.buckets = append(a.buckets, a.cur)
+	if over := len(a.buckets) - a.maxBuckets; over > 0 {
+		a.buckets = slices.Delete(a.buckets, 0, over)
+	}
+
+	a.cur = newBucket()
+
+	for _, r := range a.rules {
+		for _, al := range r.evaluate(a.buckets, a.interval) {
+			key := cooldownKey(r.Name, al.Subject, al.Domain)
+			if now.Before(a.cooldowns[key]) {
+				continue
+			}
+
+			a.cooldowns[key] = now.Add(r.cooldown())
+
+			al.Time = now
+			al.Rule = r.Name
+			al.Type = r.Type
+
+			a.history.Append(al)
+			fired = append(fired, al)
+		}
+	}
+
+	for key, t := range a.cooldowns {
+		if !now.Before(t) {
+			delete(a.cooldowns, key)
+		}
+	}
+
+	if len(fired) > 0 {
+		st = a.snapshot()
+	}
+
+	return fired, st
+}
+
+// cooldownKey returns the key of the cooldown of the rule with the name for
+// the subject and the domain.
+func cooldownKey(rule, subject, domain string) (key string) {
+	return rule + "\x00" + subject + "\x00" + domain
+}
+
+// notify sends al to the channels of its rule.  Any errors are logged.
+func (a *Alerts) notify(al *Alert) {
+	idx := slices.IndexFunc(a.rules, func(r *RuleConfig) (ok bool) { return r.Name == al.Rule })
+	if idx < 0 {
+		return
+	}
+
+	names := a.rules[idx].Channels
+	for name, n := range a.channels {
+		if len(names) > 0 && !slices.Contains(names, name) {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		err := n.notify(ctx, al)
+		cancel()
+		if err != nil {
+			log.Error("alert: notifying %q about rule %q: %s", name, al.Rule, err)
+		}
+	}
+}
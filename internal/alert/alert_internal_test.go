@@ -0,0 +1,266 @@
+package alert
+
+import (
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	testutil.DiscardLogOutput(m)
+}
+
+// testInterval is the evaluation interval for tests.
+const testInterval = time.Minute
+
+// newTestAlerts returns the new *Alerts with rules for tests.
+func newTestAlerts(t *testing.T, conf *Config) (a *Alerts) {
+	t.Helper()
+
+	conf.Interval = timeutil.Duration{Duration: testInterval}
+	conf.Enabled = true
+
+	a, err := New(conf)
+	require.NoError(t, err)
+
+	return a
+}
+
+// observeN records n requests of the client.
+func observeN(a *Alerts, n int, e *Entry) {
+	for i := 0; i < n; i++ {
+		a.Observe(e)
+	}
+}
+
+func TestRuleConfig_evaluate(t *testing.T) {
+	const (
+		cli1 = "1.2.3.4"
+		cli2 = "5.6.7.8"
+		ups  = "https://dns.example"
+	)
+
+	newBuckets := func(n int) (bs []*bucket) {
+		for i := 0; i < n; i++ {
+			bs = append(bs, newBucket())
+		}
+
+		return bs
+	}
+
+	t.Run("blocked_ratio", func(t *testing.T) {
+		r := &RuleConfig{
+			Name:        "blocked",
+			Type:        RuleTypeBlockedRatio,
+			MinRequests: 10,
+		}
+
+		bs := newBuckets(1)
+		for i := 0; i < 10; i++ {
+			bs[0].add(&Entry{Client: cli1, Blocked: i < 6})
+		}
+
+		alerts := r.evaluate(bs, testInterval)
+		require.Len(t, alerts, 1)
+
+		assert.InDelta(t, 0.6, alerts[0].Value, 1e-9)
+		assert.Empty(t, alerts[0].Subject)
+
+		r.Threshold = 0.7
+		assert.Empty(t, r.evaluate(bs, testInterval))
+
+		r.Threshold, r.MinRequests = 0, 11
+		assert.Empty(t, r.evaluate(bs, testInterval))
+	})
+
+	t.Run("upstream_error_rate", func(t *testing.T) {
+		r := &RuleConfig{
+			Name:        "upstreams",
+			Type:        RuleTypeUpstreamErrorRate,
+			Threshold:   0.25,
+			MinRequests: 10,
+			Window:      timeutil.Duration{Duration: 2 * testInterval},
+		}
+
+		// The first bucket is out of the window.
+		bs := newBuckets(3)
+		bs[0].upstreamFailures[ups] = 100
+		bs[1].upstreams[ups] = 4
+		bs[2].upstreams[ups] = 4
+		bs[2].upstreamFailures[ups] = 2
+
+		assert.Empty(t, r.evaluate(bs, testInterval))
+
+		bs[1].upstreamFailures[ups] = 2
+
+		alerts := r.evaluate(bs, testInterval)
+		require.Len(t, alerts, 1)
+
+		assert.Equal(t, ups, alerts[0].Subject)
+		assert.InDelta(t, 4.0/12.0, alerts[0].Value, 1e-9)
+	})
+
+	t.Run("new_client", func(t *testing.T) {
+		r := &RuleConfig{Name: "new", Type: RuleTypeNewClient}
+
+		bs := newBuckets(2)
+		bs[0].addNewClient(&Device{IP: netip.MustParseAddr(cli1)})
+		bs[1].addNewClient(&Device{
+			Name: "phone",
+			MAC:  net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+			IP:   netip.MustParseAddr(cli1),
+		})
+		bs[1].addNewClient(&Device{ClientID: "laptop", IP: netip.MustParseAddr(cli2)})
+		bs[1].addNewClient(&Device{IP: netip.MustParseAddr(cli2)})
+
+		alerts := r.evaluate(bs, testInterval)
+		require.Len(t, alerts, 3)
+
+		assert.Equal(t, "aa:bb:cc:dd:ee:ff", alerts[0].Subject)
+		assert.Equal(t, "new client phone aa:bb:cc:dd:ee:ff (1.2.3.4)", alerts[0].Message)
+		assert.Equal(t, "laptop", alerts[1].Subject)
+		assert.Equal(t, cli2, alerts[2].Subject)
+		assert.Equal(t, "new client 5.6.7.8", alerts[2].Message)
+	})
+
+	t.Run("threat_domain", func(t *testing.T) {
+		r := &RuleConfig{Name: "threats", Type: RuleTypeThreatDomain}
+
+		e := &Entry{Client: cli1, Domain: "bad.example", Threat: "FilteredSafeBrowsing"}
+
+		bs := newBuckets(1)
+		bs[0].add(e)
+		bs[0].add(e)
+		bs[0].add(&Entry{Client: cli2, Domain: "good.example"})
+
+		alerts := r.evaluate(bs, testInterval)
+		require.Len(t, alerts, 1)
+
+		assert.Equal(t, cli1, alerts[0].Subject)
+		assert.Equal(t, "bad.example", alerts[0].Domain)
+	})
+
+	t.Run("client_spike", func(t *testing.T) {
+		r := &RuleConfig{
+			Name:        "spike",
+			Type:        RuleTypeClientSpike,
+			MinRequests: 10,
+		}
+
+		bs := newBuckets(3)
+		bs[0].clients[cli1] = 2
+		bs[1].clients[cli1] = 4
+		bs[1].clients[cli2] = 100
+		bs[2].clients[cli1] = 20
+		bs[2].clients[cli2] = 100
+
+		// The average of cli1 is 3, so the factor is about 6.7, while cli2
+		// sends as many requests as usual.
+		alerts := r.evaluate(bs, testInterval)
+		require.Len(t, alerts, 1)
+
+		assert.Equal(t, cli1, alerts[0].Subject)
+		assert.InDelta(t, 20.0/3.0, alerts[0].Value, 1e-9)
+	})
+}
+
+func TestAlerts_evaluate(t *testing.T) {
+	const cli = "1.2.3.4"
+
+	a := newTestAlerts(t, &Config{
+		Rules: []*RuleConfig{{
+			Name:    "new",
+			Type:    RuleTypeNewClient,
+			Enabled: true,
+		}, {
+			Name:        "blocked",
+			Type:        RuleTypeBlockedRatio,
+			MinRequests: 2,
+			Cooldown:    timeutil.Duration{Duration: 2 * testInterval},
+			Enabled:     true,
+		}, {
+			Name:    "disabled",
+			Type:    RuleTypeThreatDomain,
+			Enabled: false,
+		}},
+	})
+
+	blocked := &Entry{
+		Client:  cli,
+		Domain:  "bad.example",
+		Threat:  "FilteredSafeBrowsing",
+		Blocked: true,
+	}
+
+	now := time.Now()
+
+	observeN(a, 2, blocked)
+	a.ObserveNewClient(&Device{IP: netip.MustParseAddr(cli)})
+
+	fired, st := a.evaluate(now)
+	require.Len(t, fired, 2)
+	require.NotNil(t, st)
+
+	assert.Equal(t, "new", fired[0].Rule)
+	assert.Equal(t, cli, fired[0].Subject)
+	assert.Equal(t, "blocked", fired[1].Rule)
+	assert.Equal(t, now, fired[1].Time)
+
+	assert.Len(t, st.History, 2)
+
+	// The blocked ratio is still high, but the rule is cooling down.
+	now = now.Add(testInterval)
+	observeN(a, 2, blocked)
+
+	fired, st = a.evaluate(now)
+	assert.Empty(t, fired)
+	assert.Nil(t, st)
+
+	now = now.Add(testInterval)
+	observeN(a, 2, blocked)
+
+	fired, _ = a.evaluate(now)
+	require.Len(t, fired, 1)
+
+	assert.Equal(t, "blocked", fired[0].Rule)
+}
+
+func TestAlerts_state(t *testing.T) {
+	const cli = "1.2.3.4"
+
+	conf := &Config{
+		Filename: filepath.Join(t.TempDir(), "alerts.json"),
+		Rules: []*RuleConfig{{
+			Name:    "new",
+			Type:    RuleTypeNewClient,
+			Enabled: true,
+		}},
+	}
+
+	a := newTestAlerts(t, conf)
+	a.ObserveNewClient(&Device{IP: netip.MustParseAddr(cli)})
+
+	fired, _ := a.evaluate(time.Now())
+	require.Len(t, fired, 1)
+
+	require.NoError(t, a.Close())
+
+	// The history is remembered after restart.
+	a = newTestAlerts(t, conf)
+	testutil.CleanupAndRequireSuccess(t, a.Close)
+
+	require.EqualValues(t, 1, a.history.Len())
+
+	a.history.Range(func(al *Alert) (cont bool) {
+		assert.Equal(t, cli, al.Subject)
+
+		return true
+	})
+}
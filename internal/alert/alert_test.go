@@ -0,0 +1,123 @@
+package alert_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/alert"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew_validate(t *testing.T) {
+	hook := &alert.ChannelConfig{
+		Name: "hook",
+		Type: alert.ChannelTypeWebhook,
+		URL:  "https://hooks.example/alerts",
+	}
+
+	testCases := []struct {
+		conf       *alert.Config
+		name       string
+		wantErrMsg string
+	}{{
+		conf: &alert.Config{
+			Channels: []*alert.ChannelConfig{hook},
+			Rules: []*alert.RuleConfig{{
+				Name:     "blocked",
+				Type:     alert.RuleTypeBlockedRatio,
+				Channels: []string{"hook"},
+			}},
+		},
+		name:       "good",
+		wantErrMsg: "",
+	}, {
+		conf: &alert.Config{
+			Channels: []*alert.ChannelConfig{hook, hook},
+		},
+		name:       "duplicate_channel",
+		wantErrMsg: `channel at index 1: duplicate name "hook"`,
+	}, {
+		conf: &alert.Config{
+			Channels: []*alert.ChannelConfig{{
+				Name: "mail",
+				Type: alert.ChannelTypeSMTP,
+				URL:  "smtp://127.0.0.1:25",
+				From: "agh@example.com",
+			}},
+		},
+		name:       "no_recipients",
+		wantErrMsg: "channel at index 0: no recipients",
+	}, {
+		conf: &alert.Config{
+			Rules: []*alert.RuleConfig{{
+				Name:     "blocked",
+				Type:     alert.RuleTypeBlockedRatio,
+				Channels: []string{"hook"},
+			}},
+		},
+		name:       "unknown_channel",
+		wantErrMsg: `rule at index 0: unknown channel "hook"`,
+	}, {
+		conf: &alert.Config{
+			Rules: []*alert.RuleConfig{{
+				Name:      "blocked",
+				Type:      alert.RuleTypeBlockedRatio,
+				Threshold: 2,
+			}, {
+				Name: "bad",
+				Type: "bad_type",
+			}},
+		},
+		name: "several",
+		wantErrMsg: "rule at index 0: threshold 2 is greater than 1\n" +
+			`rule at index 1: bad type "bad_type"`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := alert.New(tc.conf)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestAlerts_handleHistory(t *testing.T) {
+	var handler http.HandlerFunc
+	a, err := alert.New(&alert.Config{
+		HTTPRegister: func(_, url string, h http.HandlerFunc) {
+			require.Equal(t, "/control/alerts/history", url)
+
+			handler = h
+		},
+		Enabled: true,
+	})
+	require.NoError(t, err)
+	require.NotNil(t, handler)
+
+	testutil.CleanupAndRequireSuccess(t, a.Close)
+
+	t.Run("empty", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/control/alerts/history", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp := map[string]any{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+
+		assert.Equal(t, map[string]any{
+			"alerts":  []any{},
+			"enabled": true,
+		}, resp)
+	})
+
+	t.Run("bad_limit", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/control/alerts/history?limit=-1", nil))
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
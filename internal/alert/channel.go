@@ -0,0 +1,271 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/httphdr"
+)
+
+// ChannelType is the type of a notification channel.
+type ChannelType string
+
+// Supported ChannelType values.
+const (
+	// ChannelTypeWebhook sends every alert as a JSON object in a POST request.
+	ChannelTypeWebhook ChannelType = "webhook"
+
+	// ChannelTypeSMTP sends every alert as an email through an SMTP relay,
+	// which doesn't require authentication, for example a local one.
+	ChannelTypeSMTP ChannelType = "smtp"
+
+	// ChannelTypeNtfy publishes every alert to a topic of an ntfy server.
+	ChannelTypeNtfy ChannelType = "ntfy"
+
+	// ChannelTypeGotify sends every alert as a message to a Gotify server.
+	ChannelTypeGotify ChannelType = "gotify"
+)
+
+// ChannelConfig is the configuration of a notification channel.
+type ChannelConfig struct {
+	// Name is the unique name of the channel used in the rules.
+	Name string `yaml:"name"`
+
+	// Type is the type of the channel.
+	Type ChannelType `yaml:"type"`
+
+	// URL is the address of the channel.  For webhooks, it's the URL to send
+	// POST requests to.  For ntfy, it's the URL of the topic, for example
+	// "https://ntfy.sh/my-topic".  For Gotify, it's the URL of the server.
+	// For SMTP, it's the address of the relay, for example
+	// "smtp://127.0.0.1:25".
+	URL string `yaml:"url"`
+
+	// Headers are the additional headers of HTTP requests, for example
+	// "Authorization" for ntfy or "X-Gotify-Key" with the token of the
+	// application for Gotify.
+	Headers map[string]string `yaml:"headers,omitempty"`
+
+	// From is the address of the sender of emails.
+	From string `yaml:"from,omitempty"`
+
+	// To are the addresses of the recipients of emails.
+	To []string `yaml:"to,omitempty"`
+
+	// Enabled defines if the channel is used.
+	Enabled bool `yaml:"enabled"`
+}
+
+// validate returns an error if c is invalid.
+func (c *ChannelConfig) validate() (err error) {
+	switch {
+	case c == nil:
+		return errors.Error("no channel configuration")
+	case c.Name == "":
+		return errors.Error("empty name")
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("url: %w", err)
+	}
+
+	switch c.Type {
+	case ChannelTypeWebhook, ChannelTypeNtfy, ChannelTypeGotify:
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("bad url scheme %q", u.Scheme)
+		}
+	case ChannelTypeSMTP:
+		return c.validateSMTP(u)
+	default:
+		return fmt.Errorf("bad type %q", c.Type)
+	}
+
+	return nil
+}
+
+// validateSMTP returns an error if the SMTP-specific parameters of c are
+// invalid.
+func (c *ChannelConfig) validateSMTP(u *url.URL) (err error) {
+	if u.Scheme != "smtp" || u.Host == "" {
+		return fmt.Errorf("bad smtp url %q", c.URL)
+	}
+
+	_, err = mail.ParseAddress(c.From)
+	if err != nil {
+		return fmt.Errorf("from: %w", err)
+	}
+
+	if len(c.To) == 0 {
+		return errors.Error("no recipients")
+	}
+
+	for i, addr := range c.To {
+		_, err = mail.ParseAddress(addr)
+		if err != nil {
+			return fmt.Errorf("to: at index %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// notifier sends the notifications about alerts.
+type notifier interface {
+	// notify sends the notification about al.
+	notify(ctx context.Context, al *Alert) (err error)
+}
+
+// newNotifier returns a new notifier for the valid c.
+func newNotifier(c *ChannelConfig, cli *http.Client) (n notifier) {
+	switch c.Type {
+	case ChannelTypeWebhook:
+		return &webhookNotifier{cli: cli, headers: c.Headers, url: c.URL}
+	case ChannelTypeNtfy:
+		return &ntfyNotifier{cli: cli, headers: c.Headers, url: c.URL}
+	case ChannelTypeGotify:
+		return &gotifyNotifier{
+			cli:     cli,
+			headers: c.Headers,
+			url:     strings.TrimSuffix(c.URL, "/") + "/message",
+		}
+	default:
+		// Assume that the type has been validated.
+		return newSMTPNotifier(c)
+	}
+}
+
+// title returns the short title of the notification about al.
+func (al *Alert) title() (t string) {
+	return fmt.Sprintf("AdGuard Home alert: %s", al.Rule)
+}
+
+// webhookNotifier is a notifier sending alerts as JSON objects in POST
+// requests.
+type webhookNotifier struct {
+	cli     *http.Client
+	headers map[string]string
+	url     string
+}
+
+// type check
+var _ notifier = (*webhookNotifier)(nil)
+
+// notify implements the notifier interface for *webhookNotifier.
+func (n *webhookNotifier) notify(ctx context.Context, al *Alert) (err error) {
+	body := &bytes.Buffer{}
+	err = json.NewEncoder(body).Encode(al)
+	if err != nil {
+		return fmt.Errorf("encoding: %w", err)
+	}
+
+	return post(ctx, n.cli, n.url, aghhttp.HdrValApplicationJSON, n.headers, body)
+}
+
+// ntfyNotifier is a notifier publishing alerts to an ntfy topic.
+type ntfyNotifier struct {
+	cli     *http.Client
+	headers map[string]string
+	url     string
+}
+
+// type check
+var _ notifier = (*ntfyNotifier)(nil)
+
+// notify implements the notifier interface for *ntfyNotifier.
+func (n *ntfyNotifier) notify(ctx context.Context, al *Alert) (err error) {
+	headers := map[string]string{
+		"Title": al.title(),
+		"Tags":  string(al.Type),
+	}
+
+	for k, v := range n.headers {
+		headers[k] = v
+	}
+
+	body := strings.NewReader(al.Message)
+
+	return post(ctx, n.cli, n.url, aghhttp.HdrValTextPlain, headers, body)
+}
+
+// gotifyNotifier is a notifier sending alerts as messages to a Gotify server.
+type gotifyNotifier struct {
+	cli     *http.Client
+	headers map[string]string
+	url     string
+}
+
+// gotifyMessage is the message of the Gotify API.
+type gotifyMessage struct {
+	Title    string `json:"title"`
+	Message  string `json:"message"`
+	Priority int    `json:"priority"`
+}
+
+// gotifyPriority is the priority of the messages sent to Gotify.  It's high
+// enough to trigger a notification on the default Android client.
+const gotifyPriority = 5
+
+// type check
+var _ notifier = (*gotifyNotifier)(nil)
+
+// notify implements the notifier interface for *gotifyNotifier.
+func (n *gotifyNotifier) notify(ctx context.Context, al *Alert) (err error) {
+	body := &bytes.Buffer{}
+	err = json.NewEncoder(body).Encode(&gotifyMessage{
+		Title:    al.title(),
+		Message:  al.Message,
+		Priority: gotifyPriority,
+	})
+	if err != nil {
+		return fmt.Errorf("encoding: %w", err)
+	}
+
+	return post(ctx, n.cli, n.url, aghhttp.HdrValApplicationJSON, n.headers, body)
+}
+
+// post sends body in a POST request to u and checks that the response has a
+// successful status.
+func post(
+	ctx context.Context,
+	cli *http.Client,
+	u string,
+	contentType string,
+	headers map[string]string,
+	body io.Reader,
+) (err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, body)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set(httphdr.ContentType, contentType)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := cli.Do(req)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	// Read the body to reuse the connection.
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("got status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,245 @@
+package alert
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/httphdr"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testTimeout is the common timeout for tests.
+const testTimeout = 1 * time.Second
+
+// testAlert is the alert sent in tests.
+var testAlert = &Alert{
+	Time:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	Rule:    "blocked",
+	Type:    RuleTypeBlockedRatio,
+	Message: "60.0% of 100 requests blocked",
+	Value:   0.6,
+}
+
+// testRequest is the received HTTP request.
+type testRequest struct {
+	header http.Header
+	path   string
+	body   []byte
+}
+
+// newTestServer returns the URL of a test HTTP server sending the received
+// requests into the returned channel.
+func newTestServer(t *testing.T) (u string, reqs chan *testRequest) {
+	t.Helper()
+
+	reqs = make(chan *testRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(testutil.PanicT{}, err)
+
+		reqs <- &testRequest{
+			header: r.Header,
+			path:   r.URL.Path,
+			body:   body,
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv.URL, reqs
+}
+
+func TestNotifiers_http(t *testing.T) {
+	u, reqs := newTestServer(t)
+
+	testCases := []struct {
+		check func(t *testing.T, req *testRequest)
+		name  string
+		conf  *ChannelConfig
+	}{{
+		check: func(t *testing.T, req *testRequest) {
+			al := &Alert{}
+			require.NoError(t, json.Unmarshal(req.body, al))
+
+			assert.Equal(t, testAlert, al)
+			assert.Equal(t, "secret", req.header.Get("X-Token"))
+		},
+		name: "webhook",
+		conf: &ChannelConfig{
+			Name:    "hook",
+			Type:    ChannelTypeWebhook,
+			URL:     u + "/hook",
+			Headers: map[string]string{"X-Token": "secret"},
+		},
+	}, {
+		check: func(t *testing.T, req *testRequest) {
+			assert.Equal(t, "/topic", req.path)
+			assert.Equal(t, testAlert.Message, string(req.body))
+			assert.Equal(t, testAlert.title(), req.header.Get("Title"))
+			assert.Equal(t, string(RuleTypeBlockedRatio), req.header.Get("Tags"))
+		},
+		name: "ntfy",
+		conf: &ChannelConfig{
+			Name: "ntfy",
+			Type: ChannelTypeNtfy,
+			URL:  u + "/topic",
+		},
+	}, {
+		check: func(t *testing.T, req *testRequest) {
+			msg := &gotifyMessage{}
+			require.NoError(t, json.Unmarshal(req.body, msg))
+
+			assert.Equal(t, "/message", req.path)
+			assert.Equal(t, "app-token", req.header.Get("X-Gotify-Key"))
+			assert.Equal(t, &gotifyMessage{
+				Title:    testAlert.title(),
+				Message:  testAlert.Message,
+				Priority: gotifyPriority,
+			}, msg)
+		},
+		name: "gotify",
+		conf: &ChannelConfig{
+			Name:    "gotify",
+			Type:    ChannelTypeGotify,
+			URL:     u + "/",
+			Headers: map[string]string{"X-Gotify-Key": "app-token"},
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, tc.conf.validate())
+
+			n := newNotifier(tc.conf, http.DefaultClient)
+
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			t.Cleanup(cancel)
+
+			require.NoError(t, n.notify(ctx, testAlert))
+
+			req, ok := testutil.RequireReceive(t, reqs, testTimeout)
+			require.True(t, ok)
+
+			tc.check(t, req)
+		})
+	}
+}
+
+func TestNotifiers_httpError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	t.Cleanup(srv.Close)
+
+	n := newNotifier(&ChannelConfig{Type: ChannelTypeWebhook, URL: srv.URL}, http.DefaultClient)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	testutil.AssertErrorMsg(t, "got status code 401", n.notify(ctx, testAlert))
+}
+
+// serveSMTP accepts a single connection on l, plays the server side of an
+// SMTP session, and sends the received message into msgs.
+func serveSMTP(l net.Listener, msgs chan<- string) {
+	pt := testutil.PanicT{}
+
+	conn, err := l.Accept()
+	require.NoError(pt, err)
+
+	defer func() { require.NoError(pt, conn.Close()) }()
+
+	tc := textproto.NewConn(conn)
+	reply := func(format string, args ...any) {
+		require.NoError(pt, tc.PrintfLine(format, args...))
+	}
+
+	reply("220 localhost ESMTP")
+
+	var rcpts []string
+	for {
+		line, rerr := tc.ReadLine()
+		require.NoError(pt, rerr)
+
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(cmd) {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "MAIL":
+			reply("250 OK")
+		case "RCPT":
+			rcpts = append(rcpts, arg)
+			reply("250 OK")
+		case "DATA":
+			reply("354 Go ahead")
+
+			data, derr := tc.ReadDotBytes()
+			require.NoError(pt, derr)
+
+			msgs <- fmt.Sprintf("%s\n%s", strings.Join(rcpts, ","), data)
+			reply("250 OK")
+		case "QUIT":
+			reply("221 Bye")
+
+			return
+		default:
+			reply("502 Not implemented")
+		}
+	}
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	msgs := make(chan string, 1)
+	go serveSMTP(l, msgs)
+
+	conf := &ChannelConfig{
+		Name: "mail",
+		Type: ChannelTypeSMTP,
+		URL:  "smtp://" + l.Addr().String(),
+		From: "AdGuard Home <agh@example.com>",
+		To:   []string{"admin@example.com"},
+	}
+	require.NoError(t, conf.validate())
+
+	n := newNotifier(conf, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+
+	require.NoError(t, n.notify(ctx, testAlert))
+
+	msg, ok := testutil.RequireReceive(t, msgs, testTimeout)
+	require.True(t, ok)
+
+	rcpts, data, _ := strings.Cut(msg, "\n")
+	assert.Equal(t, "TO:<admin@example.com>", rcpts)
+
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(data)))
+	hdr, err := r.ReadMIMEHeader()
+	require.NoError(t, err)
+
+	assert.Equal(t, `"AdGuard Home" <agh@example.com>`, hdr.Get("From"))
+	assert.Equal(t, "admin@example.com", hdr.Get("To"))
+	assert.Equal(t, testAlert.title(), hdr.Get("Subject"))
+	assert.Equal(t, "text/plain; charset=utf-8", hdr.Get(httphdr.ContentType))
+
+	body, err := io.ReadAll(r.R)
+	require.NoError(t, err)
+
+	assert.Equal(t, testAlert.Message+"\n", string(body))
+}
@@ -0,0 +1,55 @@
+package alert
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+)
+
+// historyResp is the response of the GET /control/alerts/history HTTP API.
+type historyResp struct {
+	// Alerts are the last fired alerts from the newest to the oldest.
+	Alerts []*Alert `json:"alerts"`
+
+	// Enabled is true if the rules are evaluated.
+	Enabled bool `json:"enabled"`
+}
+
+// handleHistory is the handler for the GET /control/alerts/history HTTP API.
+// The optional "limit" query parameter is the maximum number of the returned
+// alerts.
+func (a *Alerts) handleHistory(w http.ResponseWriter, r *http.Request) {
+	limit := -1
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			aghhttp.Error(r, w, http.StatusBadRequest, "limit: bad value %q", s)
+
+			return
+		}
+	}
+
+	resp := &historyResp{
+		Alerts:  []*Alert{},
+		Enabled: a.enabled,
+	}
+
+	func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		a.history.ReverseRange(func(al *Alert) (cont bool) {
+			if limit >= 0 && len(resp.Alerts) >= limit {
+				return false
+			}
+
+			resp.Alerts = append(resp.Alerts, al)
+
+			return true
+		})
+	}()
+
+	aghhttp.WriteJSONResponseOK(w, r, resp)
+}
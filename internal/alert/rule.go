@@ -0,0 +1,437 @@
+package alert
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"golang.org/x/exp/maps"
+)
+
+// RuleType is the type of an alert rule.
+type RuleType string
+
+// Supported RuleType values.
+const (
+	// RuleTypeBlockedRatio fires when the share of the blocked requests
+	// exceeds the threshold.
+	RuleTypeBlockedRatio RuleType = "blocked_ratio"
+
+	// RuleTypeUpstreamErrorRate fires for each upstream, the share of the
+	// failed exchanges with which exceeds the threshold.
+	RuleTypeUpstreamErrorRate RuleType = "upstream_error_rate"
+
+	// RuleTypeNewClient fires for each client, identified by its hardware
+	// address, ClientID, or IP address, sending requests for the first time,
+	// if it isn't a persistent client.
+	RuleTypeNewClient RuleType = "new_client"
+
+	// RuleTypeThreatDomain fires for each client requesting a domain known as
+	// a malware or a phishing one.
+	RuleTypeThreatDomain RuleType = "threat_domain"
+
+	// RuleTypeClientSpike fires for each client, the number of requests of
+	// which exceeds its average number of requests in the previous windows by
+	// the threshold times.
+	RuleTypeClientSpike RuleType = "client_spike"
+)
+
+const (
+	// defaultCooldown is the default minimum time between two alerts of a rule
+	// about the same subject.
+	defaultCooldown = 1 * time.Hour
+
+	// spikeBaselineWindows is the number of the previous windows the number
+	// of requests of a client is compared with by the rules of type
+	// [RuleTypeClientSpike].
+	spikeBaselineWindows = 12
+
+	// maxBucketEvents is the maximum number of the new clients and the
+	// requests for the threat domains stored in a single bucket.
+	maxBucketEvents = 1_000
+)
+
+// RuleConfig is the configuration of an alert rule.
+type RuleConfig struct {
+	// Name is the unique name of the rule.
+	Name string `yaml:"name"`
+
+	// Type is the type of the rule.
+	Type RuleType `yaml:"type"`
+
+	// Channels are the names of the channels the alerts are sent to.  If
+	// empty, all the channels are used.
+	Channels []string `yaml:"channels,omitempty"`
+
+	// Threshold is the share of the requests for the rules of types
+	// [RuleTypeBlockedRatio] and [RuleTypeUpstreamErrorRate], and the factor
+	// of the number of requests for the rules of type [RuleTypeClientSpike].
+	// If zero, the default value of the type is used.
+	Threshold float64 `yaml:"threshold,omitempty"`
+
+	// MinRequests is the minimum number of requests in the window for the
+	// rules of types [RuleTypeBlockedRatio], [RuleTypeUpstreamErrorRate], and
+	// [RuleTypeClientSpike] to fire.  If zero, the default value of the type
+	// is used.
+	MinRequests uint64 `yaml:"min_requests,omitempty"`
+
+	// Window is the period the requests are counted over.  It's rounded up to
+	// the evaluation interval, and if zero, the interval is used.
+	Window timeutil.Duration `yaml:"window,omitempty"`
+
+	// Cooldown is the minimum time between two alerts of the rule about the
+	// same subject.  If zero, one hour is used.
+	Cooldown timeutil.Duration `yaml:"cooldown,omitempty"`
+
+	// Enabled defines if the rule is evaluated.
+	Enabled bool `yaml:"enabled"`
+}
+
+// validate returns an error if r is invalid.  channels are the names of the
+// configured channels.
+func (r *RuleConfig) validate(channels map[string]struct{}) (err error) {
+	switch {
+	case r == nil:
+		return errors.Error("no rule configuration")
+	case r.Name == "":
+		return errors.Error("empty name")
+	case r.Threshold < 0:
+		return fmt.Errorf("negative threshold %v", r.Threshold)
+	case r.Window.Duration < 0:
+		return fmt.Errorf("negative window %s", r.Window)
+	case r.Cooldown.Duration < 0:
+		return fmt.Errorf("negative cooldown %s", r.Cooldown)
+	}
+
+	switch r.Type {
+	case RuleTypeBlockedRatio, RuleTypeUpstreamErrorRate:
+		if r.Threshold > 1 {
+			return fmt.Errorf("threshold %v is greater than 1", r.Threshold)
+		}
+	case RuleTypeNewClient, RuleTypeThreatDomain, RuleTypeClientSpike:
+		// Go on.
+	default:
+		return fmt.Errorf("bad type %q", r.Type)
+	}
+
+	for _, name := range r.Channels {
+		if _, ok := channels[name]; !ok {
+			return fmt.Errorf("unknown channel %q", name)
+		}
+	}
+
+	return nil
+}
+
+// threshold returns the threshold of r or the default one of its type.
+func (r *RuleConfig) threshold() (t float64) {
+	if r.Threshold != 0 {
+		return r.Threshold
+	}
+
+	switch r.Type {
+	case RuleTypeBlockedRatio:
+		return 0.5
+	case RuleTypeUpstreamErrorRate:
+		return 0.1
+	case RuleTypeClientSpike:
+		return 5
+	default:
+		return 0
+	}
+}
+
+// minRequests returns the minimum number of requests of r or the default one
+// of its type.
+func (r *RuleConfig) minRequests() (n uint64) {
+	if r.MinRequests != 0 {
+		return r.MinRequests
+	}
+
+	switch r.Type {
+	case RuleTypeUpstreamErrorRate:
+		return 20
+	default:
+		return 100
+	}
+}
+
+// cooldown returns the cooldown of r or the default one.
+func (r *RuleConfig) cooldown() (d time.Duration) {
+	if r.Cooldown.Duration != 0 {
+		return r.Cooldown.Duration
+	}
+
+	return defaultCooldown
+}
+
+// windowBuckets returns the number of the buckets of the window of r.
+func (r *RuleConfig) windowBuckets(interval time.Duration) (n int) {
+	n = int((r.Window.Duration + interval - 1) / interval)
+
+	return max(n, 1)
+}
+
+// bucketsNeeded returns the number of the completed buckets needed to evaluate
+// r.
+func (r *RuleConfig) bucketsNeeded(interval time.Duration) (n int) {
+	switch r.Type {
+	case RuleTypeNewClient, RuleTypeThreatDomain:
+		return 1
+	case RuleTypeClientSpike:
+		return r.windowBuckets(interval) * (spikeBaselineWindows + 1)
+	default:
+		return r.windowBuckets(interval)
+	}
+}
+
+// evaluate returns the alerts fired by r on buckets, which are sorted from the
+// oldest to the newest.  The alerts only have their subjects, messages, and
+// values set.
+func (r *RuleConfig) evaluate(buckets []*bucket, interval time.Duration) (alerts []*Alert) {
+	if len(buckets) == 0 {
+		return nil
+	}
+
+	last := buckets[len(buckets)-1]
+	window := buckets[max(len(buckets)-r.windowBuckets(interval), 0):]
+
+	switch r.Type {
+	case RuleTypeBlockedRatio:
+		return r.evaluateBlockedRatio(window)
+	case RuleTypeUpstreamErrorRate:
+		return r.evaluateUpstreamErrorRate(window)
+	case RuleTypeNewClient:
+		return newClientAlerts(last)
+	case RuleTypeThreatDomain:
+		return threatAlerts(last)
+	case RuleTypeClientSpike:
+		return r.evaluateClientSpike(buckets, r.windowBuckets(interval))
+	default:
+		return nil
+	}
+}
+
+// evaluateBlockedRatio returns the alert if the share of the blocked requests
+// in window exceeds the threshold.
+func (r *RuleConfig) evaluateBlockedRatio(window []*bucket) (alerts []*Alert) {
+	var total, blocked uint64
+	for _, b := range window {
+		total += b.total
+		blocked += b.blocked
+	}
+
+	if total < r.minRequests() {
+		return nil
+	}
+
+	ratio := float64(blocked) / float64(total)
+	if ratio <= r.threshold() {
+		return nil
+	}
+
+	return []*Alert{{
+		Message: fmt.Sprintf("%.1f%% of %d requests blocked", ratio*100, total),
+		Value:   ratio,
+	}}
+}
+
+// evaluateUpstreamErrorRate returns the alerts about the upstreams, the share
+// of the failed exchanges with which in window exceeds the threshold.
+func (r *RuleConfig) evaluateUpstreamErrorRate(window []*bucket) (alerts []*Alert) {
+	ok := map[string]uint64{}
+	failed := map[string]uint64{}
+	for _, b := range window {
+		addCounts(ok, b.upstreams)
+		addCounts(failed, b.upstreamFailures)
+	}
+
+	for _, ups := range sortedKeys(failed) {
+		n := failed[ups]
+		total := n + ok[ups]
+		if total < r.minRequests() {
+			continue
+		}
+
+		rate := float64(n) / float64(total)
+		if rate <= r.threshold() {
+			continue
+		}
+
+		alerts = append(alerts, &Alert{
+			Subject: ups,
+			Message: fmt.Sprintf("%d of %d exchanges with upstream %s failed", n, total, ups),
+			Value:   rate,
+		})
+	}
+
+	return alerts
+}
+
+// newClientAlerts returns the alerts about the new clients of b.
+func newClientAlerts(b *bucket) (alerts []*Alert) {
+	for _, d := range b.newClients {
+		alerts = append(alerts, &Alert{
+			Subject: d.ID(),
+			Message: fmt.Sprintf("new client %s", d),
+		})
+	}
+
+	return alerts
+}
+
+// threatAlerts returns the alerts about the requests for the threat domains
+// of b.
+func threatAlerts(b *bucket) (alerts []*Alert) {
+	for _, t := range b.threats {
+		alerts = append(alerts, &Alert{
+			Subject: t.client,
+			Domain:  t.domain,
+			Message: fmt.Sprintf("client %s requested %s (%s)", t.client, t.domain, t.reason),
+		})
+	}
+
+	return alerts
+}
+
+// evaluateClientSpike returns the alerts about the clients, the number of
+// requests of which in the last n buckets exceeds the threshold times their
+// average number of requests in the previous windows of n buckets.
+func (r *RuleConfig) evaluateClientSpike(buckets []*bucket, n int) (alerts []*Alert) {
+	split := max(len(buckets)-n, 0)
+	cur := map[string]uint64{}
+	for _, b := range buckets[split:] {
+		addCounts(cur, b.clients)
+	}
+
+	prev := map[string]uint64{}
+	for _, b := range buckets[:split] {
+		addCounts(prev, b.clients)
+	}
+
+	// Count the windows actually seen, so that the average isn't
+	// underestimated right after the start.
+	windows := max(float64(split)/float64(n), 1)
+
+	for _, c := range sortedKeys(cur) {
+		cnt := cur[c]
+		if cnt < r.minRequests() {
+			continue
+		}
+
+		avg := max(float64(prev[c])/windows, 1)
+		factor := float64(cnt) / avg
+		if factor <= r.threshold() {
+			continue
+		}
+
+		alerts = append(alerts, &Alert{
+			Subject: c,
+			Message: fmt.Sprintf(
+				"client %s sent %d requests, %.1f times more than usual",
+				c,
+				cnt,
+				factor,
+			),
+			Value: factor,
+		})
+	}
+
+	return alerts
+}
+
+// threatRequest is a request of a client for a threat domain.
+type threatRequest struct {
+	client string
+	domain string
+	reason string
+}
+
+// bucket contains the counters of the requests during a single evaluation
+// interval.
+type bucket struct {
+	// clients are the numbers of requests of each client.
+	clients map[string]uint64
+
+	// upstreams are the numbers of the requests answered by each upstream.
+	upstreams map[string]uint64
+
+	// upstreamFailures are the numbers of failed exchanges with each
+	// upstream.
+	upstreamFailures map[string]uint64
+
+	// threats are the unique requests for the threat domains.
+	threats []threatRequest
+
+	// newClients are the clients seen for the first time.
+	newClients []*Device
+
+	// total is the total number of requests.
+	total uint64
+
+	// blocked is the number of blocked requests.
+	blocked uint64
+}
+
+// newBucket returns a new empty *bucket.
+func newBucket() (b *bucket) {
+	return &bucket{
+		clients:          map[string]uint64{},
+		upstreams:        map[string]uint64{},
+		upstreamFailures: map[string]uint64{},
+	}
+}
+
+// add counts e in b.
+func (b *bucket) add(e *Entry) {
+	b.total++
+	if e.Blocked {
+		b.blocked++
+	}
+
+	if e.Client != "" {
+		b.clients[e.Client]++
+	}
+
+	if e.Upstream != "" {
+		b.upstreams[e.Upstream]++
+	}
+
+	if e.Threat == "" || len(b.threats) >= maxBucketEvents {
+		return
+	}
+
+	t := threatRequest{
+		client: e.Client,
+		domain: e.Domain,
+		reason: e.Threat,
+	}
+
+	if !slices.Contains(b.threats, t) {
+		b.threats = append(b.threats, t)
+	}
+}
+
+// addNewClient adds d to the new clients of b.
+func (b *bucket) addNewClient(d *Device) {
+	if len(b.newClients) < maxBucketEvents {
+		b.newClients = append(b.newClients, d)
+	}
+}
+
+// addCounts adds the counts from src to dst.
+func addCounts(dst, src map[string]uint64) {
+	for k, v := range src {
+		dst[k] += v
+	}
+}
+
+// sortedKeys returns the sorted keys of m.
+func sortedKeys(m map[string]uint64) (keys []string) {
+	keys = maps.Keys(m)
+	slices.Sort(keys)
+
+	return keys
+}
@@ -0,0 +1,130 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// smtpNotifier is a notifier sending alerts as emails through an SMTP relay
+// without authentication.
+type smtpNotifier struct {
+	// addr is the address of the relay.
+	addr string
+
+	// host is the host name of the relay.
+	host string
+
+	// from is the header value of the sender.
+	from string
+
+	// fromAddr is the address of the sender.
+	fromAddr string
+
+	// to are the addresses of the recipients.
+	to []string
+}
+
+// newSMTPNotifier returns a new *smtpNotifier for the valid c.
+func newSMTPNotifier(c *ChannelConfig) (n *smtpNotifier) {
+	// The URL and the addresses have already been validated.
+	u, _ := url.Parse(c.URL)
+	from, _ := mail.ParseAddress(c.From)
+
+	n = &smtpNotifier{
+		addr:     u.Host,
+		host:     u.Hostname(),
+		from:     from.String(),
+		fromAddr: from.Address,
+		to:       make([]string, 0, len(c.To)),
+	}
+
+	for _, addr := range c.To {
+		to, _ := mail.ParseAddress(addr)
+		n.to = append(n.to, to.Address)
+	}
+
+	return n
+}
+
+// type check
+var _ notifier = (*smtpNotifier)(nil)
+
+// notify implements the notifier interface for *smtpNotifier.
+func (n *smtpNotifier) notify(ctx context.Context, al *Alert) (err error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return fmt.Errorf("dialing: %w", err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		err = conn.SetDeadline(deadline)
+		if err != nil {
+			return errors.WithDeferred(fmt.Errorf("setting deadline: %w", err), conn.Close())
+		}
+	}
+
+	c, err := smtp.NewClient(conn, n.host)
+	if err != nil {
+		return errors.WithDeferred(fmt.Errorf("greeting: %w", err), conn.Close())
+	}
+
+	err = n.send(c, al)
+	if err != nil {
+		return errors.WithDeferred(err, c.Close())
+	}
+
+	return c.Quit()
+}
+
+// send sends the email about al using c.
+func (n *smtpNotifier) send(c *smtp.Client, al *Alert) (err error) {
+	err = c.Mail(n.fromAddr)
+	if err != nil {
+		return fmt.Errorf("mail: %w", err)
+	}
+
+	for _, to := range n.to {
+		err = c.Rcpt(to)
+		if err != nil {
+			return fmt.Errorf("rcpt %q: %w", to, err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("data: %w", err)
+	}
+
+	_, err = w.Write(n.message(al))
+	if err != nil {
+		return errors.WithDeferred(fmt.Errorf("writing: %w", err), w.Close())
+	}
+
+	return w.Close()
+}
+
+// message returns the email about al including the headers.
+func (n *smtpNotifier) message(al *Alert) (msg []byte) {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", n.from)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", al.title()))
+	fmt.Fprintf(buf, "Date: %s\r\n", al.Time.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(al.Message)
+	buf.WriteString("\r\n")
+
+	return buf.Bytes()
+}
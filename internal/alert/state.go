@@ -0,0 +1,87 @@
+package alert
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghrenameio"
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// state is the persistent state of the alerts.
+type state struct {
+	// History are the last fired alerts from the oldest to the newest.
+	History []*Alert `json:"history"`
+}
+
+// loadState loads the state of a from its file, if any.
+func (a *Alerts) loadState() (err error) {
+	if a.filename == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(a.filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	st := &state{}
+	err = json.Unmarshal(data, st)
+	if err != nil {
+		return fmt.Errorf("decoding %q: %w", a.filename, err)
+	}
+
+	for _, al := range st.History {
+		a.history.Append(al)
+	}
+
+	return nil
+}
+
+// snapshot returns the current state of a.  a.mu must be locked.
+func (a *Alerts) snapshot() (st *state) {
+	st = &state{
+		History: make([]*Alert, 0, a.history.Len()),
+	}
+
+	a.history.Range(func(al *Alert) (cont bool) {
+		st.History = append(st.History, al)
+
+		return true
+	})
+
+	return st
+}
+
+// write atomically writes st into the file.  It does nothing if filename is
+// empty.
+func (st *state) write(filename string) (err error) {
+	if filename == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("encoding: %w", err)
+	}
+
+	pf, err := aghrenameio.NewPendingFile(filename, 0o644)
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+
+	defer func() { err = aghrenameio.WithDeferredCleanup(err, pf) }()
+
+	_, err = pf.Write(data)
+	if err != nil {
+		return fmt.Errorf("writing: %w", err)
+	}
+
+	return nil
+}
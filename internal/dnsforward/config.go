@@ -30,14 +30,21 @@ import (
 // ClientsContainer provides information about preconfigured DNS clients.
 type ClientsContainer interface {
 	// UpstreamConfigByID returns the custom upstream configuration for the
-	// client having id, using boot to initialize the one if necessary.  It
-	// returns nil if there is no custom upstream configuration for the client.
-	// The id is expected to be either a string representation of an IP address
-	// or the ClientID.
+	// client having id, using boot to initialize the one if necessary and wrap,
+	// if not nil, to wrap its upstreams before it's used.  It returns nil if
+	// there is no custom upstream configuration for the client.  The id is
+	// expected to be either a string representation of an IP address or the
+	// ClientID.
 	UpstreamConfigByID(
 		id string,
 		boot upstream.Resolver,
+		wrap func(uc *proxy.UpstreamConfig),
 	) (conf *proxy.CustomUpstreamConfig, err error)
+
+	// ObserveClient records a request from the client with the IP address ip
+	// and the ClientID, which may be empty.  It's used to detect the new
+	// devices.
+	ObserveClient(ip netip.Addr, clientID string)
 }
 
 // Config represents the DNS filtering configuration of AdGuard Home.  The zero
@@ -169,6 +176,9 @@ type Config struct {
 	// BootstrapPreferIPv6, if true, instructs the bootstrapper to prefer IPv6
 	// addresses to IPv4 ones for DoH, DoQ, and DoT.
 	BootstrapPreferIPv6 bool `yaml:"bootstrap_prefer_ipv6"`
+
+	// DNSTap is the configuration of the live dnstap output.
+	DNSTap *DNSTapConfig `yaml:"dnstap"`
 }
 
 // EDNSClientSubnet is the settings list for EDNS Client Subnet.
@@ -183,6 +193,25 @@ type EDNSClientSubnet struct {
 	UseCustom bool `yaml:"use_custom"`
 }
 
+// DNSTapConfig is the configuration of the live dnstap output.
+type DNSTapConfig struct {
+	// Address is the address of the dnstap collector in the form of
+	// "unix:///path/to/socket" or "tcp://host:port".
+	Address string `yaml:"address"`
+
+	// Identity is the identity of the server included into every message.  If
+	// it's empty, the hostname is used.
+	Identity string `yaml:"identity"`
+
+	// BufferSize is the maximum number of messages buffered while the
+	// collector is slow or unavailable.  If it's zero, the default value is
+	// used.
+	BufferSize int `yaml:"buffer_size"`
+
+	// Enabled defines if the dnstap output is enabled.
+	Enabled bool `yaml:"enabled"`
+}
+
 // TLSConfig is the TLS configuration for HTTPS, DNS-over-HTTPS, and DNS-over-TLS
 type TLSConfig struct {
 	cert tls.Certificate
@@ -17,6 +17,7 @@ import (
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/alert"
 	"github.com/AdguardTeam/AdGuardHome/internal/client"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
 	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
@@ -118,6 +119,10 @@ type Server struct {
 	// stats is the statistics collector for client's DNS usage data.
 	stats stats.Interface
 
+	// alerts evaluates the alert rules on the processed requests.  It may be
+	// nil.
+	alerts alert.Interface
+
 	// access drops disallowed clients.
 	access *accessManager
 
@@ -172,6 +177,9 @@ type Server struct {
 	// anonymizer masks the client's IP addresses if needed.
 	anonymizer *aghnet.IPMut
 
+	// dnstap is the live dnstap output.  It's nil if the output is disabled.
+	dnstap dnstapSink
+
 	// clientIDCache is a temporary storage for ClientIDs that were extracted
 	// during the BeforeRequestHandler stage.
 	clientIDCache cache.Cache
@@ -204,6 +212,7 @@ const defaultLocalDomainSuffix = "lan"
 type DNSCreateParams struct {
 	DNSFilter   *filtering.DNSFilter
 	Stats       stats.Interface
+	Alerts      alert.Interface
 	QueryLog    querylog.QueryLog
 	DHCPServer  DHCP
 	PrivateNets netutil.SubnetSet
@@ -251,6 +260,7 @@ func NewServer(p DNSCreateParams) (s *Server, err error) {
 		dnsFilter:   p.DNSFilter,
 		dhcpServer:  p.DHCPServer,
 		stats:       p.Stats,
+		alerts:      p.Alerts,
 		queryLog:    p.QueryLog,
 		privateNets: p.PrivateNets,
 		// TODO(e.burkov):  Use some case-insensitive string comparison.
@@ -292,12 +302,21 @@ func (s *Server) Close() {
 
 	// TODO(s.chzhen):  Remove it.
 	s.stats = nil
+	s.alerts = nil
 	s.queryLog = nil
 	s.dnsProxy = nil
 
 	if err := s.ipset.close(); err != nil {
 		log.Error("dnsforward: closing ipset: %s", err)
 	}
+
+	if s.dnstap != nil {
+		if err := s.dnstap.Close(); err != nil {
+			log.Error("dnsforward: closing dnstap sink: %s", err)
+		}
+
+		s.dnstap = nil
+	}
 }
 
 // WriteDiskConfig - write configuration
@@ -603,6 +622,11 @@ func (s *Server) Prepare(conf *ServerConfig) (err error) {
 
 	s.recDetector.clear()
 
+	err = s.setupDNSTap()
+	if err != nil {
+		return fmt.Errorf("setting up dnstap: %w", err)
+	}
+
 	s.setupAddrProc()
 
 	s.registerHandlers()
@@ -660,6 +684,7 @@ func (s *Server) setupFallbackDNS() (err error) {
 		return err
 	}
 
+	wrapStatsUpstreams(uc, s.stats, s.alerts)
 	s.dnsProxy.Fallbacks = uc
 
 	return nil
@@ -722,9 +722,11 @@ func TestServerCustomClientUpstream(t *testing.T) {
 		OnUpstreamConfigByID: func(
 			_ string,
 			_ upstream.Resolver,
+			_ func(uc *proxy.UpstreamConfig),
 		) (conf *proxy.CustomUpstreamConfig, err error) {
 			return customUpsConf, nil
 		},
+		OnObserveClient: func(_ netip.Addr, _ string) {},
 	}
 
 	startDeferStop(t, s)
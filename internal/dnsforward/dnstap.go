@@ -0,0 +1,211 @@
+package dnsforward
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnstap"
+	"github.com/AdguardTeam/AdGuardHome/internal/version"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultDNSTapBufferSize is the default maximum number of dnstap messages
+	// buffered while the collector is slow or unavailable.
+	defaultDNSTapBufferSize = 10_000
+
+	// dnstapReconnectInterval is the interval between the attempts to connect
+	// to the dnstap collector.
+	dnstapReconnectInterval = 5 * time.Second
+
+	// dnstapTimeout is the timeout of the connection to the dnstap collector
+	// and of every write to it.
+	dnstapTimeout = 5 * time.Second
+)
+
+// dnstapSink is the live dnstap output.  [*dnstap.Sink] is the implementation
+// used in production.
+type dnstapSink interface {
+	// Send queues m for sending without blocking.  It may be called after
+	// Close, in which case m is discarded.
+	Send(m *dnstap.Message)
+
+	// Close stops the output.
+	Close() (err error)
+}
+
+// setupDNSTap closes the previous dnstap sink, if any, and creates a new one
+// if the dnstap output is enabled.
+func (s *Server) setupDNSTap() (err error) {
+	if s.dnstap != nil {
+		err = s.dnstap.Close()
+		if err != nil {
+			log.Error("dnsforward: closing dnstap sink: %s", err)
+		}
+
+		s.dnstap = nil
+	}
+
+	c := s.conf.DNSTap
+	if c == nil || !c.Enabled {
+		return nil
+	}
+
+	identity := c.Identity
+	if identity == "" {
+		identity, err = os.Hostname()
+		if err != nil {
+			log.Error("dnsforward: getting hostname for dnstap identity: %s", err)
+		}
+	}
+
+	bufSize := c.BufferSize
+	if bufSize <= 0 {
+		bufSize = defaultDNSTapBufferSize
+	}
+
+	sink, err := dnstap.NewSink(&dnstap.SinkConfig{
+		Address:           c.Address,
+		Identity:          identity,
+		Version:           version.Version(),
+		BufferSize:        bufSize,
+		ReconnectInterval: dnstapReconnectInterval,
+		Timeout:           dnstapTimeout,
+	})
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	s.dnstap = sink
+
+	return nil
+}
+
+// prepareDNSTap sets the dnstap output of dctx and copies the request received
+// from the client, if the dnstap output is enabled.
+func (s *Server) prepareDNSTap(dctx *dnsContext) {
+	s.serverLock.RLock()
+	defer s.serverLock.RUnlock()
+
+	if s.dnstap == nil {
+		return
+	}
+
+	dctx.dnstap = s.dnstap
+	dctx.origReq = dctx.proxyCtx.Req.Copy()
+}
+
+// sendDNSTap sends the dnstap messages about the request and its response to
+// the dnstap output of dctx, if any.  clientIP is the anonymized IP address of
+// the client.  The forwarder messages are only sent if the response was
+// received from an upstream.  The messages are packed, so s.serverLock isn't
+// expected to be locked.
+func sendDNSTap(dctx *dnsContext, clientIP net.IP) {
+	sink := dctx.dnstap
+	if sink == nil {
+		return
+	}
+
+	pctx := dctx.proxyCtx
+
+	var clientAddr netip.AddrPort
+	if addr, ok := netip.AddrFromSlice(clientIP); ok {
+		clientAddr = netip.AddrPortFrom(addr.Unmap(), pctx.Addr.Port())
+	}
+
+	sp := protoToDNSTap(pctx)
+	sink.Send(&dnstap.Message{
+		QueryTime:      dctx.startTime,
+		QueryAddr:      clientAddr,
+		QueryMessage:   packForDNSTap(dctx.origReq),
+		Type:           dnstap.MessageTypeClientQuery,
+		SocketProtocol: sp,
+	})
+
+	if pctx.Upstream != nil && !dctx.upstreamStartTime.IsZero() {
+		sendForwarderDNSTap(sink, dctx)
+	}
+
+	if pctx.Res != nil {
+		sink.Send(&dnstap.Message{
+			QueryTime:       dctx.startTime,
+			ResponseTime:    time.Now(),
+			QueryAddr:       clientAddr,
+			ResponseMessage: packForDNSTap(pctx.Res),
+			Type:            dnstap.MessageTypeClientResponse,
+			SocketProtocol:  sp,
+		})
+	}
+}
+
+// sendForwarderDNSTap sends the dnstap messages about the request forwarded to
+// the upstream and the upstream's response to sink.
+func sendForwarderDNSTap(sink dnstapSink, dctx *dnsContext) {
+	pctx := dctx.proxyCtx
+
+	sink.Send(&dnstap.Message{
+		QueryTime:    dctx.upstreamStartTime,
+		QueryMessage: packForDNSTap(pctx.Req),
+		Type:         dnstap.MessageTypeForwarderQuery,
+	})
+
+	resp := dctx.origResp
+	if resp == nil {
+		resp = pctx.Res
+	}
+
+	if resp == nil {
+		return
+	}
+
+	sink.Send(&dnstap.Message{
+		QueryTime:       dctx.upstreamStartTime,
+		ResponseTime:    dctx.upstreamStartTime.Add(pctx.QueryDuration),
+		ResponseMessage: packForDNSTap(resp),
+		Type:            dnstap.MessageTypeForwarderResponse,
+	})
+}
+
+// packForDNSTap returns the packed msg.  Any errors are logged and nil is
+// returned.
+func packForDNSTap(msg *dns.Msg) (b []byte) {
+	b, err := msg.Pack()
+	if err != nil {
+		log.Debug("dnsforward: packing message for dnstap: %s", err)
+
+		return nil
+	}
+
+	return b
+}
+
+// protoToDNSTap returns the dnstap socket protocol of the request.
+func protoToDNSTap(pctx *proxy.DNSContext) (sp dnstap.SocketProtocol) {
+	switch pctx.Proto {
+	case proxy.ProtoUDP:
+		return dnstap.SocketProtocolUDP
+	case proxy.ProtoTCP:
+		return dnstap.SocketProtocolTCP
+	case proxy.ProtoTLS:
+		return dnstap.SocketProtocolDoT
+	case proxy.ProtoHTTPS:
+		return dnstap.SocketProtocolDoH
+	case proxy.ProtoQUIC:
+		return dnstap.SocketProtocolDoQ
+	case proxy.ProtoDNSCrypt:
+		if w := pctx.DNSCryptResponseWriter; w != nil {
+			if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+				return dnstap.SocketProtocolDNSCryptTCP
+			}
+		}
+
+		return dnstap.SocketProtocolDNSCryptUDP
+	default:
+		return 0
+	}
+}
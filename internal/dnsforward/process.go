@@ -34,6 +34,15 @@ type dnsContext struct {
 	// response is modified by filters.
 	origResp *dns.Msg
 
+	// origReq is a copy of the request received from the client.  It is only
+	// set when dnstap is not nil, since the request may be modified while
+	// processing.
+	origReq *dns.Msg
+
+	// dnstap is the dnstap output at the start of the processing.  It's nil
+	// if the output is disabled.
+	dnstap dnstapSink
+
 	// unreversedReqIP stores an IP address obtained from a PTR request if it
 	// was parsed successfully and belongs to one of the locally served IP
 	// ranges.
@@ -48,6 +57,10 @@ type dnsContext struct {
 	// startTime is the time at which the processing of the request has started.
 	startTime time.Time
 
+	// upstreamStartTime is the time at which the request has been sent to the
+	// upstream servers, if it has.
+	upstreamStartTime time.Time
+
 	// origQuestion is the question received from the client.  It is set
 	// when the request is modified by rewrites.
 	origQuestion dns.Question
@@ -101,6 +114,8 @@ func (s *Server) handleDNSRequest(_ *proxy.Proxy, pctx *proxy.DNSContext) error
 		startTime: time.Now(),
 	}
 
+	s.prepareDNSTap(dctx)
+
 	type modProcessFunc func(ctx *dnsContext) (rc resultCode)
 
 	// Since (*dnsforward.Server).handleDNSRequest(...) is used as
@@ -712,6 +727,7 @@ func (s *Server) processUpstream(dctx *dnsContext) (rc resultCode) {
 		return resultCodeError
 	}
 
+	dctx.upstreamStartTime = time.Now()
 	if err := prx.Resolve(pctx); err != nil {
 		if errors.Is(err, upstream.ErrNoUpstreams) {
 			// Do not even put into querylog.  Currently this happens either
@@ -811,7 +827,16 @@ func (s *Server) setCustomUpstream(pctx *proxy.DNSContext, clientID string) {
 
 	// Use the ClientID first, since it has a higher priority.
 	id := stringutil.Coalesce(clientID, pctx.Addr.Addr().String())
-	upsConf, err := s.conf.ClientsContainer.UpstreamConfigByID(id, s.bootstrap)
+	// Wrap the custom upstreams the same way as the ones of the global
+	// configuration, so that their failures are also counted in the
+	// statistics and the alerts.  Don't lock s.serverLock within wrap, since
+	// it's called with the clients locked.
+	s.serverLock.RLock()
+	st, al := s.stats, s.alerts
+	s.serverLock.RUnlock()
+
+	wrap := func(uc *proxy.UpstreamConfig) { wrapStatsUpstreams(uc, st, al) }
+	upsConf, err := s.conf.ClientsContainer.UpstreamConfigByID(id, s.bootstrap, wrap)
 	if err != nil {
 		log.Error("dnsforward: getting custom upstreams for client %s: %s", id, err)
 
@@ -2,14 +2,19 @@ package dnsforward
 
 import (
 	"net"
+	"os"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/alert"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
 	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
 	"github.com/AdguardTeam/AdGuardHome/internal/stats"
 	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
 	"github.com/miekg/dns"
 )
 
@@ -32,6 +37,9 @@ func (s *Server) processQueryLogsAndStats(dctx *dnsContext) (rc resultCode) {
 	ids := []string{ipStr, dctx.clientID}
 	qt, cl := q.Qtype, q.Qclass
 
+	// Pack the dnstap messages before locking, since it may take a while.
+	sendDNSTap(dctx, ip)
+
 	// Synchronize access to s.queryLog and s.stats so they won't be suddenly
 	// uninitialized while in use.  This can happen after proxy server has been
 	// stopped, but its workers haven't yet exited.
@@ -62,6 +70,18 @@ func (s *Server) processQueryLogsAndStats(dctx *dnsContext) (rc resultCode) {
 		)
 	}
 
+	if s.alerts != nil {
+		s.observeAlert(dctx, ipStr)
+	}
+
+	if s.dnsFilter != nil {
+		s.dnsFilter.ObserveDomain(host)
+	}
+
+	if s.conf.ClientsContainer != nil {
+		s.conf.ClientsContainer.ObserveClient(pctx.Addr.Addr(), dctx.clientID)
+	}
+
 	return resultCodeSuccess
 }
 
@@ -128,15 +148,24 @@ func (s *Server) logQuery(dctx *dnsContext, ip net.IP, processingTime time.Durat
 func (s *Server) updateStats(dctx *dnsContext, clientIP string, processingTime time.Duration) {
 	pctx := dctx.proxyCtx
 
+	q := pctx.Req.Question[0]
 	e := &stats.Entry{
-		Domain:         aghnet.NormalizeDomain(pctx.Req.Question[0].Name),
+		Domain:         aghnet.NormalizeDomain(q.Name),
 		Result:         stats.RNotFiltered,
 		ProcessingTime: processingTime,
 		UpstreamTime:   pctx.QueryDuration,
+		QType:          dns.Type(q.Qtype).String(),
+		Proto:          statsClientProto(pctx.Proto),
+	}
+
+	if pctx.Res != nil {
+		e.RCode = dns.RcodeToString[pctx.Res.Rcode]
 	}
 
 	if pctx.Upstream != nil {
 		e.Upstream = pctx.Upstream.Address()
+	} else if pctx.CachedUpstreamAddr != "" {
+		e.Cached = true
 	}
 
 	if clientID := dctx.clientID; clientID != "" {
@@ -155,9 +184,156 @@ func (s *Server) updateStats(dctx *dnsContext, clientIP string, processingTime t
 	case
 		filtering.FilteredBlockList,
 		filtering.FilteredInvalid,
-		filtering.FilteredBlockedService:
+		filtering.FilteredBlockedService,
+		filtering.FilteredThreatIOC,
+		filtering.FilteredThreatLookup,
+		filtering.FilteredThreatDNSBL,
+		filtering.FilteredNewDomain:
 		e.Result = stats.RFiltered
 	}
 
+	for _, r := range dctx.result.Rules {
+		if r.Text != "" {
+			e.Rules = append(e.Rules, stats.Rule{
+				Text:         r.Text,
+				FilterListID: r.FilterListID,
+			})
+		}
+	}
+
 	s.stats.Update(e)
 }
+
+// observeAlert passes the request to the alerts.  s.serverLock is expected to
+// be locked.
+func (s *Server) observeAlert(dctx *dnsContext, clientIP string) {
+	pctx := dctx.proxyCtx
+
+	e := &alert.Entry{
+		Client: stringutil.Coalesce(dctx.clientID, clientIP),
+		Domain: aghnet.NormalizeDomain(pctx.Req.Question[0].Name),
+	}
+
+	if pctx.Upstream != nil {
+		e.Upstream = pctx.Upstream.Address()
+	}
+
+	switch reason := dctx.result.Reason; reason {
+	case
+		filtering.FilteredSafeBrowsing,
+		filtering.FilteredThreatIOC,
+		filtering.FilteredThreatLookup,
+		filtering.FilteredThreatDNSBL:
+		e.Threat = reason.String()
+		e.Blocked = true
+	case
+		filtering.FilteredBlockList,
+		filtering.FilteredInvalid,
+		filtering.FilteredBlockedService,
+		filtering.FilteredParental,
+		filtering.FilteredNewDomain:
+		e.Blocked = true
+	}
+
+	s.alerts.Observe(e)
+}
+
+// statsClientProto returns the statistics protocol for the proxy one.
+func statsClientProto(proto proxy.Proto) (cp stats.ClientProto) {
+	switch proto {
+	case proxy.ProtoHTTPS:
+		return stats.ClientProtoDoH
+	case proxy.ProtoQUIC:
+		return stats.ClientProtoDoQ
+	case proxy.ProtoTLS:
+		return stats.ClientProtoDoT
+	case proxy.ProtoDNSCrypt:
+		return stats.ClientProtoDNSCrypt
+	default:
+		// Consider this a plain DNS-over-UDP or DNS-over-TCP request.
+		return stats.ClientProtoPlain
+	}
+}
+
+// statsUpstream is an [upstream.Upstream] that counts the failed exchanges with
+// the wrapped upstream in the statistics and the alerts.
+type statsUpstream struct {
+	upstream.Upstream
+
+	// stats is the statistics module to count the failures in.  It's captured
+	// when wrapping, since the exchanges are performed without holding
+	// s.serverLock.  It may be nil.
+	stats stats.Interface
+
+	// alerts is the alerts module to count the failures in.  It's captured
+	// the same way as stats.  It may be nil.
+	alerts alert.Interface
+}
+
+// type check
+var _ upstream.Upstream = (*statsUpstream)(nil)
+
+// Exchange implements the [upstream.Upstream] interface for *statsUpstream.
+func (u *statsUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	resp, err = u.Upstream.Exchange(req)
+	if err == nil {
+		return resp, nil
+	}
+
+	addr := u.Address()
+	if u.stats != nil {
+		u.stats.UpdateUpstream(&stats.UpstreamEntry{
+			Upstream: addr,
+			Timeout:  isTimeout(err),
+		})
+	}
+
+	if u.alerts != nil {
+		u.alerts.ObserveUpstreamFailure(addr)
+	}
+
+	return resp, err
+}
+
+// isTimeout returns true if err is caused by a timeout.
+func isTimeout(err error) (ok bool) {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+
+	var netErr net.Error
+
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// wrapStatsUpstreams replaces all the upstreams of uc with the ones counting
+// their failed exchanges in st and al.  It does nothing if uc is nil or both st
+// and al are nil.  The same upstream used for several domains is only wrapped
+// once.
+func wrapStatsUpstreams(uc *proxy.UpstreamConfig, st stats.Interface, al alert.Interface) {
+	if uc == nil || (st == nil && al == nil) {
+		return
+	}
+
+	wrapped := map[upstream.Upstream]upstream.Upstream{}
+	wrapAll := func(ups []upstream.Upstream) {
+		for i, u := range ups {
+			w, ok := wrapped[u]
+			if !ok {
+				w = &statsUpstream{Upstream: u, stats: st, alerts: al}
+				wrapped[u] = w
+			}
+
+			ups[i] = w
+		}
+	}
+
+	wrapAll(uc.Upstreams)
+	for _, ups := range uc.DomainReservedUpstreams {
+		wrapAll(ups)
+	}
+
+	for _, ups := range uc.SpecifiedDomainUpstreams {
+		wrapAll(ups)
+	}
+}
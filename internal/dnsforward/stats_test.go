@@ -1,16 +1,21 @@
 package dnsforward
 
 import (
+	"fmt"
 	"net/netip"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnstap"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
 	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
 	"github.com/AdguardTeam/AdGuardHome/internal/stats"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -42,6 +47,8 @@ type testStats struct {
 	stats.Interface
 
 	lastEntry *stats.Entry
+
+	upstreamEntries []*stats.UpstreamEntry
 }
 
 // Update implements the [stats.Interface] interface for *testStats.
@@ -53,6 +60,11 @@ func (l *testStats) Update(e *stats.Entry) {
 	l.lastEntry = e
 }
 
+// UpdateUpstream implements the [stats.Interface] interface for *testStats.
+func (l *testStats) UpdateUpstream(e *stats.UpstreamEntry) {
+	l.upstreamEntries = append(l.upstreamEntries, e)
+}
+
 // ShouldCount implements the [stats.Interface] interface for *testStats.
 func (l *testStats) ShouldCount(string, uint16, uint16, []string) bool {
 	return true
@@ -236,3 +248,167 @@ func TestServer_ProcessQueryLogsAndStats(t *testing.T) {
 		})
 	}
 }
+
+// testDNSTapSink is a dnstapSink for tests.
+type testDNSTapSink struct {
+	msgs []*dnstap.Message
+}
+
+// Send implements the dnstapSink interface for *testDNSTapSink.
+func (s *testDNSTapSink) Send(m *dnstap.Message) {
+	s.msgs = append(s.msgs, m)
+}
+
+// Close implements the dnstapSink interface for *testDNSTapSink.
+func (s *testDNSTapSink) Close() (err error) {
+	return nil
+}
+
+func TestServer_ProcessQueryLogsAndStats_dnstap(t *testing.T) {
+	ups, err := upstream.AddressToUpstream("1.1.1.1", nil)
+	require.NoError(t, err)
+
+	req := (&dns.Msg{}).SetQuestion("example.com.", dns.TypeA)
+	rewrittenReq := (&dns.Msg{}).SetQuestion("rewritten.example.", dns.TypeA)
+	resp := (&dns.Msg{}).SetReply(req)
+	start := time.Now()
+
+	testCases := []struct {
+		ups       upstream.Upstream
+		name      string
+		wantTypes []dnstap.MessageType
+	}{{
+		ups:  ups,
+		name: "upstream",
+		wantTypes: []dnstap.MessageType{
+			dnstap.MessageTypeClientQuery,
+			dnstap.MessageTypeForwarderQuery,
+			dnstap.MessageTypeForwarderResponse,
+			dnstap.MessageTypeClientResponse,
+		},
+	}, {
+		ups:  nil,
+		name: "cached",
+		wantTypes: []dnstap.MessageType{
+			dnstap.MessageTypeClientQuery,
+			dnstap.MessageTypeClientResponse,
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sink := &testDNSTapSink{}
+			srv := &Server{
+				queryLog:   &testQueryLog{},
+				stats:      &testStats{},
+				anonymizer: aghnet.NewIPMut(nil),
+				dnstap:     sink,
+			}
+
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Proto:         proxy.ProtoHTTPS,
+					Req:           req,
+					Res:           resp,
+					Addr:          netip.MustParseAddrPort("1.2.3.4:5353"),
+					Upstream:      tc.ups,
+					QueryDuration: time.Millisecond,
+				},
+				startTime:         start,
+				upstreamStartTime: start,
+				result:            &filtering.Result{},
+			}
+
+			srv.prepareDNSTap(dctx)
+
+			// Modify the request like the rewrites do.
+			dctx.proxyCtx.Req = rewrittenReq
+
+			srv.processQueryLogsAndStats(dctx)
+
+			types := make([]dnstap.MessageType, 0, len(sink.msgs))
+			for _, m := range sink.msgs {
+				types = append(types, m.Type)
+			}
+
+			require.Equal(t, tc.wantTypes, types)
+
+			cq := sink.msgs[0]
+			assert.Equal(t, netip.MustParseAddrPort("1.2.3.4:5353"), cq.QueryAddr)
+			assert.Equal(t, dnstap.SocketProtocolDoH, cq.SocketProtocol)
+
+			wantReq, pErr := req.Pack()
+			require.NoError(t, pErr)
+
+			assert.Equal(t, wantReq, cq.QueryMessage)
+
+			if tc.ups == nil {
+				return
+			}
+
+			wantFwdReq, pErr := rewrittenReq.Pack()
+			require.NoError(t, pErr)
+
+			assert.Equal(t, wantFwdReq, sink.msgs[1].QueryMessage)
+		})
+	}
+}
+
+func TestWrapStatsUpstreams(t *testing.T) {
+	const (
+		okAddr      = "ok.example"
+		failAddr    = "fail.example"
+		timeoutAddr = "timeout.example"
+	)
+
+	newUps := func(addr string, err error) (u upstream.Upstream) {
+		return &aghtest.UpstreamMock{
+			OnAddress: func() (a string) { return addr },
+			OnExchange: func(req *dns.Msg) (resp *dns.Msg, exchErr error) {
+				if err != nil {
+					return nil, err
+				}
+
+				return (&dns.Msg{}).SetReply(req), nil
+			},
+			OnClose: func() (closeErr error) { panic("not implemented") },
+		}
+	}
+
+	okUps := newUps(okAddr, nil)
+	failUps := newUps(failAddr, errors.Error("test error"))
+	timeoutUps := newUps(timeoutAddr, fmt.Errorf("reading: %w", os.ErrDeadlineExceeded))
+
+	uc := &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{okUps, failUps},
+		DomainReservedUpstreams: map[string][]upstream.Upstream{
+			"domain.example.": {timeoutUps},
+		},
+		SpecifiedDomainUpstreams: map[string][]upstream.Upstream{
+			"domain.example.": {timeoutUps},
+		},
+	}
+
+	st := &testStats{}
+	wrapStatsUpstreams(uc, st, nil)
+
+	req := (&dns.Msg{}).SetQuestion("domain.example.", dns.TypeA)
+	for _, u := range uc.Upstreams {
+		_, _ = u.Exchange(req)
+	}
+
+	_, _ = uc.DomainReservedUpstreams["domain.example."][0].Exchange(req)
+
+	assert.Same(
+		t,
+		uc.DomainReservedUpstreams["domain.example."][0],
+		uc.SpecifiedDomainUpstreams["domain.example."][0],
+	)
+	assert.Equal(t, []*stats.UpstreamEntry{{
+		Upstream: failAddr,
+		Timeout:  false,
+	}, {
+		Upstream: timeoutAddr,
+		Timeout:  true,
+	}}, st.upstreamEntries)
+}
@@ -65,6 +65,8 @@ func (s *Server) prepareUpstreamSettings(boot upstream.Resolver) (err error) {
 		return fmt.Errorf("preparing upstream config: %w", err)
 	}
 
+	wrapStatsUpstreams(s.conf.UpstreamConfig, s.stats, s.alerts)
+
 	return nil
 }
 
@@ -0,0 +1,184 @@
+// Package dnstap contains a minimal encoder of dnstap messages and a writer of
+// Frame Streams.
+//
+// See https://dnstap.info.
+package dnstap
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"time"
+)
+
+// MessageType is the type of a dnstap message.
+type MessageType uint8
+
+// Message types used by AdGuard Home.
+const (
+	MessageTypeClientQuery       MessageType = 5
+	MessageTypeClientResponse    MessageType = 6
+	MessageTypeForwarderQuery    MessageType = 7
+	MessageTypeForwarderResponse MessageType = 8
+)
+
+// SocketProtocol is the protocol of the transport a message was received
+// over.
+type SocketProtocol uint8
+
+// Socket protocols.
+const (
+	SocketProtocolUDP         SocketProtocol = 1
+	SocketProtocolTCP         SocketProtocol = 2
+	SocketProtocolDoT         SocketProtocol = 3
+	SocketProtocolDoH         SocketProtocol = 4
+	SocketProtocolDNSCryptUDP SocketProtocol = 5
+	SocketProtocolDNSCryptTCP SocketProtocol = 6
+	SocketProtocolDoQ         SocketProtocol = 7
+)
+
+// Message is a single dnstap message.
+type Message struct {
+	// QueryTime is the time the query was received.
+	QueryTime time.Time
+
+	// ResponseTime is the time the response was sent.  It's ignored if zero.
+	ResponseTime time.Time
+
+	// QueryAddr is the address of the client.  It's ignored if invalid.
+	QueryAddr netip.AddrPort
+
+	// QueryMessage is the packed query, if any.
+	QueryMessage []byte
+
+	// ResponseMessage is the packed response, if any.
+	ResponseMessage []byte
+
+	// Type is the type of the message.  It must not be zero.
+	Type MessageType
+
+	// SocketProtocol is the protocol of the transport of the query.  It's
+	// ignored if zero.
+	SocketProtocol SocketProtocol
+}
+
+// Field numbers of the Dnstap protobuf message.
+const (
+	fieldDnstapIdentity = 1
+	fieldDnstapVersion  = 2
+	fieldDnstapMessage  = 14
+	fieldDnstapType     = 15
+)
+
+// dnstapTypeMessage is the only type of the Dnstap protobuf message.
+const dnstapTypeMessage = 1
+
+// Field numbers of the Message protobuf message.
+const (
+	fieldMsgType             = 1
+	fieldMsgSocketFamily     = 2
+	fieldMsgSocketProtocol   = 3
+	fieldMsgQueryAddress     = 4
+	fieldMsgQueryPort        = 6
+	fieldMsgQueryTimeSec     = 8
+	fieldMsgQueryTimeNsec    = 9
+	fieldMsgQueryMessage     = 10
+	fieldMsgResponseTimeSec  = 12
+	fieldMsgResponseTimeNsec = 13
+	fieldMsgResponseMessage  = 14
+)
+
+// Socket families.
+const (
+	socketFamilyINET  = 1
+	socketFamilyINET6 = 2
+)
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// appendDnstap appends the Dnstap protobuf message containing m to b.
+func appendDnstap(b []byte, m *Message, identity, version string) (res []byte) {
+	if identity != "" {
+		b = appendBytesField(b, fieldDnstapIdentity, []byte(identity))
+	}
+
+	if version != "" {
+		b = appendBytesField(b, fieldDnstapVersion, []byte(version))
+	}
+
+	b = appendBytesField(b, fieldDnstapMessage, m.marshal())
+
+	return appendVarintField(b, fieldDnstapType, dnstapTypeMessage)
+}
+
+// marshal returns the Message protobuf message for m.
+func (m *Message) marshal() (b []byte) {
+	b = appendVarintField(b, fieldMsgType, uint64(m.Type))
+
+	if addr := m.QueryAddr.Addr(); addr.IsValid() {
+		addr = addr.Unmap()
+		family := uint64(socketFamilyINET6)
+		if addr.Is4() {
+			family = socketFamilyINET
+		}
+
+		b = appendVarintField(b, fieldMsgSocketFamily, family)
+		b = appendBytesField(b, fieldMsgQueryAddress, addr.AsSlice())
+		b = appendVarintField(b, fieldMsgQueryPort, uint64(m.QueryAddr.Port()))
+	}
+
+	if m.SocketProtocol != 0 {
+		b = appendVarintField(b, fieldMsgSocketProtocol, uint64(m.SocketProtocol))
+	}
+
+	if !m.QueryTime.IsZero() {
+		b = appendVarintField(b, fieldMsgQueryTimeSec, uint64(m.QueryTime.Unix()))
+		b = appendFixed32Field(b, fieldMsgQueryTimeNsec, uint32(m.QueryTime.Nanosecond()))
+	}
+
+	if m.QueryMessage != nil {
+		b = appendBytesField(b, fieldMsgQueryMessage, m.QueryMessage)
+	}
+
+	if !m.ResponseTime.IsZero() {
+		b = appendVarintField(b, fieldMsgResponseTimeSec, uint64(m.ResponseTime.Unix()))
+		b = appendFixed32Field(b, fieldMsgResponseTimeNsec, uint32(m.ResponseTime.Nanosecond()))
+	}
+
+	if m.ResponseMessage != nil {
+		b = appendBytesField(b, fieldMsgResponseMessage, m.ResponseMessage)
+	}
+
+	return b
+}
+
+// appendTag appends the protobuf field tag to b.
+func appendTag(b []byte, field, wireType uint64) (res []byte) {
+	return binary.AppendUvarint(b, field<<3|wireType)
+}
+
+// appendVarintField appends the protobuf varint field to b.
+func appendVarintField(b []byte, field, v uint64) (res []byte) {
+	b = appendTag(b, field, wireVarint)
+
+	return binary.AppendUvarint(b, v)
+}
+
+// appendFixed32Field appends the protobuf fixed32 field to b.
+func appendFixed32Field(b []byte, field uint64, v uint32) (res []byte) {
+	b = appendTag(b, field, wireFixed32)
+
+	return binary.LittleEndian.AppendUint32(b, v)
+}
+
+// appendBytesField appends the protobuf length-delimited field to b.
+func appendBytesField(b []byte, field uint64, v []byte) (res []byte) {
+	b = appendTag(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+
+	return append(b, v...)
+}
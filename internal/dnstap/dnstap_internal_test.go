@@ -0,0 +1,265 @@
+package dnstap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// protoFields parses the top-level protobuf fields of b into a map of field
+// numbers to their raw values.  Varints and fixed32 values are decoded into
+// uint64.
+func protoFields(t *testing.T, b []byte) (fields map[uint64]any) {
+	t.Helper()
+
+	fields = map[uint64]any{}
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		require.Positive(t, n)
+
+		b = b[n:]
+		switch field, wireType := tag>>3, tag&0x7; wireType {
+		case wireVarint:
+			v, vn := binary.Uvarint(b)
+			require.Positive(t, vn)
+
+			fields[field], b = v, b[vn:]
+		case wireFixed32:
+			require.GreaterOrEqual(t, len(b), 4)
+
+			fields[field], b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case wireBytes:
+			l, ln := binary.Uvarint(b)
+			require.Positive(t, ln)
+
+			b = b[ln:]
+			require.GreaterOrEqual(t, uint64(len(b)), l)
+
+			fields[field], b = b[:l], b[l:]
+		default:
+			t.Fatalf("unexpected wire type %d", wireType)
+		}
+	}
+
+	return fields
+}
+
+func TestWriter(t *testing.T) {
+	qTime := time.Unix(1700000000, 123)
+	msg := &Message{
+		QueryTime:       qTime,
+		ResponseTime:    qTime.Add(time.Millisecond),
+		QueryAddr:       netip.MustParseAddrPort("1.2.3.4:5353"),
+		QueryMessage:    []byte{1, 2},
+		ResponseMessage: []byte{3, 4},
+		Type:            MessageTypeClientResponse,
+		SocketProtocol:  SocketProtocolDoH,
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, "test-identity", "v1")
+	require.NoError(t, err)
+
+	require.NoError(t, w.WriteMessage(msg))
+	require.NoError(t, w.Close())
+
+	b := buf.Bytes()
+
+	// Start frame.
+	wantStart := []byte{
+		0, 0, 0, 0,
+		0, 0, 0, 8 + byte(len(ContentType)) + 4,
+		0, 0, 0, byte(controlStart),
+		0, 0, 0, controlFieldContentType,
+		0, 0, 0, byte(len(ContentType)),
+	}
+	wantStart = append(wantStart, ContentType...)
+	require.True(t, bytes.HasPrefix(b, wantStart))
+
+	b = b[len(wantStart):]
+
+	// Data frame.
+	require.GreaterOrEqual(t, len(b), 4)
+
+	l := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	require.GreaterOrEqual(t, uint32(len(b)), l)
+
+	dt := protoFields(t, b[:l])
+	b = b[l:]
+
+	assert.Equal(t, []byte("test-identity"), dt[fieldDnstapIdentity])
+	assert.Equal(t, []byte("v1"), dt[fieldDnstapVersion])
+	assert.Equal(t, uint64(dnstapTypeMessage), dt[fieldDnstapType])
+
+	raw, ok := dt[fieldDnstapMessage].([]byte)
+	require.True(t, ok)
+
+	m := protoFields(t, raw)
+	assert.Equal(t, map[uint64]any{
+		fieldMsgType:             uint64(MessageTypeClientResponse),
+		fieldMsgSocketFamily:     uint64(socketFamilyINET),
+		fieldMsgSocketProtocol:   uint64(SocketProtocolDoH),
+		fieldMsgQueryAddress:     []byte{1, 2, 3, 4},
+		fieldMsgQueryPort:        uint64(5353),
+		fieldMsgQueryTimeSec:     uint64(1700000000),
+		fieldMsgQueryTimeNsec:    uint64(123),
+		fieldMsgQueryMessage:     []byte{1, 2},
+		fieldMsgResponseTimeSec:  uint64(1700000000),
+		fieldMsgResponseTimeNsec: uint64(1_000_123),
+		fieldMsgResponseMessage:  []byte{3, 4},
+	}, m)
+
+	// Stop frame.
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 4, 0, 0, 0, byte(controlStop)}, b)
+}
+
+func TestParseAddress(t *testing.T) {
+	testCases := []struct {
+		name        string
+		in          string
+		wantNetwork string
+		wantAddr    string
+		wantErrMsg  string
+	}{{
+		name:        "unix",
+		in:          "unix:///var/run/dnstap.sock",
+		wantNetwork: "unix",
+		wantAddr:    "/var/run/dnstap.sock",
+		wantErrMsg:  "",
+	}, {
+		name:        "tcp",
+		in:          "tcp://127.0.0.1:6000",
+		wantNetwork: "tcp",
+		wantAddr:    "127.0.0.1:6000",
+		wantErrMsg:  "",
+	}, {
+		name:        "bad_scheme",
+		in:          "udp://127.0.0.1:6000",
+		wantNetwork: "",
+		wantAddr:    "",
+		wantErrMsg:  `bad address scheme "udp", want "unix" or "tcp"`,
+	}, {
+		name:        "empty",
+		in:          "tcp://",
+		wantNetwork: "",
+		wantAddr:    "",
+		wantErrMsg:  `empty address in "tcp://"`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			network, addr, err := ParseAddress(tc.in)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.wantNetwork, network)
+			assert.Equal(t, tc.wantAddr, addr)
+		})
+	}
+}
+
+// collect accepts a single connection on l, performs the reader side of the
+// Frame Streams handshake, and sends the received data frames into frames
+// until the stop frame.
+func collect(t *testing.T, l net.Listener, frames chan<- []byte) {
+	t.Helper()
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	ct, contentTypes, err := readControlFrame(conn)
+	require.NoError(t, err)
+	require.Equal(t, controlReady, ct)
+	require.Equal(t, []string{ContentType}, contentTypes)
+
+	_, err = conn.Write(appendControlFrame(nil, controlAccept, ContentType))
+	require.NoError(t, err)
+
+	ct, _, err = readControlFrame(conn)
+	require.NoError(t, err)
+	require.Equal(t, controlStart, ct)
+
+	for {
+		var hdr [4]byte
+		_, err = io.ReadFull(conn, hdr[:])
+		require.NoError(t, err)
+
+		l := binary.BigEndian.Uint32(hdr[:])
+		if l == 0 {
+			// The stop frame.
+			_, err = io.ReadFull(conn, make([]byte, 8))
+			require.NoError(t, err)
+
+			_, err = conn.Write(appendControlFrame(nil, controlFinish, ""))
+			require.NoError(t, err)
+
+			close(frames)
+
+			return
+		}
+
+		frame := make([]byte, l)
+		_, err = io.ReadFull(conn, frame)
+		require.NoError(t, err)
+
+		frames <- frame
+	}
+}
+
+func TestSink(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	frames := make(chan []byte, 10)
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+
+		collect(t, l, frames)
+	}()
+
+	s, err := NewSink(&SinkConfig{
+		Address:           "tcp://" + l.Addr().String(),
+		Identity:          "test",
+		Version:           "v1",
+		BufferSize:        10,
+		ReconnectInterval: 10 * time.Millisecond,
+		Timeout:           time.Second,
+	})
+	require.NoError(t, err)
+
+	s.Send(&Message{
+		QueryMessage: []byte{1, 2},
+		Type:         MessageTypeClientQuery,
+	})
+
+	var frame []byte
+	select {
+	case frame = <-frames:
+	case <-time.After(time.Second):
+		t.Fatal("no frame received")
+	}
+
+	dt := protoFields(t, frame)
+	assert.Equal(t, []byte("test"), dt[fieldDnstapIdentity])
+
+	raw, ok := dt[fieldDnstapMessage].([]byte)
+	require.True(t, ok)
+
+	m := protoFields(t, raw)
+	assert.Equal(t, uint64(MessageTypeClientQuery), m[fieldMsgType])
+	assert.Equal(t, []byte{1, 2}, m[fieldMsgQueryMessage])
+
+	require.NoError(t, s.Close())
+	<-collected
+}
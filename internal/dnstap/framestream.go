@@ -0,0 +1,168 @@
+package dnstap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// ContentType is the Frame Streams content type of dnstap data.
+const ContentType = "protobuf:dnstap.Dnstap"
+
+// controlType is the type of a Frame Streams control frame.
+type controlType uint32
+
+// Control frame types.
+const (
+	controlAccept controlType = 0x01
+	controlStart  controlType = 0x02
+	controlStop   controlType = 0x03
+	controlReady  controlType = 0x04
+	controlFinish controlType = 0x05
+)
+
+// controlFieldContentType is the type of the content type field of a control
+// frame.
+const controlFieldContentType = 0x01
+
+// maxControlFrameLen is the maximum length of a control frame accepted from
+// the reader.
+const maxControlFrameLen = 512
+
+// Writer writes dnstap messages as a unidirectional Frame Stream, for example
+// into a file.  It's not safe for concurrent use.
+type Writer struct {
+	w        *bufio.Writer
+	identity string
+	version  string
+	buf      []byte
+}
+
+// NewWriter returns a new *Writer and writes the start frame into w.  identity
+// and version, if not empty, are included into every message.
+func NewWriter(w io.Writer, identity, version string) (dw *Writer, err error) {
+	dw = &Writer{
+		w:        bufio.NewWriter(w),
+		identity: identity,
+		version:  version,
+	}
+
+	err = dw.writeControl(controlStart, ContentType)
+	if err != nil {
+		return nil, fmt.Errorf("writing start frame: %w", err)
+	}
+
+	return dw, nil
+}
+
+// WriteMessage writes m as a data frame.
+func (dw *Writer) WriteMessage(m *Message) (err error) {
+	dw.buf = appendDataFrame(dw.buf[:0], m, dw.identity, dw.version)
+
+	_, err = dw.w.Write(dw.buf)
+	if err != nil {
+		return fmt.Errorf("writing frame: %w", err)
+	}
+
+	return nil
+}
+
+// Flush writes the buffered frames into the underlying writer.
+func (dw *Writer) Flush() (err error) {
+	return dw.w.Flush()
+}
+
+// Close writes the stop frame and flushes the buffered frames.  It doesn't
+// close the underlying writer.
+func (dw *Writer) Close() (err error) {
+	err = dw.writeControl(controlStop, "")
+	if err != nil {
+		return fmt.Errorf("writing stop frame: %w", err)
+	}
+
+	return dw.w.Flush()
+}
+
+// writeControl writes the control frame of type ct with the optional content
+// type field.
+func (dw *Writer) writeControl(ct controlType, contentType string) (err error) {
+	_, err = dw.w.Write(appendControlFrame(nil, ct, contentType))
+
+	return err
+}
+
+// appendDataFrame appends the data frame containing m to b.
+func appendDataFrame(b []byte, m *Message, identity, version string) (res []byte) {
+	// Reserve the space for the frame length.
+	start := len(b)
+	b = append(b, 0, 0, 0, 0)
+	b = appendDnstap(b, m, identity, version)
+	binary.BigEndian.PutUint32(b[start:], uint32(len(b)-start-4))
+
+	return b
+}
+
+// appendControlFrame appends the control frame of type ct with the optional
+// content type field to b.
+func appendControlFrame(b []byte, ct controlType, contentType string) (res []byte) {
+	frameLen := 4
+	if contentType != "" {
+		frameLen += 8 + len(contentType)
+	}
+
+	// The escape sequence, that is the zero data frame length, precedes the
+	// length of every control frame.
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint32(b, uint32(frameLen))
+	b = binary.BigEndian.AppendUint32(b, uint32(ct))
+	if contentType != "" {
+		b = binary.BigEndian.AppendUint32(b, controlFieldContentType)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(contentType)))
+		b = append(b, contentType...)
+	}
+
+	return b
+}
+
+// readControlFrame reads a control frame from r and returns its type and the
+// values of its content type fields.
+func readControlFrame(r io.Reader) (ct controlType, contentTypes []string, err error) {
+	var hdr [8]byte
+	_, err = io.ReadFull(r, hdr[:])
+	if err != nil {
+		return 0, nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	if esc := binary.BigEndian.Uint32(hdr[:4]); esc != 0 {
+		return 0, nil, fmt.Errorf("expected control frame, got data frame of length %d", esc)
+	}
+
+	frameLen := binary.BigEndian.Uint32(hdr[4:])
+	if frameLen < 4 || frameLen > maxControlFrameLen {
+		return 0, nil, fmt.Errorf("bad control frame length %d", frameLen)
+	}
+
+	frame := make([]byte, frameLen)
+	_, err = io.ReadFull(r, frame)
+	if err != nil {
+		return 0, nil, fmt.Errorf("reading control frame: %w", err)
+	}
+
+	ct, frame = controlType(binary.BigEndian.Uint32(frame)), frame[4:]
+	for len(frame) >= 8 {
+		fieldType, fieldLen := binary.BigEndian.Uint32(frame), binary.BigEndian.Uint32(frame[4:])
+		frame = frame[8:]
+		if uint32(len(frame)) < fieldLen {
+			return 0, nil, fmt.Errorf("bad control field length %d", fieldLen)
+		}
+
+		if fieldType == controlFieldContentType {
+			contentTypes = append(contentTypes, string(frame[:fieldLen]))
+		}
+
+		frame = frame[fieldLen:]
+	}
+
+	return ct, contentTypes, nil
+}
@@ -0,0 +1,259 @@
+package dnstap
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// SinkConfig is the configuration of a [Sink].
+type SinkConfig struct {
+	// Address is the address of the dnstap collector in the form of
+	// "unix:///path/to/socket" or "tcp://host:port".  See [ParseAddress].
+	Address string
+
+	// Identity is the identity of the server included into every message.
+	Identity string
+
+	// Version is the version of the server included into every message.
+	Version string
+
+	// BufferSize is the maximum number of messages buffered while the
+	// collector is slow or unavailable.  The messages sent when the buffer is
+	// full are dropped.  It must be positive.
+	BufferSize int
+
+	// ReconnectInterval is the interval between the attempts to connect to
+	// the collector.  It must be positive.
+	ReconnectInterval time.Duration
+
+	// Timeout is the timeout of connecting to the collector and of every
+	// write.  It must be positive.
+	Timeout time.Duration
+}
+
+// ParseAddress parses the address of a dnstap collector in the form of
+// "unix:///path/to/socket" or "tcp://host:port" and returns its network and
+// address suitable for [net.Dial].
+func ParseAddress(s string) (network, addr string, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", fmt.Errorf("parsing address: %w", err)
+	}
+
+	switch u.Scheme {
+	case "unix":
+		addr = u.Path
+	case "tcp":
+		addr = u.Host
+	default:
+		return "", "", fmt.Errorf("bad address scheme %q, want %q or %q", u.Scheme, "unix", "tcp")
+	}
+
+	if addr == "" {
+		return "", "", fmt.Errorf("empty address in %q", s)
+	}
+
+	return u.Scheme, addr, nil
+}
+
+// Sink sends dnstap messages to a collector over a bidirectional Frame Stream.
+// It reconnects to the collector if the connection is lost.
+type Sink struct {
+	conf    *SinkConfig
+	msgs    chan *Message
+	stop    chan struct{}
+	done    chan struct{}
+	network string
+	addr    string
+	dropped atomic.Uint64
+}
+
+// NewSink returns a new properly initialized *Sink and starts sending the
+// messages in a separate goroutine.  c must not be nil.
+func NewSink(c *SinkConfig) (s *Sink, err error) {
+	network, addr, err := ParseAddress(c.Address)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	s = &Sink{
+		conf:    c,
+		msgs:    make(chan *Message, c.BufferSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		network: network,
+		addr:    addr,
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+// Send queues m for sending without blocking.  m is dropped if the buffer is
+// full.  m must not be modified after the call.
+func (s *Sink) Send(m *Message) {
+	select {
+	case s.msgs <- m:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// Close stops the sink and closes the connection to the collector.  The
+// messages remaining in the buffer are discarded.
+func (s *Sink) Close() (err error) {
+	close(s.stop)
+	<-s.done
+
+	s.logDropped()
+
+	return nil
+}
+
+// logDropped logs the number of dropped messages since the last call, if any.
+func (s *Sink) logDropped() {
+	if n := s.dropped.Swap(0); n > 0 {
+		log.Info("dnstap: dropped %d messages because of full buffer", n)
+	}
+}
+
+// run connects to the collector and sends the messages until the sink is
+// closed.  It's intended to be used as a goroutine.
+func (s *Sink) run() {
+	defer close(s.done)
+	defer log.OnPanic("dnstap: sink")
+
+	for {
+		conn, err := s.connect()
+		if err == nil {
+			log.Info("dnstap: connected to %s", s.conf.Address)
+			s.logDropped()
+
+			var stopped bool
+			stopped, err = s.serve(conn)
+			if stopped {
+				return
+			}
+		}
+
+		log.Error("dnstap: %s; reconnecting in %s", err, s.conf.ReconnectInterval)
+
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(s.conf.ReconnectInterval):
+			// Go on.
+		}
+	}
+}
+
+// connect connects to the collector and performs the handshake.
+func (s *Sink) connect() (conn net.Conn, err error) {
+	conn, err = net.DialTimeout(s.network, s.addr, s.conf.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("connecting: %w", err)
+	}
+
+	err = s.handshake(conn)
+	if err != nil {
+		err = fmt.Errorf("handshake: %w", err)
+
+		return nil, errors.WithDeferred(err, conn.Close())
+	}
+
+	return conn, nil
+}
+
+// handshake performs the Frame Streams handshake over conn.
+func (s *Sink) handshake(conn net.Conn) (err error) {
+	err = conn.SetDeadline(time.Now().Add(s.conf.Timeout))
+	if err != nil {
+		return fmt.Errorf("setting deadline: %w", err)
+	}
+
+	_, err = conn.Write(appendControlFrame(nil, controlReady, ContentType))
+	if err != nil {
+		return fmt.Errorf("writing ready frame: %w", err)
+	}
+
+	ct, contentTypes, err := readControlFrame(conn)
+	if err != nil {
+		return fmt.Errorf("reading accept frame: %w", err)
+	} else if ct != controlAccept {
+		return fmt.Errorf("got control frame of type %d, want accept", ct)
+	} else if !slices.Contains(contentTypes, ContentType) {
+		return fmt.Errorf("content type %q not accepted", ContentType)
+	}
+
+	_, err = conn.Write(appendControlFrame(nil, controlStart, ContentType))
+	if err != nil {
+		return fmt.Errorf("writing start frame: %w", err)
+	}
+
+	return conn.SetDeadline(time.Time{})
+}
+
+// serve sends the messages over conn until an error occurs or the sink is
+// closed, in which case stopped is true.  conn is closed on return.
+func (s *Sink) serve(conn net.Conn) (stopped bool, err error) {
+	defer func() { err = errors.WithDeferred(err, conn.Close()) }()
+
+	w := bufio.NewWriter(conn)
+	var buf []byte
+	for {
+		select {
+		case <-s.stop:
+			s.finish(conn, w)
+
+			return true, nil
+		case m := <-s.msgs:
+			err = conn.SetWriteDeadline(time.Now().Add(s.conf.Timeout))
+			if err != nil {
+				return false, fmt.Errorf("setting write deadline: %w", err)
+			}
+
+			buf = appendDataFrame(buf[:0], m, s.conf.Identity, s.conf.Version)
+			_, err = w.Write(buf)
+			if err == nil && len(s.msgs) == 0 {
+				// Only flush when there are no more messages in the buffer
+				// to reduce the number of writes.
+				err = w.Flush()
+			}
+
+			if err != nil {
+				return false, fmt.Errorf("writing: %w", err)
+			}
+		}
+	}
+}
+
+// finish gracefully stops the Frame Stream over conn.  Any errors are logged,
+// since the connection is going to be closed anyway.
+func (s *Sink) finish(conn net.Conn, w *bufio.Writer) {
+	err := conn.SetDeadline(time.Now().Add(s.conf.Timeout))
+	if err == nil {
+		_, err = w.Write(appendControlFrame(nil, controlStop, ""))
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		_, _, err = readControlFrame(conn)
+	}
+
+	if err != nil {
+		log.Debug("dnstap: stopping stream: %s", err)
+	}
+}
@@ -10,41 +10,12 @@ import (
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
 	"github.com/AdguardTeam/AdGuardHome/internal/schedule"
 	"github.com/AdguardTeam/golibs/log"
-	"github.com/AdguardTeam/urlfilter/rules"
 )
 
-// serviceRules maps a service ID to its filtering rules.
-var serviceRules map[string][]*rules.NetworkRule
-
-// serviceIDs contains service IDs sorted alphabetically.
-var serviceIDs []string
-
-// initBlockedServices initializes package-level blocked service data.
+// initBlockedServices initializes package-level blocked service data with the
+// built-in services.
 func initBlockedServices() {
-	l := len(blockedServices)
-	serviceIDs = make([]string, l)
-	serviceRules = make(map[string][]*rules.NetworkRule, l)
-
-	for i, s := range blockedServices {
-		netRules := make([]*rules.NetworkRule, 0, len(s.Rules))
-		for _, text := range s.Rules {
-			rule, err := rules.NewNetworkRule(text, BlockedSvcsListID)
-			if err != nil {
-				log.Error("parsing blocked service %q rule %q: %s", s.ID, text, err)
-
-				continue
-			}
-
-			netRules = append(netRules, rule)
-		}
-
-		serviceIDs[i] = s.ID
-		serviceRules[s.ID] = netRules
-	}
-
-	slices.Sort(serviceIDs)
-
-	log.Debug("filtering: initialized %d services", l)
+	catalog.setBase(blockedServices, "", time.Time{})
 }
 
 // BlockedServices is the configuration of blocked services.
@@ -72,7 +43,7 @@ func (s *BlockedServices) Clone() (c *BlockedServices) {
 // must not be nil.
 func (s *BlockedServices) Validate() (err error) {
 	for _, id := range s.IDs {
-		_, ok := serviceRules[id]
+		_, ok := catalog.serviceRules(id)
 		if !ok {
 			return fmt.Errorf("unknown blocked-service %q", id)
 		}
@@ -81,6 +52,51 @@ func (s *BlockedServices) Validate() (err error) {
 	return nil
 }
 
+// PruneRemoved removes the IDs of the services, which have been removed from
+// the catalog, for example by an update of the remote catalog, from s and
+// returns them.  The other unknown IDs are kept, so that
+// [BlockedServices.Validate] reports them.  s must not be nil.
+func (s *BlockedServices) PruneRemoved() (removed []string) {
+	s.IDs = slices.DeleteFunc(s.IDs, func(id string) (ok bool) {
+		if catalog.isRemoved(id) {
+			removed = append(removed, id)
+
+			return true
+		}
+
+		return false
+	})
+
+	return removed
+}
+
+// pruneRemovedServices removes the IDs of the services removed from the catalog
+// from the global blocked services and the ones of the persistent clients, so
+// that the configuration stays valid after a restart.  pruned is true if any
+// have been removed and the configuration needs to be saved.
+func (d *DNSFilter) pruneRemovedServices() (pruned bool) {
+	var removed []string
+	func() {
+		d.confMu.Lock()
+		defer d.confMu.Unlock()
+
+		if d.conf.BlockedServices != nil {
+			removed = d.conf.BlockedServices.PruneRemoved()
+		}
+	}()
+
+	if len(removed) > 0 {
+		log.Info("filtering: blocked services: removed from the catalog: %q", removed)
+	}
+
+	pruned = len(removed) > 0
+	if d.conf.PruneClientsServices != nil && d.conf.PruneClientsServices() {
+		pruned = true
+	}
+
+	return pruned
+}
+
 // ApplyBlockedServices - set blocked services settings for this DNS request
 func (d *DNSFilter) ApplyBlockedServices(setts *Settings) {
 	d.confMu.RLock()
@@ -99,9 +115,13 @@ func (d *DNSFilter) ApplyBlockedServices(setts *Settings) {
 // ApplyBlockedServicesList appends filtering rules to the settings.
 func (d *DNSFilter) ApplyBlockedServicesList(setts *Settings, list []string) {
 	for _, name := range list {
-		rules, ok := serviceRules[name]
+		rules, ok := catalog.serviceRules(name)
 		if !ok {
-			log.Error("unknown service name: %s", name)
+			if catalog.isRemoved(name) {
+				log.Debug("filtering: service %q removed from the catalog", name)
+			} else {
+				log.Error("unknown service name: %s", name)
+			}
 
 			continue
 		}
@@ -114,14 +134,18 @@ func (d *DNSFilter) ApplyBlockedServicesList(setts *Settings, list []string) {
 }
 
 func (d *DNSFilter) handleBlockedServicesIDs(w http.ResponseWriter, r *http.Request) {
-	aghhttp.WriteJSONResponseOK(w, r, serviceIDs)
+	aghhttp.WriteJSONResponseOK(w, r, catalog.serviceIDs())
 }
 
 func (d *DNSFilter) handleBlockedServicesAll(w http.ResponseWriter, r *http.Request) {
+	svcs, version := catalog.allServices()
+
 	aghhttp.WriteJSONResponseOK(w, r, struct {
+		Version         string           `json:"version,omitempty"`
 		BlockedServices []blockedService `json:"blocked_services"`
 	}{
-		BlockedServices: blockedServices,
+		Version:         version,
+		BlockedServices: svcs,
 	})
 }
 
@@ -212,3 +236,172 @@ func (d *DNSFilter) handleBlockedServicesUpdate(w http.ResponseWriter, r *http.R
 
 	d.conf.ConfigModified()
 }
+
+// customServicesResp is the response to the GET
+// /control/blocked_services/custom HTTP API.
+type customServicesResp struct {
+	CustomServices []*CustomService `json:"custom_services"`
+}
+
+// customServiceUpdateReq is the request to the PUT
+// /control/blocked_services/custom/update HTTP API.
+type customServiceUpdateReq struct {
+	// Data is the new data of the service.
+	Data *CustomService `json:"data"`
+
+	// ID is the ID of the service to update.
+	ID string `json:"id"`
+}
+
+// customServiceDeleteReq is the request to the POST
+// /control/blocked_services/custom/delete HTTP API.
+type customServiceDeleteReq struct {
+	ID string `json:"id"`
+}
+
+// handleCustomServicesList is the handler for the GET
+// /control/blocked_services/custom HTTP API.
+func (d *DNSFilter) handleCustomServicesList(w http.ResponseWriter, r *http.Request) {
+	resp := &customServicesResp{
+		CustomServices: []*CustomService{},
+	}
+
+	func() {
+		d.confMu.RLock()
+		defer d.confMu.RUnlock()
+
+		if c := d.conf.ServicesCatalog; c != nil {
+			for _, s := range c.CustomServices {
+				resp.CustomServices = append(resp.CustomServices, s.Clone())
+			}
+		}
+	}()
+
+	aghhttp.WriteJSONResponseOK(w, r, resp)
+}
+
+// handleCustomServicesAdd is the handler for the POST
+// /control/blocked_services/custom/add HTTP API.
+func (d *DNSFilter) handleCustomServicesAdd(w http.ResponseWriter, r *http.Request) {
+	svc := &CustomService{}
+	err := json.NewDecoder(r.Body).Decode(svc)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+
+		return
+	}
+
+	err = d.updateCustomServices(func(svcs []*CustomService) (upd []*CustomService, err error) {
+		return append(svcs, svc), nil
+	})
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "adding custom service: %s", err)
+
+		return
+	}
+
+	log.Debug("filtering: added custom blocked service %q", svc.ID)
+}
+
+// handleCustomServicesUpdate is the handler for the PUT
+// /control/blocked_services/custom/update HTTP API.
+func (d *DNSFilter) handleCustomServicesUpdate(w http.ResponseWriter, r *http.Request) {
+	req := &customServiceUpdateReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+
+		return
+	} else if req.Data == nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "data is required")
+
+		return
+	}
+
+	err = d.updateCustomServices(func(svcs []*CustomService) (upd []*CustomService, err error) {
+		i := slices.IndexFunc(svcs, func(s *CustomService) (ok bool) { return s.ID == req.ID })
+		if i < 0 {
+			return nil, fmt.Errorf("no custom service with id %q", req.ID)
+		}
+
+		svcs[i] = req.Data
+
+		return svcs, nil
+	})
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "updating custom service: %s", err)
+
+		return
+	}
+
+	log.Debug("filtering: updated custom blocked service %q", req.ID)
+}
+
+// handleCustomServicesDelete is the handler for the POST
+// /control/blocked_services/custom/delete HTTP API.
+func (d *DNSFilter) handleCustomServicesDelete(w http.ResponseWriter, r *http.Request) {
+	req := &customServiceDeleteReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+
+		return
+	}
+
+	err = d.updateCustomServices(func(svcs []*CustomService) (upd []*CustomService, err error) {
+		upd = slices.DeleteFunc(svcs, func(s *CustomService) (ok bool) { return s.ID == req.ID })
+		if len(upd) == len(svcs) {
+			return nil, fmt.Errorf("no custom service with id %q", req.ID)
+		}
+
+		return upd, nil
+	})
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "deleting custom service: %s", err)
+
+		return
+	}
+
+	log.Debug("filtering: deleted custom blocked service %q", req.ID)
+}
+
+// updateCustomServices applies upd to a copy of the custom services, validates
+// the result, and, if it's valid, sets it in both the configuration and the
+// catalog.
+func (d *DNSFilter) updateCustomServices(
+	upd func(svcs []*CustomService) (updated []*CustomService, err error),
+) (err error) {
+	err = func() (err error) {
+		d.confMu.Lock()
+		defer d.confMu.Unlock()
+
+		if d.conf.ServicesCatalog == nil {
+			d.conf.ServicesCatalog = &ServicesCatalogConfig{}
+		}
+
+		svcs, err := upd(slices.Clone(d.conf.ServicesCatalog.CustomServices))
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return err
+		}
+
+		err = validateCustomServices(svcs)
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return err
+		}
+
+		d.conf.ServicesCatalog.CustomServices = svcs
+		catalog.setCustom(svcs)
+
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	d.pruneRemovedServices()
+	d.conf.ConfigModified()
+
+	return nil
+}
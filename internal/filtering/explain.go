@@ -0,0 +1,496 @@
+package filtering
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/urlfilter"
+	"github.com/AdguardTeam/urlfilter/rules"
+)
+
+// Names of the filtering stages that have a special meaning in explanations.
+const (
+	stageNameRewrites        = "rewrites"
+	stageNameFiltering       = "filtering"
+	stageNameBlockedServices = "blocked services"
+)
+
+// Statuses of a filtering stage within an explanation.
+const (
+	stageStatusMatched    = "matched"
+	stageStatusNotMatched = "not_matched"
+	stageStatusNotReached = "not_reached"
+	stageStatusSkipped    = "skipped"
+	stageStatusError      = "error"
+)
+
+// Statuses of a candidate rule within an explanation.
+const (
+	ruleStatusApplied       = "applied"
+	ruleStatusOverridden    = "overridden"
+	ruleStatusNotApplicable = "not_applicable"
+)
+
+// explanation is the detailed description of the filtering decision made for
+// a request.
+type explanation struct {
+	// Settings are the effective filtering settings used for the request.
+	Settings *explainSettings `json:"settings"`
+
+	// Stages are the filtering stages in the order in which they are run by
+	// the DNS server.
+	Stages []*explainStage `json:"stages"`
+
+	// Rules are the candidate rules, which are the rules that match the
+	// request, including the overridden ones.
+	Rules []*explainRule `json:"rules"`
+}
+
+// explainSettings are the effective filtering settings of an explanation.
+type explainSettings struct {
+	ClientName          string   `json:"client_name"`
+	ClientTags          []string `json:"client_tags"`
+	BlockedServices     []string `json:"blocked_services"`
+	FilteringEnabled    bool     `json:"filtering_enabled"`
+	ProtectionEnabled   bool     `json:"protection_enabled"`
+	SafeBrowsingEnabled bool     `json:"safebrowsing_enabled"`
+	SafeSearchEnabled   bool     `json:"safesearch_enabled"`
+	ParentalEnabled     bool     `json:"parental_enabled"`
+}
+
+// newExplainSettings returns the effective settings for an explanation from
+// setts.
+func newExplainSettings(setts *Settings) (s *explainSettings) {
+	s = &explainSettings{
+		ClientName:          setts.ClientName,
+		ClientTags:          slices.Clone(setts.ClientTags),
+		BlockedServices:     make([]string, 0, len(setts.ServicesRules)),
+		FilteringEnabled:    setts.FilteringEnabled,
+		ProtectionEnabled:   setts.ProtectionEnabled,
+		SafeBrowsingEnabled: setts.SafeBrowsingEnabled,
+		SafeSearchEnabled:   setts.SafeSearchEnabled,
+		ParentalEnabled:     setts.ParentalEnabled,
+	}
+
+	if s.ClientTags == nil {
+		s.ClientTags = []string{}
+	}
+
+	for _, svc := range setts.ServicesRules {
+		s.BlockedServices = append(s.BlockedServices, svc.Name)
+	}
+
+	return s
+}
+
+// explainStage is a single filtering stage of an explanation.
+type explainStage struct {
+	// Name is the name of the stage.
+	Name string `json:"name"`
+
+	// Status is the status of the stage, one of stageStatus constants.
+	Status string `json:"status"`
+
+	// Reason is the filtering reason returned by the stage, if it matched.
+	Reason string `json:"reason,omitempty"`
+
+	// Error is the error returned by the stage, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// explainRule is a single candidate rule of an explanation.
+type explainRule struct {
+	// Text is the text of the rule.
+	Text string `json:"text"`
+
+	// Stage is the name of the filtering stage the rule belongs to.
+	Stage string `json:"stage"`
+
+	// Status is the status of the rule, one of ruleStatus constants.
+	Status string `json:"status"`
+
+	// Explanation is the human-readable description of the status.
+	Explanation string `json:"explanation"`
+
+	// FilterListID is the ID of the rule's filter list, if any.
+	FilterListID int64 `json:"filter_list_id"`
+}
+
+// explain returns the detailed description of how the request for host with
+// qtype is filtered using setts.  It runs the same stages in the same order as
+// [DNSFilter.CheckHost], except for the ones sending requests to remote
+// servers, which are skipped.
+func (d *DNSFilter) explain(host string, qtype uint16, setts *Settings) (e *explanation) {
+	host = strings.ToLower(host)
+
+	e = &explanation{
+		Settings: newExplainSettings(setts),
+		Stages:   make([]*explainStage, 0, len(d.hostCheckers)+1),
+		Rules:    []*explainRule{},
+	}
+
+	var res Result
+	stage := &explainStage{
+		Name:   stageNameRewrites,
+		Status: stageStatusNotMatched,
+	}
+	if setts.FilteringEnabled {
+		res = d.processRewrites(host, qtype)
+	}
+
+	winner := ""
+	if res.Reason == Rewritten {
+		stage.Status, stage.Reason = stageStatusMatched, res.Reason.String()
+		winner = stageNameRewrites
+	} else {
+		res = Result{}
+	}
+
+	e.Stages = append(e.Stages, stage)
+
+	for _, hc := range d.hostCheckers {
+		stage = &explainStage{
+			Name:   hc.name,
+			Status: stageStatusNotReached,
+		}
+		e.Stages = append(e.Stages, stage)
+
+		if winner != "" {
+			continue
+		} else if hc.remote {
+			stage.Status = stageStatusSkipped
+
+			continue
+		}
+
+		hcRes, err := hc.check(host, qtype, setts)
+		if err != nil {
+			stage.Status, stage.Error = stageStatusError, err.Error()
+			winner = hc.name
+
+			continue
+		}
+
+		if !hcRes.Reason.Matched() {
+			stage.Status = stageStatusNotMatched
+
+			continue
+		}
+
+		stage.Status, stage.Reason = stageStatusMatched, hcRes.Reason.String()
+		winner, res = hc.name, hcRes
+	}
+
+	e.Rules = append(e.Rules, d.explainRewrites(host, qtype, setts, winner)...)
+	e.Rules = append(e.Rules, d.explainListRules(host, qtype, setts, res, winner)...)
+	e.Rules = append(e.Rules, explainServices(host, setts, res, winner)...)
+
+	if winner != "" && winner != stageNameRewrites && winner != stageNameFiltering &&
+		winner != stageNameBlockedServices {
+		for _, r := range res.Rules {
+			e.Rules = append(e.Rules, &explainRule{
+				Text:         r.Text,
+				Stage:        winner,
+				Status:       ruleStatusApplied,
+				Explanation:  fmt.Sprintf("matched by the %s stage", winner),
+				FilterListID: r.FilterListID,
+			})
+		}
+	}
+
+	return e
+}
+
+// explainRewrites returns the candidate legacy and regular-expression rewrites
+// for host.
+func (d *DNSFilter) explainRewrites(
+	host string,
+	qtype uint16,
+	setts *Settings,
+	winner string,
+) (ers []*explainRule) {
+	d.confMu.RLock()
+	defer d.confMu.RUnlock()
+
+	for _, rw := range d.conf.Rewrites {
+		if rw.Domain != host && !matchDomainWildcard(host, rw.Domain) {
+			continue
+		}
+
+		er := &explainRule{
+			Text:   rw.Domain + " -> " + rw.Answer,
+			Stage:  stageNameRewrites,
+			Status: ruleStatusNotApplicable,
+		}
+
+		switch {
+		case !setts.FilteringEnabled:
+			er.Explanation = "filtering is disabled"
+		case !rw.matchesQType(qtype):
+			er.Explanation = "rewrite is for another query type"
+		case winner == stageNameRewrites:
+			er.Status, er.Explanation = ruleStatusApplied, "legacy rewrite matched"
+		default:
+			er.Status, er.Explanation = ruleStatusOverridden, "rewrite is an exception or "+
+				"has lower priority than another rewrite"
+		}
+
+		ers = append(ers, er)
+	}
+
+	return append(ers, d.explainRegexpRewrites(host, qtype, setts, winner, len(ers) > 0)...)
+}
+
+// explainRegexpRewrites returns the candidate regular-expression rewrites for
+// host.  legacyMatched is true if any of the legacy rewrites matched host.
+// d.confMu must be locked.
+func (d *DNSFilter) explainRegexpRewrites(
+	host string,
+	qtype uint16,
+	setts *Settings,
+	winner string,
+	legacyMatched bool,
+) (ers []*explainRule) {
+	applied, _ := findRegexpRewrites(d.conf.RegexpRewrites, host, qtype)
+	for _, rw := range d.conf.RegexpRewrites {
+		lrw, ok := rw.expand(host)
+		if !ok {
+			continue
+		}
+
+		er := &explainRule{
+			Text:   rw.Pattern + " -> " + lrw.Answer,
+			Stage:  stageNameRewrites,
+			Status: ruleStatusNotApplicable,
+		}
+
+		isApplied := slices.ContainsFunc(applied, func(a *LegacyRewrite) (ok bool) {
+			return a.Answer == lrw.Answer
+		})
+
+		switch {
+		case !setts.FilteringEnabled:
+			er.Explanation = "filtering is disabled"
+		case (rw.qtype != 0 && rw.qtype != qtype) || !lrw.matchesQType(qtype):
+			er.Explanation = "rewrite is for another query type"
+		case legacyMatched:
+			er.Status, er.Explanation = ruleStatusOverridden, "legacy rewrites take "+
+				"precedence over regexp rewrites"
+		case winner == stageNameRewrites && isApplied:
+			er.Status, er.Explanation = ruleStatusApplied, "regexp rewrite matched"
+		default:
+			er.Status, er.Explanation = ruleStatusOverridden, "rewrite is an exception or "+
+				"has lower priority than another rewrite"
+		}
+
+		ers = append(ers, er)
+	}
+
+	return ers
+}
+
+// explainServices returns the candidate blocked services rules for host.
+func explainServices(host string, setts *Settings, res Result, winner string) (ers []*explainRule) {
+	req := rules.NewRequestForHostname(host)
+	for _, s := range setts.ServicesRules {
+		for _, rule := range s.Rules {
+			if !rule.Match(req) {
+				continue
+			}
+
+			er := &explainRule{
+				Text:         rule.Text(),
+				Stage:        stageNameBlockedServices,
+				Status:       ruleStatusOverridden,
+				FilterListID: int64(rule.GetFilterListID()),
+			}
+
+			switch {
+			case !setts.ProtectionEnabled:
+				er.Status, er.Explanation = ruleStatusNotApplicable, "protection is disabled"
+			case winner == stageNameBlockedServices && res.ServiceName == s.Name &&
+				len(res.Rules) > 0 && res.Rules[0].Text == er.Text:
+				er.Status, er.Explanation = ruleStatusApplied, "service "+s.Name+" is blocked"
+			case winner == stageNameBlockedServices:
+				er.Explanation = "another blocked service rule matched first"
+			default:
+				er.Explanation = fmt.Sprintf("overridden by the %s stage", winner)
+			}
+
+			ers = append(ers, er)
+		}
+	}
+
+	return ers
+}
+
+// explainListRules returns the candidate rules from the filtering-rule lists,
+// including the allowlists, for host.  res is the final result of filtering,
+// which was made by the winner stage.
+func (d *DNSFilter) explainListRules(
+	host string,
+	qtype uint16,
+	setts *Settings,
+	res Result,
+	winner string,
+) (ers []*explainRule) {
+	ufReq := &urlfilter.DNSRequest{
+		Hostname:         host,
+		SortedClientTags: setts.ClientTags,
+		ClientIP:         setts.ClientIP,
+		ClientName:       setts.ClientName,
+		DNSType:          qtype,
+	}
+
+	d.engineLock.RLock()
+	defer d.engineLock.RUnlock()
+
+	var cands []*listCandidate
+	for _, eng := range []*urlfilter.DNSEngine{d.filteringEngineAllow, d.filteringEngine} {
+		cands = append(cands, matchCandidates(eng, ufReq)...)
+	}
+
+	applied := make(map[ResultRule]struct{}, len(res.Rules))
+	for _, r := range res.Rules {
+		applied[ResultRule{Text: r.Text, FilterListID: r.FilterListID}] = struct{}{}
+	}
+
+	var winRule *rules.NetworkRule
+	for _, c := range cands {
+		if _, ok := applied[c.key()]; ok && winner == stageNameFiltering {
+			winRule, _ = c.rule.(*rules.NetworkRule)
+		}
+	}
+
+	for _, c := range cands {
+		er := &explainRule{
+			Text:         c.rule.Text(),
+			Stage:        stageNameFiltering,
+			FilterListID: int64(c.rule.GetFilterListID()),
+		}
+
+		er.Status, er.Explanation = c.status(setts, winner, winRule, applied, cands)
+		ers = append(ers, er)
+	}
+
+	return ers
+}
+
+// matchCandidates returns the rules of eng matching req.  eng may be nil.
+// d.engineLock is expected to be locked.
+func matchCandidates(eng *urlfilter.DNSEngine, req *urlfilter.DNSRequest) (cands []*listCandidate) {
+	if eng == nil {
+		return nil
+	}
+
+	dnsres, _ := eng.MatchRequest(req)
+	for _, r := range dnsres.NetworkRules {
+		cands = append(cands, &listCandidate{rule: r})
+	}
+
+	for _, r := range dnsres.HostRulesV4 {
+		cands = append(cands, &listCandidate{rule: r})
+	}
+
+	for _, r := range dnsres.HostRulesV6 {
+		cands = append(cands, &listCandidate{rule: r})
+	}
+
+	return cands
+}
+
+// listCandidate is a filtering rule that matches the request.
+type listCandidate struct {
+	// rule is the candidate rule.
+	rule rules.Rule
+}
+
+// key returns the key of c for looking up the applied rules.
+func (c *listCandidate) key() (k ResultRule) {
+	return ResultRule{
+		Text:         c.rule.Text(),
+		FilterListID: int64(c.rule.GetFilterListID()),
+	}
+}
+
+// status returns the status of the candidate rule along with its explanation.
+func (c *listCandidate) status(
+	setts *Settings,
+	winner string,
+	winRule *rules.NetworkRule,
+	applied map[ResultRule]struct{},
+	cands []*listCandidate,
+) (status, expl string) {
+	nr, isNetRule := c.rule.(*rules.NetworkRule)
+	if isNetRule && nr.IsOptionEnabled(rules.OptionBadfilter) {
+		return ruleStatusNotApplicable, "$badfilter rule only disables other rules"
+	}
+
+	if _, ok := applied[c.key()]; ok && winner == stageNameFiltering {
+		return ruleStatusApplied, "rule determined the result"
+	}
+
+	if isNetRule {
+		for _, other := range cands {
+			bf, ok := other.rule.(*rules.NetworkRule)
+			if ok && negatesRule(bf, nr) {
+				return ruleStatusOverridden, "disabled by $badfilter rule " + bf.Text()
+			}
+		}
+	}
+
+	switch {
+	case !setts.FilteringEnabled:
+		return ruleStatusNotApplicable, "filtering is disabled"
+	case winner == "":
+		return ruleStatusOverridden, "protection is disabled or the rule is not a blocking one"
+	case winner != stageNameFiltering:
+		return ruleStatusOverridden, fmt.Sprintf("overridden by the %s stage", winner)
+	case winRule == nil:
+		return ruleStatusOverridden, "overridden by another rule"
+	case winRule.Whitelist && winRule.IsOptionEnabled(rules.OptionImportant):
+		return ruleStatusOverridden, "overridden by $important allowlist rule " + winRule.Text()
+	case winRule.Whitelist && isNetRule && nr.IsOptionEnabled(rules.OptionImportant):
+		return ruleStatusOverridden, "overridden by allowlist rule " + winRule.Text() +
+			", since allowlists are checked before blocklists"
+	case winRule.IsOptionEnabled(rules.OptionImportant):
+		return ruleStatusOverridden, "overridden by $important rule " + winRule.Text()
+	case winRule.Whitelist:
+		return ruleStatusOverridden, "overridden by allowlist rule " + winRule.Text()
+	default:
+		return ruleStatusOverridden, "lower priority than rule " + winRule.Text()
+	}
+}
+
+// cutRuleOptions splits the text of a network rule into the pattern part and
+// the modifiers.  Regular expression rules without modifiers are returned
+// unchanged.
+func cutRuleOptions(text string) (base string, opts []string) {
+	pattern := strings.TrimPrefix(text, "@@")
+	if len(pattern) > 1 && pattern[0] == '/' && pattern[len(pattern)-1] == '/' {
+		return text, nil
+	}
+
+	i := strings.LastIndexByte(text, '$')
+	if i < 0 {
+		return text, nil
+	}
+
+	return text[:i], strings.Split(text[i+1:], ",")
+}
+
+// negatesRule returns true if bf is a $badfilter rule that disables r.
+func negatesRule(bf, r *rules.NetworkRule) (ok bool) {
+	if !bf.IsOptionEnabled(rules.OptionBadfilter) || r.IsOptionEnabled(rules.OptionBadfilter) {
+		return false
+	}
+
+	base, opts := cutRuleOptions(bf.Text())
+	opts = slices.DeleteFunc(opts, func(opt string) (del bool) { return opt == "badfilter" })
+	if len(opts) > 0 {
+		base += "$" + strings.Join(opts, ",")
+	}
+
+	return base == r.Text()
+}
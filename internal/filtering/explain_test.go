@@ -0,0 +1,201 @@
+package filtering
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSFilter_explain(t *testing.T) {
+	const (
+		blockListID = 1
+		allowListID = 2
+	)
+
+	blockRules := "||blocked.example^\n" +
+		"||blocked.example^$client=1.2.3.4\n" +
+		"||blocked.example^$ctag=device_pc\n" +
+		"||blocked.example^$dnstype=AAAA\n" +
+		"||important.example^$important\n" +
+		"@@||important.example^\n" +
+		"||bad.example^\n" +
+		"||bad.example^$badfilter\n" +
+		"||other.example^\n"
+	allowRules := "@@||blocked.example^$client=5.6.7.8\n"
+
+	d, setts := newForTest(t, &Config{}, nil)
+	t.Cleanup(d.Close)
+
+	err := d.setFilters(
+		[]Filter{{ID: blockListID, Data: []byte(blockRules)}},
+		[]Filter{{ID: allowListID, Data: []byte(allowRules)}},
+		false,
+	)
+	require.NoError(t, err)
+
+	stageStatuses := func(e *explanation) (statuses map[string]string) {
+		statuses = map[string]string{}
+		for _, s := range e.Stages {
+			statuses[s.Name] = s.Status
+		}
+
+		return statuses
+	}
+
+	ruleStatuses := func(e *explanation) (statuses map[string]string) {
+		statuses = map[string]string{}
+		for _, r := range e.Rules {
+			statuses[r.Text] = r.Status
+		}
+
+		return statuses
+	}
+
+	t.Run("blocked", func(t *testing.T) {
+		e := d.explain("blocked.example", dns.TypeA, setts)
+
+		require.Len(t, e.Stages, len(d.hostCheckers)+1)
+
+		assert.Equal(t, stageNameRewrites, e.Stages[0].Name)
+		assert.Equal(t, map[string]string{
+			stageNameRewrites:        stageStatusNotMatched,
+			"hosts container":        stageStatusNotMatched,
+			stageNameFiltering:       stageStatusMatched,
+			stageNameBlockedServices: stageStatusNotReached,
+			"safe browsing":          stageStatusNotReached,
+			"parental":               stageStatusNotReached,
+			"threat intelligence":    stageStatusNotReached,
+			"newly observed domains": stageStatusNotReached,
+			"safe search":            stageStatusNotReached,
+		}, stageStatuses(e))
+
+		assert.Equal(t, map[string]string{
+			"||blocked.example^": ruleStatusApplied,
+		}, ruleStatuses(e))
+	})
+
+	t.Run("not_blocked", func(t *testing.T) {
+		e := d.explain("allowed.example", dns.TypeA, setts)
+
+		assert.Equal(t, map[string]string{
+			stageNameRewrites:        stageStatusNotMatched,
+			"hosts container":        stageStatusNotMatched,
+			stageNameFiltering:       stageStatusNotMatched,
+			stageNameBlockedServices: stageStatusNotMatched,
+			"safe browsing":          stageStatusSkipped,
+			"parental":               stageStatusSkipped,
+			"threat intelligence":    stageStatusSkipped,
+			"newly observed domains": stageStatusNotMatched,
+			"safe search":            stageStatusNotMatched,
+		}, stageStatuses(e))
+
+		assert.Empty(t, e.Rules)
+	})
+
+	t.Run("client", func(t *testing.T) {
+		cliSetts := *setts
+		cliSetts.ClientIP = netip.MustParseAddr("5.6.7.8")
+
+		e := d.explain("blocked.example", dns.TypeA, &cliSetts)
+
+		require.Len(t, e.Rules, 2)
+
+		assert.Equal(t, ruleStatusApplied, e.Rules[0].Status)
+		assert.Equal(t, "@@||blocked.example^$client=5.6.7.8", e.Rules[0].Text)
+
+		assert.Equal(t, ruleStatusOverridden, e.Rules[1].Status)
+		assert.Equal(t, "||blocked.example^", e.Rules[1].Text)
+		assert.Contains(t, e.Rules[1].Explanation, "allowlist")
+	})
+
+	t.Run("important", func(t *testing.T) {
+		e := d.explain("important.example", dns.TypeA, setts)
+
+		assert.Equal(t, map[string]string{
+			"@@||important.example^":         ruleStatusOverridden,
+			"||important.example^$important": ruleStatusApplied,
+		}, ruleStatuses(e))
+	})
+
+	t.Run("badfilter", func(t *testing.T) {
+		e := d.explain("bad.example", dns.TypeA, setts)
+
+		assert.Equal(t, map[string]string{
+			"||bad.example^":           ruleStatusOverridden,
+			"||bad.example^$badfilter": ruleStatusNotApplicable,
+		}, ruleStatuses(e))
+	})
+}
+
+func TestDNSFilter_handleCheckHost_explain(t *testing.T) {
+	d, _ := newForTest(t, &Config{
+		ApplyClientFiltering: func(clientIP netip.Addr, _ string, setts *Settings) {
+			setts.ClientIP = clientIP
+			setts.ClientName = "client"
+		},
+	}, []Filter{{ID: 1, Data: []byte("||blocked.example^$dnstype=AAAA\n")}})
+	t.Cleanup(d.Close)
+
+	testCases := []struct {
+		name       string
+		query      string
+		wantReason string
+		wantCode   int
+		wantRules  int
+	}{{
+		name:       "a",
+		query:      "name=blocked.example&explain=true&client=1.2.3.4",
+		wantReason: NotFilteredNotFound.String(),
+		wantCode:   http.StatusOK,
+		wantRules:  0,
+	}, {
+		name:       "aaaa",
+		query:      "name=blocked.example&qtype=aaaa&explain=true&client=1.2.3.4",
+		wantReason: FilteredBlockList.String(),
+		wantCode:   http.StatusOK,
+		wantRules:  1,
+	}, {
+		name:       "bad_qtype",
+		query:      "name=blocked.example&qtype=BAD",
+		wantReason: "",
+		wantCode:   http.StatusBadRequest,
+		wantRules:  0,
+	}, {
+		name:       "bad_client",
+		query:      "name=blocked.example&client=bad",
+		wantReason: "",
+		wantCode:   http.StatusBadRequest,
+		wantRules:  0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/control/filtering/check_host?"+tc.query, nil)
+			w := httptest.NewRecorder()
+
+			d.handleCheckHost(w, r)
+			require.Equal(t, tc.wantCode, w.Code)
+
+			if tc.wantCode != http.StatusOK {
+				return
+			}
+
+			resp := &checkHostResp{}
+			err := json.NewDecoder(w.Body).Decode(resp)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantReason, resp.Reason)
+
+			require.NotNil(t, resp.Explanation)
+
+			assert.Equal(t, "client", resp.Explanation.Settings.ClientName)
+			assert.Len(t, resp.Explanation.Rules, tc.wantRules)
+		})
+	}
+}
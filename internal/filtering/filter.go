@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"slices"
@@ -14,8 +15,10 @@ import (
 	"github.com/AdguardTeam/AdGuardHome/internal/aghrenameio"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering/rulelist"
 	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/ioutil"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/c2h5oh/datasize"
 )
 
 // filterDir is the subdirectory of a data directory to store downloaded
@@ -36,8 +39,20 @@ type FilterYAML struct {
 	Name        string    `yaml:"name"`
 	RulesCount  int       `yaml:"-"`
 	LastUpdated time.Time `yaml:"-"`
-	checksum    uint32    // checksum of the file data
-	white       bool
+
+	// PublicKey is the minisign or SSH public key used to verify the detached
+	// signature of the list.  If it's empty, the signature isn't verified.
+	PublicKey string `yaml:"public_key,omitempty"`
+
+	// updateErr is the error of the last update of the list, if any.
+	updateErr error
+
+	checksum uint32 // checksum of the file data
+	white    bool
+
+	// VerifyChecksum, if true, requires the list to have a valid
+	// "! Checksum:" header.
+	VerifyChecksum bool `yaml:"verify_checksum,omitempty"`
 
 	Filter `yaml:",inline"`
 }
@@ -113,18 +128,29 @@ func (d *DNSFilter) filterSetProperties(
 		flt.URL,
 	)
 
-	defer func(oldURL, oldName string, oldEnabled bool, oldUpdated time.Time, oldRulesCount int) {
+	defer func(old FilterYAML) {
 		if err != nil {
-			flt.URL = oldURL
-			flt.Name = oldName
-			flt.Enabled = oldEnabled
-			flt.LastUpdated = oldUpdated
-			flt.RulesCount = oldRulesCount
+			flt.URL = old.URL
+			flt.Name = old.Name
+			flt.Enabled = old.Enabled
+			flt.LastUpdated = old.LastUpdated
+			flt.RulesCount = old.RulesCount
+			flt.PublicKey = old.PublicKey
+			flt.VerifyChecksum = old.VerifyChecksum
 		}
-	}(flt.URL, flt.Name, flt.Enabled, flt.LastUpdated, flt.RulesCount)
+	}(*flt)
 
 	flt.Name = newList.Name
 
+	if flt.PublicKey != newList.PublicKey || flt.VerifyChecksum != newList.VerifyChecksum {
+		// Verify the list again with the new settings.
+		shouldRestart = true
+
+		flt.PublicKey = newList.PublicKey
+		flt.VerifyChecksum = newList.VerifyChecksum
+		flt.checksum = 0
+	}
+
 	if flt.URL != newList.URL {
 		if d.filterExistsLocked(newList.URL) {
 			return false, errFilterExists
@@ -188,6 +214,46 @@ func (d *DNSFilter) filterExistsLocked(url string) (ok bool) {
 	return false
 }
 
+// FilterListRules returns the texts of the rules of the filtering-rule list
+// with the given ID, including comments.  ok is false if there is no such list.
+// It's safe for concurrent use.
+func (d *DNSFilter) FilterListRules(id int64) (rules []string, ok bool) {
+	var fltPath string
+	func() {
+		d.conf.filtersMu.RLock()
+		defer d.conf.filtersMu.RUnlock()
+
+		if id == CustomListID {
+			rules, ok = slices.Clone(d.conf.UserRules), true
+
+			return
+		}
+
+		for _, flts := range [][]FilterYAML{d.conf.Filters, d.conf.WhitelistFilters} {
+			i := slices.IndexFunc(flts, func(flt FilterYAML) (found bool) { return flt.ID == id })
+			if i != -1 {
+				fltPath, ok = flts[i].Path(d.conf.DataDir), true
+
+				return
+			}
+		}
+	}()
+
+	if fltPath == "" {
+		return rules, ok
+	}
+
+	data, err := os.ReadFile(fltPath)
+	if err != nil {
+		// Consider the list empty, since it may not have been downloaded yet.
+		log.Debug("filtering: reading rules of filter %d: %s", id, err)
+
+		return nil, true
+	}
+
+	return strings.Split(string(data), "\n"), true
+}
+
 // Add a filter
 // Return FALSE if a filter with this URL exists
 func (d *DNSFilter) filterAdd(flt FilterYAML) (err error) {
@@ -304,9 +370,11 @@ func (d *DNSFilter) listsToUpdate(filters *[]FilterYAML, force bool) (toUpd []Fi
 			Filter: Filter{
 				ID: flt.ID,
 			},
-			URL:      flt.URL,
-			Name:     flt.Name,
-			checksum: flt.checksum,
+			URL:            flt.URL,
+			Name:           flt.Name,
+			PublicKey:      flt.PublicKey,
+			checksum:       flt.checksum,
+			VerifyChecksum: flt.VerifyChecksum,
 		})
 	}
 
@@ -335,6 +403,8 @@ func (d *DNSFilter) refreshFiltersArray(filters *[]FilterYAML, force bool) (int,
 	}
 
 	if failNum == len(updateFilters) {
+		d.setUpdateErrors(filters, updateFilters)
+
 		return 0, nil, nil, true
 	}
 
@@ -353,6 +423,7 @@ func (d *DNSFilter) refreshFiltersArray(filters *[]FilterYAML, force bool) (int,
 				continue
 			}
 
+			f.updateErr = uf.updateErr
 			f.LastUpdated = uf.LastUpdated
 			if !updated {
 				continue
@@ -375,6 +446,23 @@ func (d *DNSFilter) refreshFiltersArray(filters *[]FilterYAML, force bool) (int,
 	return updateCount, updateFilters, updateFlags, false
 }
 
+// setUpdateErrors sets the errors of the last update from the updated copies
+// of the lists to the corresponding lists in filters.
+func (d *DNSFilter) setUpdateErrors(filters *[]FilterYAML, updated []FilterYAML) {
+	d.conf.filtersMu.Lock()
+	defer d.conf.filtersMu.Unlock()
+
+	for i := range updated {
+		uf := &updated[i]
+		for k := range *filters {
+			f := &(*filters)[k]
+			if f.ID == uf.ID && f.URL == uf.URL {
+				f.updateErr = uf.updateErr
+			}
+		}
+	}
+}
+
 // refreshFiltersIntl checks filters and updates them if necessary.  If force is
 // true, it ignores the filter.LastUpdated field value.
 //
@@ -441,6 +529,7 @@ func (d *DNSFilter) refreshFiltersIntl(block, allow, force bool) (int, bool) {
 // update refreshes filter's content and a/mtimes of it's file.
 func (d *DNSFilter) update(filter *FilterYAML) (b bool, err error) {
 	b, err = d.updateIntl(filter)
+	filter.updateErr = err
 	filter.LastUpdated = time.Now()
 	if !b {
 		chErr := os.Chtimes(
@@ -473,6 +562,14 @@ func (d *DNSFilter) updateIntl(flt *FilterYAML) (ok bool, err error) {
 	}
 	defer func() { err = d.finalizeUpdate(tmpFile, flt, res, err, ok) }()
 
+	var sigVerifier rulelist.SignatureVerifier
+	if flt.PublicKey != "" {
+		sigVerifier, err = d.signatureVerifier(flt)
+		if err != nil {
+			return false, fmt.Errorf("verifying signature: %w", err)
+		}
+	}
+
 	r, err := d.reader(flt.URL)
 	if err != nil {
 		// Don't wrap the error since it's informative enough as is.
@@ -480,13 +577,73 @@ func (d *DNSFilter) updateIntl(flt *FilterYAML) (ok bool, err error) {
 	}
 	defer func() { err = errors.WithDeferred(err, r.Close()) }()
 
+	var src io.Reader = r
+	if sigVerifier != nil {
+		src = io.TeeReader(r, sigVerifier)
+	}
+
 	bufPtr := d.bufPool.Get()
 	defer d.bufPool.Put(bufPtr)
 
-	p := rulelist.NewParser()
-	res, err = p.Parse(tmpFile, r, *bufPtr)
+	p := d.newParser(flt)
+	res, err = p.Parse(tmpFile, src, *bufPtr)
+	if err != nil {
+		return false, err
+	}
 
-	return res.Checksum != flt.checksum && err == nil, err
+	err = verifyList(flt, res, sigVerifier)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return false, err
+	}
+
+	return res.Checksum != flt.checksum, nil
+}
+
+// signatureVerifier fetches the detached signature of flt and returns the
+// verifier for it.
+func (d *DNSFilter) signatureVerifier(flt *FilterYAML) (v rulelist.SignatureVerifier, err error) {
+	sigURL := rulelist.SignatureURL(flt.URL, flt.PublicKey)
+	r, err := d.reader(sigURL)
+	if err != nil {
+		return nil, fmt.Errorf("fetching signature: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, r.Close()) }()
+
+	sig, err := io.ReadAll(ioutil.LimitReader(r, maxSignatureSize.Bytes()))
+	if err != nil {
+		return nil, fmt.Errorf("reading signature: %w", err)
+	}
+
+	return rulelist.NewSignatureVerifier(flt.PublicKey, sig)
+}
+
+// maxSignatureSize is the maximum size of a detached signature of a
+// filtering-rule list.
+const maxSignatureSize = 16 * datasize.KB
+
+// verifyList returns an error if the checksum header or the signature of the
+// parsed list flt is required but invalid.  sigVerifier may be nil.
+func verifyList(
+	flt *FilterYAML,
+	res *rulelist.ParseResult,
+	sigVerifier rulelist.SignatureVerifier,
+) (err error) {
+	if flt.VerifyChecksum {
+		err = res.VerifyChecksumHeader()
+		if err != nil {
+			return fmt.Errorf("verifying checksum: %w", err)
+		}
+	}
+
+	if sigVerifier != nil {
+		err = sigVerifier.Verify()
+		if err != nil {
+			return fmt.Errorf("verifying signature: %w", err)
+		}
+	}
+
+	return nil
 }
 
 // finalizeUpdate closes and gets rid of temporary file f with filter's content
@@ -545,6 +702,87 @@ func (d *DNSFilter) reader(fltURL string) (r io.ReadCloser, err error) {
 	return r, nil
 }
 
+// newParser returns a new filtering-rule list parser for flt, which URL is
+// either a URL or an absolute file path.  The parser expands the !#include
+// directives, unless the URL is invalid.  If the checksum or the signature of
+// flt must be verified, the parser rejects the !#include directives instead,
+// since they only cover the top-level list.
+func (d *DNSFilter) newParser(flt *FilterYAML) (p *rulelist.Parser) {
+	fltURL := flt.URL
+
+	var includer rulelist.Includer = &filterIncluder{d: d}
+	if flt.VerifyChecksum || flt.PublicKey != "" {
+		includer = verifiedIncluder{}
+	}
+
+	var baseURL *url.URL
+	if filepath.IsAbs(fltURL) {
+		// Make sure that the path is rooted even on Windows, so that relative
+		// includes are resolved properly.
+		baseURL = &url.URL{
+			Scheme: "file",
+			Path:   "/" + strings.TrimPrefix(filepath.ToSlash(fltURL), "/"),
+		}
+	} else {
+		var err error
+		baseURL, err = url.Parse(fltURL)
+		if err != nil {
+			log.Debug("filtering: parsing url %q: %s; includes are disabled", fltURL, err)
+
+			return rulelist.NewParser()
+		}
+	}
+
+	return rulelist.NewIncludingParser(&rulelist.IncludeConfig{
+		Includer: includer,
+		BaseURL:  baseURL,
+	})
+}
+
+// errIncludeVerified is returned when a filtering-rule list, which checksum or
+// signature must be verified, includes other lists.
+const errIncludeVerified errors.Error = "includes are not allowed in verified lists"
+
+// verifiedIncluder is the [rulelist.Includer] for the filtering-rule lists,
+// which checksum or signature must be verified.  The included lists aren't
+// covered by either, so it rejects them.
+type verifiedIncluder struct{}
+
+// type check
+var _ rulelist.Includer = verifiedIncluder{}
+
+// Open implements the [rulelist.Includer] interface for verifiedIncluder.  It
+// always returns [errIncludeVerified].
+func (verifiedIncluder) Open(_ *url.URL) (rc io.ReadCloser, err error) {
+	return nil, errIncludeVerified
+}
+
+// filterIncluder is the [rulelist.Includer] that opens the included
+// filtering-rule lists the same way [DNSFilter.reader] does.
+type filterIncluder struct {
+	d *DNSFilter
+}
+
+// type check
+var _ rulelist.Includer = (*filterIncluder)(nil)
+
+// Open implements the [rulelist.Includer] interface for *filterIncluder.
+func (i *filterIncluder) Open(u *url.URL) (rc io.ReadCloser, err error) {
+	if u.Scheme != "file" {
+		return i.d.readerFromURL(u.String())
+	}
+
+	fltPath := filepath.FromSlash(u.Path)
+	if vol := filepath.VolumeName(fltPath[1:]); vol != "" {
+		// Remove the leading separator added in newParser from Windows paths.
+		fltPath = fltPath[1:]
+	}
+
+	// #nosec G304 -- The path is checked to be within the directory of the
+	// including list by the parser.
+	return os.Open(fltPath)
+}
+
 // readerFromURL returns an io.ReadCloser reading filtering-rule list data form
 // the filter's URL.
 func (d *DNSFilter) readerFromURL(fltURL string) (r io.ReadCloser, err error) {
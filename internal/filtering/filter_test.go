@@ -136,6 +136,38 @@ func TestDNSFilter_Update(t *testing.T) {
 	})
 }
 
+func TestDNSFilter_Update_verifyChecksum(t *testing.T) {
+	const (
+		goodContent = "[Adblock Plus 2.0]\n" +
+			"! Checksum: kHQDao0L0FVs3246AMzy7Q\n" +
+			"||blocked.example^\n"
+		badContent = goodContent + "||other.example^\n"
+	)
+
+	dnsFilter := newDNSFilter(t)
+	f := &FilterYAML{
+		URL:            serveFiltersLocally(t, []byte(goodContent)),
+		Name:           "test-filter",
+		VerifyChecksum: true,
+	}
+
+	updateAndAssert(t, dnsFilter, f, require.True, 2)
+
+	f.URL = serveFiltersLocally(t, []byte(badContent))
+
+	ok, err := dnsFilter.update(f)
+	require.Error(t, err)
+
+	assert.False(t, ok)
+	assert.Equal(t, err, f.updateErr)
+	assert.Equal(t, 2, f.RulesCount)
+
+	data, err := os.ReadFile(f.Path(dnsFilter.conf.DataDir))
+	require.NoError(t, err)
+
+	assert.Equal(t, "[Adblock Plus 2.0]\n||blocked.example^\n", string(data))
+}
+
 func TestFilterYAML_EnsureName(t *testing.T) {
 	dnsFilter := newDNSFilter(t)
 
@@ -173,3 +205,34 @@ func TestFilterYAML_EnsureName(t *testing.T) {
 		assert.Equal(t, "List 0", f.Name)
 	})
 }
+
+func TestDNSFilter_Update_verifiedInclude(t *testing.T) {
+	const (
+		content  = "||blocked.example^\n!#include included.txt\n"
+		included = "||included.example^\n"
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/list.txt", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(content))
+	})
+	mux.HandleFunc("/included.txt", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(included))
+	})
+
+	dnsFilter := newDNSFilter(t)
+	f := &FilterYAML{
+		URL:            serveHTTPLocally(t, mux) + "/list.txt",
+		Name:           "test-filter",
+		VerifyChecksum: true,
+	}
+
+	ok, err := dnsFilter.update(f)
+	require.ErrorIs(t, err, errIncludeVerified)
+
+	assert.False(t, ok)
+	assert.NoFileExists(t, f.Path(dnsFilter.conf.DataDir))
+
+	f.VerifyChecksum = false
+	updateAndAssert(t, dnsFilter, f, require.True, 2)
+}
@@ -20,12 +20,14 @@ import (
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering/rulelist"
+	"github.com/AdguardTeam/AdGuardHome/internal/firstseen"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/hostsfile"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/mathutil"
 	"github.com/AdguardTeam/golibs/stringutil"
 	"github.com/AdguardTeam/golibs/syncutil"
+	"github.com/AdguardTeam/golibs/timeutil"
 	"github.com/AdguardTeam/urlfilter"
 	"github.com/AdguardTeam/urlfilter/filterlist"
 	"github.com/AdguardTeam/urlfilter/rules"
@@ -43,6 +45,8 @@ const (
 	ParentalListID
 	SafeBrowsingListID
 	SafeSearchListID
+	ThreatIntelListID
+	NewDomainsListID
 )
 
 // ServiceEntry - blocked service array element
@@ -94,12 +98,26 @@ type Config struct {
 	// Per-client settings can override this configuration.
 	BlockedServices *BlockedServices `yaml:"blocked_services"`
 
+	// ServicesCatalog is the configuration of the catalog of blocked
+	// services.  If it's nil, the built-in catalog is used.
+	ServicesCatalog *ServicesCatalogConfig `yaml:"blocked_services_catalog,omitempty"`
+
 	// EtcHosts is a container of IP-hostname pairs taken from the operating
 	// system configuration files (e.g. /etc/hosts).
 	//
 	// TODO(e.burkov):  Move it to dnsforward entirely.
 	EtcHosts hostsfile.Storage `yaml:"-"`
 
+	// ApplyClientFiltering, if not nil, applies the settings of the client
+	// with the given IP address and ClientID, including the blocked services,
+	// to setts.  It is used to check hosts on behalf of a client.
+	ApplyClientFiltering func(clientIP netip.Addr, clientID string, setts *Settings) `yaml:"-"`
+
+	// PruneClientsServices, if not nil, removes the IDs of the services removed
+	// from the catalog from the blocked services of the persistent clients.
+	// pruned is true if any have been removed.
+	PruneClientsServices func() (pruned bool) `yaml:"-"`
+
 	// Called when the configuration is changed by HTTP request
 	ConfigModified func() `yaml:"-"`
 
@@ -132,8 +150,35 @@ type Config struct {
 	// to DNS requests blocked by safe-browsing.
 	SafeBrowsingBlockHost string `yaml:"safebrowsing_block_host"`
 
+	// SafeBrowsingDatabase is the configuration of the local safe browsing
+	// hash-prefix database.  If it's nil, the remote lookup service is used.
+	SafeBrowsingDatabase *HashPrefixDatabaseConfig `yaml:"safebrowsing_database,omitempty"`
+
+	// ParentalDatabase is the configuration of the local parental control
+	// hash-prefix database.  If it's nil, the remote lookup service is used.
+	ParentalDatabase *HashPrefixDatabaseConfig `yaml:"parental_database,omitempty"`
+
+	// ThreatIntel are the configurations of the external threat-intelligence
+	// checkers.
+	ThreatIntel []*ThreatIntelConfig `yaml:"threat_intel"`
+
+	// ThreatIntelCheckers are the external threat-intelligence checkers by
+	// the names from ThreatIntel.
+	ThreatIntelCheckers map[string]Checker `yaml:"-"`
+
+	// NewDomains is the configuration of tracking the newly observed domains.
+	NewDomains NewDomainsConfig `yaml:"newly_observed_domains"`
+
+	// NewDomainTracker tracks the first time the registered domains have been
+	// requested.  If it's nil, the newly observed domains aren't tracked.
+	NewDomainTracker *firstseen.Tracker `yaml:"-"`
+
 	Rewrites []*LegacyRewrite `yaml:"rewrites"`
 
+	// RegexpRewrites are the DNS rewrites with regular-expression domain
+	// patterns.
+	RegexpRewrites []*RegexpRewrite `yaml:"regexp_rewrites"`
+
 	// Filters are the blocking filter lists.
 	Filters []FilterYAML `yaml:"-"`
 
@@ -222,6 +267,10 @@ type filtersInitializerParams struct {
 type hostChecker struct {
 	check func(host string, qtype uint16, setts *Settings) (res Result, err error)
 	name  string
+
+	// remote is true if check may send requests to remote servers.  Such
+	// checkers are skipped when explaining the filtering.
+	remote bool
 }
 
 // Checker is used for safe browsing or parental control hash-prefix filtering.
@@ -230,6 +279,26 @@ type Checker interface {
 	Check(host string) (block bool, err error)
 }
 
+// refresher is implemented by the [Checker] implementations that keep local
+// data, which must be refreshed periodically.
+type refresher interface {
+	// Refresh updates the local data, if necessary.
+	Refresh() (err error)
+}
+
+// HashPrefixDatabaseConfig is the configuration of a local hash-prefix
+// database used by safe browsing or parental control instead of the remote
+// lookup service.
+type HashPrefixDatabaseConfig struct {
+	// URL is the URL or the absolute path of the database.  If it's empty, the
+	// remote lookup service is used.
+	URL string `yaml:"url"`
+
+	// UpdateInterval is the minimum interval between the updates of the
+	// database.  The database is updated along with the filters.
+	UpdateInterval timeutil.Duration `yaml:"update_interval"`
+}
+
 // DNSFilter matches hostnames and DNS requests against filtering rules.
 type DNSFilter struct {
 	// bufPool is a pool of buffers used for filtering-rule list parsing.
@@ -260,6 +329,10 @@ type DNSFilter struct {
 	// done is the channel to signal to stop running filters updates loop.
 	done chan struct{}
 
+	// refreshDone is the channel to signal to stop running the checkers
+	// refresh loop.
+	refreshDone chan struct{}
+
 	// Channel for passing data to filters-initializer goroutine
 	filtersInitializerChan chan filtersInitializerParams
 	filtersInitializerLock sync.Mutex
@@ -325,6 +398,22 @@ const (
 	//
 	// See https://github.com/AdguardTeam/AdGuardHome/issues/2499.
 	RewrittenRule
+
+	// FilteredThreatIOC is returned when the host was matched by a local file
+	// of indicators of compromise.
+	FilteredThreatIOC
+
+	// FilteredThreatLookup is returned when the host was blocked by an HTTP
+	// threat-intelligence lookup API.
+	FilteredThreatLookup
+
+	// FilteredThreatDNSBL is returned when the host was listed in a DNS-based
+	// blocklist.
+	FilteredThreatDNSBL
+
+	// FilteredNewDomain is returned when the registered domain of the host was
+	// observed for the first time recently.
+	FilteredNewDomain
 )
 
 // TODO(a.garipov): Resync with actual code names or replace completely
@@ -344,6 +433,12 @@ var reasonNames = []string{
 	Rewritten:          "Rewrite",
 	RewrittenAutoHosts: "RewriteEtcHosts",
 	RewrittenRule:      "RewriteRule",
+
+	FilteredThreatIOC:    "FilteredThreatIOC",
+	FilteredThreatLookup: "FilteredThreatLookup",
+	FilteredThreatDNSBL:  "FilteredThreatDNSBL",
+
+	FilteredNewDomain: "FilteredNewDomain",
 }
 
 func (r Reason) String() string {
@@ -354,6 +449,17 @@ func (r Reason) String() string {
 	return reasonNames[r]
 }
 
+// ParseReason returns the reason with the given name, as returned by
+// [Reason.String].
+func ParseReason(s string) (r Reason, err error) {
+	i := slices.Index(reasonNames, s)
+	if i < 0 || s == "" {
+		return 0, fmt.Errorf("invalid reason %q", s)
+	}
+
+	return Reason(i), nil
+}
+
 // In returns true if reasons include r.
 func (r Reason) In(reasons ...Reason) (ok bool) { return slices.Contains(reasons, r) }
 
@@ -436,7 +542,17 @@ func (d *DNSFilter) Close() {
 		d.done <- struct{}{}
 	}
 
+	if d.refreshDone != nil {
+		d.refreshDone <- struct{}{}
+	}
+
 	d.reset()
+
+	if t := d.conf.NewDomainTracker; t != nil {
+		if err := t.Save(); err != nil {
+			log.Error("filtering: saving newly observed domains: %s", err)
+		}
+	}
 }
 
 func (d *DNSFilter) reset() {
@@ -630,7 +746,7 @@ func (d *DNSFilter) processRewrites(host string, qtype uint16) (res Result) {
 	d.confMu.RLock()
 	defer d.confMu.RUnlock()
 
-	rewrites, matched := findRewrites(d.conf.Rewrites, host, qtype)
+	rewrites, matched := d.findAllRewrites(host, qtype)
 	if !matched {
 		return Result{}
 	}
@@ -670,7 +786,7 @@ func (d *DNSFilter) processRewrites(host string, qtype uint16) (res Result) {
 
 		cnames.Add(host)
 		res.CanonName = host
-		rewrites, matched = findRewrites(d.conf.Rewrites, host, qtype)
+		rewrites, matched = d.findAllRewrites(host, qtype)
 	}
 
 	setRewriteResult(&res, host, rewrites, qtype)
@@ -1005,16 +1121,25 @@ func New(c *Config, blockFilters []Filter) (d *DNSFilter, err error) {
 		name:  "hosts container",
 	}, {
 		check: d.matchHost,
-		name:  "filtering",
+		name:  stageNameFiltering,
 	}, {
 		check: matchBlockedServicesRules,
-		name:  "blocked services",
+		name:  stageNameBlockedServices,
+	}, {
+		check:  d.checkSafeBrowsing,
+		name:   "safe browsing",
+		remote: true,
 	}, {
-		check: d.checkSafeBrowsing,
-		name:  "safe browsing",
+		check:  d.checkParental,
+		name:   "parental",
+		remote: true,
 	}, {
-		check: d.checkParental,
-		name:  "parental",
+		check:  d.checkThreatIntel,
+		name:   "threat intelligence",
+		remote: true,
+	}, {
+		check: d.checkNewDomain,
+		name:  "newly observed domains",
 	}, {
 		check: d.checkSafeSearch,
 		name:  "safe search",
@@ -1030,7 +1155,17 @@ func New(c *Config, blockFilters []Filter) (d *DNSFilter, err error) {
 		return nil, fmt.Errorf("rewrites: preparing: %s", err)
 	}
 
+	err = prepareRegexpRewrites(d.conf.RegexpRewrites)
+	if err != nil {
+		return nil, fmt.Errorf("regexp rewrites: preparing: %w", err)
+	}
+
 	if d.conf.BlockedServices != nil {
+		removed := d.conf.BlockedServices.PruneRemoved()
+		if len(removed) > 0 {
+			log.Info("filtering: blocked services: removed from the catalog: %q", removed)
+		}
+
 		err = d.conf.BlockedServices.Validate()
 		if err != nil {
 			return nil, fmt.Errorf("filtering: %w", err)
@@ -1064,10 +1199,47 @@ func New(c *Config, blockFilters []Filter) (d *DNSFilter, err error) {
 func (d *DNSFilter) Start() {
 	d.filtersInitializerChan = make(chan filtersInitializerParams, 1)
 	d.done = make(chan struct{}, 1)
+	d.refreshDone = make(chan struct{}, 1)
 
 	d.RegisterFilteringHandlers()
 
 	go d.updatesLoop()
+	go d.refreshLoop()
+}
+
+// hashPrefixRefreshInterval is the interval between the checks for the updates
+// of the local hash-prefix databases.  The databases are only downloaded when
+// their own update intervals have passed.
+const hashPrefixRefreshInterval = 10 * time.Minute
+
+// threatIntelRefreshInterval is the interval between the checks for the
+// modifications of the local data of the threat-intelligence checkers, such as
+// the files of indicators of compromise.
+const threatIntelRefreshInterval = 1 * time.Minute
+
+// refreshLoop loads the local data of the checkers on start and refreshes it
+// on its own schedule, independently of the filters updates.
+func (d *DNSFilter) refreshLoop() {
+	defer log.OnPanic("filtering: refresh loop")
+
+	d.refreshHashPrefix()
+
+	hpTicker := time.NewTicker(hashPrefixRefreshInterval)
+	defer hpTicker.Stop()
+
+	tiTicker := time.NewTicker(threatIntelRefreshInterval)
+	defer tiTicker.Stop()
+
+	for {
+		select {
+		case <-hpTicker.C:
+			d.refreshHashPrefix()
+		case <-tiTicker.C:
+			d.refreshThreatIntel()
+		case <-d.refreshDone:
+			return
+		}
+	}
 }
 
 // updatesLoop initializes new filters and checks for filters updates in a loop.
@@ -1106,6 +1278,11 @@ func (d *DNSFilter) periodicallyRefreshFilters(ivl time.Duration) (nextIvl time.
 		return ivl
 	}
 
+	err := d.refreshServicesCatalog()
+	if err != nil {
+		log.Error("filtering: %s", err)
+	}
+
 	isNetErr, ok := false, false
 	_, isNetErr, ok = d.tryRefreshFilters(true, true, false)
 
@@ -1119,6 +1296,38 @@ func (d *DNSFilter) periodicallyRefreshFilters(ivl time.Duration) (nextIvl time.
 	return ivl
 }
 
+// refreshHashPrefix refreshes the local hash-prefix databases of the safe
+// browsing and parental control checkers, if they use any.
+func (d *DNSFilter) refreshHashPrefix() {
+	refreshCheckers(d.safeBrowsingChecker, d.parentalControlChecker)
+}
+
+// refreshThreatIntel refreshes the local data of the enabled
+// threat-intelligence checkers, if they keep any.
+func (d *DNSFilter) refreshThreatIntel() {
+	var checkers []Checker
+	for _, e := range d.enabledThreatIntel() {
+		checkers = append(checkers, e.checker)
+	}
+
+	refreshCheckers(checkers...)
+}
+
+// refreshCheckers refreshes the local data of the checkers, if they keep any.
+func refreshCheckers(checkers ...Checker) {
+	for _, c := range checkers {
+		r, ok := c.(refresher)
+		if !ok {
+			continue
+		}
+
+		err := r.Refresh()
+		if err != nil {
+			log.Error("filtering: %s", err)
+		}
+	}
+}
+
 // Safe browsing and parental control methods.
 
 // TODO(a.garipov): Unify with checkParental.
@@ -694,3 +694,44 @@ func BenchmarkSafeBrowsingParallel(b *testing.B) {
 		}
 	})
 }
+
+// testRefresher is a [Checker] with local data for tests.
+type testRefresher struct {
+	onRefresh func() (err error)
+}
+
+// Check implements the [Checker] interface for *testRefresher.
+func (r *testRefresher) Check(_ string) (block bool, err error) {
+	return false, nil
+}
+
+// Refresh implements the refresher interface for *testRefresher.
+func (r *testRefresher) Refresh() (err error) {
+	return r.onRefresh()
+}
+
+func TestDNSFilter_refreshLoop(t *testing.T) {
+	refreshed := make(chan struct{}, 1)
+	c := &testRefresher{
+		onRefresh: func() (err error) {
+			select {
+			case refreshed <- struct{}{}:
+			default:
+			}
+
+			return nil
+		},
+	}
+
+	// The hash-prefix databases must be loaded even if the filters are never
+	// updated.
+	d, _ := newForTest(t, &Config{
+		SafeBrowsingChecker:        c,
+		FiltersUpdateIntervalHours: 0,
+	}, nil)
+
+	d.Start()
+	t.Cleanup(d.Close)
+
+	testutil.RequireReceive(t, refreshed, testTimeout)
+}
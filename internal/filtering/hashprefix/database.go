@@ -0,0 +1,461 @@
+package hashprefix
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghrenameio"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/ioutil"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/c2h5oh/datasize"
+)
+
+// DatabaseConfig is the configuration of the local hash-prefix database, which
+// is used instead of the remote lookup service.
+//
+// The database is a text file with a single hexadecimal-encoded SHA256 hash of
+// a hostname per line.  The optional header
+//
+//	! Version: 42
+//
+// sets the version of the database.  A delta update additionally contains the
+// header
+//
+//	! Delta-From: 41
+//
+// with the version it's based on, and its lines are hashes prefixed with "+"
+// for additions and "-" for removals.  Other lines starting with "!" or "#" are
+// ignored.
+type DatabaseConfig struct {
+	// HTTPClient is the client used to download the database.  It must not be
+	// nil if URL is not a local path.
+	HTTPClient *http.Client
+
+	// URL is the URL or the absolute path of the database.  If the current
+	// version of the database is known, the request to the URL contains the
+	// "from_version" query parameter, so that the server is able to respond
+	// with a delta update.
+	URL string
+
+	// CachePath is the path to the file to store the downloaded database in.
+	CachePath string
+
+	// UpdateInterval is the minimum interval between the updates of the
+	// database.
+	UpdateInterval time.Duration
+}
+
+const (
+	// versionHeader is the header of the version of the database.
+	versionHeader = "! Version:"
+
+	// deltaFromHeader is the header of the version of the database a delta
+	// update is based on.
+	deltaFromHeader = "! Delta-From:"
+
+	// fromVersionParam is the query parameter with the current version of the
+	// database.
+	fromVersionParam = "from_version"
+)
+
+// maxDatabaseSize is the maximum size of the downloaded database.
+const maxDatabaseSize = 512 * datasize.MB
+
+// database is the local hash-prefix database.
+type database struct {
+	// mu protects hashes, updated, and version.
+	mu *sync.RWMutex
+
+	// updateMu serializes the updates of the database, so that hashes isn't
+	// replaced between building its new value and swapping it.
+	updateMu *sync.Mutex
+
+	// hashes is the set of the hashes of the blocked hostnames.  It's never
+	// modified in place but replaced with a new set on update.
+	hashes map[hostnameHash]struct{}
+
+	// updated is the time of the last update of the database.
+	updated time.Time
+
+	// conf is the configuration of the database.
+	conf *DatabaseConfig
+
+	// svc is the name of the service.
+	svc string
+
+	// version is the version of the database.  It's zero if the database
+	// isn't loaded or is unversioned.
+	version uint64
+}
+
+// newDatabase returns a new database and loads it from the cache file, if
+// there is one.
+func newDatabase(conf *DatabaseConfig, svc string) (db *database) {
+	db = &database{
+		mu:       &sync.RWMutex{},
+		updateMu: &sync.Mutex{},
+		conf:     conf,
+		svc:      svc,
+	}
+
+	err := db.loadCache()
+	if err != nil {
+		log.Error("%s: loading database cache: %s", svc, err)
+	}
+
+	return db
+}
+
+// loadCache loads the database from the cache file, if it exists.
+func (db *database) loadCache() (err error) {
+	if db.conf.CachePath == "" {
+		return nil
+	}
+
+	f, err := os.Open(db.conf.CachePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	upd, err := parseDatabase(f)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	} else if upd.deltaFrom != 0 {
+		return errors.Error("cache contains a delta update")
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.hashes, db.version, db.updated = upd.added, upd.version, fi.ModTime()
+
+	log.Info("%s: loaded %d hashes of version %d from cache", db.svc, len(db.hashes), db.version)
+
+	return nil
+}
+
+// contains returns true if any of hashes is in the database.
+func (db *database) contains(hashes []hostnameHash) (ok bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, h := range hashes {
+		if _, ok = db.hashes[h]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isLoaded returns true if the database has been loaded.
+func (db *database) isLoaded() (ok bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return db.hashes != nil
+}
+
+// refresh updates the database if the update interval has passed.
+func (db *database) refresh() (err error) {
+	db.updateMu.Lock()
+	defer db.updateMu.Unlock()
+
+	db.mu.RLock()
+	version, updated := db.version, db.updated
+	db.mu.RUnlock()
+
+	if time.Since(updated) < db.conf.UpdateInterval {
+		return nil
+	}
+
+	upd, err := db.download(version)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	if upd.deltaFrom != 0 && upd.deltaFrom != version {
+		log.Info(
+			"%s: delta from version %d doesn't match version %d; downloading full database",
+			db.svc,
+			upd.deltaFrom,
+			version,
+		)
+
+		upd, err = db.download(0)
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return err
+		} else if upd.deltaFrom != 0 {
+			return errors.Error("got delta update instead of full database")
+		}
+	}
+
+	return db.apply(upd)
+}
+
+// apply applies the update to the database and writes the result into the
+// cache file.  The new set of hashes is built and written without locking
+// db.mu, so that the lookups aren't blocked.  db.updateMu must be locked.
+func (db *database) apply(upd *databaseUpdate) (err error) {
+	db.mu.RLock()
+	cur, curVersion := db.hashes, db.version
+	db.mu.RUnlock()
+
+	now := time.Now()
+	if upd.version != 0 && upd.version == curVersion && cur != nil {
+		log.Debug("%s: database version %d is up to date", db.svc, curVersion)
+
+		db.mu.Lock()
+		defer db.mu.Unlock()
+
+		db.updated = now
+
+		return nil
+	}
+
+	hashes := upd.added
+	if upd.deltaFrom != 0 {
+		hashes = make(map[hostnameHash]struct{}, len(cur)+len(upd.added))
+		for h := range cur {
+			hashes[h] = struct{}{}
+		}
+
+		for h := range upd.added {
+			hashes[h] = struct{}{}
+		}
+
+		for h := range upd.removed {
+			delete(hashes, h)
+		}
+	}
+
+	err = writeDatabase(db.conf.CachePath, hashes, upd.version)
+	if err != nil {
+		return fmt.Errorf("writing cache: %w", err)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.hashes, db.version, db.updated = hashes, upd.version, now
+
+	log.Info("%s: updated database to version %d, %d hashes", db.svc, upd.version, len(hashes))
+
+	return nil
+}
+
+// download fetches the database or the delta update from the configured URL.
+// fromVersion is the current version of the database, if any.
+func (db *database) download(fromVersion uint64) (upd *databaseUpdate, err error) {
+	r, err := db.reader(fromVersion)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+	defer func() { err = errors.WithDeferred(err, r.Close()) }()
+
+	upd, err = parseDatabase(ioutil.LimitReader(r, maxDatabaseSize.Bytes()))
+	if err != nil {
+		return nil, fmt.Errorf("parsing database: %w", err)
+	}
+
+	return upd, nil
+}
+
+// reader returns the reader of the database from the configured URL.
+func (db *database) reader(fromVersion uint64) (r io.ReadCloser, err error) {
+	if filepath.IsAbs(db.conf.URL) {
+		// #nosec G304 -- Trust the file path that is given in the
+		// configuration.
+		return os.Open(db.conf.URL)
+	}
+
+	u, err := url.Parse(db.conf.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing url: %w", err)
+	}
+
+	if fromVersion != 0 {
+		q := u.Query()
+		q.Set(fromVersionParam, strconv.FormatUint(fromVersion, 10))
+		u.RawQuery = q.Encode()
+	}
+
+	log.Debug("%s: downloading database from %q", db.svc, u)
+
+	resp, err := db.conf.HTTPClient.Get(u.String())
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+
+		return nil, fmt.Errorf("got status code %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	return resp.Body, nil
+}
+
+// databaseUpdate is a parsed full database or a delta update.
+type databaseUpdate struct {
+	// added are the hashes of a full database or the hashes added by a delta
+	// update.
+	added map[hostnameHash]struct{}
+
+	// removed are the hashes removed by a delta update.
+	removed map[hostnameHash]struct{}
+
+	// version is the version of the database after the update.
+	version uint64
+
+	// deltaFrom is the version a delta update is based on.  It's zero for
+	// full databases.
+	deltaFrom uint64
+}
+
+// parseDatabase parses a full database or a delta update from r.
+func parseDatabase(r io.Reader) (upd *databaseUpdate, err error) {
+	upd = &databaseUpdate{
+		added:   map[hostnameHash]struct{}{},
+		removed: map[hostnameHash]struct{}{},
+	}
+
+	s := bufio.NewScanner(r)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		err = upd.parseLine(strings.TrimSpace(s.Text()))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+	}
+
+	err = s.Err()
+	if err != nil {
+		return nil, fmt.Errorf("reading: %w", err)
+	}
+
+	if upd.deltaFrom == 0 && len(upd.removed) > 0 {
+		return nil, errors.Error("removals in a full database")
+	}
+
+	return upd, nil
+}
+
+// parseLine parses a single line of a database.
+func (upd *databaseUpdate) parseLine(line string) (err error) {
+	switch {
+	case line == "":
+		return nil
+	case strings.HasPrefix(line, versionHeader):
+		upd.version, err = parseHeaderValue(line, versionHeader)
+
+		return err
+	case strings.HasPrefix(line, deltaFromHeader):
+		upd.deltaFrom, err = parseHeaderValue(line, deltaFromHeader)
+
+		return err
+	case line[0] == '!' || line[0] == '#':
+		return nil
+	}
+
+	set := upd.added
+	if line[0] == '+' {
+		line = line[1:]
+	} else if line[0] == '-' {
+		set, line = upd.removed, line[1:]
+	}
+
+	h, err := parseHash(line)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	set[h] = struct{}{}
+
+	return nil
+}
+
+// parseHeaderValue parses the numeric value of the header.
+func parseHeaderValue(line, header string) (v uint64, err error) {
+	v, err = strconv.ParseUint(strings.TrimSpace(line[len(header):]), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad %q header: %w", header, err)
+	}
+
+	return v, nil
+}
+
+// parseHash parses a hexadecimal-encoded hash of a hostname.
+func parseHash(s string) (h hostnameHash, err error) {
+	if len(s) != hexSize {
+		return h, fmt.Errorf("bad hash length %d, want %d", len(s), hexSize)
+	}
+
+	_, err = hex.Decode(h[:], []byte(s))
+	if err != nil {
+		return h, fmt.Errorf("decoding hash: %w", err)
+	}
+
+	return h, nil
+}
+
+// writeDatabase atomically writes the full database into the file at path.
+// If path is empty, it does nothing.
+func writeDatabase(path string, hashes map[hostnameHash]struct{}, version uint64) (err error) {
+	if path == "" {
+		return nil
+	}
+
+	sorted := make([]hostnameHash, 0, len(hashes))
+	for h := range hashes {
+		sorted = append(sorted, h)
+	}
+
+	slices.SortFunc(sorted, func(a, b hostnameHash) (res int) {
+		return bytes.Compare(a[:], b[:])
+	})
+
+	f, err := aghrenameio.NewPendingFile(path, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() { err = aghrenameio.WithDeferredCleanup(err, f) }()
+
+	w := bufio.NewWriter(f)
+	_, _ = fmt.Fprintf(w, "%s %d\n", versionHeader, version)
+	for _, h := range sorted {
+		// nolint:looppointer // The subslice of h is used for encoding.
+		_, _ = w.WriteString(hex.EncodeToString(h[:]))
+		_ = w.WriteByte('\n')
+	}
+
+	return w.Flush()
+}
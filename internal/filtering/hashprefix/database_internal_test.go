@@ -0,0 +1,178 @@
+package hashprefix
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// hexHash returns the hexadecimal-encoded SHA256 hash of host.
+func hexHash(host string) (s string) {
+	sum := sha256.Sum256([]byte(host))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func TestParseDatabase(t *testing.T) {
+	testCases := []struct {
+		name          string
+		data          string
+		wantErrMsg    string
+		wantVersion   uint64
+		wantDeltaFrom uint64
+		wantAdded     int
+		wantRemoved   int
+	}{{
+		name: "full",
+		data: "! Version: 2\n# Comment\n\n" +
+			hexHash("blocked.example") + "\n" +
+			hexHash("other.example") + "\n",
+		wantErrMsg:    "",
+		wantVersion:   2,
+		wantDeltaFrom: 0,
+		wantAdded:     2,
+		wantRemoved:   0,
+	}, {
+		name: "delta",
+		data: "! Version: 3\n! Delta-From: 2\n" +
+			"+" + hexHash("new.example") + "\n" +
+			"-" + hexHash("other.example") + "\n",
+		wantErrMsg:    "",
+		wantVersion:   3,
+		wantDeltaFrom: 2,
+		wantAdded:     1,
+		wantRemoved:   1,
+	}, {
+		name:       "bad_hash",
+		data:       "abc\n",
+		wantErrMsg: "line 1: bad hash length 3, want 64",
+	}, {
+		name:       "bad_version",
+		data:       "! Version: abc\n",
+		wantErrMsg: `line 1: bad "! Version:" header: strconv.ParseUint: parsing "abc": invalid syntax`,
+	}, {
+		name:       "removals_in_full",
+		data:       "-" + hexHash("other.example") + "\n",
+		wantErrMsg: "removals in a full database",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			upd, err := parseDatabase(strings.NewReader(tc.data))
+			if tc.wantErrMsg != "" {
+				require.Error(t, err)
+
+				assert.Equal(t, tc.wantErrMsg, err.Error())
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantVersion, upd.version)
+			assert.Equal(t, tc.wantDeltaFrom, upd.deltaFrom)
+			assert.Len(t, upd.added, tc.wantAdded)
+			assert.Len(t, upd.removed, tc.wantRemoved)
+		})
+	}
+}
+
+func TestChecker_Check_offline(t *testing.T) {
+	full := "! Version: 1\n" +
+		hexHash("blocked.example") + "\n" +
+		hexHash("removed.example") + "\n"
+	delta := "! Version: 2\n! Delta-From: 1\n" +
+		"+" + hexHash("added.example") + "\n" +
+		"-" + hexHash("removed.example") + "\n"
+
+	var reqNum atomic.Uint32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqNum.Add(1)
+
+		switch r.URL.Query().Get(fromVersionParam) {
+		case "":
+			_, _ = w.Write([]byte(full))
+		case "1":
+			_, _ = w.Write([]byte(delta))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	cachePath := filepath.Join(t.TempDir(), "db.txt")
+	newChecker := func() (c *Checker) {
+		return New(&Config{
+			// Make sure that the upstream is never used.
+			Upstream:    &aghtest.UpstreamMock{},
+			ServiceName: "SafeBrowsing",
+			CacheTime:   cacheTime,
+			CacheSize:   cacheSize,
+			Database: &DatabaseConfig{
+				HTTPClient: srv.Client(),
+				URL:        srv.URL,
+				CachePath:  cachePath,
+			},
+		})
+	}
+
+	c := newChecker()
+
+	blocked, err := c.Check("sub.blocked.example")
+	require.NoError(t, err)
+
+	assert.False(t, blocked)
+
+	err = c.Refresh()
+	require.NoError(t, err)
+
+	for host, want := range map[string]bool{
+		"sub.blocked.example": true,
+		"removed.example":     true,
+		"added.example":       false,
+		"other.example":       false,
+	} {
+		blocked, err = c.Check(host)
+		require.NoError(t, err)
+
+		assert.Equalf(t, want, blocked, "host %q", host)
+	}
+
+	err = c.Refresh()
+	require.NoError(t, err)
+
+	assert.Equal(t, uint32(2), reqNum.Load())
+
+	for host, want := range map[string]bool{
+		"sub.blocked.example": true,
+		"removed.example":     false,
+		"added.example":       true,
+	} {
+		blocked, err = c.Check(host)
+		require.NoError(t, err)
+
+		assert.Equalf(t, want, blocked, "host %q", host)
+	}
+
+	data, err := os.ReadFile(cachePath)
+	require.NoError(t, err)
+
+	assert.True(t, strings.HasPrefix(string(data), "! Version: 2\n"))
+
+	c = newChecker()
+
+	blocked, err = c.Check("added.example")
+	require.NoError(t, err)
+
+	assert.True(t, blocked)
+}
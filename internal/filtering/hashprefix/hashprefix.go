@@ -64,6 +64,11 @@ type Config struct {
 	// CacheTime is the time period to store hash.
 	CacheTime time.Duration
 
+	// Database is the configuration of the local hash-prefix database.  If
+	// it's not nil, the checker works in the offline mode and never sends the
+	// prefixes to Upstream.
+	Database *DatabaseConfig
+
 	// CacheSize is the maximum size of the cache.  If it's zero, cache size is
 	// unlimited.
 	CacheSize uint
@@ -76,6 +81,10 @@ type Checker struct {
 	// cache stores hostname hashes.
 	cache cache.Cache
 
+	// db is the local hash-prefix database.  It's nil unless the checker works
+	// in the offline mode.
+	db *database
+
 	// svc is the name of the service.
 	svc string
 
@@ -88,7 +97,7 @@ type Checker struct {
 
 // New returns Checker.
 func New(conf *Config) (c *Checker) {
-	return &Checker{
+	c = &Checker{
 		upstream: conf.Upstream,
 		cache: cache.New(cache.Config{
 			EnableLRU: true,
@@ -98,12 +107,37 @@ func New(conf *Config) (c *Checker) {
 		txtSuffix: conf.TXTSuffix,
 		cacheTime: conf.CacheTime,
 	}
+
+	if conf.Database != nil {
+		c.db = newDatabase(conf.Database, conf.ServiceName)
+	}
+
+	return c
+}
+
+// Refresh updates the local hash-prefix database, if the checker works in the
+// offline mode and the update interval has passed.
+func (c *Checker) Refresh() (err error) {
+	if c.db == nil {
+		return nil
+	}
+
+	err = c.db.refresh()
+	if err != nil {
+		return fmt.Errorf("%s: refreshing database: %w", c.svc, err)
+	}
+
+	return nil
 }
 
 // Check returns true if request for the host should be blocked.
 func (c *Checker) Check(host string) (ok bool, err error) {
 	hashes := hostnameToHashes(host)
 
+	if c.db != nil {
+		return c.checkLocal(host, hashes), nil
+	}
+
 	found, blocked, hashesToRequest := c.findInCache(hashes)
 	if found {
 		log.Debug("%s: found %q in cache, blocked: %t", c.svc, host, blocked)
@@ -128,6 +162,20 @@ func (c *Checker) Check(host string) (ok bool, err error) {
 	return matched, nil
 }
 
+// checkLocal returns true if one of the hashes is in the local database.
+func (c *Checker) checkLocal(host string, hashes []hostnameHash) (blocked bool) {
+	if !c.db.isLoaded() {
+		log.Debug("%s: database isn't loaded yet, not checking %q", c.svc, host)
+
+		return false
+	}
+
+	blocked = c.db.contains(hashes)
+	log.Debug("%s: checked %q in local database, blocked: %t", c.svc, host, blocked)
+
+	return blocked
+}
+
 // hostnameToHashes returns hashes that should be checked by the hash prefix
 // filter.
 func hostnameToHashes(host string) (hashes []hostnameHash) {
@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"slices"
+	"strings"
 	"sync"
 	"time"
 
@@ -50,9 +51,11 @@ func validateFilterURL(urlStr string) (err error) {
 }
 
 type filterAddJSON struct {
-	Name      string `json:"name"`
-	URL       string `json:"url"`
-	Whitelist bool   `json:"whitelist"`
+	Name           string `json:"name"`
+	URL            string `json:"url"`
+	PublicKey      string `json:"public_key"`
+	Whitelist      bool   `json:"whitelist"`
+	VerifyChecksum bool   `json:"verify_checksum"`
 }
 
 func (d *DNSFilter) handleFilteringAddURL(w http.ResponseWriter, r *http.Request) {
@@ -81,10 +84,12 @@ func (d *DNSFilter) handleFilteringAddURL(w http.ResponseWriter, r *http.Request
 
 	// Set necessary properties
 	filt := FilterYAML{
-		Enabled: true,
-		URL:     fj.URL,
-		Name:    fj.Name,
-		white:   fj.Whitelist,
+		Enabled:        true,
+		URL:            fj.URL,
+		Name:           fj.Name,
+		PublicKey:      fj.PublicKey,
+		white:          fj.Whitelist,
+		VerifyChecksum: fj.VerifyChecksum,
 		Filter: Filter{
 			ID: assignUniqueFilterID(),
 		},
@@ -198,9 +203,11 @@ func (d *DNSFilter) handleFilteringRemoveURL(w http.ResponseWriter, r *http.Requ
 }
 
 type filterURLReqData struct {
-	Name    string `json:"name"`
-	URL     string `json:"url"`
-	Enabled bool   `json:"enabled"`
+	Name           string `json:"name"`
+	URL            string `json:"url"`
+	PublicKey      string `json:"public_key"`
+	Enabled        bool   `json:"enabled"`
+	VerifyChecksum bool   `json:"verify_checksum"`
 }
 
 type filterURLReq struct {
@@ -232,9 +239,11 @@ func (d *DNSFilter) handleFilteringSetURL(w http.ResponseWriter, r *http.Request
 	}
 
 	filt := FilterYAML{
-		Enabled: fj.Data.Enabled,
-		Name:    fj.Data.Name,
-		URL:     fj.Data.URL,
+		Enabled:        fj.Data.Enabled,
+		Name:           fj.Data.Name,
+		URL:            fj.Data.URL,
+		PublicKey:      fj.Data.PublicKey,
+		VerifyChecksum: fj.Data.VerifyChecksum,
 	}
 
 	restart, err := d.filterSetProperties(fj.URL, filt, fj.Whitelist)
@@ -273,6 +282,22 @@ func (d *DNSFilter) handleFilteringSetRules(w http.ResponseWriter, r *http.Reque
 	d.EnableFilters(true)
 }
 
+// handleFilteringValidateRules is the handler for the POST
+// /control/filtering/validate_rules HTTP API.
+func (d *DNSFilter) handleFilteringValidateRules(w http.ResponseWriter, r *http.Request) {
+	req := &filteringRulesReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "reading req: %s", err)
+
+		return
+	}
+
+	aghhttp.WriteJSONResponseOK(w, r, &validateRulesResp{
+		Diagnostics: validateRules(req.Rules),
+	})
+}
+
 func (d *DNSFilter) handleFilteringRefresh(w http.ResponseWriter, r *http.Request) {
 	type Req struct {
 		White bool `json:"whitelist"`
@@ -310,9 +335,16 @@ type filterJSON struct {
 	URL         string `json:"url"`
 	Name        string `json:"name"`
 	LastUpdated string `json:"last_updated,omitempty"`
-	ID          int64  `json:"id"`
-	RulesCount  uint32 `json:"rules_count"`
-	Enabled     bool   `json:"enabled"`
+	PublicKey   string `json:"public_key,omitempty"`
+
+	// UpdateError is the error of the last update of the list, for example a
+	// failed checksum or signature verification.
+	UpdateError string `json:"update_error,omitempty"`
+
+	ID             int64  `json:"id"`
+	RulesCount     uint32 `json:"rules_count"`
+	Enabled        bool   `json:"enabled"`
+	VerifyChecksum bool   `json:"verify_checksum"`
 }
 
 type filteringConfig struct {
@@ -325,17 +357,23 @@ type filteringConfig struct {
 
 func filterToJSON(f FilterYAML) filterJSON {
 	fj := filterJSON{
-		ID:         f.ID,
-		Enabled:    f.Enabled,
-		URL:        f.URL,
-		Name:       f.Name,
-		RulesCount: uint32(f.RulesCount),
+		ID:             f.ID,
+		Enabled:        f.Enabled,
+		URL:            f.URL,
+		Name:           f.Name,
+		PublicKey:      f.PublicKey,
+		RulesCount:     uint32(f.RulesCount),
+		VerifyChecksum: f.VerifyChecksum,
 	}
 
 	if !f.LastUpdated.IsZero() {
 		fj.LastUpdated = f.LastUpdated.Format(time.RFC3339)
 	}
 
+	if f.updateErr != nil {
+		fj.UpdateError = f.updateErr.Error()
+	}
+
 	return fj
 }
 
@@ -413,17 +451,86 @@ type checkHostResp struct {
 	//
 	// Deprecated: Use Rules[*].FilterListID.
 	FilterID int64 `json:"filter_id"`
+
+	// Explanation is the detailed description of the filtering decision.  It
+	// is only set when the explain mode is requested.
+	Explanation *explanation `json:"explanation,omitempty"`
 }
 
-func (d *DNSFilter) handleCheckHost(w http.ResponseWriter, r *http.Request) {
-	host := r.URL.Query().Get("name")
+// checkHostReq contains the parsed query parameters of the check host request.
+type checkHostReq struct {
+	clientIP netip.Addr
+	host     string
+	clientID string
+	tags     []string
+	qtype    uint16
+	explain  bool
+}
+
+// parseCheckHostReq parses the query parameters of the check host request.
+func parseCheckHostReq(q url.Values) (req *checkHostReq, err error) {
+	req = &checkHostReq{
+		host:     q.Get("name"),
+		clientID: q.Get("client_id"),
+		qtype:    dns.TypeA,
+		explain:  q.Get("explain") == "true",
+	}
+
+	if qt := q.Get("qtype"); qt != "" {
+		var ok bool
+		req.qtype, ok = dns.StringToType[strings.ToUpper(qt)]
+		if !ok {
+			return nil, fmt.Errorf("bad qtype %q", qt)
+		}
+	}
+
+	if cli := q.Get("client"); cli != "" {
+		req.clientIP, err = netip.ParseAddr(cli)
+		if err != nil {
+			return nil, fmt.Errorf("bad client: %w", err)
+		}
+	}
+
+	if tags := q.Get("tags"); tags != "" {
+		req.tags = strings.Split(tags, ",")
+		slices.Sort(req.tags)
+	}
+
+	return req, nil
+}
 
-	setts := d.Settings()
+// checkHostSettings returns the effective filtering settings for the check
+// host request.
+func (d *DNSFilter) checkHostSettings(req *checkHostReq) (setts *Settings) {
+	setts = d.Settings()
 	setts.FilteringEnabled = true
 	setts.ProtectionEnabled = true
 
-	d.ApplyBlockedServices(setts)
-	result, err := d.CheckHost(host, dns.TypeA, setts)
+	if d.conf.ApplyClientFiltering != nil {
+		d.conf.ApplyClientFiltering(req.clientIP, req.clientID, setts)
+	} else {
+		d.ApplyBlockedServices(setts)
+		setts.ClientIP = req.clientIP
+	}
+
+	if req.tags != nil {
+		setts.ClientTags = req.tags
+	}
+
+	return setts
+}
+
+func (d *DNSFilter) handleCheckHost(w http.ResponseWriter, r *http.Request) {
+	req, err := parseCheckHostReq(r.URL.Query())
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "parsing request: %s", err)
+
+		return
+	}
+
+	host := req.host
+	setts := d.checkHostSettings(req)
+	result, err := d.CheckHost(host, req.qtype, setts)
 	if err != nil {
 		aghhttp.Error(
 			r,
@@ -458,6 +565,10 @@ func (d *DNSFilter) handleCheckHost(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if req.explain {
+		resp.Explanation = d.explain(host, req.qtype, setts)
+	}
+
 	aghhttp.WriteJSONResponseOK(w, r, resp)
 }
 
@@ -550,6 +661,12 @@ func (d *DNSFilter) RegisterFilteringHandlers() {
 	registerHTTP(http.MethodPost, "/control/parental/disable", d.handleParentalDisable)
 	registerHTTP(http.MethodGet, "/control/parental/status", d.handleParentalStatus)
 
+	registerHTTP(http.MethodGet, "/control/threat_intel/status", d.handleThreatIntelStatus)
+	registerHTTP(http.MethodPut, "/control/threat_intel/update", d.handleThreatIntelUpdate)
+
+	registerHTTP(http.MethodGet, "/control/newly_observed_domains/status", d.handleNewDomainsStatus)
+	registerHTTP(http.MethodPut, "/control/newly_observed_domains/config", d.handleNewDomainsConfig)
+
 	registerHTTP(http.MethodPost, "/control/safesearch/enable", d.handleSafeSearchEnable)
 	registerHTTP(http.MethodPost, "/control/safesearch/disable", d.handleSafeSearchDisable)
 	registerHTTP(http.MethodGet, "/control/safesearch/status", d.handleSafeSearchStatus)
@@ -559,6 +676,8 @@ func (d *DNSFilter) RegisterFilteringHandlers() {
 	registerHTTP(http.MethodPost, "/control/rewrite/add", d.handleRewriteAdd)
 	registerHTTP(http.MethodPut, "/control/rewrite/update", d.handleRewriteUpdate)
 	registerHTTP(http.MethodPost, "/control/rewrite/delete", d.handleRewriteDelete)
+	registerHTTP(http.MethodGet, "/control/rewrite/regexp/list", d.handleRegexpRewriteList)
+	registerHTTP(http.MethodPut, "/control/rewrite/regexp/update", d.handleRegexpRewriteUpdate)
 
 	registerHTTP(http.MethodGet, "/control/blocked_services/services", d.handleBlockedServicesIDs)
 	registerHTTP(http.MethodGet, "/control/blocked_services/all", d.handleBlockedServicesAll)
@@ -570,6 +689,23 @@ func (d *DNSFilter) RegisterFilteringHandlers() {
 	registerHTTP(http.MethodGet, "/control/blocked_services/get", d.handleBlockedServicesGet)
 	registerHTTP(http.MethodPut, "/control/blocked_services/update", d.handleBlockedServicesUpdate)
 
+	registerHTTP(http.MethodGet, "/control/blocked_services/custom", d.handleCustomServicesList)
+	registerHTTP(
+		http.MethodPost,
+		"/control/blocked_services/custom/add",
+		d.handleCustomServicesAdd,
+	)
+	registerHTTP(
+		http.MethodPut,
+		"/control/blocked_services/custom/update",
+		d.handleCustomServicesUpdate,
+	)
+	registerHTTP(
+		http.MethodPost,
+		"/control/blocked_services/custom/delete",
+		d.handleCustomServicesDelete,
+	)
+
 	registerHTTP(http.MethodGet, "/control/filtering/status", d.handleFilteringStatus)
 	registerHTTP(http.MethodPost, "/control/filtering/config", d.handleFilteringConfig)
 	registerHTTP(http.MethodPost, "/control/filtering/add_url", d.handleFilteringAddURL)
@@ -577,6 +713,11 @@ func (d *DNSFilter) RegisterFilteringHandlers() {
 	registerHTTP(http.MethodPost, "/control/filtering/set_url", d.handleFilteringSetURL)
 	registerHTTP(http.MethodPost, "/control/filtering/refresh", d.handleFilteringRefresh)
 	registerHTTP(http.MethodPost, "/control/filtering/set_rules", d.handleFilteringSetRules)
+	registerHTTP(
+		http.MethodPost,
+		"/control/filtering/validate_rules",
+		d.handleFilteringValidateRules,
+	)
 	registerHTTP(http.MethodGet, "/control/filtering/check_host", d.handleCheckHost)
 }
 
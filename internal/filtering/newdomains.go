@@ -0,0 +1,282 @@
+package filtering
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/firstseen"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/net/publicsuffix"
+)
+
+// defaultNewDomainsBlockHours is the default age in hours, under which the
+// newly observed domains are blocked.
+const defaultNewDomainsBlockHours = 24
+
+// newDomainRuleText is the rule text in the filtering results for the newly
+// observed domains.
+const newDomainRuleText = "newly observed domain"
+
+// NewDomainsConfig is the configuration of tracking the newly observed domains,
+// that is the registered domains requested by any client for the first time.
+type NewDomainsConfig struct {
+	// BlockHours is the age in hours, under which the newly observed domains
+	// are blocked if Block is true.  If zero, 24 hours are used.
+	BlockHours uint32 `yaml:"block_hours"`
+
+	// Enabled defines if the first time each registered domain has been
+	// requested is tracked.
+	Enabled bool `yaml:"enabled"`
+
+	// Block defines if the domains first requested less than BlockHours ago
+	// are blocked.  The domains aren't blocked during the first BlockHours of
+	// tracking, since all of them are new at that time, as well as during
+	// BlockHours after the last request for any forgotten domain, since the
+	// domains seen for the first time after that may have been seen recently.
+	Block bool `yaml:"block"`
+}
+
+// blockAge returns the age, under which the newly observed domains are
+// blocked.
+func (c *NewDomainsConfig) blockAge() (age time.Duration) {
+	hours := c.BlockHours
+	if hours == 0 {
+		hours = defaultNewDomainsBlockHours
+	}
+
+	return time.Duration(hours) * time.Hour
+}
+
+// registeredDomain returns the registered domain, also known as eTLD+1, of
+// host.  domain is empty if host isn't tracked, for example if it's a local
+// domain name, a reverse lookup name, or an IP address.
+func registeredDomain(host string) (domain string) {
+	host = strings.TrimSuffix(host, ".")
+	if host == "arpa" || strings.HasSuffix(host, ".arpa") {
+		return ""
+	}
+
+	suffix, icann := publicsuffix.PublicSuffix(host)
+	if !icann && !strings.Contains(suffix, ".") {
+		// Not a domain name under a known top-level domain, for example
+		// "printer.lan".
+		return ""
+	}
+
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return ""
+	}
+
+	return domain
+}
+
+// ObserveDomain records the request for host, if tracking of the newly observed
+// domains is enabled.  It must only be called for the actual DNS requests, so
+// that checking a host doesn't start its blocking period.
+func (d *DNSFilter) ObserveDomain(host string) {
+	t := d.conf.NewDomainTracker
+	if t == nil {
+		return
+	}
+
+	d.confMu.RLock()
+	enabled := d.conf.NewDomains.Enabled
+	d.confMu.RUnlock()
+
+	if !enabled {
+		return
+	}
+
+	domain := registeredDomain(host)
+	if domain == "" {
+		return
+	}
+
+	_, isNew := t.Observe(domain, time.Now())
+	if isNew {
+		log.Debug("filtering: newly observed domain %q", domain)
+	}
+}
+
+// checkNewDomain blocks host, if blocking is enabled and its registered domain
+// has been observed for the first time recently or hasn't been observed yet.
+// It doesn't record the request, see [DNSFilter.ObserveDomain].
+func (d *DNSFilter) checkNewDomain(
+	host string,
+	_ uint16,
+	setts *Settings,
+) (res Result, err error) {
+	t := d.conf.NewDomainTracker
+	if t == nil || !setts.ProtectionEnabled {
+		return Result{}, nil
+	}
+
+	d.confMu.RLock()
+	conf := d.conf.NewDomains
+	d.confMu.RUnlock()
+
+	if !conf.Enabled || !conf.Block {
+		return Result{}, nil
+	}
+
+	domain := registeredDomain(host)
+	if domain == "" {
+		return Result{}, nil
+	}
+
+	now := time.Now()
+	firstSeen, ok := t.FirstSeen(domain)
+	if !ok {
+		// The domain is going to be observed for the first time with this
+		// request.
+		firstSeen = now
+	}
+
+	age := conf.blockAge()
+	if now.Sub(firstSeen) >= age || firstSeen.Sub(learningStart(t)) < age {
+		return Result{}, nil
+	}
+
+	return Result{
+		Rules: []*ResultRule{{
+			Text:         newDomainRuleText,
+			FilterListID: NewDomainsListID,
+		}},
+		Reason:     FilteredNewDomain,
+		IsFiltered: true,
+	}, nil
+}
+
+// learningStart returns the start of the current learning period of t, during
+// which the newly observed domains aren't blocked.  It's restarted when the
+// forgotten domains have been seen recently, since the domains seen for the
+// first time after that may be one of them.  Forgetting the domains not seen
+// for longer than the learning period doesn't restart it.
+func learningStart(t *firstseen.Tracker) (start time.Time) {
+	start = t.Started()
+	if forgotten := t.Forgotten(); forgotten.After(start) {
+		return forgotten
+	}
+
+	return start
+}
+
+// defaultNewDomainsLimit is the default number of the recently observed
+// domains returned by the GET /control/newly_observed_domains/status HTTP API.
+const defaultNewDomainsLimit = 100
+
+// newDomainJSON is the JSON representation of a newly observed domain.
+type newDomainJSON struct {
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Domain    string    `json:"domain"`
+}
+
+// newDomainsConfigJSON is the JSON representation of [NewDomainsConfig].
+type newDomainsConfigJSON struct {
+	BlockHours uint32 `json:"block_hours"`
+	Enabled    bool   `json:"enabled"`
+	Block      bool   `json:"block"`
+}
+
+// newDomainsStatusResp is the response to the GET
+// /control/newly_observed_domains/status HTTP API.
+type newDomainsStatusResp struct {
+	newDomainsConfigJSON
+
+	// Started is the time the tracking has started.
+	Started time.Time `json:"started"`
+
+	// LearningUntil is the time, before which the domains aren't blocked.  It
+	// moves forward when the recently seen domains are forgotten.
+	LearningUntil time.Time `json:"learning_until"`
+
+	// Recent are the recently observed domains from the newest to the oldest.
+	Recent []*newDomainJSON `json:"recent"`
+
+	// Total is the number of the tracked domains.
+	Total int `json:"total"`
+}
+
+// handleNewDomainsStatus is the handler for the GET
+// /control/newly_observed_domains/status HTTP API.  The optional "limit" query
+// parameter is the maximum number of the returned recently observed domains.
+func (d *DNSFilter) handleNewDomainsStatus(w http.ResponseWriter, r *http.Request) {
+	limit := defaultNewDomainsLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			aghhttp.Error(r, w, http.StatusBadRequest, "limit: bad value %q", s)
+
+			return
+		}
+	}
+
+	d.confMu.RLock()
+	conf := d.conf.NewDomains
+	d.confMu.RUnlock()
+
+	resp := &newDomainsStatusResp{
+		newDomainsConfigJSON: newDomainsConfigJSON{
+			BlockHours: uint32(conf.blockAge() / time.Hour),
+			Enabled:    conf.Enabled,
+			Block:      conf.Block,
+		},
+		Recent: []*newDomainJSON{},
+	}
+
+	if t := d.conf.NewDomainTracker; t != nil {
+		resp.Started = t.Started()
+		resp.LearningUntil = learningStart(t).Add(conf.blockAge())
+		resp.Total = t.Len()
+
+		for _, it := range t.Recent(limit) {
+			resp.Recent = append(resp.Recent, &newDomainJSON{
+				FirstSeen: it.FirstSeen,
+				LastSeen:  it.LastSeen,
+				Domain:    it.Key,
+			})
+		}
+	}
+
+	aghhttp.WriteJSONResponseOK(w, r, resp)
+}
+
+// handleNewDomainsConfig is the handler for the PUT
+// /control/newly_observed_domains/config HTTP API.
+func (d *DNSFilter) handleNewDomainsConfig(w http.ResponseWriter, r *http.Request) {
+	req := &newDomainsConfigJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+
+		return
+	}
+
+	if req.BlockHours == 0 {
+		aghhttp.Error(r, w, http.StatusBadRequest, "block_hours: must be positive")
+
+		return
+	}
+
+	func() {
+		d.confMu.Lock()
+		defer d.confMu.Unlock()
+
+		d.conf.NewDomains = NewDomainsConfig{
+			BlockHours: req.BlockHours,
+			Enabled:    req.Enabled,
+			Block:      req.Block,
+		}
+	}()
+
+	log.Debug("filtering: newly observed domains config: %+v", req)
+
+	d.conf.ConfigModified()
+}
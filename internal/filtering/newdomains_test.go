@@ -0,0 +1,210 @@
+package filtering
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/firstseen"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisteredDomain(t *testing.T) {
+	testCases := []struct {
+		host string
+		want string
+	}{{
+		host: "www.example.com",
+		want: "example.com",
+	}, {
+		host: "a.b.example.co.uk.",
+		want: "example.co.uk",
+	}, {
+		host: "user.github.io",
+		want: "user.github.io",
+	}, {
+		host: "com",
+		want: "",
+	}, {
+		host: "printer.lan",
+		want: "",
+	}, {
+		host: "1.0.168.192.in-addr.arpa",
+		want: "",
+	}, {
+		host: "192.168.0.1",
+		want: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.host, func(t *testing.T) {
+			assert.Equal(t, tc.want, registeredDomain(tc.host))
+		})
+	}
+}
+
+// newTestTracker returns a new tracker of the domains, the tracking by which
+// has started at started.  The forgotten domains have last been seen at
+// forgotten, if it's not zero.
+func newTestTracker(t *testing.T, started, forgotten time.Time) (tr *firstseen.Tracker) {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "newdomains.json")
+	data := fmt.Sprintf(`{"started":%q,"forgotten":%q,"items":{"example.org":[%d,%d]}}`,
+		started.Format(time.RFC3339),
+		forgotten.Format(time.RFC3339),
+		started.Unix(),
+		started.Unix(),
+	)
+
+	err := os.WriteFile(filename, []byte(data), 0o644)
+	require.NoError(t, err)
+
+	tr, err = firstseen.New(&firstseen.Config{
+		Filename: filename,
+		MaxSize:  100,
+	})
+	require.NoError(t, err)
+
+	return tr
+}
+
+func TestDNSFilter_checkNewDomain(t *testing.T) {
+	const blockHours = 2
+
+	conf := &Config{
+		ConfigModified: func() {},
+		NewDomains: NewDomainsConfig{
+			BlockHours: blockHours,
+			Enabled:    true,
+			Block:      true,
+		},
+		NewDomainTracker: newTestTracker(t, time.Now().Add(-2*blockHours*time.Hour), time.Time{}),
+	}
+
+	d, setts := newForTest(t, conf, nil)
+	t.Cleanup(d.Close)
+
+	res, err := d.CheckHost("www.example.net", dns.TypeA, setts)
+	require.NoError(t, err)
+
+	assert.True(t, res.IsFiltered)
+	assert.Equal(t, FilteredNewDomain, res.Reason)
+	require.Len(t, res.Rules, 1)
+
+	assert.EqualValues(t, NewDomainsListID, res.Rules[0].FilterListID)
+
+	_, ok := conf.NewDomainTracker.FirstSeen("example.net")
+	assert.False(t, ok)
+
+	d.ObserveDomain("www.example.net")
+
+	_, ok = conf.NewDomainTracker.FirstSeen("example.net")
+	assert.True(t, ok)
+
+	res, err = d.CheckHost("www.example.net", dns.TypeA, setts)
+	require.NoError(t, err)
+
+	assert.True(t, res.IsFiltered)
+
+	res, err = d.CheckHost("example.org", dns.TypeA, setts)
+	require.NoError(t, err)
+
+	assert.False(t, res.IsFiltered)
+
+	t.Run("protection_disabled", func(t *testing.T) {
+		res, err = d.CheckHost("www.example.net", dns.TypeA, &Settings{})
+		require.NoError(t, err)
+
+		assert.False(t, res.IsFiltered)
+	})
+
+	t.Run("learning", func(t *testing.T) {
+		d.conf.NewDomainTracker = newTestTracker(t, time.Now().Add(-time.Hour), time.Time{})
+
+		res, err = d.CheckHost("example.info", dns.TypeA, setts)
+		require.NoError(t, err)
+
+		assert.False(t, res.IsFiltered)
+	})
+
+	t.Run("forgotten", func(t *testing.T) {
+		now := time.Now()
+		d.conf.NewDomainTracker = newTestTracker(
+			t,
+			now.Add(-2*blockHours*time.Hour),
+			now.Add(-time.Hour),
+		)
+
+		res, err = d.CheckHost("example.info", dns.TypeA, setts)
+		require.NoError(t, err)
+
+		assert.False(t, res.IsFiltered)
+	})
+
+	t.Run("forgotten_long_ago", func(t *testing.T) {
+		now := time.Now()
+		d.conf.NewDomainTracker = newTestTracker(
+			t,
+			now.Add(-4*blockHours*time.Hour),
+			now.Add(-2*blockHours*time.Hour),
+		)
+
+		res, err = d.CheckHost("example.info", dns.TypeA, setts)
+		require.NoError(t, err)
+
+		assert.True(t, res.IsFiltered)
+	})
+}
+
+func TestDNSFilter_handleNewDomains(t *testing.T) {
+	conf := &Config{
+		ConfigModified:   func() {},
+		NewDomainTracker: newTestTracker(t, time.Now().Add(-time.Hour), time.Time{}),
+	}
+
+	d, _ := newForTest(t, conf, nil)
+	t.Cleanup(d.Close)
+
+	body := []byte(`{"enabled":true,"block":true,"block_hours":12}`)
+	r := httptest.NewRequest(http.MethodPut, "/control/newly_observed_domains/config", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	d.handleNewDomainsConfig(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.Equal(t, NewDomainsConfig{
+		BlockHours: 12,
+		Enabled:    true,
+		Block:      true,
+	}, d.conf.NewDomains)
+
+	r = httptest.NewRequest(http.MethodGet, "/control/newly_observed_domains/status", nil)
+	w = httptest.NewRecorder()
+	d.handleNewDomainsStatus(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := &newDomainsStatusResp{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), resp))
+
+	assert.Equal(t, uint32(12), resp.BlockHours)
+	assert.Equal(t, 1, resp.Total)
+	require.Len(t, resp.Recent, 1)
+
+	assert.Equal(t, "example.org", resp.Recent[0].Domain)
+	assert.Equal(t, resp.Started.Add(12*time.Hour), resp.LearningUntil)
+
+	body = []byte(`{"enabled":true,"block":true,"block_hours":0}`)
+	r = httptest.NewRequest(http.MethodPut, "/control/newly_observed_domains/config", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	d.handleNewDomainsConfig(w, r)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,243 @@
+package filtering
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// RegexpRewrite is a DNS rewrite rule with a regular-expression domain pattern.
+// The regular-expression rewrites are only checked if none of the legacy
+// rewrites match the hostname.
+type RegexpRewrite struct {
+	// re is the compiled Pattern.
+	re *regexp.Regexp
+
+	// Pattern is the regular expression matched against the hostname.  The
+	// hostname is lowercased and has no trailing dot.
+	Pattern string `yaml:"pattern" json:"pattern"`
+
+	// Answer is the template of the IP address or the canonical name to
+	// respond with.  It may contain references to the capture groups of
+	// Pattern in the form accepted by [regexp.Regexp.Expand], for example "$1"
+	// or "${name}".
+	Answer string `yaml:"answer" json:"answer"`
+
+	// QType is the optional type of the questions the rewrite applies to, for
+	// example "A" or "HTTPS".  If it's empty, the rewrite applies to the
+	// questions of all types, in the same way as the legacy rewrites do.
+	QType string `yaml:"qtype,omitempty" json:"qtype,omitempty"`
+
+	// Priority is the priority of the rewrite.  Only the matching rewrites
+	// with the highest priority are applied.
+	Priority int `yaml:"priority,omitempty" json:"priority,omitempty"`
+
+	// qtype is the parsed QType.  It's zero if QType is empty.
+	qtype uint16
+}
+
+// normalize validates rw and compiles its pattern.
+func (rw *RegexpRewrite) normalize() (err error) {
+	if rw == nil {
+		return errors.Error("nil rewrite entry")
+	} else if rw.Answer == "" {
+		return errors.Error("empty answer")
+	}
+
+	rw.re, err = regexp.Compile(rw.Pattern)
+	if err != nil {
+		return fmt.Errorf("pattern: %w", err)
+	}
+
+	rw.qtype = 0
+	if rw.QType != "" {
+		var ok bool
+		rw.qtype, ok = dns.StringToType[strings.ToUpper(rw.QType)]
+		if !ok {
+			return fmt.Errorf("bad qtype %q", rw.QType)
+		}
+	}
+
+	return nil
+}
+
+// expand returns the legacy rewrite for host made from the answer template of
+// rw.  ok is false if the pattern of rw doesn't match host or the expanded
+// answer is invalid.
+func (rw *RegexpRewrite) expand(host string) (lrw *LegacyRewrite, ok bool) {
+	submatches := rw.re.FindStringSubmatchIndex(host)
+	if submatches == nil {
+		return nil, false
+	}
+
+	ans := string(rw.re.ExpandString(nil, rw.Answer, host, submatches))
+	lrw = &LegacyRewrite{
+		Domain: host,
+		Answer: ans,
+	}
+
+	ip, err := netip.ParseAddr(ans)
+	if err == nil {
+		lrw.IP = ip
+		lrw.Type = dns.TypeA
+		if ip.Is6() {
+			lrw.Type = dns.TypeAAAA
+		}
+
+		return lrw, true
+	}
+
+	ans = strings.ToLower(ans)
+	err = netutil.ValidateHostname(ans)
+	if err != nil {
+		log.Debug("rewrite: regexp %q: bad answer for %q: %s", rw.Pattern, host, err)
+
+		return nil, false
+	}
+
+	lrw.Answer, lrw.Type = ans, dns.TypeCNAME
+
+	return lrw, true
+}
+
+// prepareRegexpRewrites validates all regular-expression DNS rewrites.
+func prepareRegexpRewrites(rws []*RegexpRewrite) (err error) {
+	for i, rw := range rws {
+		err = rw.normalize()
+		if err != nil {
+			return fmt.Errorf("at index %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// findRegexpRewrites returns the legacy rewrites made from the
+// regular-expression rewrites with the highest priority matching host and
+// qtype.  The semantics of the results are the same as the ones of
+// [findRewrites].
+func findRegexpRewrites(
+	entries []*RegexpRewrite,
+	host string,
+	qtype uint16,
+) (rewrites []*LegacyRewrite, matched bool) {
+	prio := 0
+	for _, e := range entries {
+		if (matched && e.Priority < prio) || (e.qtype != 0 && e.qtype != qtype) {
+			continue
+		}
+
+		lrw, ok := e.expand(host)
+		if !ok {
+			continue
+		}
+
+		if !matched || e.Priority > prio {
+			rewrites = rewrites[:0]
+		}
+
+		matched, prio = true, e.Priority
+		if lrw.matchesQType(qtype) {
+			rewrites = append(rewrites, lrw)
+		}
+	}
+
+	// Make sure that CNAMEs go first, as they do in findRewrites.
+	slices.SortStableFunc(rewrites, func(a, b *LegacyRewrite) (res int) {
+		return cmp.Compare(rewriteTypeOrder(a.Type), rewriteTypeOrder(b.Type))
+	})
+
+	return rewrites, matched
+}
+
+// rewriteTypeOrder returns the sorting order of the rewrite of type t.
+func rewriteTypeOrder(t uint16) (order int) {
+	if t == dns.TypeCNAME {
+		return 0
+	}
+
+	return 1
+}
+
+// findAllRewrites returns the legacy rewrites for host and qtype, or, if there
+// are none, the ones made from the regular-expression rewrites.  d.confMu must
+// be locked.
+func (d *DNSFilter) findAllRewrites(
+	host string,
+	qtype uint16,
+) (rewrites []*LegacyRewrite, matched bool) {
+	rewrites, matched = findRewrites(d.conf.Rewrites, host, qtype)
+	if matched {
+		return rewrites, matched
+	}
+
+	return findRegexpRewrites(d.conf.RegexpRewrites, host, qtype)
+}
+
+// cloneRegexpRewrites returns a copy of entries.  The compiled patterns are
+// shared, since they are safe for concurrent use.
+func cloneRegexpRewrites(entries []*RegexpRewrite) (clone []*RegexpRewrite) {
+	clone = make([]*RegexpRewrite, 0, len(entries))
+	for _, rw := range entries {
+		c := *rw
+		clone = append(clone, &c)
+	}
+
+	return clone
+}
+
+// handleRegexpRewriteList is the handler for the GET
+// /control/rewrite/regexp/list HTTP API.
+func (d *DNSFilter) handleRegexpRewriteList(w http.ResponseWriter, r *http.Request) {
+	var resp []*RegexpRewrite
+	func() {
+		d.confMu.RLock()
+		defer d.confMu.RUnlock()
+
+		resp = cloneRegexpRewrites(d.conf.RegexpRewrites)
+	}()
+
+	aghhttp.WriteJSONResponseOK(w, r, resp)
+}
+
+// handleRegexpRewriteUpdate is the handler for the PUT
+// /control/rewrite/regexp/update HTTP API.  It replaces all
+// regular-expression rewrites.
+func (d *DNSFilter) handleRegexpRewriteUpdate(w http.ResponseWriter, r *http.Request) {
+	rws := []*RegexpRewrite{}
+	err := json.NewDecoder(r.Body).Decode(&rws)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+
+		return
+	}
+
+	err = prepareRegexpRewrites(rws)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "regexp rewrites: %s", err)
+
+		return
+	}
+
+	func() {
+		d.confMu.Lock()
+		defer d.confMu.Unlock()
+
+		d.conf.RegexpRewrites = rws
+	}()
+
+	log.Debug("rewrite: set %d regexp rewrites", len(rws))
+
+	d.conf.ConfigModified()
+}
@@ -0,0 +1,190 @@
+package filtering
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSFilter_processRewrites_regexp(t *testing.T) {
+	d, _ := newForTest(t, nil, nil)
+	t.Cleanup(d.Close)
+
+	var (
+		addrV4    = netip.MustParseAddr("192.0.2.1")
+		addrV6    = netip.MustParseAddr("2001:db8::1")
+		addrPrio  = netip.MustParseAddr("192.0.2.2")
+		addrK8s   = netip.MustParseAddr("192.0.2.3")
+		addrExact = netip.MustParseAddr("192.0.2.4")
+	)
+
+	d.conf.Rewrites = []*LegacyRewrite{{
+		Domain: "exact.dev.lan",
+		Answer: addrExact.String(),
+	}, {
+		Domain: "svc.k8s.lan",
+		Answer: addrK8s.String(),
+	}}
+	d.conf.RegexpRewrites = []*RegexpRewrite{{
+		Pattern: `^(?P<name>.+)\.dev\.lan$`,
+		Answer:  "${name}.k8s.lan",
+	}, {
+		Pattern: `^host-(\d+)-(\d+)\.ip\.lan$`,
+		Answer:  "192.0.$1.$2",
+	}, {
+		Pattern: `^dual\.lan$`,
+		Answer:  addrV4.String(),
+		QType:   "A",
+	}, {
+		Pattern: `^dual\.lan$`,
+		Answer:  addrV6.String(),
+		QType:   "aaaa",
+	}, {
+		Pattern:  `^prio\.`,
+		Answer:   addrV4.String(),
+		Priority: 0,
+	}, {
+		Pattern:  `^prio\.lan$`,
+		Answer:   addrPrio.String(),
+		Priority: 10,
+	}, {
+		Pattern: `^self\.other$`,
+		Answer:  "self.other",
+	}}
+
+	require.NoError(t, d.prepareRewrites())
+	require.NoError(t, prepareRegexpRewrites(d.conf.RegexpRewrites))
+
+	testCases := []struct {
+		name       string
+		host       string
+		wantCName  string
+		wantIPs    []netip.Addr
+		wantReason Reason
+		qtype      uint16
+	}{{
+		name:       "cname_template",
+		host:       "svc.dev.lan",
+		wantCName:  "svc.k8s.lan",
+		wantIPs:    []netip.Addr{addrK8s},
+		wantReason: Rewritten,
+		qtype:      dns.TypeA,
+	}, {
+		name:       "legacy_first",
+		host:       "exact.dev.lan",
+		wantCName:  "",
+		wantIPs:    []netip.Addr{addrExact},
+		wantReason: Rewritten,
+		qtype:      dns.TypeA,
+	}, {
+		name:       "ip_template",
+		host:       "host-0-42.ip.lan",
+		wantCName:  "",
+		wantIPs:    []netip.Addr{netip.MustParseAddr("192.0.0.42")},
+		wantReason: Rewritten,
+		qtype:      dns.TypeA,
+	}, {
+		name:       "qtype_a",
+		host:       "dual.lan",
+		wantCName:  "",
+		wantIPs:    []netip.Addr{addrV4},
+		wantReason: Rewritten,
+		qtype:      dns.TypeA,
+	}, {
+		name:       "qtype_aaaa",
+		host:       "dual.lan",
+		wantCName:  "",
+		wantIPs:    []netip.Addr{addrV6},
+		wantReason: Rewritten,
+		qtype:      dns.TypeAAAA,
+	}, {
+		name:       "qtype_other",
+		host:       "dual.lan",
+		wantCName:  "",
+		wantIPs:    nil,
+		wantReason: NotFilteredNotFound,
+		qtype:      dns.TypeMX,
+	}, {
+		name:       "priority",
+		host:       "prio.lan",
+		wantCName:  "",
+		wantIPs:    []netip.Addr{addrPrio},
+		wantReason: Rewritten,
+		qtype:      dns.TypeA,
+	}, {
+		name:       "exception",
+		host:       "self.other",
+		wantCName:  "",
+		wantIPs:    nil,
+		wantReason: NotFilteredNotFound,
+		qtype:      dns.TypeA,
+	}, {
+		name:       "no_match",
+		host:       "example.org",
+		wantCName:  "",
+		wantIPs:    nil,
+		wantReason: NotFilteredNotFound,
+		qtype:      dns.TypeA,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res := d.processRewrites(tc.host, tc.qtype)
+
+			assert.Equal(t, tc.wantReason, res.Reason)
+			assert.Equal(t, tc.wantCName, res.CanonName)
+			assert.Equal(t, tc.wantIPs, res.IPList)
+		})
+	}
+}
+
+func TestDNSFilter_handleRegexpRewriteUpdate(t *testing.T) {
+	confModifiedCalled := false
+	d, _ := newForTest(t, &Config{
+		ConfigModified: func() { confModifiedCalled = true },
+	}, nil)
+	t.Cleanup(d.Close)
+
+	testCases := []struct {
+		name     string
+		body     string
+		wantCode int
+	}{{
+		name:     "valid",
+		body:     `[{"pattern":"^(.+)\\.dev\\.lan$","answer":"$1.k8s.lan","priority":1}]`,
+		wantCode: http.StatusOK,
+	}, {
+		name:     "bad_pattern",
+		body:     `[{"pattern":"(","answer":"k8s.lan"}]`,
+		wantCode: http.StatusBadRequest,
+	}, {
+		name:     "bad_qtype",
+		body:     `[{"pattern":"lan$","answer":"k8s.lan","qtype":"BAD"}]`,
+		wantCode: http.StatusBadRequest,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(
+				http.MethodPut,
+				"/control/rewrite/regexp/update",
+				bytes.NewReader([]byte(tc.body)),
+			)
+			w := httptest.NewRecorder()
+
+			d.handleRegexpRewriteUpdate(w, r)
+			assert.Equal(t, tc.wantCode, w.Code)
+		})
+	}
+
+	assert.True(t, confModifiedCalled)
+
+	res := d.processRewrites("svc.dev.lan", dns.TypeA)
+	assert.Equal(t, "svc.k8s.lan", res.CanonName)
+}
@@ -0,0 +1,341 @@
+package rulelist
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// Preprocessor directives supported by [Parser].
+//
+// See https://adguard.com/kb/general/ad-filtering/create-own-filters/#preprocessor-directives.
+const (
+	directivePrefix  = "!#"
+	directiveIf      = "!#if"
+	directiveElse    = "!#else"
+	directiveEndif   = "!#endif"
+	directiveInclude = "!#include"
+)
+
+// DefaultMaxIncludeDepth is the default maximum depth of nested !#include
+// directives.
+const DefaultMaxIncludeDepth uint = 5
+
+// Includer opens the filtering-rule lists referenced by the !#include
+// directive.
+type Includer interface {
+	// Open returns the data of the filtering-rule list located at u.  u is
+	// never nil and always has the same origin as the including list.
+	Open(u *url.URL) (rc io.ReadCloser, err error)
+}
+
+// IncludeConfig is the configuration for processing the !#include directive
+// by [Parser].
+type IncludeConfig struct {
+	// Includer is used to open the included filtering-rule lists.  It must not
+	// be nil.
+	Includer Includer
+
+	// BaseURL is the URL of the filtering-rule list being parsed.  It is used
+	// to resolve relative includes and to check that the included lists have
+	// the same origin.  It must not be nil.  Supported schemes are:
+	//   - http
+	//   - https
+	//   - file
+	BaseURL *url.URL
+
+	// MaxDepth is the maximum depth of nested includes.  If it is zero,
+	// [DefaultMaxIncludeDepth] is used.
+	MaxDepth uint
+}
+
+// Errors returned by [Parser.Parse] when processing the !#include directive.
+const (
+	errIncludeCycle  errors.Error = "include cycle"
+	errIncludeDepth  errors.Error = "include depth exceeded"
+	errIncludeOrigin errors.Error = "included list must have the same origin"
+)
+
+// conditionFrame is a single level of nested !#if directives.
+type conditionFrame struct {
+	// parentActive is true if the enclosing block is active.
+	parentActive bool
+
+	// cond is the value of the current branch condition.
+	cond bool
+
+	// elseSeen is true if the !#else directive has already been processed for
+	// this frame.
+	elseSeen bool
+}
+
+// source is the state of a single filtering-rule list being parsed, either
+// the top-level one or an included one.
+type source struct {
+	// url is the URL of the list.  It is nil if includes are disabled.
+	url *url.URL
+
+	// conds is the stack of the currently open !#if directives.
+	conds []conditionFrame
+
+	// depth is the include depth of the list, with the top-level list having
+	// the depth of zero.
+	depth uint
+
+	// hasRules is true if at least one rule has been found in this source.
+	hasRules bool
+}
+
+// isActive returns true if the rules at the current position of s should be
+// used.
+func (s *source) isActive() (ok bool) {
+	if len(s.conds) == 0 {
+		return true
+	}
+
+	f := s.conds[len(s.conds)-1]
+
+	return f.parentActive && f.cond
+}
+
+// processDirective processes a single preprocessor directive line.  line is
+// assumed to be trimmed of whitespace characters and to start with
+// [directivePrefix].  Unknown directives, such as !#safari_cb_affinity, are
+// ignored, as well as unbalanced !#else and !#endif ones.
+func (p *Parser) processDirective(
+	dst io.Writer,
+	s *source,
+	line []byte,
+	buf []byte,
+) (err error) {
+	name, arg, _ := bytes.Cut(line, []byte(" "))
+	arg = bytes.TrimSpace(arg)
+
+	switch string(name) {
+	case directiveIf:
+		s.conds = append(s.conds, conditionFrame{
+			parentActive: s.isActive(),
+			cond:         evalCondition(string(arg)),
+		})
+	case directiveElse:
+		if l := len(s.conds); l > 0 && !s.conds[l-1].elseSeen {
+			s.conds[l-1].cond = !s.conds[l-1].cond
+			s.conds[l-1].elseSeen = true
+		}
+	case directiveEndif:
+		if l := len(s.conds); l > 0 {
+			s.conds = s.conds[:l-1]
+		}
+	case directiveInclude:
+		if s.isActive() {
+			return p.include(dst, s, string(arg), buf)
+		}
+	default:
+		// Ignore other directives, since they are meaningless for DNS
+		// filtering.
+	}
+
+	return nil
+}
+
+// include parses the filtering-rule list located at rawURL relative to s into
+// dst.
+func (p *Parser) include(dst io.Writer, s *source, rawURL string, buf []byte) (err error) {
+	if p.includes == nil {
+		// Includes are disabled, so just skip the directive like any other
+		// comment.
+		return nil
+	}
+
+	defer func() { err = errors.Annotate(err, "including %q: %w", rawURL) }()
+
+	u, err := s.url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("parsing url: %w", err)
+	}
+
+	if !isSameOrigin(p.includes.BaseURL, u) {
+		return errIncludeOrigin
+	}
+
+	maxDepth := p.includes.MaxDepth
+	if maxDepth == 0 {
+		maxDepth = DefaultMaxIncludeDepth
+	}
+
+	if s.depth >= maxDepth {
+		return fmt.Errorf("%w: max %d", errIncludeDepth, maxDepth)
+	}
+
+	urlStr := u.String()
+	for _, incURL := range p.includeStack {
+		if incURL == urlStr {
+			return errIncludeCycle
+		}
+	}
+
+	rc, err := p.includes.Includer.Open(u)
+	if err != nil {
+		return fmt.Errorf("opening: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, rc.Close()) }()
+
+	p.includeStack = append(p.includeStack, urlStr)
+	defer func() { p.includeStack = p.includeStack[:len(p.includeStack)-1] }()
+
+	// The buffer of the including list is still used by its scanner, so use a
+	// separate one of the same size.
+	return p.parse(dst, rc, make([]byte, len(buf)), &source{
+		url:   u,
+		depth: s.depth + 1,
+	})
+}
+
+// isSameOrigin returns true if the filtering-rule list located at u may be
+// included into the one located at base.  For HTTP(S) URLs that means that the
+// scheme and the host are the same; for local files, u must be located within
+// the directory of base.
+func isSameOrigin(base, u *url.URL) (ok bool) {
+	if base.Scheme != u.Scheme {
+		return false
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		return strings.EqualFold(base.Host, u.Host)
+	case "file":
+		dir := path.Dir(base.Path)
+
+		return strings.HasPrefix(path.Clean(u.Path), strings.TrimSuffix(dir, "/")+"/")
+	default:
+		return false
+	}
+}
+
+// platformConstants are the constants of the !#if directive that are true for
+// AdGuard Home.  All other constants are false.
+var platformConstants = map[string]bool{
+	"adguard": true,
+	"true":    true,
+}
+
+// evalCondition evaluates the condition of an !#if directive.  Conditions
+// consist of constants, the operators "!", "&&", and "||", and parentheses.
+// Invalid conditions are considered false.
+func evalCondition(cond string) (ok bool) {
+	e := &condEvaluator{tokens: tokenizeCondition(cond)}
+	ok, err := e.or()
+	if err != nil || e.pos != len(e.tokens) {
+		return false
+	}
+
+	return ok
+}
+
+// tokenizeCondition splits an !#if condition into tokens.
+func tokenizeCondition(cond string) (tokens []string) {
+	for i := 0; i < len(cond); {
+		switch c := cond[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.HasPrefix(cond[i:], "&&"), strings.HasPrefix(cond[i:], "||"):
+			tokens = append(tokens, cond[i:i+2])
+			i += 2
+		case c == '!' || c == '(' || c == ')':
+			tokens = append(tokens, cond[i:i+1])
+			i++
+		default:
+			j := i + 1
+			for j < len(cond) && strings.IndexByte(" \t&|!()", cond[j]) == -1 {
+				j++
+			}
+
+			tokens = append(tokens, cond[i:j])
+			i = j
+		}
+	}
+
+	return tokens
+}
+
+// errBadCondition is returned by [condEvaluator] when the condition is
+// malformed.
+const errBadCondition errors.Error = "bad condition"
+
+// condEvaluator is a recursive-descent evaluator of !#if conditions.
+type condEvaluator struct {
+	tokens []string
+	pos    int
+}
+
+// next returns the current token without consuming it or an empty string if
+// there are no more tokens.
+func (e *condEvaluator) next() (tok string) {
+	if e.pos < len(e.tokens) {
+		return e.tokens[e.pos]
+	}
+
+	return ""
+}
+
+// or evaluates a disjunction.
+func (e *condEvaluator) or() (ok bool, err error) {
+	ok, err = e.and()
+	for err == nil && e.next() == "||" {
+		e.pos++
+
+		var rhs bool
+		rhs, err = e.and()
+		ok = ok || rhs
+	}
+
+	return ok, err
+}
+
+// and evaluates a conjunction.
+func (e *condEvaluator) and() (ok bool, err error) {
+	ok, err = e.unary()
+	for err == nil && e.next() == "&&" {
+		e.pos++
+
+		var rhs bool
+		rhs, err = e.unary()
+		ok = ok && rhs
+	}
+
+	return ok, err
+}
+
+// unary evaluates a negation, a parenthesized expression, or a constant.
+func (e *condEvaluator) unary() (ok bool, err error) {
+	switch tok := e.next(); tok {
+	case "", "&&", "||", ")":
+		return false, errBadCondition
+	case "!":
+		e.pos++
+		ok, err = e.unary()
+
+		return !ok, err
+	case "(":
+		e.pos++
+		ok, err = e.or()
+		if err != nil {
+			return false, err
+		} else if e.next() != ")" {
+			return false, errBadCondition
+		}
+
+		e.pos++
+
+		return ok, nil
+	default:
+		e.pos++
+
+		return platformConstants[tok], nil
+	}
+}
@@ -0,0 +1,259 @@
+package rulelist_test
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering/rulelist"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParser_Parse_conditions(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name    string
+		in      string
+		wantDst string
+	}{{
+		name:    "if_true",
+		in:      "!#if adguard\n" + testRuleTextBlocked + "!#endif\n",
+		wantDst: testRuleTextBlocked,
+	}, {
+		name:    "if_false",
+		in:      "!#if adguard_ext_safari\n" + testRuleTextBlocked + "!#endif\n",
+		wantDst: "",
+	}, {
+		name: "else",
+		in: "!#if !adguard\n" +
+			testRuleTextBlocked +
+			"!#else\n" +
+			testRuleTextBlocked2 +
+			"!#endif\n",
+		wantDst: testRuleTextBlocked2,
+	}, {
+		name: "complex",
+		in: "!#if (adguard && !adguard_ext_safari) || ext_ublock\n" +
+			testRuleTextBlocked +
+			"!#endif\n",
+		wantDst: testRuleTextBlocked,
+	}, {
+		name: "nested",
+		in: "!#if !adguard\n" +
+			"!#if adguard\n" +
+			testRuleTextBlocked +
+			"!#else\n" +
+			testRuleTextBlocked +
+			"!#endif\n" +
+			"!#endif\n" +
+			testRuleTextBlocked2,
+		wantDst: testRuleTextBlocked2,
+	}, {
+		name:    "bad_condition",
+		in:      "!#if (adguard\n" + testRuleTextBlocked + "!#endif\n",
+		wantDst: "",
+	}, {
+		name:    "unbalanced_endif",
+		in:      "!#endif\n" + testRuleTextBlocked,
+		wantDst: testRuleTextBlocked,
+	}, {
+		name: "safari_cb_affinity",
+		in: "!#safari_cb_affinity(general)\n" +
+			testRuleTextBlocked +
+			"!#safari_cb_affinity\n",
+		wantDst: testRuleTextBlocked,
+	}, {
+		name:    "include_disabled",
+		in:      "!#include other.txt\n" + testRuleTextBlocked,
+		wantDst: testRuleTextBlocked,
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			dst := &bytes.Buffer{}
+			buf := make([]byte, rulelist.DefaultRuleBufSize)
+
+			p := rulelist.NewParser()
+			r, err := p.Parse(dst, strings.NewReader(tc.in), buf)
+			require.NoError(t, err)
+			require.NotNil(t, r)
+
+			assert.Equal(t, tc.wantDst, dst.String())
+		})
+	}
+}
+
+// testIncluder is a [rulelist.Includer] for tests.
+type testIncluder struct {
+	lists map[string]string
+}
+
+// type check
+var _ rulelist.Includer = (*testIncluder)(nil)
+
+// Open implements the [rulelist.Includer] interface for *testIncluder.
+func (i *testIncluder) Open(u *url.URL) (rc io.ReadCloser, err error) {
+	data, ok := i.lists[u.String()]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return io.NopCloser(strings.NewReader(data)), nil
+}
+
+func TestParser_Parse_include(t *testing.T) {
+	t.Parallel()
+
+	baseURL := &url.URL{
+		Scheme: "https",
+		Host:   "lists.example",
+		Path:   "/filters/main.txt",
+	}
+
+	includer := &testIncluder{
+		lists: map[string]string{
+			"https://lists.example/filters/part.txt": "! Title: Ignored\n" +
+				testRuleTextBlocked2,
+			"https://lists.example/filters/nested.txt": "!#include part.txt\n",
+			"https://lists.example/filters/cycle.txt":  "!#include main.txt\n",
+			"https://lists.example/filters/deep.txt":   "!#include deep-2.txt\n",
+			"https://lists.example/filters/deep-2.txt": "!#include part.txt\n",
+			"https://lists.example/filters/cond.txt": "!#if !adguard\n" +
+				"!#include missing.txt\n" +
+				"!#endif\n",
+		},
+	}
+
+	testCases := []struct {
+		name         string
+		in           string
+		wantDst      string
+		wantErrMsg   string
+		maxDepth     uint
+		wantRulesNum int
+	}{{
+		name:         "simple",
+		in:           testRuleTextTitle + testRuleTextBlocked + "!#include part.txt\n",
+		wantDst:      testRuleTextBlocked + testRuleTextBlocked2,
+		wantErrMsg:   "",
+		maxDepth:     0,
+		wantRulesNum: 2,
+	}, {
+		name:         "absolute",
+		in:           "!#include https://lists.example/filters/part.txt\n",
+		wantDst:      testRuleTextBlocked2,
+		wantErrMsg:   "",
+		maxDepth:     0,
+		wantRulesNum: 1,
+	}, {
+		name:         "nested",
+		in:           "!#include nested.txt\n",
+		wantDst:      testRuleTextBlocked2,
+		wantErrMsg:   "",
+		maxDepth:     0,
+		wantRulesNum: 1,
+	}, {
+		name:         "conditional",
+		in:           "!#include cond.txt\n",
+		wantDst:      "",
+		wantErrMsg:   "",
+		maxDepth:     0,
+		wantRulesNum: 0,
+	}, {
+		name:         "other_origin",
+		in:           "!#include https://other.example/filters/part.txt\n",
+		wantDst:      "",
+		wantErrMsg:   `line 1: including "https://other.example/filters/part.txt": ` + "included list must have the same origin",
+		maxDepth:     0,
+		wantRulesNum: 0,
+	}, {
+		name:         "cycle",
+		in:           "!#include cycle.txt\n",
+		wantDst:      "",
+		wantErrMsg:   `line 1: including "cycle.txt": ` + `line 1: including "main.txt": include cycle`,
+		maxDepth:     0,
+		wantRulesNum: 0,
+	}, {
+		name:    "too_deep",
+		in:      "!#include deep.txt\n",
+		wantDst: "",
+		wantErrMsg: `line 1: including "deep.txt": ` +
+			`line 1: including "deep-2.txt": include depth exceeded: max 1`,
+		maxDepth:     1,
+		wantRulesNum: 0,
+	}, {
+		name:         "missing",
+		in:           "!#include missing.txt\n",
+		wantDst:      "",
+		wantErrMsg:   `line 1: including "missing.txt": opening: file does not exist`,
+		maxDepth:     0,
+		wantRulesNum: 0,
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			dst := &bytes.Buffer{}
+			buf := make([]byte, rulelist.DefaultRuleBufSize)
+
+			p := rulelist.NewIncludingParser(&rulelist.IncludeConfig{
+				Includer: includer,
+				BaseURL:  baseURL,
+				MaxDepth: tc.maxDepth,
+			})
+			r, err := p.Parse(dst, strings.NewReader(tc.in), buf)
+			require.NotNil(t, r)
+
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			assert.Equal(t, tc.wantDst, dst.String())
+			assert.Equal(t, tc.wantRulesNum, r.RulesCount)
+		})
+	}
+}
+
+func TestParser_Parse_includeFile(t *testing.T) {
+	t.Parallel()
+
+	baseURL := &url.URL{
+		Scheme: "file",
+		Path:   "/lists/main.txt",
+	}
+
+	includer := &testIncluder{
+		lists: map[string]string{
+			"file:///lists/parts/part.txt": testRuleTextBlocked,
+			"file:///etc/passwd":           testRuleTextBlocked2,
+		},
+	}
+
+	p := rulelist.NewIncludingParser(&rulelist.IncludeConfig{
+		Includer: includer,
+		BaseURL:  baseURL,
+	})
+
+	dst := &bytes.Buffer{}
+	buf := make([]byte, rulelist.DefaultRuleBufSize)
+	_, err := p.Parse(dst, strings.NewReader("!#include parts/part.txt\n"), buf)
+	require.NoError(t, err)
+
+	assert.Equal(t, testRuleTextBlocked, dst.String())
+
+	dst.Reset()
+	_, err = p.Parse(dst, strings.NewReader("!#include ../etc/passwd\n"), buf)
+	testutil.AssertErrorMsg(
+		t,
+		`line 1: including "../etc/passwd": included list must have the same origin`,
+		err,
+	)
+}
@@ -3,27 +3,65 @@ package rulelist
 import (
 	"bufio"
 	"bytes"
+	// #nosec G501 -- MD5 is required by the format of the "! Checksum:"
+	// header.
+	"crypto/md5"
+	"encoding"
+	"encoding/base64"
 	"fmt"
+	"hash"
 	"hash/crc32"
 	"io"
+	"regexp"
 	"slices"
+	"strings"
 
 	"github.com/AdguardTeam/golibs/errors"
 )
 
 // Parser is a filtering-rule parser that collects data, such as the checksum
-// and the title, as well as counts rules and removes comments.
+// and the title, as well as counts rules and removes comments.  It also
+// evaluates the preprocessor directives.
 type Parser struct {
-	title      string
-	rulesCount int
-	written    int
-	checksum   uint32
-	titleFound bool
+	// includes is the configuration for the !#include directive.  If it is
+	// nil, including lists is not supported.
+	includes *IncludeConfig
+
+	// includeStack contains the URLs of the included lists currently being
+	// parsed.  It is used to detect include cycles.
+	includeStack []string
+
+	// contentHash is the MD5 hash of the top-level list contents used to
+	// verify the "! Checksum:" header.
+	contentHash hash.Hash
+
+	title          string
+	checksumHeader string
+	hashedLines    int
+	rulesCount     int
+	written        int
+	checksum       uint32
+	titleFound     bool
 }
 
-// NewParser returns a new filtering-rule parser.
+// NewParser returns a new filtering-rule parser.  The returned parser ignores
+// the !#include directives.
 func NewParser() (p *Parser) {
-	return &Parser{}
+	return &Parser{
+		// #nosec G401 -- See the comment on the import.
+		contentHash: md5.New(),
+	}
+}
+
+// NewIncludingParser returns a new filtering-rule parser that expands the
+// !#include directives using c.  c must not be nil.
+func NewIncludingParser(c *IncludeConfig) (p *Parser) {
+	return &Parser{
+		includes:     c,
+		includeStack: []string{c.BaseURL.String()},
+		// #nosec G401 -- See the comment on the import.
+		contentHash: md5.New(),
+	}
 }
 
 // ParseResult contains information about the results of parsing a
@@ -39,14 +77,53 @@ type ParseResult struct {
 	// BytesWritten is the number of bytes written to dst.
 	BytesWritten int
 
+	// ChecksumHeader is the value of the "! Checksum:" header of the list, if
+	// any.
+	ChecksumHeader string
+
 	// Checksum is the CRC-32 checksum of the rules content.  That is, excluding
 	// empty lines and comments.
 	Checksum uint32
+
+	// checksumHeaderValid is true if ChecksumHeader matches the contents of
+	// the list.
+	checksumHeaderValid bool
+}
+
+// Errors returned by [ParseResult.VerifyChecksumHeader].
+const (
+	ErrNoChecksumHeader errors.Error = "no checksum header"
+	ErrChecksumHeader   errors.Error = "checksum header mismatch"
+)
+
+// VerifyChecksumHeader returns an error if the list has no "! Checksum:" header
+// or if it doesn't match the contents of the list.
+func (r *ParseResult) VerifyChecksumHeader() (err error) {
+	if r.ChecksumHeader == "" {
+		return ErrNoChecksumHeader
+	} else if !r.checksumHeaderValid {
+		return ErrChecksumHeader
+	}
+
+	return nil
 }
 
 // Parse parses data from src into dst using buf during parsing.  r is never
 // nil.
 func (p *Parser) Parse(dst io.Writer, src io.Reader, buf []byte) (r *ParseResult, err error) {
+	s := &source{}
+	if p.includes != nil {
+		s.url = p.includes.BaseURL
+	}
+
+	err = p.parse(dst, src, buf, s)
+
+	return p.result(), err
+}
+
+// parse parses data of the filtering-rule list src into dst using buf during
+// parsing.
+func (p *Parser) parse(dst io.Writer, src io.Reader, buf []byte, srcState *source) (err error) {
 	s := bufio.NewScanner(src)
 
 	// Don't use [DefaultRuleBufSize] as the maximum size, since some
@@ -63,42 +140,128 @@ func (p *Parser) Parse(dst io.Writer, src io.Reader, buf []byte) (r *ParseResult
 	lineNum := 1
 	for s.Scan() {
 		var n int
-		n, err = p.processLine(dst, s.Bytes(), lineNum)
+		n, err = p.processLine(dst, srcState, s.Bytes(), lineNum, buf)
 		p.written += n
 		if err != nil {
 			// Don't wrap the error, because it's informative enough as is.
-			return p.result(), err
+			return err
 		}
 
 		lineNum++
 	}
 
-	r = p.result()
-	err = s.Err()
-
-	return r, errors.Annotate(err, "scanning filter contents: %w")
+	return errors.Annotate(s.Err(), "scanning filter contents: %w")
 }
 
 // result returns the current parsing result.
 func (p *Parser) result() (r *ParseResult) {
 	return &ParseResult{
-		Title:        p.title,
-		RulesCount:   p.rulesCount,
-		BytesWritten: p.written,
-		Checksum:     p.checksum,
+		Title:               p.title,
+		RulesCount:          p.rulesCount,
+		BytesWritten:        p.written,
+		ChecksumHeader:      p.checksumHeader,
+		Checksum:            p.checksum,
+		checksumHeaderValid: p.isChecksumHeaderValid(),
+	}
+}
+
+// checksumHeaderRe matches the "! Checksum:" header of a filtering-rule list.
+//
+// See https://hg.adblockplus.org/adblockplus/file/tip/addChecksum.py.
+var checksumHeaderRe = regexp.MustCompile(`(?i)^\s*!\s*checksum[\s\-:]+([\w+/=]+)`)
+
+// hashLine adds line from the top-level list to the hash used to verify the
+// "! Checksum:" header.  The hash is calculated the same way Adblock Plus does
+// it, that is, over the contents without the header and empty lines.
+func (p *Parser) hashLine(line []byte) {
+	if len(line) == 0 {
+		return
+	}
+
+	if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 && trimmed[0] == '!' {
+		m := checksumHeaderRe.FindSubmatch(line)
+		if m != nil {
+			if p.checksumHeader == "" {
+				p.checksumHeader = string(m[1])
+			}
+
+			return
+		}
+	}
+
+	if p.hashedLines > 0 {
+		_, _ = p.contentHash.Write([]byte{'\n'})
+	}
+
+	_, _ = p.contentHash.Write(line)
+	p.hashedLines++
+}
+
+// isChecksumHeaderValid returns true if the "! Checksum:" header matches the
+// contents.  Since the parser doesn't know if the contents ended with a
+// newline, both variants are considered valid.
+func (p *Parser) isChecksumHeaderValid() (ok bool) {
+	if p.checksumHeader == "" {
+		return false
+	}
+
+	want := strings.TrimRight(p.checksumHeader, "=")
+	if encodeChecksum(p.contentHash.Sum(nil)) == want {
+		return true
+	}
+
+	state, err := p.contentHash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		// Should never happen, since MD5 is always marshalable.
+		panic(err)
 	}
+
+	// #nosec G401 -- See the comment on the import.
+	h := md5.New()
+	err = h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+	if err != nil {
+		// Should never happen, since the state has just been marshaled.
+		panic(err)
+	}
+
+	_, _ = h.Write([]byte{'\n'})
+
+	return encodeChecksum(h.Sum(nil)) == want
+}
+
+// encodeChecksum encodes sum the way it is encoded in "! Checksum:" headers.
+func encodeChecksum(sum []byte) (s string) {
+	return base64.RawStdEncoding.EncodeToString(sum)
 }
 
-// processLine processes a single line.  It may write to dst, and if it does, n
-// is the number of bytes written.
-func (p *Parser) processLine(dst io.Writer, line []byte, lineNum int) (n int, err error) {
+// processLine processes a single line from s.  It may write to dst, and if it
+// does, n is the number of bytes written.  buf is the buffer used to scan s.
+func (p *Parser) processLine(
+	dst io.Writer,
+	s *source,
+	line []byte,
+	lineNum int,
+	buf []byte,
+) (n int, err error) {
+	if s.depth == 0 {
+		p.hashLine(line)
+	}
+
 	trimmed := bytes.TrimSpace(line)
-	if p.written == 0 && isHTMLLine(trimmed) {
+	if !s.hasRules && isHTMLLine(trimmed) {
 		return 0, ErrHTML
 	}
 
+	if bytes.HasPrefix(trimmed, []byte(directivePrefix)) {
+		err = p.processDirective(dst, s, trimmed, buf)
+
+		return 0, errors.Annotate(err, "line %d: %w", lineNum)
+	} else if !s.isActive() {
+		return 0, nil
+	}
+
 	badIdx, isRule := 0, false
-	if p.titleFound {
+	if p.titleFound || s.depth > 0 {
 		badIdx, isRule = parseLine(trimmed)
 	} else {
 		badIdx, isRule = p.parseLineTitle(trimmed)
@@ -116,6 +279,7 @@ func (p *Parser) processLine(dst io.Writer, line []byte, lineNum int) (n int, er
 		return 0, nil
 	}
 
+	s.hasRules = true
 	p.rulesCount++
 	p.checksum = crc32.Update(p.checksum, crc32.IEEETable, trimmed)
 
@@ -203,6 +203,52 @@ func TestParser_Parse_checksums(t *testing.T) {
 	assert.Equal(t, gotWithoutComments, gotWithComments)
 }
 
+func TestParseResult_VerifyChecksumHeader(t *testing.T) {
+	t.Parallel()
+
+	const (
+		header  = "[Adblock Plus 2.0]\n"
+		content = testRuleTextBlocked
+	)
+
+	testCases := []struct {
+		name       string
+		in         string
+		wantErrMsg string
+	}{{
+		name:       "valid",
+		in:         header + "! Checksum: kHQDao0L0FVs3246AMzy7Q\n" + content,
+		wantErrMsg: "",
+	}, {
+		name:       "valid_no_trailing_newline",
+		in:         header + "! Checksum: kHQDao0L0FVs3246AMzy7Q\n" + content + "\n\n",
+		wantErrMsg: "",
+	}, {
+		name:       "mismatch",
+		in:         header + "! Checksum: kHQDao0L0FVs3246AMzy7Q\n" + content + testRuleTextBlocked2,
+		wantErrMsg: rulelist.ErrChecksumHeader.Error(),
+	}, {
+		name:       "no_header",
+		in:         header + content,
+		wantErrMsg: rulelist.ErrNoChecksumHeader.Error(),
+	}}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			buf := make([]byte, rulelist.DefaultRuleBufSize)
+
+			p := rulelist.NewParser()
+			r, err := p.Parse(&bytes.Buffer{}, strings.NewReader(tc.in), buf)
+			require.NoError(t, err)
+
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, r.VerifyChecksumHeader())
+		})
+	}
+}
+
 var (
 	resSink *rulelist.ParseResult
 	errSink error
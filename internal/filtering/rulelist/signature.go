@@ -0,0 +1,368 @@
+package rulelist
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ssh"
+)
+
+// SignatureVerifier verifies a detached signature of a filtering-rule list.
+// The data of the list is written into it, and then [SignatureVerifier.Verify]
+// is called.
+type SignatureVerifier interface {
+	// Writer is used to write the list data to verify.
+	io.Writer
+
+	// Verify returns an error if the signature doesn't match the data written
+	// so far.
+	Verify() (err error)
+}
+
+// ErrSignature is returned by [SignatureVerifier.Verify] when the signature
+// is invalid.
+const ErrSignature errors.Error = "signature verification failed"
+
+// Extensions of the detached signature files appended to the URL of the
+// filtering-rule list.
+const (
+	minisignExt = ".minisig"
+	sshSigExt   = ".sig"
+)
+
+// SignatureURL returns the URL of the detached signature for the
+// filtering-rule list located at listURL verified by pubKey.  Minisign
+// signatures are expected to have the ".minisig" extension, and SSH ones, the
+// ".sig" extension.
+func SignatureURL(listURL, pubKey string) (sigURL string) {
+	if isSSHPublicKey(pubKey) {
+		return listURL + sshSigExt
+	}
+
+	return listURL + minisignExt
+}
+
+// NewSignatureVerifier returns a new verifier of the detached signature sig
+// made with the private key corresponding to pubKey.  pubKey is either a
+// minisign public key, with or without the untrusted comment line, or an SSH
+// public key in the authorized_keys format.
+func NewSignatureVerifier(pubKey string, sig []byte) (v SignatureVerifier, err error) {
+	if isSSHPublicKey(pubKey) {
+		v, err = newSSHVerifier(pubKey, sig)
+
+		return v, errors.Annotate(err, "ssh: %w")
+	}
+
+	v, err = newMinisignVerifier(pubKey, sig)
+
+	return v, errors.Annotate(err, "minisign: %w")
+}
+
+// isSSHPublicKey returns true if pubKey looks like an SSH public key in the
+// authorized_keys format.
+func isSSHPublicKey(pubKey string) (ok bool) {
+	pubKey = strings.TrimSpace(pubKey)
+
+	return strings.HasPrefix(pubKey, "ssh-") ||
+		strings.HasPrefix(pubKey, "ecdsa-") ||
+		strings.HasPrefix(pubKey, "sk-")
+}
+
+// Minisign algorithm identifiers.
+const (
+	minisignAlgLegacy    = "Ed"
+	minisignAlgPrehashed = "ED"
+)
+
+// Minisign key and signature sizes.
+const (
+	minisignKeyIDLen  = 8
+	minisignPubKeyLen = 2 + minisignKeyIDLen + ed25519.PublicKeySize
+	minisignSigLen    = 2 + minisignKeyIDLen + ed25519.SignatureSize
+)
+
+// minisignVerifier is a [SignatureVerifier] for minisign signatures.
+//
+// See https://jedisct1.github.io/minisign/#signature-format.
+type minisignVerifier struct {
+	// hash is the BLAKE2b-512 hash of the data for prehashed signatures.  It
+	// is nil for legacy signatures.
+	hash hash.Hash
+
+	// buf accumulates the data for legacy signatures.  It is nil for
+	// prehashed signatures.
+	buf *bytes.Buffer
+
+	pubKey         ed25519.PublicKey
+	sig            []byte
+	globalSig      []byte
+	trustedComment string
+}
+
+// newMinisignVerifier returns a new minisign signature verifier.
+func newMinisignVerifier(pubKey string, sigData []byte) (v *minisignVerifier, err error) {
+	key, err := decodeMinisign(lastLine(pubKey), minisignPubKeyLen)
+	if err != nil {
+		return nil, fmt.Errorf("public key: %w", err)
+	} else if alg := string(key[:2]); alg != minisignAlgLegacy {
+		return nil, fmt.Errorf("public key: bad algorithm %q", alg)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(sigData)), "\n")
+	if len(lines) != 4 {
+		return nil, fmt.Errorf("signature: got %d lines, want 4", len(lines))
+	}
+
+	sig, err := decodeMinisign(lines[1], minisignSigLen)
+	if err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+
+	if !bytes.Equal(key[2:2+minisignKeyIDLen], sig[2:2+minisignKeyIDLen]) {
+		return nil, errors.Error("signature: key id mismatch")
+	}
+
+	const trustedPrefix = "trusted comment: "
+	trustedComment, ok := strings.CutPrefix(strings.TrimRight(lines[2], "\r"), trustedPrefix)
+	if !ok {
+		return nil, errors.Error("signature: no trusted comment")
+	}
+
+	globalSig, err := decodeMinisign(lines[3], ed25519.SignatureSize)
+	if err != nil {
+		return nil, fmt.Errorf("global signature: %w", err)
+	}
+
+	v = &minisignVerifier{
+		pubKey:         key[2+minisignKeyIDLen:],
+		sig:            sig,
+		globalSig:      globalSig,
+		trustedComment: trustedComment,
+	}
+
+	switch alg := string(sig[:2]); alg {
+	case minisignAlgLegacy:
+		v.buf = &bytes.Buffer{}
+	case minisignAlgPrehashed:
+		v.hash, err = blake2b.New512(nil)
+		if err != nil {
+			// Should never happen, since there is no key.
+			panic(err)
+		}
+	default:
+		return nil, fmt.Errorf("signature: bad algorithm %q", alg)
+	}
+
+	return v, nil
+}
+
+// lastLine returns the last non-empty line of s trimmed of whitespace.
+func lastLine(s string) (l string) {
+	s = strings.TrimSpace(s)
+
+	return strings.TrimSpace(s[strings.LastIndexByte(s, '\n')+1:])
+}
+
+// decodeMinisign decodes a base64-encoded line of a minisign file and checks
+// its length.
+func decodeMinisign(line string, wantLen int) (b []byte, err error) {
+	b, err = base64.StdEncoding.DecodeString(strings.TrimSpace(line))
+	if err != nil {
+		return nil, fmt.Errorf("decoding: %w", err)
+	} else if len(b) != wantLen {
+		return nil, fmt.Errorf("got length %d, want %d", len(b), wantLen)
+	}
+
+	return b, nil
+}
+
+// type check
+var _ SignatureVerifier = (*minisignVerifier)(nil)
+
+// Write implements the [SignatureVerifier] interface for *minisignVerifier.
+func (v *minisignVerifier) Write(b []byte) (n int, err error) {
+	if v.hash != nil {
+		return v.hash.Write(b)
+	}
+
+	return v.buf.Write(b)
+}
+
+// Verify implements the [SignatureVerifier] interface for *minisignVerifier.
+func (v *minisignVerifier) Verify() (err error) {
+	var msg []byte
+	if v.hash != nil {
+		msg = v.hash.Sum(nil)
+	} else {
+		msg = v.buf.Bytes()
+	}
+
+	sig := v.sig[2+minisignKeyIDLen:]
+	if !ed25519.Verify(v.pubKey, msg, sig) {
+		return ErrSignature
+	}
+
+	globalMsg := append(slices.Clone(sig), v.trustedComment...)
+	if !ed25519.Verify(v.pubKey, globalMsg, v.globalSig) {
+		return fmt.Errorf("%w: bad trusted comment signature", ErrSignature)
+	}
+
+	return nil
+}
+
+// SSH signature constants.
+//
+// See https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.sshsig.
+const (
+	sshSigMagic     = "SSHSIG"
+	sshSigVersion   = 1
+	sshSigNamespace = "file"
+	sshSigArmorHead = "-----BEGIN SSH SIGNATURE-----"
+	sshSigArmorTail = "-----END SSH SIGNATURE-----"
+)
+
+// sshSigBlob is the wire format of an SSH signature without the magic
+// preamble.
+type sshSigBlob struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// sshSignedData is the wire format of the data signed by an SSH signature
+// without the magic preamble.
+type sshSignedData struct {
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Hash          []byte
+}
+
+// sshVerifier is a [SignatureVerifier] for SSH signatures created with
+// "ssh-keygen -Y sign -n file".
+type sshVerifier struct {
+	pubKey ssh.PublicKey
+	hash   hash.Hash
+	blob   *sshSigBlob
+	sig    *ssh.Signature
+}
+
+// newSSHVerifier returns a new SSH signature verifier.
+func newSSHVerifier(pubKey string, sigData []byte) (v *sshVerifier, err error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKey))
+	if err != nil {
+		return nil, fmt.Errorf("public key: %w", err)
+	}
+
+	armored := strings.TrimSpace(string(sigData))
+	armored, ok := strings.CutPrefix(armored, sshSigArmorHead)
+	if !ok {
+		return nil, errors.Error("signature: no armor header")
+	}
+
+	armored, ok = strings.CutSuffix(armored, sshSigArmorTail)
+	if !ok {
+		return nil, errors.Error("signature: no armor footer")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(armored), ""))
+	if err != nil {
+		return nil, fmt.Errorf("signature: decoding: %w", err)
+	}
+
+	raw, ok = bytes.CutPrefix(raw, []byte(sshSigMagic))
+	if !ok {
+		return nil, errors.Error("signature: bad magic")
+	}
+
+	blob := &sshSigBlob{}
+	err = ssh.Unmarshal(raw, blob)
+	if err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+
+	err = validateSSHSigBlob(blob, key)
+	if err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+
+	sig := &ssh.Signature{}
+	err = ssh.Unmarshal(blob.Signature, sig)
+	if err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+
+	v = &sshVerifier{
+		pubKey: key,
+		blob:   blob,
+		sig:    sig,
+	}
+
+	switch blob.HashAlgorithm {
+	case "sha256":
+		v.hash = sha256.New()
+	case "sha512":
+		v.hash = sha512.New()
+	default:
+		return nil, fmt.Errorf("signature: bad hash algorithm %q", blob.HashAlgorithm)
+	}
+
+	return v, nil
+}
+
+// validateSSHSigBlob returns an error if blob is not a signature of a file made
+// with key.
+func validateSSHSigBlob(blob *sshSigBlob, key ssh.PublicKey) (err error) {
+	if blob.Version != sshSigVersion {
+		return fmt.Errorf("bad version %d", blob.Version)
+	} else if blob.Namespace != sshSigNamespace {
+		return fmt.Errorf("bad namespace %q, want %q", blob.Namespace, sshSigNamespace)
+	}
+
+	sigKey, err := ssh.ParsePublicKey(blob.PublicKey)
+	if err != nil {
+		return fmt.Errorf("public key: %w", err)
+	} else if !bytes.Equal(sigKey.Marshal(), key.Marshal()) {
+		return errors.Error("public key mismatch")
+	}
+
+	return nil
+}
+
+// type check
+var _ SignatureVerifier = (*sshVerifier)(nil)
+
+// Write implements the [SignatureVerifier] interface for *sshVerifier.
+func (v *sshVerifier) Write(b []byte) (n int, err error) {
+	return v.hash.Write(b)
+}
+
+// Verify implements the [SignatureVerifier] interface for *sshVerifier.
+func (v *sshVerifier) Verify() (err error) {
+	signed := append([]byte(sshSigMagic), ssh.Marshal(&sshSignedData{
+		Namespace:     v.blob.Namespace,
+		Reserved:      v.blob.Reserved,
+		HashAlgorithm: v.blob.HashAlgorithm,
+		Hash:          v.hash.Sum(nil),
+	})...)
+
+	err = v.pubKey.Verify(signed, v.sig)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrSignature, err)
+	}
+
+	return nil
+}
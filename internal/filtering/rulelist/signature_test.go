@@ -0,0 +1,179 @@
+package rulelist_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering/rulelist"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/ssh"
+)
+
+// testListData is the common filtering-rule list data for signature tests.
+const testListData = testRuleTextTitle + testRuleTextBlocked
+
+// testKeyID is the common minisign key ID for tests.
+var testKeyID = []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+// newMinisignKey returns a new Ed25519 key pair along with the minisign public
+// key encoded for use in the configuration.
+func newMinisignKey(t *testing.T) (pubKey string, priv ed25519.PrivateKey) {
+	t.Helper()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	keyData := append(append([]byte("Ed"), testKeyID...), pub...)
+	pubKey = "untrusted comment: minisign public key\n" +
+		base64.StdEncoding.EncodeToString(keyData) + "\n"
+
+	return pubKey, priv
+}
+
+// signMinisign returns the minisign signature of data made with priv.  If
+// prehashed is true, the data is prehashed with BLAKE2b-512.
+func signMinisign(priv ed25519.PrivateKey, data string, prehashed bool) (sig []byte) {
+	alg, msg := "Ed", []byte(data)
+	if prehashed {
+		sum := blake2b.Sum512(msg)
+		alg, msg = "ED", sum[:]
+	}
+
+	dataSig := ed25519.Sign(priv, msg)
+
+	const trustedComment = "timestamp:1700000000"
+	globalSig := ed25519.Sign(priv, append(slices.Clone(dataSig), trustedComment...))
+
+	return []byte("untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte(alg), testKeyID...), dataSig...)) + "\n" +
+		"trusted comment: " + trustedComment + "\n" +
+		base64.StdEncoding.EncodeToString(globalSig) + "\n")
+}
+
+// signSSH returns the SSH signature of data made with signer in the "file"
+// namespace.
+func signSSH(t *testing.T, signer ssh.Signer, data string) (sig []byte) {
+	t.Helper()
+
+	hash := sha512.Sum512([]byte(data))
+	signed := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{
+		Namespace:     "file",
+		HashAlgorithm: "sha512",
+		Hash:          hash[:],
+	})...)
+
+	s, err := signer.Sign(rand.Reader, signed)
+	require.NoError(t, err)
+
+	blob := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}{
+		Version:       1,
+		PublicKey:     signer.PublicKey().Marshal(),
+		Namespace:     "file",
+		HashAlgorithm: "sha512",
+		Signature:     ssh.Marshal(s),
+	})...)
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  "SSH SIGNATURE",
+		Bytes: blob,
+	})
+}
+
+// verify writes data into a new verifier and verifies it.
+func verify(t *testing.T, pubKey string, sig []byte, data string) (err error) {
+	t.Helper()
+
+	v, err := rulelist.NewSignatureVerifier(pubKey, sig)
+	require.NoError(t, err)
+
+	_, err = io.WriteString(v, data)
+	require.NoError(t, err)
+
+	return v.Verify()
+}
+
+func TestSignatureVerifier_minisign(t *testing.T) {
+	t.Parallel()
+
+	pubKey, priv := newMinisignKey(t)
+
+	for _, prehashed := range []bool{true, false} {
+		sig := signMinisign(priv, testListData, prehashed)
+
+		err := verify(t, pubKey, sig, testListData)
+		assert.NoError(t, err)
+
+		err = verify(t, pubKey, sig, testListData+testRuleTextBlocked2)
+		assert.ErrorIs(t, err, rulelist.ErrSignature)
+	}
+
+	otherPubKey, _ := newMinisignKey(t)
+	err := verify(t, otherPubKey, signMinisign(priv, testListData, true), testListData)
+	assert.ErrorIs(t, err, rulelist.ErrSignature)
+
+	_, err = rulelist.NewSignatureVerifier(pubKey, []byte("bad signature"))
+	testutil.AssertErrorMsg(t, "minisign: signature: got 1 lines, want 4", err)
+}
+
+func TestSignatureVerifier_ssh(t *testing.T) {
+	t.Parallel()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+
+	pubKey := string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+	sig := signSSH(t, signer, testListData)
+
+	err = verify(t, pubKey, sig, testListData)
+	assert.NoError(t, err)
+
+	err = verify(t, pubKey, sig, testListData+testRuleTextBlocked2)
+	assert.ErrorIs(t, err, rulelist.ErrSignature)
+
+	_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	otherSigner, err := ssh.NewSignerFromKey(otherPriv)
+	require.NoError(t, err)
+
+	otherPubKey := string(ssh.MarshalAuthorizedKey(otherSigner.PublicKey()))
+	_, err = rulelist.NewSignatureVerifier(otherPubKey, sig)
+	testutil.AssertErrorMsg(t, "ssh: signature: public key mismatch", err)
+}
+
+func TestSignatureURL(t *testing.T) {
+	t.Parallel()
+
+	const listURL = "https://lists.example/list.txt"
+
+	pubKey, _ := newMinisignKey(t)
+	assert.Equal(t, listURL+".minisig", rulelist.SignatureURL(listURL, pubKey))
+
+	sshKey := "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIE test@example"
+	assert.True(t, strings.HasSuffix(rulelist.SignatureURL(listURL, sshKey), ".sig"))
+}
@@ -0,0 +1,233 @@
+package filtering
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/urlfilter/rules"
+)
+
+// Severities of rule diagnostics.
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// ruleDiagnostic is a problem found in a single line of custom filtering
+// rules.
+type ruleDiagnostic struct {
+	// Rule is the text of the line.
+	Rule string `json:"rule"`
+
+	// Severity is the severity of the problem, either severityError or
+	// severityWarning.  Rules with errors are dropped when the rules are
+	// compiled.
+	Severity string `json:"severity"`
+
+	// Message is the human-readable description of the problem.
+	Message string `json:"message"`
+
+	// Line is the one-based number of the line.
+	Line int `json:"line"`
+}
+
+// validateRulesResp is the response to the POST
+// /control/filtering/validate_rules HTTP API.
+type validateRulesResp struct {
+	Diagnostics []*ruleDiagnostic `json:"diagnostics"`
+}
+
+// parsedRule is a successfully parsed rule along with its line number.
+type parsedRule struct {
+	// rule is the parsed rule.
+	rule rules.Rule
+
+	// domain is the domain of a rule of the "||domain^" form without
+	// modifiers.  It is empty for all other rules.
+	domain string
+
+	// line is the one-based number of the line.
+	line int
+}
+
+// validateRules returns the diagnostics for the lines of custom filtering
+// rules.  It uses the same parser as the filtering engine, so the rules with
+// errors are exactly the ones that are dropped during compilation.
+func validateRules(lines []string) (diags []*ruleDiagnostic) {
+	diags = []*ruleDiagnostic{}
+	seen := make(map[string]int, len(lines))
+
+	var parsed []*parsedRule
+	for i, text := range lines {
+		lineNum := i + 1
+		text = strings.TrimSpace(text)
+
+		r, diag := validateRule(text, lineNum, seen)
+		if diag != nil {
+			diags = append(diags, diag)
+
+			continue
+		} else if r == nil {
+			// Empty line or comment.
+			continue
+		}
+
+		seen[text] = lineNum
+		parsed = append(parsed, &parsedRule{
+			rule:   r,
+			domain: plainRuleDomain(r),
+			line:   lineNum,
+		})
+	}
+
+	byDomain := map[string][]*parsedRule{}
+	for _, p := range parsed {
+		if p.domain != "" {
+			byDomain[p.domain] = append(byDomain[p.domain], p)
+		}
+	}
+
+	for _, p := range parsed {
+		diag := shadowingDiagnostic(p, byDomain)
+		if diag != nil {
+			diags = append(diags, diag)
+		}
+	}
+
+	slices.SortStableFunc(diags, func(a, b *ruleDiagnostic) (res int) {
+		return cmp.Compare(a.Line, b.Line)
+	})
+
+	return diags
+}
+
+// validateRule parses a single line of custom filtering rules.  It returns
+// a non-nil diag if there is a problem with the line.  r is nil for empty lines
+// and comments.  seen contains the line numbers of the valid rules seen so far.
+func validateRule(
+	text string,
+	lineNum int,
+	seen map[string]int,
+) (r rules.Rule, diag *ruleDiagnostic) {
+	diag = &ruleDiagnostic{
+		Rule:     text,
+		Severity: severityWarning,
+		Line:     lineNum,
+	}
+
+	if prev, ok := seen[text]; ok {
+		diag.Message = fmt.Sprintf("duplicate of the rule on line %d", prev)
+
+		return nil, diag
+	}
+
+	r, err := rules.NewRule(text, CustomListID)
+	if err != nil {
+		diag.Severity, diag.Message = severityError, err.Error()
+
+		return nil, diag
+	}
+
+	switch r := r.(type) {
+	case nil, *rules.HostRule:
+		return r, nil
+	case *rules.NetworkRule:
+		if !r.IsHostLevelNetworkRule() {
+			diag.Message = "rule contains modifiers not supported by DNS filtering " +
+				"and is ignored"
+
+			return nil, diag
+		}
+
+		return r, nil
+	default:
+		diag.Message = "cosmetic rules are not supported by DNS filtering and are ignored"
+
+		return nil, diag
+	}
+}
+
+// plainRuleDomain returns the domain of r if it is a network rule of the
+// "||domain^" or "@@||domain^" form without modifiers.
+func plainRuleDomain(r rules.Rule) (domain string) {
+	nr, ok := r.(*rules.NetworkRule)
+	if !ok {
+		return ""
+	}
+
+	pattern := strings.TrimPrefix(nr.Text(), "@@")
+	domain, ok = strings.CutPrefix(pattern, "||")
+	if !ok {
+		return ""
+	}
+
+	domain, ok = strings.CutSuffix(domain, "^")
+	if !ok || strings.ContainsAny(domain, "*|^$/") {
+		return ""
+	}
+
+	return domain
+}
+
+// shadowingDiagnostic returns the diagnostic for p if it is either shadowed by
+// a broader rule of the same kind, or is a blocking rule that is always
+// overridden by an allowlist rule.  Only rules without modifiers are checked.
+// byDomain contains such rules by their domains.
+func shadowingDiagnostic(p *parsedRule, byDomain map[string][]*parsedRule) (diag *ruleDiagnostic) {
+	if p.domain == "" {
+		return nil
+	}
+
+	// Only the rules for the domain itself and its parent domains may shadow
+	// it.
+	var cands []*parsedRule
+	for d := p.domain; ; {
+		cands = append(cands, byDomain[d]...)
+
+		var ok bool
+		_, d, ok = strings.Cut(d, ".")
+		if !ok {
+			break
+		}
+	}
+
+	// Report the first rule in the order of lines.
+	slices.SortFunc(cands, func(a, b *parsedRule) (res int) {
+		return cmp.Compare(a.line, b.line)
+	})
+
+	nr := p.rule.(*rules.NetworkRule)
+	for _, other := range cands {
+		if other == p {
+			continue
+		}
+
+		otherNR := other.rule.(*rules.NetworkRule)
+		switch {
+		case otherNR.Whitelist == nr.Whitelist && p.domain != other.domain:
+			return &ruleDiagnostic{
+				Rule:     nr.Text(),
+				Severity: severityWarning,
+				Message:  fmt.Sprintf("shadowed by the broader rule on line %d", other.line),
+				Line:     p.line,
+			}
+		case otherNR.Whitelist && !nr.Whitelist:
+			return &ruleDiagnostic{
+				Rule:     nr.Text(),
+				Severity: severityWarning,
+				Message: fmt.Sprintf(
+					"rule is a no-op, since it is always overridden by "+
+						"the allowlist rule on line %d",
+					other.line,
+				),
+				Line: p.line,
+			}
+		default:
+			// Go on.
+		}
+	}
+
+	return nil
+}
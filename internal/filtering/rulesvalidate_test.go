@@ -0,0 +1,133 @@
+package filtering
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateRules(t *testing.T) {
+	testCases := []struct {
+		name      string
+		lines     []string
+		wantDiags []*ruleDiagnostic
+	}{{
+		name: "valid",
+		lines: []string{
+			"! Comment",
+			"",
+			"||blocked.example^",
+			"@@||allowed.example^",
+			"0.0.0.0 hosts.example",
+			"||client.example^$client=1.2.3.4",
+		},
+		wantDiags: []*ruleDiagnostic{},
+	}, {
+		name:  "parse_error",
+		lines: []string{"||blocked.example^$unknown"},
+		wantDiags: []*ruleDiagnostic{{
+			Rule:     "||blocked.example^$unknown",
+			Severity: severityError,
+			Message:  "unknown filter modifier: unknown=",
+			Line:     1,
+		}},
+	}, {
+		name:  "unsupported_modifier",
+		lines: []string{"||blocked.example^$domain=other.example"},
+		wantDiags: []*ruleDiagnostic{{
+			Rule:     "||blocked.example^$domain=other.example",
+			Severity: severityWarning,
+			Message:  "rule contains modifiers not supported by DNS filtering and is ignored",
+			Line:     1,
+		}},
+	}, {
+		name:  "cosmetic",
+		lines: []string{"example.org##.banner"},
+		wantDiags: []*ruleDiagnostic{{
+			Rule:     "example.org##.banner",
+			Severity: severityWarning,
+			Message:  "cosmetic rules are not supported by DNS filtering and are ignored",
+			Line:     1,
+		}},
+	}, {
+		name:  "duplicate",
+		lines: []string{"||blocked.example^", "||blocked.example^"},
+		wantDiags: []*ruleDiagnostic{{
+			Rule:     "||blocked.example^",
+			Severity: severityWarning,
+			Message:  "duplicate of the rule on line 1",
+			Line:     2,
+		}},
+	}, {
+		name:  "shadowed",
+		lines: []string{"||sub.blocked.example^", "||blocked.example^"},
+		wantDiags: []*ruleDiagnostic{{
+			Rule:     "||sub.blocked.example^",
+			Severity: severityWarning,
+			Message:  "shadowed by the broader rule on line 2",
+			Line:     1,
+		}},
+	}, {
+		name:  "shadowed_deep",
+		lines: []string{"||blocked.example^", "||a.b.blocked.example^", "||notblocked.example^"},
+		wantDiags: []*ruleDiagnostic{{
+			Rule:     "||a.b.blocked.example^",
+			Severity: severityWarning,
+			Message:  "shadowed by the broader rule on line 1",
+			Line:     2,
+		}},
+	}, {
+		name:  "no_op",
+		lines: []string{"||sub.allowed.example^", "@@||allowed.example^"},
+		wantDiags: []*ruleDiagnostic{{
+			Rule:     "||sub.allowed.example^",
+			Severity: severityWarning,
+			Message: "rule is a no-op, since it is always overridden by " +
+				"the allowlist rule on line 2",
+			Line: 1,
+		}},
+	}, {
+		name:      "important",
+		lines:     []string{"||allowed.example^$important", "@@||allowed.example^"},
+		wantDiags: []*ruleDiagnostic{},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.wantDiags, validateRules(tc.lines))
+		})
+	}
+}
+
+func TestDNSFilter_handleFilteringValidateRules(t *testing.T) {
+	d, _ := newForTest(t, nil, nil)
+	t.Cleanup(d.Close)
+
+	body, err := json.Marshal(&filteringRulesReq{
+		Rules: []string{"||blocked.example^", "||blocked.example^"},
+	})
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(
+		http.MethodPost,
+		"/control/filtering/validate_rules",
+		bytes.NewReader(body),
+	)
+	w := httptest.NewRecorder()
+
+	d.handleFilteringValidateRules(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := &validateRulesResp{}
+	err = json.NewDecoder(w.Body).Decode(resp)
+	require.NoError(t, err)
+
+	require.Len(t, resp.Diagnostics, 1)
+
+	assert.Equal(t, 2, resp.Diagnostics[0].Line)
+}
@@ -31,6 +31,23 @@ type SafeSearchConfig struct {
 	Pixabay    bool `yaml:"pixabay" json:"pixabay"`
 	Yandex     bool `yaml:"yandex" json:"yandex"`
 	YouTube    bool `yaml:"youtube" json:"youtube"`
+
+	// CustomRewrites are the user-defined safe search rules.  They take
+	// precedence over the built-in rules of the services and don't depend on
+	// the service flags.
+	CustomRewrites []*SafeSearchRewrite `yaml:"custom_rewrites,omitempty" json:"custom_rewrites,omitempty"`
+}
+
+// SafeSearchRewrite is a user-defined safe search rule, which redirects the
+// queries for a domain of a search engine to its restricted version.
+type SafeSearchRewrite struct {
+	// Domain is the domain of the search engine.  A domain starting with "*."
+	// matches all subdomains of the rest of it, but not the domain itself.
+	Domain string `yaml:"domain" json:"domain"`
+
+	// Answer is either the hostname of the restricted version, which the
+	// queries are redirected to with a CNAME, or its IP address.
+	Answer string `yaml:"answer" json:"answer"`
 }
 
 // checkSafeSearch checks host with safe search engine.  Matches
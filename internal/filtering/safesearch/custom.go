@@ -0,0 +1,115 @@
+package safesearch
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/urlfilter/rules"
+	"github.com/miekg/dns"
+)
+
+// customRewrite is a compiled user-defined safe search rule.
+type customRewrite struct {
+	// domain is the domain without the wildcard prefix.
+	domain string
+
+	// cname is the hostname to redirect the queries to.  It's empty if ip is
+	// set.
+	cname string
+
+	// ip is the address to respond with.  It's invalid if cname is set.
+	ip netip.Addr
+
+	// wildcard is true if the rule matches the subdomains of domain instead
+	// of domain itself.
+	wildcard bool
+}
+
+// compileCustom validates and compiles the user-defined safe search rules.
+func compileCustom(rws []*filtering.SafeSearchRewrite) (custom []*customRewrite, err error) {
+	custom = make([]*customRewrite, 0, len(rws))
+	for i, rw := range rws {
+		var c *customRewrite
+		c, err = newCustomRewrite(rw)
+		if err != nil {
+			return nil, fmt.Errorf("custom rewrite at index %d: %w", i, err)
+		}
+
+		custom = append(custom, c)
+	}
+
+	return custom, nil
+}
+
+// newCustomRewrite validates and compiles a single user-defined safe search
+// rule.
+func newCustomRewrite(rw *filtering.SafeSearchRewrite) (c *customRewrite, err error) {
+	if rw == nil {
+		return nil, errors.Error("no value")
+	}
+
+	c = &customRewrite{}
+	c.domain, c.wildcard = strings.CutPrefix(strings.ToLower(rw.Domain), "*.")
+	err = netutil.ValidateHostname(c.domain)
+	if err != nil {
+		return nil, fmt.Errorf("domain: %w", err)
+	}
+
+	c.ip, err = netip.ParseAddr(rw.Answer)
+	if err == nil {
+		return c, nil
+	}
+
+	c.cname = strings.ToLower(rw.Answer)
+	err = netutil.ValidateHostname(c.cname)
+	if err != nil {
+		return nil, fmt.Errorf("answer: %w", err)
+	}
+
+	return c, nil
+}
+
+// matches returns true if host matches the rule.
+func (c *customRewrite) matches(host string) (ok bool) {
+	if c.wildcard {
+		return strings.HasSuffix(host, "."+c.domain)
+	}
+
+	return host == c.domain
+}
+
+// matchCustom returns the rewrite for host from the user-defined rules.  If
+// the only matching rules have IP addresses of the other protocol version, the
+// returned rewrite is empty, which means a NODATA response.  ss.mu must be
+// locked.
+func (ss *Default) matchCustom(host string, qtype rules.RRType) (res *rules.DNSRewrite) {
+	for _, c := range ss.custom {
+		if !c.matches(host) {
+			continue
+		}
+
+		if c.cname != "" {
+			return &rules.DNSRewrite{
+				NewCNAME: c.cname,
+				RCode:    dns.RcodeSuccess,
+				RRType:   dns.TypeCNAME,
+			}
+		} else if (qtype == dns.TypeA) == c.ip.Is4() {
+			return &rules.DNSRewrite{
+				Value:  c.ip,
+				RCode:  dns.RcodeSuccess,
+				RRType: qtype,
+			}
+		}
+
+		res = &rules.DNSRewrite{
+			RCode: dns.RcodeSuccess,
+		}
+	}
+
+	return res
+}
@@ -65,6 +65,10 @@ type Default struct {
 	// engine may be nil, which means that this safe search filter is disabled.
 	engine *urlfilter.DNSEngine
 
+	// custom are the compiled user-defined rules.  They are checked before the
+	// rules in engine.
+	custom []*customRewrite
+
 	cache     cache.Cache
 	resolver  filtering.Resolver
 	logPrefix string
@@ -128,6 +132,12 @@ func (ss *Default) resetEngine(
 	listID int,
 	conf filtering.SafeSearchConfig,
 ) (err error) {
+	custom, err := compileCustom(conf.CustomRewrites)
+	if err != nil {
+		// Don't wrap the error, because it's informative enough as is.
+		return err
+	}
+
 	if !conf.Enabled {
 		ss.log(log.INFO, "disabled")
 
@@ -153,8 +163,9 @@ func (ss *Default) resetEngine(
 	}
 
 	ss.engine = urlfilter.NewDNSEngine(rs)
+	ss.custom = custom
 
-	ss.log(log.INFO, "reset %d rules", ss.engine.RulesCount)
+	ss.log(log.INFO, "reset %d rules and %d custom rules", ss.engine.RulesCount, len(custom))
 
 	return nil
 }
@@ -208,8 +219,13 @@ func (ss *Default) searchHost(host string, qtype rules.RRType) (res *rules.DNSRe
 		return nil
 	}
 
+	host = strings.ToLower(host)
+	if rw := ss.matchCustom(host, qtype); rw != nil {
+		return rw
+	}
+
 	r, _ := ss.engine.MatchRequest(&urlfilter.DNSRequest{
-		Hostname: strings.ToLower(host),
+		Hostname: host,
 		DNSType:  qtype,
 	})
 
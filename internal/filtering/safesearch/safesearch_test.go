@@ -215,3 +215,92 @@ func TestDefault_Update(t *testing.T) {
 
 	assert.False(t, res.IsFiltered)
 }
+
+func TestDefault_CheckHost_custom(t *testing.T) {
+	const strictHost = "restrict.youtube.com"
+
+	customIP := netip.MustParseAddr("192.0.2.1")
+	wantIP, _ := aghtest.HostToIPs(strictHost)
+
+	conf := testConf
+	conf.CustomResolver = &aghtest.Resolver{
+		OnLookupIP: func(_ context.Context, _, host string) (ips []net.IP, err error) {
+			ip4, ip6 := aghtest.HostToIPs(host)
+
+			return []net.IP{ip4.AsSlice(), ip6.AsSlice()}, nil
+		},
+	}
+	conf.CustomRewrites = []*filtering.SafeSearchRewrite{{
+		Domain: "www.youtube.com",
+		Answer: strictHost,
+	}, {
+		Domain: "*.search.example",
+		Answer: customIP.String(),
+	}}
+
+	ss, err := safesearch.NewDefault(conf, "", testCacheSize, testCacheTTL)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		host         string
+		wantIP       netip.Addr
+		qtype        uint16
+		wantFiltered bool
+	}{{
+		host:         "www.youtube.com",
+		wantIP:       wantIP,
+		qtype:        dns.TypeA,
+		wantFiltered: true,
+	}, {
+		host:         "www.search.example",
+		wantIP:       customIP,
+		qtype:        dns.TypeA,
+		wantFiltered: true,
+	}, {
+		host:         "www.search.example",
+		wantIP:       netip.Addr{},
+		qtype:        dns.TypeAAAA,
+		wantFiltered: true,
+	}, {
+		host:         "search.example",
+		wantIP:       netip.Addr{},
+		qtype:        dns.TypeA,
+		wantFiltered: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.host+"_"+dns.Type(tc.qtype).String(), func(t *testing.T) {
+			res, checkErr := ss.CheckHost(tc.host, tc.qtype)
+			require.NoError(t, checkErr)
+
+			assert.Equal(t, tc.wantFiltered, res.IsFiltered)
+			if !tc.wantFiltered {
+				return
+			}
+
+			require.Len(t, res.Rules, 1)
+
+			assert.Equal(t, tc.wantIP, res.Rules[0].IP)
+		})
+	}
+
+	err = ss.Update(filtering.SafeSearchConfig{
+		Enabled: true,
+		CustomRewrites: []*filtering.SafeSearchRewrite{{
+			Domain: "bad domain",
+			Answer: strictHost,
+		}},
+	})
+	testutil.AssertErrorMsg(
+		t,
+		`custom rewrite at index 0: domain: bad hostname "bad domain": `+
+			`bad top-level domain name label "bad domain": `+
+			`bad top-level domain name label rune ' '`,
+		err,
+	)
+
+	res, err := ss.CheckHost("www.search.example", dns.TypeA)
+	require.NoError(t, err)
+
+	assert.True(t, res.IsFiltered)
+}
@@ -0,0 +1,464 @@
+package filtering
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghrenameio"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/ioutil"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/urlfilter/rules"
+	"github.com/c2h5oh/datasize"
+)
+
+// ServicesCatalogConfig is the configuration of the blocked services catalog.
+type ServicesCatalogConfig struct {
+	// URL is the URL or the absolute path of the versioned JSON catalog of
+	// blocked services in the Hostlists Registry format.  If it's empty, the
+	// built-in catalog is used.
+	URL string `yaml:"url"`
+
+	// CustomServices are the user-defined blocked services.  They take
+	// precedence over the services from the catalog with the same ID.
+	CustomServices []*CustomService `yaml:"custom_services"`
+}
+
+// CustomService is a user-defined blocked service.
+type CustomService struct {
+	// ID is the unique identifier of the service.
+	ID string `json:"id" yaml:"id"`
+
+	// Name is the human-readable name of the service.
+	Name string `json:"name" yaml:"name"`
+
+	// Rules are the filtering rules blocking the service.
+	Rules []string `json:"rules" yaml:"rules"`
+}
+
+// Clone returns a deep copy of s.
+func (s *CustomService) Clone() (c *CustomService) {
+	return &CustomService{
+		ID:    s.ID,
+		Name:  s.Name,
+		Rules: slices.Clone(s.Rules),
+	}
+}
+
+// validate returns an error if s is not a valid custom service.  s must not be
+// nil.
+func (s *CustomService) validate() (err error) {
+	switch {
+	case s.ID == "":
+		return errors.Error("empty service id")
+	case strings.ContainsAny(s.ID, " \t\r\n"):
+		return fmt.Errorf("service id %q contains whitespace", s.ID)
+	case s.Name == "":
+		return fmt.Errorf("service %q: empty name", s.ID)
+	case len(s.Rules) == 0:
+		return fmt.Errorf("service %q: no rules", s.ID)
+	}
+
+	for _, text := range s.Rules {
+		_, err = rules.NewNetworkRule(text, BlockedSvcsListID)
+		if err != nil {
+			return fmt.Errorf("service %q: rule %q: %w", s.ID, text, err)
+		}
+	}
+
+	return nil
+}
+
+// validateCustomServices returns an error if any of the custom services is
+// invalid or if their IDs aren't unique.
+func validateCustomServices(svcs []*CustomService) (err error) {
+	ids := make(map[string]struct{}, len(svcs))
+	for i, s := range svcs {
+		if s == nil {
+			return fmt.Errorf("custom service at index %d: no value", i)
+		}
+
+		err = s.validate()
+		if err != nil {
+			return fmt.Errorf("custom service at index %d: %w", i, err)
+		}
+
+		if _, ok := ids[s.ID]; ok {
+			return fmt.Errorf("custom service at index %d: duplicate id %q", i, s.ID)
+		}
+
+		ids[s.ID] = struct{}{}
+	}
+
+	return nil
+}
+
+// servicesCatalogJSON is the JSON structure of the remote blocked services
+// catalog.
+type servicesCatalogJSON struct {
+	// Version is the optional version of the catalog.  If the version of the
+	// downloaded catalog is the same as the one of the current catalog, the
+	// update is skipped.
+	Version string `json:"version"`
+
+	BlockedServices []*servicesCatalogService `json:"blocked_services"`
+}
+
+// servicesCatalogService is the JSON structure of a single service in the
+// remote blocked services catalog.
+type servicesCatalogService struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	IconSVG string   `json:"icon_svg"`
+	Rules   []string `json:"rules"`
+}
+
+// parseServicesCatalog parses and validates the remote catalog data.
+func parseServicesCatalog(data []byte) (svcs []blockedService, version string, err error) {
+	c := &servicesCatalogJSON{}
+	err = json.Unmarshal(data, c)
+	if err != nil {
+		return nil, "", fmt.Errorf("decoding: %w", err)
+	} else if len(c.BlockedServices) == 0 {
+		return nil, "", errors.Error("no services")
+	}
+
+	svcs = make([]blockedService, 0, len(c.BlockedServices))
+	for i, s := range c.BlockedServices {
+		if s == nil || s.ID == "" || len(s.Rules) == 0 {
+			return nil, "", fmt.Errorf("service at index %d: no id or rules", i)
+		}
+
+		svcs = append(svcs, blockedService{
+			ID:      s.ID,
+			Name:    s.Name,
+			IconSVG: []byte(s.IconSVG),
+			Rules:   s.Rules,
+		})
+	}
+
+	return svcs, c.Version, nil
+}
+
+// servicesCatalog is the catalog of the blocked services.  It contains either
+// the built-in services or the ones from the remote catalog, along with the
+// custom ones.
+type servicesCatalog struct {
+	// mu protects all fields below.
+	mu *sync.RWMutex
+
+	// rules maps a service ID to its filtering rules.
+	rules map[string][]*rules.NetworkRule
+
+	// updated is the time of the last update of the remote catalog.
+	updated time.Time
+
+	// version is the version of the remote catalog, if any.
+	version string
+
+	// ids contains service IDs sorted alphabetically.
+	ids []string
+
+	// services are all services sorted by ID.
+	services []blockedService
+
+	// base are the built-in services or the ones from the remote catalog.
+	base []blockedService
+
+	// custom are the user-defined services.
+	custom []blockedService
+
+	// removed contains the IDs of the services, which have been in the catalog
+	// but have been removed from it, for example by an update of the remote
+	// catalog.
+	removed map[string]struct{}
+}
+
+// catalog is the package-level catalog of blocked services.
+var catalog = &servicesCatalog{
+	mu:      &sync.RWMutex{},
+	removed: map[string]struct{}{},
+}
+
+// setBase sets the base services of the catalog.
+func (c *servicesCatalog) setBase(base []blockedService, version string, updated time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.base, c.version, c.updated = base, version, updated
+	c.rebuild()
+}
+
+// setUpdated sets the time of the last update of the remote catalog without
+// changing the services.
+func (c *servicesCatalog) setUpdated(updated time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.updated = updated
+}
+
+// setCustom sets the custom services of the catalog.  svcs must be valid.
+func (c *servicesCatalog) setCustom(svcs []*CustomService) {
+	custom := make([]blockedService, 0, len(svcs))
+	for _, s := range svcs {
+		custom = append(custom, blockedService{
+			ID:    s.ID,
+			Name:  s.Name,
+			Rules: slices.Clone(s.Rules),
+		})
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.custom = custom
+	c.rebuild()
+}
+
+// rebuild recompiles the services and their rules.  c.mu must be locked.
+func (c *servicesCatalog) rebuild() {
+	byID := make(map[string]blockedService, len(c.base)+len(c.custom))
+	for _, s := range c.base {
+		byID[s.ID] = s
+	}
+
+	for _, s := range c.custom {
+		byID[s.ID] = s
+	}
+
+	for _, id := range c.ids {
+		if _, ok := byID[id]; !ok {
+			c.removed[id] = struct{}{}
+		}
+	}
+
+	c.services = make([]blockedService, 0, len(byID))
+	c.ids = make([]string, 0, len(byID))
+	c.rules = make(map[string][]*rules.NetworkRule, len(byID))
+	for id, s := range byID {
+		netRules := make([]*rules.NetworkRule, 0, len(s.Rules))
+		for _, text := range s.Rules {
+			rule, err := rules.NewNetworkRule(text, BlockedSvcsListID)
+			if err != nil {
+				log.Error("parsing blocked service %q rule %q: %s", id, text, err)
+
+				continue
+			}
+
+			netRules = append(netRules, rule)
+		}
+
+		c.services = append(c.services, s)
+		c.ids = append(c.ids, id)
+		c.rules[id] = netRules
+		delete(c.removed, id)
+	}
+
+	slices.Sort(c.ids)
+	slices.SortFunc(c.services, func(a, b blockedService) (res int) {
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	log.Debug("filtering: initialized %d services", len(c.ids))
+}
+
+// serviceRules returns the rules of the service with the given ID.
+func (c *servicesCatalog) serviceRules(id string) (netRules []*rules.NetworkRule, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	netRules, ok = c.rules[id]
+
+	return netRules, ok
+}
+
+// isRemoved returns true if the service with the given ID has been in the
+// catalog but has been removed from it.
+func (c *servicesCatalog) isRemoved(id string) (ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	_, ok = c.removed[id]
+
+	return ok
+}
+
+// serviceIDs returns the sorted IDs of all services.
+func (c *servicesCatalog) serviceIDs() (ids []string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return slices.Clone(c.ids)
+}
+
+// allServices returns all services along with the version of the remote
+// catalog, if any.
+func (c *servicesCatalog) allServices() (svcs []blockedService, version string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return slices.Clone(c.services), c.version
+}
+
+// lastUpdate returns the version and the time of the last update of the
+// remote catalog.
+func (c *servicesCatalog) lastUpdate() (version string, updated time.Time) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.version, c.updated
+}
+
+// servicesCacheFile is the name of the file in the filters directory that
+// caches the remote blocked services catalog.
+const servicesCacheFile = "services.json"
+
+// maxServicesCatalogSize is the maximum size of the remote blocked services
+// catalog.
+const maxServicesCatalogSize = 16 * datasize.MB
+
+// servicesCachePath returns the path to the cached remote catalog.
+func servicesCachePath(dataDir string) (p string) {
+	return filepath.Join(dataDir, filterDir, servicesCacheFile)
+}
+
+// InitServicesCatalog initializes the blocked services catalog from the cached
+// remote catalog in dataDir, if c has a URL, and the custom services from c.
+// c may be nil.  [InitModule] must be called before this function.
+func InitServicesCatalog(dataDir string, c *ServicesCatalogConfig) (err error) {
+	if c == nil {
+		return nil
+	}
+
+	err = validateCustomServices(c.CustomServices)
+	if err != nil {
+		return fmt.Errorf("blocked services catalog: %w", err)
+	}
+
+	catalog.setCustom(c.CustomServices)
+
+	if c.URL == "" {
+		return nil
+	}
+
+	cachePath := servicesCachePath(dataDir)
+	fi, err := os.Stat(cachePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		log.Error("filtering: blocked services catalog: %s", err)
+
+		return nil
+	}
+
+	// #nosec G304 -- Trust the path to the data directory.
+	data, err := os.ReadFile(cachePath)
+	if err != nil {
+		log.Error("filtering: blocked services catalog: reading cache: %s", err)
+
+		return nil
+	}
+
+	svcs, version, err := parseServicesCatalog(data)
+	if err != nil {
+		log.Error("filtering: blocked services catalog: parsing cache: %s", err)
+
+		return nil
+	}
+
+	catalog.setBase(svcs, version, fi.ModTime())
+
+	return nil
+}
+
+// refreshServicesCatalog downloads the remote blocked services catalog, if
+// configured and if the update interval has passed, and applies it.
+func (d *DNSFilter) refreshServicesCatalog() (err error) {
+	var catalogURL string
+	var ivl time.Duration
+	func() {
+		d.confMu.RLock()
+		defer d.confMu.RUnlock()
+
+		if d.conf.ServicesCatalog != nil {
+			catalogURL = d.conf.ServicesCatalog.URL
+		}
+
+		ivl = time.Duration(d.conf.FiltersUpdateIntervalHours) * time.Hour
+	}()
+
+	if catalogURL == "" {
+		return nil
+	}
+
+	curVersion, updated := catalog.lastUpdate()
+	if time.Since(updated) < ivl {
+		return nil
+	}
+
+	defer func() { err = errors.Annotate(err, "blocked services catalog: %w") }()
+
+	log.Debug("filtering: downloading blocked services catalog from %q", catalogURL)
+
+	r, err := d.reader(catalogURL)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+	defer func() { err = errors.WithDeferred(err, r.Close()) }()
+
+	data, err := io.ReadAll(ioutil.LimitReader(r, maxServicesCatalogSize.Bytes()))
+	if err != nil {
+		return fmt.Errorf("reading: %w", err)
+	}
+
+	svcs, version, err := parseServicesCatalog(data)
+	if err != nil {
+		return fmt.Errorf("parsing: %w", err)
+	}
+
+	now := time.Now()
+	if version != "" && version == curVersion {
+		log.Debug("filtering: blocked services catalog version %q is up to date", version)
+		catalog.setUpdated(now)
+
+		return nil
+	}
+
+	err = writeServicesCache(servicesCachePath(d.conf.DataDir), data)
+	if err != nil {
+		return fmt.Errorf("writing cache: %w", err)
+	}
+
+	catalog.setBase(svcs, version, now)
+
+	log.Info("filtering: updated blocked services catalog to version %q", version)
+
+	if d.pruneRemovedServices() {
+		d.conf.ConfigModified()
+	}
+
+	return nil
+}
+
+// writeServicesCache atomically writes the remote catalog data to the cache
+// file.
+func writeServicesCache(cachePath string, data []byte) (err error) {
+	f, err := aghrenameio.NewPendingFile(cachePath, 0o644)
+	if err != nil {
+		return err
+	}
+	defer func() { err = aghrenameio.WithDeferredCleanup(err, f) }()
+
+	_, err = f.Write(data)
+
+	return err
+}
@@ -0,0 +1,268 @@
+package filtering
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCatalogData is the common remote blocked services catalog for tests.
+const testCatalogData = `{
+  "version": "1",
+  "blocked_services": [{
+    "id": "remote_svc",
+    "name": "Remote Service",
+    "icon_svg": "<svg/>",
+    "rules": ["||remote.example^"]
+  }]
+}`
+
+// resetCatalog restores the built-in state of the package-level catalog after
+// the test.
+func resetCatalog(t testing.TB) {
+	t.Helper()
+
+	t.Cleanup(func() {
+		catalog.setCustom(nil)
+		catalog.setBase(blockedServices, "", time.Time{})
+
+		catalog.mu.Lock()
+		defer catalog.mu.Unlock()
+
+		clear(catalog.removed)
+	})
+}
+
+func TestParseServicesCatalog(t *testing.T) {
+	testCases := []struct {
+		name        string
+		data        string
+		wantVersion string
+		wantErrMsg  string
+		wantLen     int
+	}{{
+		name:        "valid",
+		data:        testCatalogData,
+		wantVersion: "1",
+		wantErrMsg:  "",
+		wantLen:     1,
+	}, {
+		name:        "empty",
+		data:        `{"blocked_services":[]}`,
+		wantVersion: "",
+		wantErrMsg:  "no services",
+		wantLen:     0,
+	}, {
+		name:        "no_rules",
+		data:        `{"blocked_services":[{"id":"svc"}]}`,
+		wantVersion: "",
+		wantErrMsg:  "service at index 0: no id or rules",
+		wantLen:     0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			svcs, version, err := parseServicesCatalog([]byte(tc.data))
+			if tc.wantErrMsg != "" {
+				require.Error(t, err)
+
+				assert.Equal(t, tc.wantErrMsg, err.Error())
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantVersion, version)
+			assert.Len(t, svcs, tc.wantLen)
+		})
+	}
+}
+
+func TestInitServicesCatalog(t *testing.T) {
+	resetCatalog(t)
+
+	dataDir := t.TempDir()
+	err := os.MkdirAll(filepath.Join(dataDir, filterDir), 0o755)
+	require.NoError(t, err)
+
+	err = os.WriteFile(servicesCachePath(dataDir), []byte(testCatalogData), 0o644)
+	require.NoError(t, err)
+
+	err = InitServicesCatalog(dataDir, &ServicesCatalogConfig{
+		URL: "https://catalog.example/services.json",
+		CustomServices: []*CustomService{{
+			ID:    "custom_svc",
+			Name:  "Custom Service",
+			Rules: []string{"||custom.example^"},
+		}},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"custom_svc", "remote_svc"}, catalog.serviceIDs())
+
+	version, updated := catalog.lastUpdate()
+	assert.Equal(t, "1", version)
+	assert.False(t, updated.IsZero())
+
+	err = InitServicesCatalog(dataDir, &ServicesCatalogConfig{
+		CustomServices: []*CustomService{{
+			ID: "bad_svc",
+		}},
+	})
+	assert.Error(t, err)
+}
+
+func TestBlockedServices_PruneRemoved(t *testing.T) {
+	resetCatalog(t)
+
+	svcs, version, err := parseServicesCatalog([]byte(testCatalogData))
+	require.NoError(t, err)
+
+	// The remote catalog doesn't contain the built-in services.
+	catalog.setBase(svcs, version, time.Now())
+
+	bsvc := &BlockedServices{
+		IDs: []string{"remote_svc", "youtube", "not_a_service"},
+	}
+
+	assert.Equal(t, []string{"youtube"}, bsvc.PruneRemoved())
+	assert.Equal(t, []string{"remote_svc", "not_a_service"}, bsvc.IDs)
+
+	testutil.AssertErrorMsg(t, `unknown blocked-service "not_a_service"`, bsvc.Validate())
+}
+
+func TestDNSFilter_refreshServicesCatalog(t *testing.T) {
+	resetCatalog(t)
+
+	dataDir := t.TempDir()
+	catalogPath := filepath.Join(dataDir, "catalog.json")
+	err := os.WriteFile(catalogPath, []byte(testCatalogData), 0o644)
+	require.NoError(t, err)
+
+	d, setts := newForTest(t, &Config{
+		DataDir:                    dataDir,
+		FiltersUpdateIntervalHours: 24,
+		ServicesCatalog: &ServicesCatalogConfig{
+			URL: catalogPath,
+		},
+	}, nil)
+	t.Cleanup(d.Close)
+
+	err = os.MkdirAll(filepath.Join(dataDir, filterDir), 0o755)
+	require.NoError(t, err)
+
+	err = d.refreshServicesCatalog()
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"remote_svc"}, catalog.serviceIDs())
+	assert.FileExists(t, servicesCachePath(dataDir))
+
+	d.ApplyBlockedServicesList(setts, []string{"remote_svc"})
+
+	res, err := d.CheckHost("remote.example", 1, setts)
+	require.NoError(t, err)
+
+	assert.Equal(t, FilteredBlockedService, res.Reason)
+}
+
+func TestDNSFilter_handleCustomServices(t *testing.T) {
+	resetCatalog(t)
+
+	confModifiedCalled, clientsPruned := 0, 0
+	d, _ := newForTest(t, &Config{
+		ConfigModified: func() { confModifiedCalled++ },
+		PruneClientsServices: func() (pruned bool) {
+			clientsPruned++
+
+			return false
+		},
+	}, nil)
+	t.Cleanup(d.Close)
+
+	do := func(
+		t *testing.T,
+		h http.HandlerFunc,
+		method string,
+		v any,
+	) (w *httptest.ResponseRecorder) {
+		t.Helper()
+
+		var body []byte
+		if v != nil {
+			var err error
+			body, err = json.Marshal(v)
+			require.NoError(t, err)
+		}
+
+		r := httptest.NewRequest(method, "/", bytes.NewReader(body))
+		w = httptest.NewRecorder()
+		h(w, r)
+
+		return w
+	}
+
+	svc := &CustomService{
+		ID:    "custom_svc",
+		Name:  "Custom Service",
+		Rules: []string{"||custom.example^"},
+	}
+
+	w := do(t, d.handleCustomServicesAdd, http.MethodPost, svc)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.Contains(t, catalog.serviceIDs(), "custom_svc")
+
+	w = do(t, d.handleCustomServicesAdd, http.MethodPost, svc)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	upd := svc.Clone()
+	upd.ID = "renamed_svc"
+	w = do(t, d.handleCustomServicesUpdate, http.MethodPut, &customServiceUpdateReq{
+		Data: upd,
+		ID:   svc.ID,
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = do(t, d.handleCustomServicesList, http.MethodGet, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := &customServicesResp{}
+	err := json.NewDecoder(w.Body).Decode(resp)
+	require.NoError(t, err)
+
+	require.Len(t, resp.CustomServices, 1)
+
+	assert.Equal(t, upd, resp.CustomServices[0])
+
+	d.conf.BlockedServices = &BlockedServices{
+		IDs: []string{upd.ID, "youtube"},
+	}
+
+	w = do(t, d.handleCustomServicesDelete, http.MethodPost, &customServiceDeleteReq{
+		ID: upd.ID,
+	})
+	require.Equal(t, http.StatusOK, w.Code)
+
+	assert.NotContains(t, catalog.serviceIDs(), upd.ID)
+	assert.Equal(t, 3, confModifiedCalled)
+	assert.Equal(t, 3, clientsPruned)
+
+	// The deleted service is removed from the blocked ones, so that the
+	// configuration stays valid after a restart.
+	assert.Equal(t, []string{"youtube"}, d.conf.BlockedServices.IDs)
+
+	w = do(t, d.handleCustomServicesDelete, http.MethodPost, &customServiceDeleteReq{
+		ID: upd.ID,
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,259 @@
+package filtering
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+)
+
+// ThreatIntelType is the type of an external threat-intelligence checker.
+type ThreatIntelType string
+
+// Valid threat-intelligence checker types.
+const (
+	// ThreatIntelTypeIOCFile is a local file of indicators of compromise.
+	ThreatIntelTypeIOCFile ThreatIntelType = "ioc_file"
+
+	// ThreatIntelTypeHTTPLookup is an HTTP lookup API.
+	ThreatIntelTypeHTTPLookup ThreatIntelType = "http_lookup"
+
+	// ThreatIntelTypeDNSBL is a DNS-based blocklist.
+	ThreatIntelTypeDNSBL ThreatIntelType = "dnsbl"
+)
+
+// reason returns the filtering reason for the hosts blocked by a checker of
+// type t.
+func (t ThreatIntelType) reason() (r Reason) {
+	switch t {
+	case ThreatIntelTypeIOCFile:
+		return FilteredThreatIOC
+	case ThreatIntelTypeHTTPLookup:
+		return FilteredThreatLookup
+	case ThreatIntelTypeDNSBL:
+		return FilteredThreatDNSBL
+	default:
+		panic(fmt.Errorf("unexpected threat intelligence type %q", t))
+	}
+}
+
+// ThreatIntelConfig is the configuration of an external threat-intelligence
+// checker.
+type ThreatIntelConfig struct {
+	// Name is the unique name of the checker.  It's used as the rule text in
+	// the filtering results.
+	Name string `yaml:"name"`
+
+	// Type is the type of the checker.
+	Type ThreatIntelType `yaml:"type"`
+
+	// Source is the absolute path to the file of indicators of compromise, the
+	// URL template of the lookup API, or the zone of the DNS-based blocklist,
+	// depending on Type.
+	Source string `yaml:"source"`
+
+	// Upstream is the address of the upstream used to query the DNS-based
+	// blocklist.
+	Upstream string `yaml:"upstream,omitempty"`
+
+	// CacheTime is the time to cache the results of the lookups for.  If it's
+	// zero, the results aren't cached.
+	CacheTime timeutil.Duration `yaml:"cache_time"`
+
+	// Enabled defines if the checker is used.
+	Enabled bool `yaml:"enabled"`
+}
+
+// ValidateThreatIntel returns an error if any of the threat-intelligence
+// checker configurations is invalid or if their names aren't unique.
+func ValidateThreatIntel(confs []*ThreatIntelConfig) (err error) {
+	names := make(map[string]struct{}, len(confs))
+	for i, c := range confs {
+		err = validateThreatIntelConfig(c)
+		if err != nil {
+			return fmt.Errorf("threat intelligence checker at index %d: %w", i, err)
+		}
+
+		if _, ok := names[c.Name]; ok {
+			return fmt.Errorf("threat intelligence checker at index %d: duplicate name %q", i, c.Name)
+		}
+
+		names[c.Name] = struct{}{}
+	}
+
+	return nil
+}
+
+// validateThreatIntelConfig returns an error if c is invalid.
+func validateThreatIntelConfig(c *ThreatIntelConfig) (err error) {
+	switch {
+	case c == nil:
+		return errors.Error("no value")
+	case c.Name == "":
+		return errors.Error("empty name")
+	case c.Source == "":
+		return fmt.Errorf("%q: empty source", c.Name)
+	case c.Type == ThreatIntelTypeDNSBL && c.Upstream == "":
+		return fmt.Errorf("%q: empty upstream", c.Name)
+	}
+
+	switch c.Type {
+	case ThreatIntelTypeIOCFile, ThreatIntelTypeHTTPLookup, ThreatIntelTypeDNSBL:
+		return nil
+	default:
+		return fmt.Errorf("%q: bad type %q", c.Name, c.Type)
+	}
+}
+
+// threatIntelEntry is an enabled threat-intelligence checker.
+type threatIntelEntry struct {
+	checker Checker
+	name    string
+	reason  Reason
+}
+
+// enabledThreatIntel returns the enabled threat-intelligence checkers in the
+// order of their configuration.
+func (d *DNSFilter) enabledThreatIntel() (entries []threatIntelEntry) {
+	d.confMu.RLock()
+	defer d.confMu.RUnlock()
+
+	for _, c := range d.conf.ThreatIntel {
+		checker := d.conf.ThreatIntelCheckers[c.Name]
+		if !c.Enabled || checker == nil {
+			continue
+		}
+
+		entries = append(entries, threatIntelEntry{
+			checker: checker,
+			name:    c.Name,
+			reason:  c.Type.reason(),
+		})
+	}
+
+	return entries
+}
+
+// checkThreatIntel checks host against the enabled external
+// threat-intelligence checkers.  The errors of the checkers are logged and
+// don't prevent the host from being resolved.  The checkers skip the lookups
+// for a while after a failure, so the errors aren't logged for every request.
+func (d *DNSFilter) checkThreatIntel(
+	host string,
+	_ uint16,
+	setts *Settings,
+) (res Result, err error) {
+	if !setts.ProtectionEnabled {
+		return Result{}, nil
+	}
+
+	for _, e := range d.enabledThreatIntel() {
+		block, checkErr := e.checker.Check(host)
+		if checkErr != nil {
+			log.Error("filtering: threat intelligence: %s", checkErr)
+
+			continue
+		} else if !block {
+			continue
+		}
+
+		return Result{
+			Rules: []*ResultRule{{
+				Text:         e.name,
+				FilterListID: ThreatIntelListID,
+			}},
+			Reason:     e.reason,
+			IsFiltered: true,
+		}, nil
+	}
+
+	return Result{}, nil
+}
+
+// threatIntelCheckerJSON is the JSON representation of a threat-intelligence
+// checker.
+type threatIntelCheckerJSON struct {
+	Name    string          `json:"name"`
+	Type    ThreatIntelType `json:"type"`
+	Source  string          `json:"source"`
+	Enabled bool            `json:"enabled"`
+}
+
+// threatIntelStatusResp is the response to the GET /control/threat_intel/status
+// HTTP API.
+type threatIntelStatusResp struct {
+	Checkers []*threatIntelCheckerJSON `json:"checkers"`
+}
+
+// threatIntelUpdateReq is the request to the PUT /control/threat_intel/update
+// HTTP API.
+type threatIntelUpdateReq struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// handleThreatIntelStatus is the handler for the GET
+// /control/threat_intel/status HTTP API.
+func (d *DNSFilter) handleThreatIntelStatus(w http.ResponseWriter, r *http.Request) {
+	resp := &threatIntelStatusResp{
+		Checkers: []*threatIntelCheckerJSON{},
+	}
+
+	func() {
+		d.confMu.RLock()
+		defer d.confMu.RUnlock()
+
+		for _, c := range d.conf.ThreatIntel {
+			resp.Checkers = append(resp.Checkers, &threatIntelCheckerJSON{
+				Name:    c.Name,
+				Type:    c.Type,
+				Source:  c.Source,
+				Enabled: c.Enabled,
+			})
+		}
+	}()
+
+	aghhttp.WriteJSONResponseOK(w, r, resp)
+}
+
+// handleThreatIntelUpdate is the handler for the PUT
+// /control/threat_intel/update HTTP API.
+func (d *DNSFilter) handleThreatIntelUpdate(w http.ResponseWriter, r *http.Request) {
+	req := &threatIntelUpdateReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+
+		return
+	}
+
+	found := func() (ok bool) {
+		d.confMu.Lock()
+		defer d.confMu.Unlock()
+
+		i := slices.IndexFunc(d.conf.ThreatIntel, func(c *ThreatIntelConfig) (ok bool) {
+			return c.Name == req.Name
+		})
+		if i < 0 {
+			return false
+		}
+
+		d.conf.ThreatIntel[i].Enabled = req.Enabled
+
+		return true
+	}()
+	if !found {
+		aghhttp.Error(r, w, http.StatusBadRequest, "no threat intelligence checker %q", req.Name)
+
+		return
+	}
+
+	log.Debug("filtering: threat intelligence checker %q enabled: %t", req.Name, req.Enabled)
+
+	d.conf.ConfigModified()
+}
@@ -0,0 +1,140 @@
+package threatintel
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// DNSBLConfig is the configuration of a [DNSBL].
+type DNSBLConfig struct {
+	// Upstream is the upstream used to query the blocklist.  It must not be
+	// nil.  Its timeout should be shorter than the one of the DNS upstreams.
+	Upstream upstream.Upstream
+
+	// Name is the name of the checker used for logging.
+	Name string
+
+	// Zone is the zone of the blocklist, for example "dbl.example.net".
+	Zone string
+
+	// CacheTime is the time to cache the results for.  If it's zero, the
+	// results aren't cached.
+	CacheTime time.Duration
+
+	// CacheSize is the maximum number of cached results.  If it's zero, the
+	// number is unlimited.
+	CacheSize uint
+}
+
+// DNSBL is a checker that looks hostnames up in a DNS-based blocklist, such as
+// the Spamhaus DBL.  A hostname is listed if the A query for the hostname
+// within the zone of the blocklist returns an address from 127.0.0.0/8 except
+// the ones from 127.255.255.0/24, which are error codes.  The lookups are
+// skipped for a while after a failed one.
+type DNSBL struct {
+	ups     upstream.Upstream
+	cache   *resultCache
+	backoff *backoff
+	name    string
+	zone    string
+}
+
+// listedPrefix and errorPrefix are the prefixes of the addresses returned by
+// DNS-based blocklists for listed hostnames and errors respectively.
+var (
+	listedPrefix = netip.MustParsePrefix("127.0.0.0/8")
+	errorPrefix  = netip.MustParsePrefix("127.255.255.0/24")
+)
+
+// NewDNSBL returns a new checker using the DNS-based blocklist.
+func NewDNSBL(conf *DNSBLConfig) (c *DNSBL, err error) {
+	zone := strings.Trim(conf.Zone, ".")
+	if zone == "" {
+		return nil, fmt.Errorf("dnsbl %q: empty zone", conf.Name)
+	}
+
+	return &DNSBL{
+		ups:     conf.Upstream,
+		cache:   newResultCache(conf.CacheSize, conf.CacheTime),
+		backoff: &backoff{},
+		name:    conf.Name,
+		zone:    zone,
+	}, nil
+}
+
+// Check implements the [filtering.Checker] interface for *DNSBL.  Only the
+// failure that starts skipping the lookups is returned as an error.
+func (c *DNSBL) Check(host string) (block bool, err error) {
+	if block, ok := c.cache.get(host); ok {
+		log.Debug("threatintel: %s: found %q in cache, blocked: %t", c.name, host, block)
+
+		return block, nil
+	}
+
+	if c.backoff.isActive(time.Now()) {
+		log.Debug("threatintel: %s: skipping %q after failed lookup", c.name, host)
+
+		return false, nil
+	}
+
+	block, err = c.lookup(host)
+	if err != nil {
+		err = fmt.Errorf("dnsbl %q: %w", c.name, err)
+		if !c.backoff.fail(time.Now()) {
+			log.Debug("threatintel: %s", err)
+
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	c.cache.set(host, block)
+
+	return block, nil
+}
+
+// lookup queries the blocklist for host.
+func (c *DNSBL) lookup(host string) (block bool, err error) {
+	req := (&dns.Msg{}).SetQuestion(dns.Fqdn(host+"."+c.zone), dns.TypeA)
+
+	resp, err := c.ups.Exchange(req)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return false, err
+	}
+
+	if resp.Rcode != dns.RcodeSuccess {
+		// NXDOMAIN means that the hostname isn't listed.
+		return false, nil
+	}
+
+	for _, rr := range resp.Answer {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			continue
+		}
+
+		addr, ok := netip.AddrFromSlice(a.A)
+		if !ok {
+			continue
+		}
+
+		addr = addr.Unmap()
+		if errorPrefix.Contains(addr) {
+			return false, fmt.Errorf("blocklist returned error code %s", addr)
+		} else if listedPrefix.Contains(addr) {
+			log.Debug("threatintel: %s: %q is listed with code %s", c.name, host, addr)
+
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,160 @@
+package threatintel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/ioutil"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// HostPlaceholder is the placeholder in the URL template of [HTTPLookup] that
+// is replaced with the hostname being checked.
+const HostPlaceholder = "{host}"
+
+// maxLookupRespSize is the maximum size of the response of the lookup API.
+const maxLookupRespSize = 64 * 1024
+
+// HTTPLookupConfig is the configuration of a [HTTPLookup].
+type HTTPLookupConfig struct {
+	// Client is the HTTP client used for the lookups.  It must not be nil.
+	Client *http.Client
+
+	// Name is the name of the checker used for logging.
+	Name string
+
+	// URLTemplate is the URL of the lookup API with [HostPlaceholder] in it.
+	URLTemplate string
+
+	// CacheTime is the time to cache the results for.  If it's zero, the
+	// results aren't cached.
+	CacheTime time.Duration
+
+	// Timeout is the timeout of a single lookup.  It should be shorter than the
+	// timeout of the DNS upstreams.  If it's zero, only the timeout of Client
+	// is used.
+	Timeout time.Duration
+
+	// CacheSize is the maximum number of cached results.  If it's zero, the
+	// number is unlimited.
+	CacheSize uint
+}
+
+// HTTPLookup is a checker that looks hostnames up in an HTTP API.  The API
+// must respond with a JSON object with the boolean property "blocked".  The
+// lookups are skipped for a while after a failed one.
+type HTTPLookup struct {
+	cli     *http.Client
+	cache   *resultCache
+	backoff *backoff
+	name    string
+	tmpl    string
+	timeout time.Duration
+}
+
+// lookupResp is the expected response of the lookup API.
+type lookupResp struct {
+	Blocked bool `json:"blocked"`
+}
+
+// NewHTTPLookup returns a new checker using the HTTP lookup API.
+func NewHTTPLookup(conf *HTTPLookupConfig) (c *HTTPLookup, err error) {
+	if !strings.Contains(conf.URLTemplate, HostPlaceholder) {
+		return nil, fmt.Errorf(
+			"http lookup %q: url template %q has no %s placeholder",
+			conf.Name,
+			conf.URLTemplate,
+			HostPlaceholder,
+		)
+	}
+
+	_, err = url.Parse(strings.ReplaceAll(conf.URLTemplate, HostPlaceholder, "example.com"))
+	if err != nil {
+		return nil, fmt.Errorf("http lookup %q: bad url template: %w", conf.Name, err)
+	}
+
+	return &HTTPLookup{
+		cli:     conf.Client,
+		cache:   newResultCache(conf.CacheSize, conf.CacheTime),
+		backoff: &backoff{},
+		name:    conf.Name,
+		tmpl:    conf.URLTemplate,
+		timeout: conf.Timeout,
+	}, nil
+}
+
+// Check implements the [filtering.Checker] interface for *HTTPLookup.  Only
+// the failure that starts skipping the lookups is returned as an error.
+func (c *HTTPLookup) Check(host string) (block bool, err error) {
+	if block, ok := c.cache.get(host); ok {
+		log.Debug("threatintel: %s: found %q in cache, blocked: %t", c.name, host, block)
+
+		return block, nil
+	}
+
+	if c.backoff.isActive(time.Now()) {
+		log.Debug("threatintel: %s: skipping %q after failed lookup", c.name, host)
+
+		return false, nil
+	}
+
+	block, err = c.lookup(host)
+	if err != nil {
+		err = fmt.Errorf("http lookup %q: %w", c.name, err)
+		if !c.backoff.fail(time.Now()) {
+			log.Debug("threatintel: %s", err)
+
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	c.cache.set(host, block)
+
+	return block, nil
+}
+
+// lookup requests the lookup API for host.
+func (c *HTTPLookup) lookup(host string) (block bool, err error) {
+	u := strings.ReplaceAll(c.tmpl, HostPlaceholder, url.QueryEscape(host))
+
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return false, fmt.Errorf("creating request: %w", err)
+	}
+
+	resp, err := c.cli.Do(req)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return false, err
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("got status code %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	lr := &lookupResp{}
+	err = json.NewDecoder(ioutil.LimitReader(resp.Body, maxLookupRespSize)).Decode(lr)
+	if err != nil {
+		return false, fmt.Errorf("decoding response: %w", err)
+	}
+
+	log.Debug("threatintel: %s: looked up %q, blocked: %t", c.name, host, lr.Blocked)
+
+	return lr.Blocked, nil
+}
@@ -0,0 +1,134 @@
+package threatintel
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/stringutil"
+)
+
+// IOCFile is a checker that looks hostnames up in a local file of indicators
+// of compromise.  The file contains a single domain name per line, and lines
+// starting with "#" or "!" are comments.  A hostname matches if either it or
+// any of its parent domains is in the file.
+type IOCFile struct {
+	// mu protects domains and modTime.
+	mu *sync.RWMutex
+
+	// domains is the set of the domains from the file.
+	domains *stringutil.Set
+
+	// modTime is the modification time of the file when it was loaded.
+	modTime time.Time
+
+	// name is the name of the checker used for logging.
+	name string
+
+	// path is the path to the file.
+	path string
+}
+
+// NewIOCFile returns a new checker of the local file of indicators of
+// compromise at path and loads it.
+func NewIOCFile(name, path string) (c *IOCFile, err error) {
+	c = &IOCFile{
+		mu:   &sync.RWMutex{},
+		name: name,
+		path: path,
+	}
+
+	err = c.load()
+	if err != nil {
+		return nil, fmt.Errorf("ioc file %q: %w", name, err)
+	}
+
+	return c, nil
+}
+
+// Check implements the [filtering.Checker] interface for *IOCFile.
+func (c *IOCFile) Check(host string) (block bool, err error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, sub := range netutil.Subdomains(host) {
+		if c.domains.Has(sub) {
+			log.Debug("threatintel: %s: %q matched %q", c.name, host, sub)
+
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Refresh reloads the file, if it has been modified since the last load.
+func (c *IOCFile) Refresh() (err error) {
+	fi, err := os.Stat(c.path)
+	if err != nil {
+		return fmt.Errorf("ioc file %q: %w", c.name, err)
+	}
+
+	c.mu.RLock()
+	modTime := c.modTime
+	c.mu.RUnlock()
+
+	if fi.ModTime().Equal(modTime) {
+		return nil
+	}
+
+	err = c.load()
+	if err != nil {
+		return fmt.Errorf("ioc file %q: %w", c.name, err)
+	}
+
+	return nil
+}
+
+// load reads the domains from the file.
+func (c *IOCFile) load() (err error) {
+	// #nosec G304 -- Trust the file path that is given in the configuration.
+	f, err := os.Open(c.path)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	domains := stringutil.NewSet()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+
+		domains.Add(strings.ToLower(strings.TrimSuffix(line, ".")))
+	}
+
+	err = s.Err()
+	if err != nil {
+		return fmt.Errorf("reading: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.domains, c.modTime = domains, fi.ModTime()
+
+	log.Debug("threatintel: %s: loaded %d domains", c.name, domains.Len())
+
+	return nil
+}
@@ -0,0 +1,93 @@
+// Package threatintel contains the checkers that look hostnames up in external
+// threat-intelligence sources:  local files of indicators of compromise, HTTP
+// lookup APIs, and DNS-based blocklists.
+package threatintel
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/cache"
+	"github.com/AdguardTeam/golibs/mathutil"
+)
+
+// failureBackoff is the time for which the lookups are skipped after a failed
+// one, so that an unavailable source doesn't slow down every request.
+const failureBackoff = 1 * time.Minute
+
+// backoff skips the lookups for some time after a failed one.  It's safe for
+// concurrent use.
+type backoff struct {
+	// until is the time until which the lookups are skipped in Unix
+	// nanoseconds.
+	until atomic.Int64
+}
+
+// isActive returns true if the lookups should be skipped at now.
+func (b *backoff) isActive(now time.Time) (ok bool) {
+	return now.UnixNano() < b.until.Load()
+}
+
+// fail starts skipping the lookups at now.  started is false if it has already
+// been started by a concurrent lookup, so that each failure is only reported
+// once per [failureBackoff].
+func (b *backoff) fail(now time.Time) (started bool) {
+	until := b.until.Load()
+	if now.UnixNano() < until {
+		return false
+	}
+
+	return b.until.CompareAndSwap(until, now.Add(failureBackoff).UnixNano())
+}
+
+// resultCache caches the results of the lookups of hostnames.
+type resultCache struct {
+	// cache stores the results.  The values are the expiry time in Unix
+	// seconds followed by a single byte of the result.
+	cache cache.Cache
+
+	// ttl is the time-to-live of the cached results.
+	ttl time.Duration
+}
+
+// newResultCache returns a new cache of the results of the lookups.  size is
+// the maximum number of cached results, zero means unlimited.
+func newResultCache(size uint, ttl time.Duration) (c *resultCache) {
+	return &resultCache{
+		cache: cache.New(cache.Config{
+			EnableLRU: true,
+			MaxCount:  size,
+		}),
+		ttl: ttl,
+	}
+}
+
+// get returns the cached result of the lookup of host.  ok is false if there
+// is no result for host or it has expired.
+func (c *resultCache) get(host string) (blocked, ok bool) {
+	data := c.cache.Get([]byte(host))
+	if len(data) != 9 {
+		return false, false
+	}
+
+	expiry := time.Unix(int64(binary.BigEndian.Uint64(data)), 0)
+	if time.Now().After(expiry) {
+		return false, false
+	}
+
+	return data[8] == 1, true
+}
+
+// set caches the result of the lookup of host.
+func (c *resultCache) set(host string, blocked bool) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	data := make([]byte, 0, 9)
+	data = binary.BigEndian.AppendUint64(data, uint64(time.Now().Add(c.ttl).Unix()))
+	data = append(data, mathutil.BoolToNumber[byte](blocked))
+
+	c.cache.Set([]byte(host), data)
+}
@@ -0,0 +1,258 @@
+package threatintel_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering/threatintel"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	testutil.DiscardLogOutput(m)
+}
+
+// testCacheTime is the common cache time for tests.
+const testCacheTime = 1 * time.Minute
+
+// testTimeout is the common lookup timeout for tests.
+const testTimeout = 100 * time.Millisecond
+
+func TestIOCFile(t *testing.T) {
+	iocPath := filepath.Join(t.TempDir(), "ioc.txt")
+	err := os.WriteFile(iocPath, []byte("# Comment\nbad.example\nEVIL.example.\n"), 0o644)
+	require.NoError(t, err)
+
+	c, err := threatintel.NewIOCFile("ioc", iocPath)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		host string
+		want bool
+	}{{
+		host: "bad.example",
+		want: true,
+	}, {
+		host: "sub.bad.example",
+		want: true,
+	}, {
+		host: "evil.example",
+		want: true,
+	}, {
+		host: "good.example",
+		want: false,
+	}, {
+		host: "example",
+		want: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.host, func(t *testing.T) {
+			block, checkErr := c.Check(tc.host)
+			require.NoError(t, checkErr)
+
+			assert.Equal(t, tc.want, block)
+		})
+	}
+
+	t.Run("refresh", func(t *testing.T) {
+		err = os.WriteFile(iocPath, []byte("good.example\n"), 0o644)
+		require.NoError(t, err)
+
+		future := time.Now().Add(time.Hour)
+		err = os.Chtimes(iocPath, future, future)
+		require.NoError(t, err)
+
+		err = c.Refresh()
+		require.NoError(t, err)
+
+		block, checkErr := c.Check("good.example")
+		require.NoError(t, checkErr)
+
+		assert.True(t, block)
+
+		block, checkErr = c.Check("bad.example")
+		require.NoError(t, checkErr)
+
+		assert.False(t, block)
+	})
+
+	_, err = threatintel.NewIOCFile("ioc", filepath.Join(t.TempDir(), "none.txt"))
+	assert.Error(t, err)
+}
+
+func TestHTTPLookup(t *testing.T) {
+	var reqNum atomic.Uint32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqNum.Add(1)
+
+		switch r.URL.Query().Get("domain") {
+		case "bad.example":
+			_, _ = w.Write([]byte(`{"blocked":true}`))
+		case "good.example":
+			_, _ = w.Write([]byte(`{"blocked":false}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	c, err := threatintel.NewHTTPLookup(&threatintel.HTTPLookupConfig{
+		Client:      srv.Client(),
+		Name:        "lookup",
+		URLTemplate: srv.URL + "/?domain=" + threatintel.HostPlaceholder,
+		CacheTime:   testCacheTime,
+	})
+	require.NoError(t, err)
+
+	block, err := c.Check("bad.example")
+	require.NoError(t, err)
+
+	assert.True(t, block)
+
+	block, err = c.Check("good.example")
+	require.NoError(t, err)
+
+	assert.False(t, block)
+
+	_, err = c.Check("error.example")
+	assert.Error(t, err)
+
+	block, err = c.Check("bad.example")
+	require.NoError(t, err)
+
+	assert.True(t, block)
+
+	// The lookups are skipped after a failed one.
+	block, err = c.Check("other.example")
+	require.NoError(t, err)
+
+	assert.False(t, block)
+	assert.Equal(t, uint32(3), reqNum.Load())
+
+	_, err = threatintel.NewHTTPLookup(&threatintel.HTTPLookupConfig{
+		Client:      srv.Client(),
+		Name:        "lookup",
+		URLTemplate: srv.URL,
+	})
+	assert.Error(t, err)
+}
+
+func TestHTTPLookup_timeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(srv.Close)
+
+	c, err := threatintel.NewHTTPLookup(&threatintel.HTTPLookupConfig{
+		Client:      srv.Client(),
+		Name:        "lookup",
+		URLTemplate: srv.URL + "/?domain=" + threatintel.HostPlaceholder,
+		Timeout:     testTimeout,
+	})
+	require.NoError(t, err)
+
+	_, err = c.Check("slow.example")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestDNSBL(t *testing.T) {
+	const zone = "dbl.example"
+
+	answers := map[string]net.IP{
+		"bad.example." + zone + ".":   {127, 0, 1, 2},
+		"error.example." + zone + ".": {127, 255, 255, 254},
+		"other.example." + zone + ".": {192, 0, 2, 1},
+	}
+
+	var reqNum atomic.Uint32
+	ups := &aghtest.UpstreamMock{
+		OnAddress: func() (addr string) { return "dnsbl.example" },
+		OnExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			reqNum.Add(1)
+
+			resp = (&dns.Msg{}).SetReply(req)
+
+			name := req.Question[0].Name
+			ip, ok := answers[name]
+			if !ok {
+				resp.Rcode = dns.RcodeNameError
+
+				return resp, nil
+			}
+
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    60,
+				},
+				A: ip,
+			})
+
+			return resp, nil
+		},
+		OnClose: func() (err error) { return nil },
+	}
+
+	c, err := threatintel.NewDNSBL(&threatintel.DNSBLConfig{
+		Upstream:  ups,
+		Name:      "dnsbl",
+		Zone:      zone + ".",
+		CacheTime: testCacheTime,
+	})
+	require.NoError(t, err)
+
+	testCases := []struct {
+		host       string
+		wantErrMsg string
+		want       bool
+	}{{
+		host:       "bad.example",
+		wantErrMsg: "",
+		want:       true,
+	}, {
+		host:       "good.example",
+		wantErrMsg: "",
+		want:       false,
+	}, {
+		host:       "other.example",
+		wantErrMsg: "",
+		want:       false,
+	}, {
+		host:       "error.example",
+		wantErrMsg: `dnsbl "dnsbl": blocklist returned error code 127.255.255.254`,
+		want:       false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.host, func(t *testing.T) {
+			block, checkErr := c.Check(tc.host)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, checkErr)
+
+			assert.Equal(t, tc.want, block)
+		})
+	}
+
+	_, err = c.Check("bad.example")
+	require.NoError(t, err)
+
+	// The lookups are skipped after a failed one.
+	block, err := c.Check("new.example")
+	require.NoError(t, err)
+
+	assert.False(t, block)
+	assert.Equal(t, uint32(len(testCases)), reqNum.Load())
+}
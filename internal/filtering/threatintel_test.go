@@ -0,0 +1,162 @@
+package filtering
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// checkerFunc is a function that implements the [Checker] interface.
+type checkerFunc func(host string) (block bool, err error)
+
+// Check implements the [Checker] interface for checkerFunc.
+func (f checkerFunc) Check(host string) (block bool, err error) { return f(host) }
+
+func TestDNSFilter_checkThreatIntel(t *testing.T) {
+	const (
+		iocName = "ioc"
+		errName = "broken"
+		bl      = "dnsbl"
+	)
+
+	d, setts := newForTest(t, &Config{
+		ConfigModified: func() {},
+		ThreatIntel: []*ThreatIntelConfig{{
+			Name:    errName,
+			Type:    ThreatIntelTypeHTTPLookup,
+			Source:  "https://lookup.example/?host={host}",
+			Enabled: true,
+		}, {
+			Name:    iocName,
+			Type:    ThreatIntelTypeIOCFile,
+			Source:  "/ioc.txt",
+			Enabled: true,
+		}, {
+			Name:     bl,
+			Type:     ThreatIntelTypeDNSBL,
+			Source:   "dbl.example",
+			Upstream: "1.1.1.1",
+			Enabled:  false,
+		}},
+		ThreatIntelCheckers: map[string]Checker{
+			errName: checkerFunc(func(_ string) (block bool, err error) {
+				return false, errors.Error("test error")
+			}),
+			iocName: checkerFunc(func(host string) (block bool, err error) {
+				return host == "ioc.example", nil
+			}),
+			bl: checkerFunc(func(_ string) (block bool, err error) { return true, nil }),
+		},
+	}, nil)
+	t.Cleanup(d.Close)
+
+	res, err := d.CheckHost("ioc.example", dns.TypeA, setts)
+	require.NoError(t, err)
+
+	assert.True(t, res.IsFiltered)
+	assert.Equal(t, FilteredThreatIOC, res.Reason)
+
+	require.Len(t, res.Rules, 1)
+
+	assert.Equal(t, iocName, res.Rules[0].Text)
+	assert.Equal(t, int64(ThreatIntelListID), res.Rules[0].FilterListID)
+
+	res, err = d.CheckHost("other.example", dns.TypeA, setts)
+	require.NoError(t, err)
+
+	assert.False(t, res.IsFiltered)
+
+	body, err := json.Marshal(&threatIntelUpdateReq{
+		Name:    bl,
+		Enabled: true,
+	})
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodPut, "/control/threat_intel/update", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	d.handleThreatIntelUpdate(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	res, err = d.CheckHost("other.example", dns.TypeA, setts)
+	require.NoError(t, err)
+
+	assert.Equal(t, FilteredThreatDNSBL, res.Reason)
+
+	r = httptest.NewRequest(http.MethodGet, "/control/threat_intel/status", nil)
+	w = httptest.NewRecorder()
+	d.handleThreatIntelStatus(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := &threatIntelStatusResp{}
+	err = json.NewDecoder(w.Body).Decode(resp)
+	require.NoError(t, err)
+
+	require.Len(t, resp.Checkers, 3)
+
+	assert.True(t, resp.Checkers[2].Enabled)
+}
+
+func TestValidateThreatIntel(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		confs      []*ThreatIntelConfig
+	}{{
+		name:       "valid",
+		wantErrMsg: "",
+		confs: []*ThreatIntelConfig{{
+			Name:   "ioc",
+			Type:   ThreatIntelTypeIOCFile,
+			Source: "/ioc.txt",
+		}},
+	}, {
+		name: "duplicate",
+		wantErrMsg: `threat intelligence checker at index 1: ` +
+			`duplicate name "ioc"`,
+		confs: []*ThreatIntelConfig{{
+			Name:   "ioc",
+			Type:   ThreatIntelTypeIOCFile,
+			Source: "/ioc.txt",
+		}, {
+			Name:   "ioc",
+			Type:   ThreatIntelTypeIOCFile,
+			Source: "/other.txt",
+		}},
+	}, {
+		name:       "bad_type",
+		wantErrMsg: `threat intelligence checker at index 0: "ioc": bad type "bad"`,
+		confs: []*ThreatIntelConfig{{
+			Name:   "ioc",
+			Type:   "bad",
+			Source: "/ioc.txt",
+		}},
+	}, {
+		name:       "no_upstream",
+		wantErrMsg: `threat intelligence checker at index 0: "bl": empty upstream`,
+		confs: []*ThreatIntelConfig{{
+			Name:   "bl",
+			Type:   ThreatIntelTypeDNSBL,
+			Source: "dbl.example",
+		}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateThreatIntel(tc.confs)
+			if tc.wantErrMsg == "" {
+				assert.NoError(t, err)
+			} else {
+				require.Error(t, err)
+
+				assert.Equal(t, tc.wantErrMsg, err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,428 @@
+// Package firstseen tracks the first time the keys, such as the registered
+// domain names or the addresses of the devices, have been seen.
+package firstseen
+
+import (
+	"cmp"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghrenameio"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	// saveInterval is the minimum time between two saves of the seen keys
+	// made while observing them.
+	saveInterval = 10 * time.Minute
+
+	// lastSeenPrecision is the minimum change of the last time a key has been
+	// seen that needs to be saved.
+	lastSeenPrecision = 1 * time.Hour
+)
+
+// Config is the configuration of a *Tracker.
+type Config struct {
+	// Filename is the path to the file the seen keys are stored in.  If empty,
+	// they are only stored in memory.
+	Filename string
+
+	// MaxSize is the maximum number of the seen keys.  When it's reached, the
+	// keys seen the longest time ago are forgotten.  It must be positive.
+	MaxSize int
+}
+
+// Item is a seen key.
+type Item struct {
+	// FirstSeen is the first time the key has been seen.
+	FirstSeen time.Time
+
+	// LastSeen is the last time the key has been seen, with the precision of
+	// about an hour.
+	LastSeen time.Time
+
+	// Key is the seen key.
+	Key string
+}
+
+// item is the first and the last time a key has been seen in Unix seconds.
+type item [2]int64
+
+// entry is a seen key in the list of a *Tracker.
+type entry struct {
+	key string
+	it  item
+}
+
+// Tracker tracks the first time the keys have been seen.  It's safe for
+// concurrent use.
+type Tracker struct {
+	// mu protects items, order, started, forgotten, lastSave, and dirty.
+	mu *sync.Mutex
+
+	// saveMu serializes writing the file.
+	saveMu *sync.Mutex
+
+	// items are the elements of order by their keys.
+	items map[string]*list.Element
+
+	// order contains the *entry values of the seen keys from the most recently
+	// seen to the least recently seen one.
+	order *list.List
+
+	// started is the time the tracking has started.
+	started time.Time
+
+	// forgotten is the latest time any of the keys forgotten, since the
+	// maximum number of keys has been reached, could have last been seen.
+	forgotten time.Time
+
+	// lastSave is the last time the keys have been saved.
+	lastSave time.Time
+
+	filename string
+
+	maxSize int
+
+	// dirty is true if there are changes not saved yet.
+	dirty bool
+}
+
+// New returns a new properly initialized *Tracker with the keys loaded from
+// the file, if any.  conf must not be nil.
+func New(conf *Config) (t *Tracker, err error) {
+	if conf.MaxSize <= 0 {
+		return nil, fmt.Errorf("max size: must be positive, got %d", conf.MaxSize)
+	}
+
+	t = &Tracker{
+		mu:       &sync.Mutex{},
+		saveMu:   &sync.Mutex{},
+		items:    map[string]*list.Element{},
+		order:    list.New(),
+		filename: conf.Filename,
+		maxSize:  conf.MaxSize,
+	}
+
+	err = t.load()
+	if err != nil {
+		return nil, fmt.Errorf("loading %q: %w", t.filename, err)
+	}
+
+	return t, nil
+}
+
+// Observe records that key has been seen at now.  firstSeen is the first time
+// the key has been seen.  isNew is true if it has been seen for the first time
+// or since it has been forgotten.
+func (t *Tracker) Observe(key string, now time.Time) (firstSeen time.Time, isNew bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	defer t.maybeSave(now)
+
+	sec := now.Unix()
+	if el, ok := t.items[key]; ok {
+		t.order.MoveToFront(el)
+
+		e := el.Value.(*entry)
+		if sec-e.it[1] >= int64(lastSeenPrecision/time.Second) {
+			e.it[1] = sec
+			t.dirty = true
+		}
+
+		return time.Unix(e.it[0], 0), false
+	}
+
+	if t.order.Len() >= t.maxSize {
+		t.evict(now)
+	}
+
+	t.items[key] = t.order.PushFront(&entry{key: key, it: item{sec, sec}})
+	t.dirty = true
+
+	return time.Unix(sec, 0), true
+}
+
+// evict forgets the key seen the longest time ago.  t.mu must be locked.
+func (t *Tracker) evict(now time.Time) {
+	el := t.order.Back()
+	if el == nil {
+		return
+	}
+
+	e := t.order.Remove(el).(*entry)
+	delete(t.items, e.key)
+	t.forget(e, now)
+
+	log.Debug("firstseen: %q: forgot %q", t.filename, e.key)
+}
+
+// forget moves t.forgotten to the last time e could have been seen, but not
+// after now.  t.mu must be locked.
+func (t *Tracker) forget(e *entry, now time.Time) {
+	// The last time is only updated once in lastSeenPrecision.
+	lastSeen := time.Unix(e.it[1], 0).Add(lastSeenPrecision)
+	if lastSeen.After(now) {
+		lastSeen = now
+	}
+
+	if lastSeen.After(t.forgotten) {
+		t.forgotten = lastSeen
+	}
+}
+
+// FirstSeen returns the first time key has been seen.  ok is false if it
+// hasn't been seen or has been forgotten.  It doesn't record key as seen.
+func (t *Tracker) FirstSeen(key string) (firstSeen time.Time, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	el, ok := t.items[key]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(el.Value.(*entry).it[0], 0), true
+}
+
+// maybeSave saves the keys in the background, if there are changes and the
+// last save was long enough ago.  t.mu must be locked.
+func (t *Tracker) maybeSave(now time.Time) {
+	if t.filename == "" || !t.dirty || now.Sub(t.lastSave) < saveInterval {
+		return
+	}
+
+	t.lastSave = now
+
+	go func() {
+		defer log.OnPanic("firstseen: saving")
+
+		err := t.Save()
+		if err != nil {
+			log.Error("firstseen: saving %q: %s", t.filename, err)
+		}
+	}()
+}
+
+// Started returns the time the tracking has started, including the time before
+// the restarts.
+func (t *Tracker) Started() (started time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.started
+}
+
+// Forgotten returns the latest time any of the keys forgotten, since the
+// maximum number of keys has been reached, could have last been seen.  It's
+// zero if no keys have been forgotten.  The keys seen for the first time after
+// it haven't been seen since then, but may have been seen before.
+func (t *Tracker) Forgotten() (forgotten time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.forgotten
+}
+
+// Len returns the number of the seen keys.
+func (t *Tracker) Len() (n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.order.Len()
+}
+
+// Recent returns at most limit keys seen for the first time most recently,
+// from the newest to the oldest.
+func (t *Tracker) Recent(limit int) (items []*Item) {
+	entries := t.entries()
+	slices.SortFunc(entries, func(a, b entry) (res int) {
+		if res = cmp.Compare(b.it[0], a.it[0]); res != 0 {
+			return res
+		}
+
+		return strings.Compare(a.key, b.key)
+	})
+
+	entries = entries[:min(limit, len(entries))]
+	items = make([]*Item, 0, len(entries))
+	for _, e := range entries {
+		items = append(items, &Item{
+			FirstSeen: time.Unix(e.it[0], 0),
+			LastSeen:  time.Unix(e.it[1], 0),
+			Key:       e.key,
+		})
+	}
+
+	return items
+}
+
+// entries returns a copy of the seen keys, so that they could be processed
+// without holding t.mu.
+func (t *Tracker) entries() (entries []entry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entries = make([]entry, 0, t.order.Len())
+	for el := t.order.Front(); el != nil; el = el.Next() {
+		entries = append(entries, *el.Value.(*entry))
+	}
+
+	return entries
+}
+
+// fileData is the data stored in the file of a *Tracker.
+type fileData struct {
+	// Started is the time the tracking has started.
+	Started time.Time `json:"started"`
+
+	// Forgotten is the latest time any of the forgotten keys could have last
+	// been seen.
+	Forgotten time.Time `json:"forgotten,omitempty"`
+
+	// Items are the first and the last time each key has been seen in Unix
+	// seconds.
+	Items map[string]item `json:"items"`
+}
+
+// load loads the keys from the file of t.  If there is no file, it starts the
+// tracking anew.
+func (t *Tracker) load() (err error) {
+	t.started = time.Now()
+	t.dirty = true
+
+	if t.filename == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(t.filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	fd := &fileData{}
+	err = json.Unmarshal(data, fd)
+	if err != nil {
+		return fmt.Errorf("decoding: %w", err)
+	}
+
+	if !fd.Started.IsZero() {
+		t.started = fd.Started
+	}
+
+	t.forgotten = fd.Forgotten
+
+	entries := make([]entry, 0, len(fd.Items))
+	for k, it := range fd.Items {
+		entries = append(entries, entry{key: k, it: it})
+	}
+
+	// Sort the keys from the most recently seen to the least recently seen one
+	// to restore the order of forgetting them.
+	slices.SortFunc(entries, func(a, b entry) (res int) {
+		if res = cmp.Compare(b.it[1], a.it[1]); res != 0 {
+			return res
+		}
+
+		return strings.Compare(a.key, b.key)
+	})
+
+	// Keep the file dirty if some keys have been forgotten.
+	t.dirty = len(entries) > t.maxSize
+	if t.dirty {
+		// The first of the forgotten keys is the most recently seen one.
+		t.forget(&entries[t.maxSize], time.Now())
+		entries = entries[:t.maxSize]
+	}
+
+	for _, e := range entries {
+		t.items[e.key] = t.order.PushBack(&entry{key: e.key, it: e.it})
+	}
+
+	return nil
+}
+
+// Save writes the keys into the file, if there are changes.
+func (t *Tracker) Save() (err error) {
+	if t.filename == "" {
+		return nil
+	}
+
+	t.saveMu.Lock()
+	defer t.saveMu.Unlock()
+
+	fd, ok := t.snapshot()
+	if !ok {
+		return nil
+	}
+
+	defer func() {
+		if err != nil {
+			t.setDirty()
+		}
+	}()
+
+	data, err := json.Marshal(fd)
+	if err != nil {
+		return fmt.Errorf("encoding: %w", err)
+	}
+
+	pf, err := aghrenameio.NewPendingFile(t.filename, 0o644)
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+
+	defer func() { err = aghrenameio.WithDeferredCleanup(err, pf) }()
+
+	_, err = pf.Write(data)
+	if err != nil {
+		return fmt.Errorf("writing: %w", err)
+	}
+
+	return nil
+}
+
+// setDirty marks t as having the changes not saved yet.
+func (t *Tracker) setDirty() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.dirty = true
+}
+
+// snapshot returns the data to save and resets t.dirty.  ok is false if there
+// are no changes.
+func (t *Tracker) snapshot() (fd *fileData, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.dirty {
+		return nil, false
+	}
+
+	t.dirty = false
+
+	items := make(map[string]item, len(t.items))
+	for k, el := range t.items {
+		items[k] = el.Value.(*entry).it
+	}
+
+	return &fileData{
+		Started:   t.started,
+		Forgotten: t.forgotten,
+		Items:     items,
+	}, true
+}
@@ -0,0 +1,112 @@
+package firstseen_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/firstseen"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracker_Observe(t *testing.T) {
+	tr, err := firstseen.New(&firstseen.Config{
+		MaxSize: 10,
+	})
+	require.NoError(t, err)
+
+	start := time.Unix(1_700_000_000, 0)
+
+	first, isNew := tr.Observe("example.com", start)
+	assert.True(t, isNew)
+	assert.Equal(t, start, first)
+
+	first, isNew = tr.Observe("example.com", start.Add(time.Hour))
+	assert.False(t, isNew)
+	assert.Equal(t, start, first)
+
+	_, ok := tr.FirstSeen("example.org")
+	assert.False(t, ok)
+
+	_, isNew = tr.Observe("example.org", start.Add(2*time.Hour))
+	assert.True(t, isNew)
+
+	assert.Equal(t, 2, tr.Len())
+
+	items := tr.Recent(10)
+	require.Len(t, items, 2)
+
+	assert.Equal(t, "example.org", items[0].Key)
+	assert.Equal(t, &firstseen.Item{
+		FirstSeen: start,
+		LastSeen:  start.Add(time.Hour),
+		Key:       "example.com",
+	}, items[1])
+
+	assert.Len(t, tr.Recent(1), 1)
+}
+
+func TestTracker_evict(t *testing.T) {
+	tr, err := firstseen.New(&firstseen.Config{
+		MaxSize: 3,
+	})
+	require.NoError(t, err)
+
+	start := time.Unix(1_700_000_000, 0)
+
+	tr.Observe("a", start)
+	tr.Observe("b", start.Add(1*time.Hour))
+	tr.Observe("c", start.Add(2*time.Hour))
+
+	// Make "a" the most recently seen one.
+	tr.Observe("a", start.Add(3*time.Hour))
+
+	assert.True(t, tr.Forgotten().IsZero())
+
+	_, isNew := tr.Observe("d", start.Add(4*time.Hour))
+	require.True(t, isNew)
+
+	assert.Equal(t, 3, tr.Len())
+
+	// "b" has last been seen at most an hour after it has been recorded.
+	assert.Equal(t, start.Add(2*time.Hour), tr.Forgotten())
+
+	_, ok := tr.FirstSeen("b")
+	assert.False(t, ok)
+
+	first, ok := tr.FirstSeen("a")
+	require.True(t, ok)
+
+	assert.Equal(t, start, first)
+
+	_, isNew = tr.Observe("a", start.Add(5*time.Hour))
+	assert.False(t, isNew)
+
+	_, isNew = tr.Observe("b", start.Add(5*time.Hour))
+	assert.True(t, isNew)
+}
+
+func TestTracker_Save(t *testing.T) {
+	conf := &firstseen.Config{
+		Filename: filepath.Join(t.TempDir(), "seen.json"),
+		MaxSize:  10,
+	}
+
+	tr, err := firstseen.New(conf)
+	require.NoError(t, err)
+
+	started := tr.Started()
+	first, _ := tr.Observe("example.com", time.Now())
+
+	require.NoError(t, tr.Save())
+
+	tr, err = firstseen.New(conf)
+	require.NoError(t, err)
+
+	assert.Equal(t, started.Unix(), tr.Started().Unix())
+
+	got, isNew := tr.Observe("example.com", time.Now())
+	assert.False(t, isNew)
+	assert.Equal(t, first, got)
+}
@@ -4,18 +4,22 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"path/filepath"
 	"slices"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/alert"
 	"github.com/AdguardTeam/AdGuardHome/internal/arpdb"
 	"github.com/AdguardTeam/AdGuardHome/internal/client"
 	"github.com/AdguardTeam/AdGuardHome/internal/dhcpsvc"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/AdGuardHome/internal/firstseen"
 	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
 	"github.com/AdguardTeam/AdGuardHome/internal/whois"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/dnsproxy/upstream"
@@ -23,6 +27,7 @@ import (
 	"github.com/AdguardTeam/golibs/hostsfile"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/bluele/gcache"
 	"golang.org/x/exp/maps"
 )
 
@@ -68,6 +73,20 @@ type clientsContainer struct {
 	// arpDB stores the neighbors retrieved from ARP.
 	arpDB arpdb.Interface
 
+	// devices tracks the first time the devices have sent requests, by their
+	// identifiers returned by [alert.Device.ID].  It's nil in tests.
+	devices *firstseen.Tracker
+
+	// seenDevices contains the ClientIDs or, if there are none, the IP
+	// addresses of the devices already recorded in devices as keys, so that
+	// neither lock nor their hardware addresses are looked up on every
+	// request.  It's safe for concurrent use.
+	seenDevices gcache.Cache
+
+	// onNewClient, if not nil, is called for every new device, which isn't a
+	// persistent client.
+	onNewClient func(d *alert.Device)
+
 	// lock protects all fields.
 	//
 	// TODO(a.garipov): Use a pointer and describe which fields are protected in
@@ -126,6 +145,15 @@ func (clients *clientsContainer) Init(
 		return nil
 	}
 
+	clients.seenDevices = gcache.New(maxDevices).LRU().Build()
+	clients.devices, err = firstseen.New(&firstseen.Config{
+		Filename: filepath.Join(Context.getDataDir(), "devices.json"),
+		MaxSize:  maxDevices,
+	})
+	if err != nil {
+		return fmt.Errorf("initializing devices: %w", err)
+	}
+
 	// The clients.etcHosts may be nil even if config.Clients.Sources.HostsFile
 	// is true, because of the deprecated option --no-etc-hosts.
 	//
@@ -257,6 +285,15 @@ func (o *clientObject) toPersistent(
 		}
 	}
 
+	removed := o.BlockedServices.PruneRemoved()
+	if len(removed) > 0 {
+		log.Info(
+			"clients: client %q: blocked services removed from the catalog: %q",
+			cli.Name,
+			removed,
+		)
+	}
+
 	err = o.BlockedServices.Validate()
 	if err != nil {
 		return nil, fmt.Errorf("init blocked services %q: %w", cli.Name, err)
@@ -413,6 +450,7 @@ func (clients *clientsContainer) clientOrArtificial(
 	if ok {
 		return &querylog.Client{
 			Name:           cli.Name,
+			Tags:           cli.Tags,
 			IgnoreQueryLog: cli.IgnoreQueryLog,
 		}, false
 	}
@@ -446,6 +484,170 @@ func (clients *clientsContainer) find(id string) (c *persistentClient, ok bool)
 	return c.shallowClone(), true
 }
 
+// pruneRemovedServices removes the IDs of the services removed from the
+// catalog from the blocked services of the persistent clients.  pruned is true
+// if any have been removed.
+func (clients *clientsContainer) pruneRemovedServices() (pruned bool) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	for _, c := range clients.list {
+		if c.BlockedServices == nil {
+			continue
+		}
+
+		// Don't modify the IDs in place, since the shallow copies of the
+		// client may be in use.
+		svcs := c.BlockedServices.Clone()
+		removed := svcs.PruneRemoved()
+		if len(removed) == 0 {
+			continue
+		}
+
+		log.Info(
+			"clients: client %q: blocked services removed from the catalog: %q",
+			c.Name,
+			removed,
+		)
+
+		c.BlockedServices, pruned = svcs, true
+	}
+
+	return pruned
+}
+
+// maxDevices is the maximum number of the devices remembered by the clients
+// container.
+const maxDevices = 10_000
+
+// setNewClientHandler sets the function called for every new device, which
+// isn't a persistent client.  h may be nil.
+func (clients *clientsContainer) setNewClientHandler(h func(d *alert.Device)) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	clients.onNewClient = h
+}
+
+// ObserveClient implements the [dnsforward.ClientsContainer] interface for
+// *clientsContainer.  It reports the devices, which aren't persistent clients,
+// sending requests for the first time.
+func (clients *clientsContainer) ObserveClient(ip netip.Addr, clientID string) {
+	if clients.devices == nil {
+		return
+	}
+
+	ip = ip.Unmap()
+
+	var cacheKey any = ip
+	if clientID != "" {
+		cacheKey = clientID
+	}
+
+	// Don't use [gcache.Cache.GetIFPresent], since it locks the cache
+	// exclusively.  The evicted devices are just looked up once again.
+	if clients.seenDevices.Has(cacheKey) {
+		return
+	}
+
+	d, handler := clients.observeDevice(ip, clientID, cacheKey)
+	if d == nil {
+		return
+	}
+
+	log.Info("clients: new client %s", d)
+
+	// Call the handler outside of the lock, since it may look up the clients.
+	if handler != nil {
+		handler(d)
+	}
+}
+
+// observeDevice records the request from the device with ip and clientID and
+// returns it, if it's new and isn't a persistent client, along with the new
+// client handler.  cacheKey is the key of the device in clients.seenDevices.
+func (clients *clientsContainer) observeDevice(
+	ip netip.Addr,
+	clientID string,
+	cacheKey any,
+) (d *alert.Device, handler func(d *alert.Device)) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	err := clients.seenDevices.Set(cacheKey, struct{}{})
+	if err != nil {
+		log.Debug("clients: cache: adding device %v: %s", cacheKey, err)
+	}
+
+	d = &alert.Device{
+		ClientID: clientID,
+		IP:       ip,
+	}
+
+	if ip.IsPrivate() || ip.IsLinkLocalUnicast() {
+		d.MAC = clients.macByIPLocked(ip)
+	}
+
+	key := d.ID()
+
+	_, isNew := clients.devices.Observe(key, time.Now())
+	if !isNew || clients.isPersistentLocked(key, ip, clientID) {
+		return nil, nil
+	}
+
+	if rc, ok := clients.ipToRC[ip]; ok {
+		_, d.Name = rc.Info()
+	} else if clients.dhcp != nil {
+		d.Name = clients.dhcp.HostByIP(ip)
+	}
+
+	return d, clients.onNewClient
+}
+
+// macByIPLocked returns the hardware address of the device with ip from the
+// DHCP leases or the ARP neighbors, if any.  clients.lock is expected to be
+// locked.
+func (clients *clientsContainer) macByIPLocked(ip netip.Addr) (mac net.HardwareAddr) {
+	if clients.dhcp != nil {
+		mac = clients.dhcp.MACByIP(ip)
+		if mac != nil {
+			return mac
+		}
+	}
+
+	if clients.arpDB == nil {
+		return nil
+	}
+
+	for _, n := range clients.arpDB.Neighbors() {
+		if n.IP == ip {
+			return n.MAC
+		}
+	}
+
+	return nil
+}
+
+// isPersistentLocked returns true if the device with the key, ip, and clientID
+// belongs to a persistent client.  clients.lock is expected to be locked.
+func (clients *clientsContainer) isPersistentLocked(
+	key string,
+	ip netip.Addr,
+	clientID string,
+) (ok bool) {
+	for _, id := range []string{key, ip.String(), clientID} {
+		if id == "" {
+			continue
+		}
+
+		if _, ok = clients.findLocked(id); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
 // shouldCountClient is a wrapper around [clientsContainer.find] to make it a
 // valid client information finder for the statistics.  If no information about
 // the client is found, it returns true.
@@ -463,6 +665,28 @@ func (clients *clientsContainer) shouldCountClient(ids []string) (y bool) {
 	return true
 }
 
+// findStatsClient is a wrapper around [clientsContainer.findLocked] to make it
+// a valid persistent client finder for the statistics.  It also finds the
+// clients by their names.
+func (clients *clientsContainer) findStatsClient(id string) (c *stats.ClientInfo) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	cli, ok := clients.list[id]
+	if !ok {
+		cli, ok = clients.findLocked(id)
+	}
+
+	if !ok {
+		return nil
+	}
+
+	return &stats.ClientInfo{
+		Name: cli.Name,
+		Tags: slices.Clone(cli.Tags),
+	}
+}
+
 // type check
 var _ dnsforward.ClientsContainer = (*clientsContainer)(nil)
 
@@ -472,6 +696,7 @@ var _ dnsforward.ClientsContainer = (*clientsContainer)(nil)
 func (clients *clientsContainer) UpstreamConfigByID(
 	id string,
 	bootstrap upstream.Resolver,
+	wrap func(uc *proxy.UpstreamConfig),
 ) (conf *proxy.CustomUpstreamConfig, err error) {
 	clients.lock.Lock()
 	defer clients.lock.Unlock()
@@ -503,6 +728,10 @@ func (clients *clientsContainer) UpstreamConfigByID(
 		return nil, err
 	}
 
+	if wrap != nil {
+		wrap(upsConf)
+	}
+
 	conf = proxy.NewCustomUpstreamConfig(
 		upsConf,
 		c.UpstreamsCacheEnabled,
@@ -917,5 +1146,11 @@ func (clients *clientsContainer) close() (err error) {
 		}
 	}
 
+	if clients.devices != nil {
+		if err = clients.devices.Save(); err != nil {
+			errs = append(errs, fmt.Errorf("saving devices: %w", err))
+		}
+	}
+
 	return errors.Join(errs...)
 }
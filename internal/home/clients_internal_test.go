@@ -7,11 +7,15 @@ import (
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/alert"
 	"github.com/AdguardTeam/AdGuardHome/internal/client"
 	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
 	"github.com/AdguardTeam/AdGuardHome/internal/dhcpsvc"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/AdGuardHome/internal/firstseen"
 	"github.com/AdguardTeam/AdGuardHome/internal/whois"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/bluele/gcache"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -362,11 +366,88 @@ func TestClientsCustomUpstream(t *testing.T) {
 	require.NoError(t, err)
 	assert.True(t, ok)
 
-	upsConf, err := clients.UpstreamConfigByID("1.2.3.4", net.DefaultResolver)
+	var wrapped []*proxy.UpstreamConfig
+	wrap := func(uc *proxy.UpstreamConfig) { wrapped = append(wrapped, uc) }
+
+	upsConf, err := clients.UpstreamConfigByID("1.2.3.4", net.DefaultResolver, wrap)
 	assert.Nil(t, upsConf)
 	assert.NoError(t, err)
 
-	upsConf, err = clients.UpstreamConfigByID("1.1.1.1", net.DefaultResolver)
+	upsConf, err = clients.UpstreamConfigByID("1.1.1.1", net.DefaultResolver, wrap)
 	require.NotNil(t, upsConf)
 	assert.NoError(t, err)
+
+	// The cached configuration isn't wrapped again.
+	_, err = clients.UpstreamConfigByID("1.1.1.1", net.DefaultResolver, wrap)
+	require.NoError(t, err)
+
+	require.Len(t, wrapped, 1)
+
+	assert.Len(t, wrapped[0].Upstreams, 1)
+}
+
+func TestClientsContainer_ObserveClient(t *testing.T) {
+	var (
+		knownIP  = netip.MustParseAddr("192.168.0.2")
+		phoneIP  = netip.MustParseAddr("192.168.0.3")
+		laptopIP = netip.MustParseAddr("192.168.0.4")
+		publicIP = netip.MustParseAddr("1.2.3.4")
+
+		phoneMAC = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	)
+
+	clients := newClientsContainer(t)
+	clients.dhcp = &testDHCP{
+		OnLeases: func() (leases []*dhcpsvc.Lease) { panic("not implemented") },
+		OnHostBy: func(ip netip.Addr) (host string) {
+			if ip == phoneIP {
+				return "phone"
+			}
+
+			return ""
+		},
+		OnMACBy: func(ip netip.Addr) (mac net.HardwareAddr) {
+			if ip == phoneIP || ip == laptopIP {
+				return phoneMAC
+			}
+
+			return nil
+		},
+	}
+
+	var err error
+	clients.seenDevices = gcache.New(maxDevices).LRU().Build()
+	clients.devices, err = firstseen.New(&firstseen.Config{MaxSize: 10})
+	require.NoError(t, err)
+
+	ok, err := clients.add(&persistentClient{
+		Name: "known",
+		IPs:  []netip.Addr{knownIP},
+	})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	var devices []*alert.Device
+	clients.setNewClientHandler(func(d *alert.Device) { devices = append(devices, d) })
+
+	clients.ObserveClient(knownIP, "")
+	clients.ObserveClient(phoneIP, "")
+	clients.ObserveClient(phoneIP, "")
+
+	// The same device with another IP address.
+	clients.ObserveClient(laptopIP, "")
+
+	clients.ObserveClient(publicIP, "")
+	clients.ObserveClient(publicIP, "tablet")
+	clients.ObserveClient(publicIP, "tablet")
+
+	require.Len(t, devices, 3)
+
+	assert.Equal(t, &alert.Device{
+		Name: "phone",
+		MAC:  phoneMAC,
+		IP:   phoneIP,
+	}, devices[0])
+	assert.Equal(t, &alert.Device{IP: publicIP}, devices[1])
+	assert.Equal(t, &alert.Device{ClientID: "tablet", IP: publicIP}, devices[2])
 }
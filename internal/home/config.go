@@ -7,9 +7,11 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghtls"
+	"github.com/AdguardTeam/AdGuardHome/internal/alert"
 	"github.com/AdguardTeam/AdGuardHome/internal/configmigrate"
 	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
@@ -22,6 +24,7 @@ import (
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/c2h5oh/datasize"
 	"github.com/google/renameio/v2/maybe"
 	yaml "gopkg.in/yaml.v3"
 )
@@ -137,6 +140,10 @@ type configuration struct {
 	DHCP      *dhcpd.ServerConfig `yaml:"dhcp"`
 	Filtering *filtering.Config   `yaml:"filtering"`
 
+	// Alerts is the configuration of the alert rules and the notification
+	// channels.
+	Alerts *alert.Config `yaml:"alerts"`
+
 	// Clients contains the YAML representations of the persistent clients.
 	// This field is only used for reading and writing persistent client data.
 	// Keep this field sorted to ensure consistent ordering.
@@ -279,6 +286,25 @@ type queryLogConfig struct {
 
 	// FileEnabled defines, if the query log is written to the file.
 	FileEnabled bool `yaml:"file_enabled"`
+
+	// Remote are the remote destinations the query log entries are streamed
+	// to, such as syslog servers and HTTP endpoints.
+	Remote []*querylog.RemoteConfig `yaml:"remote"`
+
+	// Retention are the policies overriding Interval for some of the clients.
+	Retention []*querylog.RetentionPolicy `yaml:"retention"`
+
+	// MaxSize is the maximum total size of the query log files.  Zero means
+	// no limit.
+	MaxSize datasize.ByteSize `yaml:"max_size"`
+
+	// Backend is the storage of the query log, either "file" or "sqlite".
+	// The SQLite database is stored as querylog.sqlite in DirPath.
+	Backend querylog.Backend `yaml:"backend"`
+
+	// StoreRequests defines if the whole requests are stored in the query log
+	// in addition to the responses.
+	StoreRequests bool `yaml:"store_requests"`
 }
 
 type statsConfig struct {
@@ -292,6 +318,23 @@ type statsConfig struct {
 	// Interval is the retention interval for statistics.
 	Interval timeutil.Duration `yaml:"interval"`
 
+	// MinuteInterval is the retention interval for statistics with the minute
+	// resolution.  If zero, these statistics aren't collected.
+	MinuteInterval timeutil.Duration `yaml:"minute_interval"`
+
+	// HourlyInterval is the retention interval for statistics with the hour
+	// resolution, after which they are downsampled into the daily ones.
+	HourlyInterval timeutil.Duration `yaml:"hourly_interval"`
+
+	// DailyInterval is the retention interval for statistics with the day
+	// resolution, after which they are downsampled into the weekly ones.
+	DailyInterval timeutil.Duration `yaml:"daily_interval"`
+
+	// Backend is the storage of the statistics, either "bolt" or "sqlite".
+	// The SQLite database is stored as stats.sqlite in DirPath, and the data
+	// from stats.db is imported into it once.
+	Backend stats.Backend `yaml:"backend"`
+
 	// Enabled defines if the statistics are enabled.
 	Enabled bool `yaml:"enabled"`
 }
@@ -343,6 +386,13 @@ var config = &configuration{
 				UseCustom: false,
 			},
 
+			DNSTap: &dnsforward.DNSTapConfig{
+				Address:    "",
+				Identity:   "",
+				BufferSize: 10_000,
+				Enabled:    false,
+			},
+
 			// set default maximum concurrent queries to 300
 			// we introduced a default limit due to this:
 			// https://github.com/AdguardTeam/AdGuardHome/issues/2015#issuecomment-674041912
@@ -364,11 +414,18 @@ var config = &configuration{
 		Interval:    timeutil.Duration{Duration: 90 * timeutil.Day},
 		MemSize:     1000,
 		Ignored:     []string{},
+		Remote:      []*querylog.RemoteConfig{},
+		Retention:   []*querylog.RetentionPolicy{},
+		Backend:     querylog.BackendFile,
 	},
 	Stats: statsConfig{
-		Enabled:  true,
-		Interval: timeutil.Duration{Duration: 1 * timeutil.Day},
-		Ignored:  []string{},
+		Enabled:        true,
+		Interval:       timeutil.Duration{Duration: 1 * timeutil.Day},
+		MinuteInterval: timeutil.Duration{Duration: 6 * time.Hour},
+		HourlyInterval: timeutil.Duration{Duration: 30 * timeutil.Day},
+		DailyInterval:  timeutil.Duration{Duration: 90 * timeutil.Day},
+		Ignored:        []string{},
+		Backend:        stats.BackendBolt,
 	},
 	// NOTE: Keep these parameters in sync with the one put into
 	// client/src/helpers/filters/filters.js by scripts/vetted-filters.
@@ -419,6 +476,19 @@ var config = &configuration{
 
 		ParentalBlockHost:     defaultParentalBlockHost,
 		SafeBrowsingBlockHost: defaultSafeBrowsingBlockHost,
+
+		NewDomains: filtering.NewDomainsConfig{
+			BlockHours: 24,
+			Enabled:    false,
+			Block:      false,
+		},
+	},
+	Alerts: &alert.Config{
+		Rules:       []*alert.RuleConfig{},
+		Channels:    []*alert.ChannelConfig{},
+		Interval:    timeutil.Duration{Duration: time.Minute},
+		HistorySize: 100,
+		Enabled:     false,
 	},
 	DHCP: &dhcpd.ServerConfig{
 		LocalDomainName: "lan",
@@ -621,6 +691,9 @@ func (c *configuration) write() (err error) {
 		statsConf := stats.Config{}
 		Context.stats.WriteDiskConfig(&statsConf)
 		config.Stats.Interval = timeutil.Duration{Duration: statsConf.Limit}
+		config.Stats.MinuteInterval = timeutil.Duration{Duration: statsConf.MinuteLimit}
+		config.Stats.HourlyInterval = timeutil.Duration{Duration: statsConf.HourlyLimit}
+		config.Stats.DailyInterval = timeutil.Duration{Duration: statsConf.DailyLimit}
 		config.Stats.Enabled = statsConf.Enabled
 		config.Stats.Ignored = statsConf.Ignored.Values()
 	}
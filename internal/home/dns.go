@@ -13,6 +13,7 @@ import (
 	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/alert"
 	"github.com/AdguardTeam/AdGuardHome/internal/client"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
@@ -55,11 +56,25 @@ func initDNS() (err error) {
 
 	statsConf := stats.Config{
 		Filename:          filepath.Join(statsDir, "stats.db"),
+		RuleHitsFilename:  filepath.Join(statsDir, "rulehits.json"),
+		Backend:           config.Stats.Backend,
 		Limit:             config.Stats.Interval.Duration,
+		MinuteLimit:       config.Stats.MinuteInterval.Duration,
+		HourlyLimit:       config.Stats.HourlyInterval.Duration,
+		DailyLimit:        config.Stats.DailyInterval.Duration,
 		ConfigModified:    onConfigModified,
 		HTTPRegister:      httpRegister,
 		Enabled:           config.Stats.Enabled,
 		ShouldCountClient: Context.clients.shouldCountClient,
+		FindClient:        Context.clients.findStatsClient,
+		FilterListRules: func(id int64) (rules []string, ok bool) {
+			return Context.filters.FilterListRules(id)
+		},
+	}
+
+	if statsConf.Backend == stats.BackendSQLite {
+		statsConf.MigrateFilename = statsConf.Filename
+		statsConf.Filename = filepath.Join(statsDir, "stats.sqlite")
 	}
 
 	engine, err := aghnet.NewIgnoreEngine(config.Stats.Ignored)
@@ -78,12 +93,18 @@ func initDNS() (err error) {
 		ConfigModified:    onConfigModified,
 		HTTPRegister:      httpRegister,
 		FindClient:        Context.clients.findMultiple,
+		HTTPClient:        httpClient(),
+		Remote:            config.QueryLog.Remote,
+		Retention:         config.QueryLog.Retention,
 		BaseDir:           querylogDir,
+		Backend:           config.QueryLog.Backend,
 		AnonymizeClientIP: config.DNS.AnonymizeClientIP,
 		RotationIvl:       config.QueryLog.Interval.Duration,
+		MaxSize:           config.QueryLog.MaxSize.Bytes(),
 		MemSize:           config.QueryLog.MemSize,
 		Enabled:           config.QueryLog.Enabled,
 		FileEnabled:       config.QueryLog.FileEnabled,
+		StoreRequests:     config.QueryLog.StoreRequests,
 	}
 
 	engine, err = aghnet.NewIgnoreEngine(config.QueryLog.Ignored)
@@ -97,6 +118,18 @@ func initDNS() (err error) {
 		return fmt.Errorf("init querylog: %w", err)
 	}
 
+	alertsConf := *config.Alerts
+	alertsConf.HTTPClient = httpClient()
+	alertsConf.HTTPRegister = httpRegister
+	alertsConf.Filename = filepath.Join(Context.getDataDir(), "alerts.json")
+
+	Context.alerts, err = alert.New(&alertsConf)
+	if err != nil {
+		return fmt.Errorf("init alerts: %w", err)
+	}
+
+	Context.clients.setNewClientHandler(Context.alerts.ObserveNewClient)
+
 	Context.filters, err = filtering.New(config.Filtering, nil)
 	if err != nil {
 		// Don't wrap the error, since it's informative enough as is.
@@ -109,6 +142,7 @@ func initDNS() (err error) {
 	return initDNSServer(
 		Context.filters,
 		Context.stats,
+		Context.alerts,
 		Context.queryLog,
 		Context.dhcpServer,
 		anonymizer,
@@ -124,6 +158,7 @@ func initDNS() (err error) {
 func initDNSServer(
 	filters *filtering.DNSFilter,
 	sts stats.Interface,
+	alerts alert.Interface,
 	qlog querylog.QueryLog,
 	dhcpSrv dnsforward.DHCP,
 	anonymizer *aghnet.IPMut,
@@ -133,6 +168,7 @@ func initDNSServer(
 	Context.dnsServer, err = dnsforward.NewServer(dnsforward.DNSCreateParams{
 		DNSFilter:   filters,
 		Stats:       sts,
+		Alerts:      alerts,
 		QueryLog:    qlog,
 		PrivateNets: parseSubnetSet(config.DNS.PrivateNets),
 		Anonymizer:  anonymizer,
@@ -392,20 +428,19 @@ func applyAdditionalFiltering(clientIP netip.Addr, clientID string, setts *filte
 
 	log.Debug("%s: looking for client with ip %s and clientid %q", pref, clientIP, clientID)
 
-	if !clientIP.IsValid() {
-		return
-	}
+	c, ok := Context.clients.find(clientID)
+	if clientIP.IsValid() {
+		setts.ClientIP = clientIP
 
-	setts.ClientIP = clientIP
+		if !ok {
+			c, ok = Context.clients.find(clientIP.String())
+		}
+	}
 
-	c, ok := Context.clients.find(clientID)
 	if !ok {
-		c, ok = Context.clients.find(clientIP.String())
-		if !ok {
-			log.Debug("%s: no clients with ip %s and clientid %q", pref, clientIP, clientID)
+		log.Debug("%s: no clients with ip %s and clientid %q", pref, clientIP, clientID)
 
-			return
-		}
+		return
 	}
 
 	log.Debug("%s: using settings for client %q (%s; %q)", pref, c.Name, clientIP, clientID)
@@ -453,6 +488,7 @@ func startDNSServer() error {
 	Context.filters.Start()
 	Context.stats.Start()
 	Context.queryLog.Start()
+	Context.alerts.Start()
 
 	return nil
 }
@@ -516,6 +552,17 @@ func closeDNSServer() {
 		Context.queryLog.Close()
 	}
 
+	if Context.alerts != nil {
+		Context.clients.setNewClientHandler(nil)
+
+		err := Context.alerts.Close()
+		if err != nil {
+			log.Debug("closing alerts: %s", err)
+		}
+
+		Context.alerts = nil
+	}
+
 	log.Debug("all dns modules are closed")
 }
 
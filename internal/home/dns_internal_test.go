@@ -87,6 +87,17 @@ func TestApplyAdditionalFiltering(t *testing.T) {
 			tc.ParentalEnabled(t, setts.ParentalEnabled)
 		})
 	}
+
+	t.Run("clientid_without_ip", func(t *testing.T) {
+		setts := &filtering.Settings{}
+
+		applyAdditionalFiltering(netip.Addr{}, "custom_filtering", setts)
+		assert.True(t, setts.FilteringEnabled)
+		assert.True(t, setts.SafeSearchEnabled)
+		assert.True(t, setts.SafeBrowsingEnabled)
+		assert.True(t, setts.ParentalEnabled)
+		assert.False(t, setts.ClientIP.IsValid())
+	})
 }
 
 func TestApplyAdditionalFiltering_blockedServices(t *testing.T) {
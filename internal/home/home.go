@@ -24,12 +24,15 @@ import (
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghtls"
+	"github.com/AdguardTeam/AdGuardHome/internal/alert"
 	"github.com/AdguardTeam/AdGuardHome/internal/arpdb"
 	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering/hashprefix"
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering/safesearch"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering/threatintel"
+	"github.com/AdguardTeam/AdGuardHome/internal/firstseen"
 	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
 	"github.com/AdguardTeam/AdGuardHome/internal/stats"
 	"github.com/AdguardTeam/AdGuardHome/internal/updater"
@@ -51,6 +54,7 @@ type homeContext struct {
 	clients    clientsContainer     // per-client-settings module
 	stats      stats.Interface      // statistics module
 	queryLog   querylog.QueryLog    // query log module
+	alerts     *alert.Alerts        // alerts module
 	dnsServer  *dnsforward.Server   // DNS module
 	dhcpServer dhcpd.Interface      // DHCP module
 	auth       *Auth                // HTTP authentication module
@@ -350,6 +354,10 @@ func setupDNSFilteringConf(conf *filtering.Config) (err error) {
 	const (
 		dnsTimeout = 3 * time.Second
 
+		// maxNewDomains is the maximum number of the registered domains
+		// tracked to find the newly observed ones.
+		maxNewDomains = 100_000
+
 		sbService                 = "safe browsing"
 		defaultSafeBrowsingServer = `https://family.adguard-dns.com/dns-query`
 		sbTXTSuffix               = `sb.dns.adguard.com.`
@@ -366,6 +374,8 @@ func setupDNSFilteringConf(conf *filtering.Config) (err error) {
 	}
 
 	conf.ConfigModified = onConfigModified
+	conf.ApplyClientFiltering = applyAdditionalFiltering
+	conf.PruneClientsServices = Context.clients.pruneRemovedServices
 	conf.HTTPRegister = httpRegister
 	conf.DataDir = Context.getDataDir()
 	conf.Filters = slices.Clone(config.Filters)
@@ -400,6 +410,11 @@ func setupDNSFilteringConf(conf *filtering.Config) (err error) {
 		TXTSuffix:   sbTXTSuffix,
 		CacheTime:   cacheTime,
 		CacheSize:   conf.SafeBrowsingCacheSize,
+		Database: hashPrefixDatabaseConfig(
+			conf.SafeBrowsingDatabase,
+			conf.HTTPClient,
+			filepath.Join(conf.DataDir, "filters", "safebrowsing.txt"),
+		),
 	})
 
 	// Protect against invalid configuration, see #6181.
@@ -424,6 +439,11 @@ func setupDNSFilteringConf(conf *filtering.Config) (err error) {
 		TXTSuffix:   pcTXTSuffix,
 		CacheTime:   cacheTime,
 		CacheSize:   conf.ParentalCacheSize,
+		Database: hashPrefixDatabaseConfig(
+			conf.ParentalDatabase,
+			conf.HTTPClient,
+			filepath.Join(conf.DataDir, "filters", "parental.txt"),
+		),
 	})
 
 	// Protect against invalid configuration, see #6181.
@@ -437,6 +457,19 @@ func setupDNSFilteringConf(conf *filtering.Config) (err error) {
 		conf.ParentalBlockHost = host
 	}
 
+	conf.ThreatIntelCheckers, err = newThreatIntelCheckers(conf, upsOpts)
+	if err != nil {
+		return fmt.Errorf("initializing threat intelligence: %w", err)
+	}
+
+	conf.NewDomainTracker, err = firstseen.New(&firstseen.Config{
+		Filename: filepath.Join(conf.DataDir, "newdomains.json"),
+		MaxSize:  maxNewDomains,
+	})
+	if err != nil {
+		return fmt.Errorf("initializing newly observed domains: %w", err)
+	}
+
 	conf.SafeSearchConf.CustomResolver = safeSearchResolver{}
 	conf.SafeSearch, err = safesearch.NewDefault(
 		conf.SafeSearchConf,
@@ -451,6 +484,98 @@ func setupDNSFilteringConf(conf *filtering.Config) (err error) {
 	return nil
 }
 
+// hashPrefixDatabaseConfig returns the configuration of the local hash-prefix
+// database for a hash-prefix checker.  It returns nil if c is nil or has no
+// URL, so that the remote lookup service is used.
+func hashPrefixDatabaseConfig(
+	c *filtering.HashPrefixDatabaseConfig,
+	cli *http.Client,
+	cachePath string,
+) (dbConf *hashprefix.DatabaseConfig) {
+	if c == nil || c.URL == "" {
+		return nil
+	}
+
+	return &hashprefix.DatabaseConfig{
+		HTTPClient:     cli,
+		URL:            c.URL,
+		CachePath:      cachePath,
+		UpdateInterval: c.UpdateInterval.Duration,
+	}
+}
+
+// newThreatIntelCheckers returns the external threat-intelligence checkers for
+// the configuration, mapped by their names.
+func newThreatIntelCheckers(
+	conf *filtering.Config,
+	upsOpts *upstream.Options,
+) (checkers map[string]filtering.Checker, err error) {
+	// threatIntelCacheSize is the maximum number of cached results of each
+	// threat-intelligence checker.
+	const threatIntelCacheSize = 10_000
+
+	// Make the lookups shorter than the upstream timeout, so that a slow
+	// checker doesn't make the clients' requests time out.
+	timeout := upsOpts.Timeout / 2
+
+	err = filtering.ValidateThreatIntel(conf.ThreatIntel)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	checkers = make(map[string]filtering.Checker, len(conf.ThreatIntel))
+	for _, c := range conf.ThreatIntel {
+		var checker filtering.Checker
+		switch c.Type {
+		case filtering.ThreatIntelTypeIOCFile:
+			checker, err = threatintel.NewIOCFile(c.Name, c.Source)
+		case filtering.ThreatIntelTypeHTTPLookup:
+			checker, err = threatintel.NewHTTPLookup(&threatintel.HTTPLookupConfig{
+				Client:      conf.HTTPClient,
+				Name:        c.Name,
+				URLTemplate: c.Source,
+				CacheTime:   c.CacheTime.Duration,
+				Timeout:     timeout,
+				CacheSize:   threatIntelCacheSize,
+			})
+		case filtering.ThreatIntelTypeDNSBL:
+			checker, err = newDNSBLChecker(c, timeout, threatIntelCacheSize)
+		}
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return nil, err
+		}
+
+		checkers[c.Name] = checker
+	}
+
+	return checkers, nil
+}
+
+// newDNSBLChecker returns a new DNS-based blocklist checker for c.  timeout is
+// the timeout of a single lookup.
+func newDNSBLChecker(
+	c *filtering.ThreatIntelConfig,
+	timeout time.Duration,
+	cacheSize uint,
+) (checker *threatintel.DNSBL, err error) {
+	ups, err := upstream.AddressToUpstream(c.Upstream, &upstream.Options{
+		Timeout: timeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dnsbl %q: converting upstream: %w", c.Name, err)
+	}
+
+	return threatintel.NewDNSBL(&threatintel.DNSBLConfig{
+		Upstream:  ups,
+		Name:      c.Name,
+		Zone:      c.Source,
+		CacheTime: c.CacheTime.Duration,
+		CacheSize: cacheSize,
+	})
+}
+
 // checkPorts is a helper for ports validation in config.
 func checkPorts() (err error) {
 	tcpPorts := aghalg.UniqChecker[tcpPort]{}
@@ -559,6 +684,9 @@ func run(opts options, clientBuildFS fs.FS, done chan struct{}) {
 	// data first, but also to avoid relying on automatic Go init() function.
 	filtering.InitModule()
 
+	err = filtering.InitServicesCatalog(Context.getDataDir(), config.Filtering.ServicesCatalog)
+	fatalOnError(err)
+
 	err = initContextClients()
 	fatalOnError(err)
 
@@ -938,7 +1066,7 @@ func cmdlineUpdate(opts options, upd *updater.Updater) {
 	//
 	// TODO(e.burkov):  We could probably initialize the internal resolver
 	// separately.
-	err := initDNSServer(nil, nil, nil, nil, nil, nil, &tlsConfigSettings{})
+	err := initDNSServer(nil, nil, nil, nil, nil, nil, nil, &tlsConfigSettings{})
 	fatalOnError(err)
 
 	log.Info("cmdline update: performing update")
@@ -0,0 +1,516 @@
+package querylog
+
+import (
+	"cmp"
+	"container/heap"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
+)
+
+// aggDimension is a property of the log entries by which they are grouped.
+type aggDimension string
+
+// Aggregation dimensions.
+const (
+	aggDimDomain   aggDimension = "domain"
+	aggDimETLD1    aggDimension = "etld1"
+	aggDimClient   aggDimension = "client"
+	aggDimQType    aggDimension = "qtype"
+	aggDimRCode    aggDimension = "rcode"
+	aggDimUpstream aggDimension = "upstream"
+	aggDimReason   aggDimension = "reason"
+)
+
+// aggBucketSize is the size of the time buckets the log entries are grouped
+// into.
+type aggBucketSize string
+
+// Aggregation bucket sizes.
+const (
+	aggBucketNone   aggBucketSize = ""
+	aggBucketMinute aggBucketSize = "minute"
+	aggBucketHour   aggBucketSize = "hour"
+)
+
+// duration returns the duration of the bucket or zero if there is no
+// bucketing.
+func (s aggBucketSize) duration() (d time.Duration) {
+	switch s {
+	case aggBucketMinute:
+		return time.Minute
+	case aggBucketHour:
+		return time.Hour
+	default:
+		return 0
+	}
+}
+
+const (
+	// defaultAggLimit is the default maximum number of groups within a bucket.
+	defaultAggLimit = 100
+
+	// maxAggBuckets is the maximum number of time buckets in the response.
+	maxAggBuckets = 10_000
+
+	// aggGroupsFactor is the number of the groups kept within a bucket while
+	// aggregating per each group in the response.
+	aggGroupsFactor = 10
+)
+
+// aggParams are the parameters of the aggregation.
+type aggParams struct {
+	// groupBy are the dimensions the entries are grouped by.  If it's empty,
+	// only the totals are calculated.
+	groupBy []aggDimension
+
+	// bucket is the size of the time buckets.
+	bucket aggBucketSize
+
+	// limit is the maximum number of groups within a bucket.  The groups with
+	// the most entries are kept.
+	limit int
+}
+
+// parseAggParams parses the aggregation parameters from the query.
+func parseAggParams(q url.Values) (p *aggParams, err error) {
+	p = &aggParams{
+		bucket: aggBucketSize(q.Get("bucket")),
+		limit:  defaultAggLimit,
+	}
+
+	switch p.bucket {
+	case aggBucketNone, aggBucketMinute, aggBucketHour:
+		// Go on.
+	default:
+		return nil, fmt.Errorf("bucket: unsupported value %q", p.bucket)
+	}
+
+	if groupBy := q.Get("group_by"); groupBy != "" {
+		for _, s := range strings.Split(groupBy, ",") {
+			d := aggDimension(strings.TrimSpace(s))
+			switch d {
+			case
+				aggDimDomain,
+				aggDimETLD1,
+				aggDimClient,
+				aggDimQType,
+				aggDimRCode,
+				aggDimUpstream,
+				aggDimReason:
+				// Go on.
+			default:
+				return nil, fmt.Errorf("group_by: unsupported value %q", d)
+			}
+
+			if slices.Contains(p.groupBy, d) {
+				return nil, fmt.Errorf("group_by: duplicate value %q", d)
+			}
+
+			p.groupBy = append(p.groupBy, d)
+		}
+	}
+
+	if limit := q.Get("group_limit"); limit != "" {
+		p.limit, err = strconv.Atoi(limit)
+		if err != nil {
+			return nil, fmt.Errorf("group_limit: %w", err)
+		} else if p.limit <= 0 {
+			return nil, fmt.Errorf("group_limit: must be positive, got %d", p.limit)
+		}
+	}
+
+	return p, nil
+}
+
+// aggGroup is the aggregated data of a group of log entries.
+type aggGroup struct {
+	// elapsed is the distribution of the processing time of the entries.
+	elapsed aghalg.Sketch
+
+	// joined is the joined values of key.
+	joined string
+
+	// key are the values of the grouping dimensions in the same order as
+	// [aggParams.groupBy].
+	key []string
+
+	// count is the number of the entries.  If the group has replaced another
+	// one, it's an upper bound.
+	count uint64
+
+	// index is the index of the group in [aggBucket.byCount].
+	index int
+}
+
+// aggBucket is the aggregated data of the log entries within a time bucket.
+// The number of its groups is limited using the Space-Saving algorithm: when
+// the limit is reached, the group with the fewest entries is replaced by the
+// new one, which inherits its count.
+type aggBucket struct {
+	// groups are the groups of the bucket by the joined values of their keys.
+	groups map[string]*aggGroup
+
+	// start is the start of the bucket.  It's zero if there is no bucketing.
+	start time.Time
+
+	// byCount are the groups ordered by the number of entries.
+	byCount aggGroupHeap
+
+	// count is the number of the entries within the bucket.
+	count uint64
+
+	// approximate is true if any groups have been replaced.
+	approximate bool
+}
+
+// add adds the entry with the grouping dimensions key and the processing time
+// elapsed to b.  maxGroups is the maximum number of groups in b.
+func (b *aggBucket) add(key []string, elapsed time.Duration, maxGroups int) {
+	b.count++
+
+	joined := strings.Join(key, "\x00")
+	g, ok := b.groups[joined]
+	switch {
+	case ok:
+		g.count++
+		heap.Fix(&b.byCount, g.index)
+	case len(b.groups) < maxGroups:
+		g = &aggGroup{
+			elapsed: aghalg.Sketch{},
+			joined:  joined,
+			key:     key,
+			count:   1,
+		}
+		b.groups[joined] = g
+		heap.Push(&b.byCount, g)
+	default:
+		g = b.byCount[0]
+		delete(b.groups, g.joined)
+
+		g.elapsed, g.joined, g.key = aghalg.Sketch{}, joined, key
+		g.count++
+		b.groups[joined] = g
+		heap.Fix(&b.byCount, 0)
+
+		b.approximate = true
+	}
+
+	g.elapsed.Add(uint64(max(elapsed.Microseconds(), 0)))
+}
+
+// aggGroupHeap is a min-heap of groups by the number of entries.  It
+// implements [heap.Interface].
+type aggGroupHeap []*aggGroup
+
+// type check
+var _ heap.Interface = (*aggGroupHeap)(nil)
+
+// Len implements the [heap.Interface] interface for *aggGroupHeap.
+func (h *aggGroupHeap) Len() (n int) { return len(*h) }
+
+// Less implements the [heap.Interface] interface for *aggGroupHeap.
+func (h *aggGroupHeap) Less(i, j int) (less bool) { return (*h)[i].count < (*h)[j].count }
+
+// Swap implements the [heap.Interface] interface for *aggGroupHeap.
+func (h *aggGroupHeap) Swap(i, j int) {
+	(*h)[i], (*h)[j] = (*h)[j], (*h)[i]
+	(*h)[i].index, (*h)[j].index = i, j
+}
+
+// Push implements the [heap.Interface] interface for *aggGroupHeap.  x must
+// be an *aggGroup.
+func (h *aggGroupHeap) Push(x any) {
+	g := x.(*aggGroup)
+	g.index = len(*h)
+	*h = append(*h, g)
+}
+
+// Pop implements the [heap.Interface] interface for *aggGroupHeap.
+func (h *aggGroupHeap) Pop() (x any) {
+	old := *h
+	n := len(old)
+	g := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+
+	return g
+}
+
+// aggregator is an entryWriter grouping the log entries.
+type aggregator struct {
+	// buckets are the time buckets by their start in Unix seconds.
+	buckets map[int64]*aggBucket
+
+	// anonFunc is used to anonymize the client IP addresses.
+	anonFunc aghnet.IPMutFunc
+
+	params *aggParams
+}
+
+// newAggregator returns a new *aggregator.  anonFunc may be nil.
+func newAggregator(params *aggParams, anonFunc aghnet.IPMutFunc) (a *aggregator) {
+	return &aggregator{
+		buckets:  map[int64]*aggBucket{},
+		anonFunc: anonFunc,
+		params:   params,
+	}
+}
+
+// type check
+var _ entryWriter = (*aggregator)(nil)
+
+// errTooManyBuckets is returned when the aggregation has more buckets than
+// allowed.
+const errTooManyBuckets errors.Error = "too many buckets, narrow the time range"
+
+// writeEntry implements the entryWriter interface for *aggregator.
+func (a *aggregator) writeEntry(e *logEntry) (err error) {
+	var start time.Time
+	if d := a.params.bucket.duration(); d != 0 {
+		start = e.Time.Truncate(d)
+	}
+
+	b, ok := a.buckets[start.Unix()]
+	if !ok {
+		if len(a.buckets) >= maxAggBuckets {
+			return errTooManyBuckets
+		}
+
+		b = &aggBucket{
+			groups: map[string]*aggGroup{},
+			start:  start,
+		}
+		a.buckets[start.Unix()] = b
+	}
+
+	b.add(a.key(e), e.Elapsed, a.params.limit*aggGroupsFactor)
+
+	return nil
+}
+
+// key returns the values of the grouping dimensions for e.
+func (a *aggregator) key(e *logEntry) (key []string) {
+	key = make([]string, 0, len(a.params.groupBy))
+	for _, d := range a.params.groupBy {
+		key = append(key, a.value(e, d))
+	}
+
+	return key
+}
+
+// value returns the value of the dimension d for e.
+func (a *aggregator) value(e *logEntry, d aggDimension) (v string) {
+	switch d {
+	case aggDimDomain:
+		return e.QHost
+	case aggDimETLD1:
+		etld1, err := publicsuffix.EffectiveTLDPlusOne(e.QHost)
+		if err != nil {
+			return e.QHost
+		}
+
+		return etld1
+	case aggDimClient:
+		if e.ClientID != "" {
+			return e.ClientID
+		}
+
+		return a.clientIP(e.IP)
+	case aggDimQType:
+		return e.QType
+	case aggDimRCode:
+		if rcode, ok := answerRCode(e.Answer); ok {
+			return dns.RcodeToString[int(rcode)]
+		}
+
+		return ""
+	case aggDimUpstream:
+		return e.Upstream
+	case aggDimReason:
+		return e.Result.Reason.String()
+	default:
+		panic(fmt.Errorf("unexpected dimension %q", d))
+	}
+}
+
+// clientIP returns the string representation of ip, anonymized if needed.
+func (a *aggregator) clientIP(ip net.IP) (s string) {
+	if a.anonFunc == nil {
+		return ip.String()
+	}
+
+	anonIP := slices.Clone(ip)
+	a.anonFunc(anonIP)
+
+	return anonIP.String()
+}
+
+// close implements the entryWriter interface for *aggregator.
+func (a *aggregator) close() (err error) {
+	return nil
+}
+
+// aggResp is the response to the GET /control/querylog/aggregate HTTP API.
+type aggResp struct {
+	Buckets []*aggBucketJSON `json:"buckets"`
+}
+
+// aggBucketJSON is the JSON representation of a time bucket.
+type aggBucketJSON struct {
+	// Time is the start of the bucket.  It's nil if there is no bucketing.
+	Time *time.Time `json:"time,omitempty"`
+
+	// Groups are the groups with the most entries, sorted by the number of
+	// entries in descending order.
+	Groups []*aggGroupJSON `json:"groups"`
+
+	// Count is the total number of the entries within the bucket.
+	Count uint64 `json:"count"`
+
+	// Approximate is true if the bucket has had too many groups to count all
+	// of them, so the numbers of the entries of the groups are upper bounds.
+	Approximate bool `json:"approximate"`
+}
+
+// aggGroupJSON is the JSON representation of a group.
+type aggGroupJSON struct {
+	// Key are the values of the grouping dimensions.
+	Key map[aggDimension]string `json:"key"`
+
+	// Elapsed are the percentiles of the processing time in milliseconds.
+	Elapsed *percentilesJSON `json:"elapsed_ms"`
+
+	// Count is the number of the entries within the group.
+	Count uint64 `json:"count"`
+}
+
+// percentilesJSON is the JSON representation of a distribution.
+type percentilesJSON struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+}
+
+// response returns the aggregated data, with the buckets sorted by their time.
+func (a *aggregator) response() (resp *aggResp) {
+	resp = &aggResp{
+		Buckets: make([]*aggBucketJSON, 0, len(a.buckets)),
+	}
+
+	for _, b := range a.buckets {
+		resp.Buckets = append(resp.Buckets, a.bucketToJSON(b))
+	}
+
+	slices.SortFunc(resp.Buckets, func(x, y *aggBucketJSON) (res int) {
+		if x.Time == nil || y.Time == nil {
+			return 0
+		}
+
+		return x.Time.Compare(*y.Time)
+	})
+
+	return resp
+}
+
+// bucketToJSON returns the JSON representation of the bucket with at most
+// a.params.limit groups.
+func (a *aggregator) bucketToJSON(b *aggBucket) (bj *aggBucketJSON) {
+	groups := make([]*aggGroup, 0, len(b.groups))
+	for _, g := range b.groups {
+		groups = append(groups, g)
+	}
+
+	slices.SortFunc(groups, func(x, y *aggGroup) (res int) {
+		if res = cmp.Compare(y.count, x.count); res != 0 {
+			return res
+		}
+
+		return slices.Compare(x.key, y.key)
+	})
+
+	if len(groups) > a.params.limit {
+		groups = groups[:a.params.limit]
+	}
+
+	bj = &aggBucketJSON{
+		Groups:      make([]*aggGroupJSON, 0, len(groups)),
+		Count:       b.count,
+		Approximate: b.approximate,
+	}
+
+	if a.params.bucket != aggBucketNone {
+		start := b.start.UTC()
+		bj.Time = &start
+	}
+
+	for _, g := range groups {
+		key := make(map[aggDimension]string, len(g.key))
+		for i, d := range a.params.groupBy {
+			key[d] = g.key[i]
+		}
+
+		bj.Groups = append(bj.Groups, &aggGroupJSON{
+			Key:     key,
+			Elapsed: newPercentilesJSON(g.elapsed),
+			Count:   g.count,
+		})
+	}
+
+	return bj
+}
+
+// newPercentilesJSON returns the percentiles of the durations of sk in
+// milliseconds.  All of them are zero if sk is empty.
+func newPercentilesJSON(sk aghalg.Sketch) (p *percentilesJSON) {
+	p = &percentilesJSON{}
+
+	us := sk.Quantiles(0.5, 0.9, 0.99)
+	if us == nil {
+		return p
+	}
+
+	p.P50, p.P90, p.P99 = us[0]/1000, us[1]/1000, us[2]/1000
+
+	return p
+}
+
+// handleAggregate is the handler for the GET /control/querylog/aggregate HTTP
+// API.  It groups the entries matching the search parameters.
+func (l *queryLog) handleAggregate(w http.ResponseWriter, r *http.Request) {
+	params, err := parseSearchParams(r)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "parsing params: %s", err)
+
+		return
+	}
+
+	ap, err := parseAggParams(r.URL.Query())
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "parsing params: %s", err)
+
+		return
+	}
+
+	a := newAggregator(ap, l.anonymizer.Load())
+	err = l.export(params, a)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusUnprocessableEntity, "aggregating: %s", err)
+
+		return
+	}
+
+	aghhttp.WriteJSONResponseOK(w, r, a.response())
+}
@@ -0,0 +1,195 @@
+package querylog
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregator(t *testing.T) {
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	newEntry := func(offset time.Duration, host, qtype string, elapsed time.Duration) (e *logEntry) {
+		return &logEntry{
+			Time:    start.Add(offset),
+			QHost:   host,
+			QType:   qtype,
+			IP:      net.IP{1, 2, 3, 4},
+			Elapsed: elapsed,
+		}
+	}
+
+	entries := []*logEntry{
+		newEntry(0, "www.example.org", "A", time.Millisecond),
+		newEntry(time.Second, "mail.example.org", "A", 3*time.Millisecond),
+		newEntry(2*time.Second, "example.net", "AAAA", 2*time.Millisecond),
+		newEntry(time.Minute, "example.org", "A", time.Millisecond),
+	}
+
+	aggregate := func(t *testing.T, q url.Values) (resp *aggResp) {
+		t.Helper()
+
+		p, err := parseAggParams(q)
+		require.NoError(t, err)
+
+		a := newAggregator(p, nil)
+		for _, e := range entries {
+			require.NoError(t, a.writeEntry(e))
+		}
+
+		return a.response()
+	}
+
+	t.Run("etld1", func(t *testing.T) {
+		resp := aggregate(t, url.Values{"group_by": {"etld1"}})
+		require.Len(t, resp.Buckets, 1)
+
+		b := resp.Buckets[0]
+		assert.Nil(t, b.Time)
+		assert.Equal(t, uint64(4), b.Count)
+
+		require.Len(t, b.Groups, 2)
+		assert.Equal(t, map[aggDimension]string{aggDimETLD1: "example.org"}, b.Groups[0].Key)
+		assert.Equal(t, uint64(3), b.Groups[0].Count)
+		assert.InDelta(t, 1, b.Groups[0].Elapsed.P50, 0.1)
+
+		// The 0.99 quantile of three durations is at rank 0.99*2, which
+		// rounds down to the second shortest one.
+		assert.InDelta(t, 1, b.Groups[0].Elapsed.P99, 0.1)
+	})
+
+	t.Run("minute", func(t *testing.T) {
+		resp := aggregate(t, url.Values{
+			"group_by":    {"qtype,client"},
+			"bucket":      {"minute"},
+			"group_limit": {"1"},
+		})
+		require.Len(t, resp.Buckets, 2)
+
+		first, second := resp.Buckets[0], resp.Buckets[1]
+		require.NotNil(t, first.Time)
+		assert.Equal(t, start, *first.Time)
+		assert.Equal(t, uint64(3), first.Count)
+
+		require.Len(t, first.Groups, 1)
+		assert.Equal(t, map[aggDimension]string{
+			aggDimQType:  "A",
+			aggDimClient: "1.2.3.4",
+		}, first.Groups[0].Key)
+		assert.Equal(t, uint64(2), first.Groups[0].Count)
+
+		require.NotNil(t, second.Time)
+		assert.Equal(t, start.Add(time.Minute), *second.Time)
+		assert.Equal(t, uint64(1), second.Count)
+	})
+}
+
+func TestAggBucket_add(t *testing.T) {
+	const maxGroups = 2
+
+	b := &aggBucket{
+		groups: map[string]*aggGroup{},
+	}
+
+	for _, host := range []string{"a", "a", "a", "b", "b", "c", "a"} {
+		b.add([]string{host}, time.Millisecond, maxGroups)
+	}
+
+	assert.Equal(t, uint64(7), b.count)
+	assert.True(t, b.approximate)
+
+	require.Len(t, b.groups, maxGroups)
+	require.Contains(t, b.groups, "a")
+	require.Contains(t, b.groups, "c")
+
+	assert.Equal(t, uint64(4), b.groups["a"].count)
+
+	// "c" has replaced "b" and inherited its count.
+	assert.Equal(t, uint64(3), b.groups["c"].count)
+	assert.Equal(t, []string{"c"}, b.groups["c"].key)
+
+	// The replaced group's durations aren't inherited.
+	wantElapsed := aghalg.Sketch{}
+	wantElapsed.Add(uint64(time.Millisecond.Microseconds()))
+	assert.Equal(t, wantElapsed, b.groups["c"].elapsed)
+}
+
+func TestParseAggParams(t *testing.T) {
+	testCases := []struct {
+		query      url.Values
+		name       string
+		wantErrMsg string
+	}{{
+		query:      url.Values{"group_by": {"domain,rcode,upstream,reason"}},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		query:      url.Values{"group_by": {"domain,port"}},
+		name:       "bad_dimension",
+		wantErrMsg: `group_by: unsupported value "port"`,
+	}, {
+		query:      url.Values{"group_by": {"domain,domain"}},
+		name:       "duplicate_dimension",
+		wantErrMsg: `group_by: duplicate value "domain"`,
+	}, {
+		query:      url.Values{"bucket": {"day"}},
+		name:       "bad_bucket",
+		wantErrMsg: `bucket: unsupported value "day"`,
+	}, {
+		query:      url.Values{"group_limit": {"0"}},
+		name:       "bad_limit",
+		wantErrMsg: "group_limit: must be positive, got 0",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseAggParams(tc.query)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestQueryLog_handleAggregate(t *testing.T) {
+	l, err := newQueryLog(Config{
+		Anonymizer:  aghnet.NewIPMut(nil),
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	addEntry(l, "first.example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	require.NoError(t, l.flushLogBuffer())
+
+	addEntry(l, "second.example.org", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 1))
+	addEntry(l, "example.net", net.IPv4(1, 1, 1, 3), net.IPv4(2, 2, 2, 2))
+
+	r := httptest.NewRequest(http.MethodGet, "/control/querylog/aggregate?group_by=etld1", nil)
+	w := httptest.NewRecorder()
+	l.handleAggregate(w, r)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	resp := &aggResp{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+	require.Len(t, resp.Buckets, 1)
+
+	groups := resp.Buckets[0].Groups
+	require.Len(t, groups, 2)
+
+	assert.Equal(t, "example.org", groups[0].Key[aggDimETLD1])
+	assert.Equal(t, uint64(2), groups[0].Count)
+	assert.Equal(t, "example.net", groups[1].Key[aggDimETLD1])
+	assert.Equal(t, uint64(1), groups[1].Count)
+}
@@ -8,8 +8,13 @@ type Client struct {
 	WHOIS          *whois.Info `json:"whois,omitempty"`
 	Name           string      `json:"name"`
 	DisallowedRule string      `json:"disallowed_rule"`
-	Disallowed     bool        `json:"disallowed"`
-	IgnoreQueryLog bool        `json:"-"`
+
+	// Tags are the tags of the persistent client, if any.  They are used to
+	// match the retention policies.
+	Tags []string `json:"-"`
+
+	Disallowed     bool `json:"disallowed"`
+	IgnoreQueryLog bool `json:"-"`
 }
 
 // clientCacheKey is the key by which a cached client information is found.
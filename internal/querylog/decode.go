@@ -115,6 +115,17 @@ var logEntryHandlers = map[string]logEntryHandler{
 
 		return err
 	},
+	"Req": func(t json.Token, ent *logEntry) error {
+		v, ok := t.(string)
+		if !ok {
+			return nil
+		}
+
+		var err error
+		ent.Request, err = base64.StdEncoding.DecodeString(v)
+
+		return err
+	},
 	"ECS": func(t json.Token, ent *logEntry) error {
 		v, ok := t.(string)
 		if !ok {
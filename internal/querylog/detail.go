@@ -0,0 +1,350 @@
+package querylog
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/miekg/dns"
+)
+
+// detailSearchLimit is the maximum number of the entries with the same time
+// checked when looking up an entry.
+const detailSearchLimit = 10
+
+// entryDetailJSON is the response to the GET /control/querylog/entry HTTP API.
+type entryDetailJSON struct {
+	// Time is the time of the entry.
+	Time time.Time `json:"time"`
+
+	// Request is the request.  It's nil if the requests aren't stored.
+	Request *msgJSON `json:"request,omitempty"`
+
+	// Answer is the response sent to the client, if any.
+	Answer *msgJSON `json:"answer,omitempty"`
+
+	// OrigAnswer is the response from the upstream.  It's only set if the
+	// response has been modified by filtering.
+	OrigAnswer *msgJSON `json:"original_answer,omitempty"`
+
+	// Client is the IP address of the client, anonymized if needed.
+	Client string `json:"client"`
+
+	// ClientID is the ClientID of the client, if any.
+	ClientID string `json:"client_id,omitempty"`
+
+	// ECS is the EDNS Client Subnet of the request, if any.
+	ECS string `json:"ecs,omitempty"`
+}
+
+// msgJSON is the JSON representation of a DNS message.
+type msgJSON struct {
+	// EDNS is the EDNS data of the message, if any.
+	EDNS *ednsJSON `json:"edns,omitempty"`
+
+	// Opcode is the name of the opcode of the message.
+	Opcode string `json:"opcode"`
+
+	// RCode is the name of the response code of the message.
+	RCode string `json:"rcode"`
+
+	// Wire is the message in the wire format.  It's only set if requested.
+	Wire []byte `json:"wire,omitempty"`
+
+	// Flags are the names of the header flags set in the message.
+	Flags []string `json:"flags"`
+
+	Question   []*questionJSON `json:"question"`
+	Answer     []*rrJSON       `json:"answer"`
+	Authority  []*rrJSON       `json:"authority"`
+	Additional []*rrJSON       `json:"additional"`
+
+	// ID is the ID of the message.
+	ID uint16 `json:"id"`
+}
+
+// questionJSON is the JSON representation of a question.
+type questionJSON struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class"`
+}
+
+// rrJSON is the JSON representation of a resource record.
+type rrJSON struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class"`
+
+	// Data is the presentation format of the record data.
+	Data string `json:"data"`
+
+	TTL uint32 `json:"ttl"`
+}
+
+// ednsJSON is the JSON representation of the OPT pseudo-record.
+type ednsJSON struct {
+	Options []*ednsOptionJSON `json:"options"`
+
+	// UDPSize is the maximum UDP payload size.
+	UDPSize uint16 `json:"udp_size"`
+
+	Version uint8 `json:"version"`
+
+	// DO is the DNSSEC OK bit.
+	DO bool `json:"do"`
+}
+
+// ednsOptionJSON is the JSON representation of an EDNS option.
+type ednsOptionJSON struct {
+	// Name is the name of the option, if it's known.
+	Name string `json:"name,omitempty"`
+
+	// Value is the presentation format of the option data.
+	Value string `json:"value"`
+
+	Code uint16 `json:"code"`
+}
+
+// ednsOptionNames are the names of the known EDNS options.
+var ednsOptionNames = map[uint16]string{
+	dns.EDNS0LLQ:          "LLQ",
+	dns.EDNS0UL:           "UL",
+	dns.EDNS0NSID:         "NSID",
+	dns.EDNS0ESU:          "ESU",
+	dns.EDNS0DAU:          "DAU",
+	dns.EDNS0DHU:          "DHU",
+	dns.EDNS0N3U:          "N3U",
+	dns.EDNS0SUBNET:       "ECS",
+	dns.EDNS0EXPIRE:       "EXPIRE",
+	dns.EDNS0COOKIE:       "COOKIE",
+	dns.EDNS0TCPKEEPALIVE: "TCP_KEEPALIVE",
+	dns.EDNS0PADDING:      "PADDING",
+	dns.EDNS0EDE:          "EDE",
+}
+
+// msgToJSON returns the JSON representation of the packed DNS message.  mj is
+// nil if data is empty.  The wire format is only included if withWire is true.
+func msgToJSON(data []byte, withWire bool) (mj *msgJSON, err error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	msg := &dns.Msg{}
+	err = msg.Unpack(data)
+	if err != nil {
+		return nil, err
+	}
+
+	mj = &msgJSON{
+		Opcode:     dns.OpcodeToString[msg.Opcode],
+		RCode:      dns.RcodeToString[msg.Rcode],
+		Flags:      msgFlags(msg),
+		Question:   make([]*questionJSON, 0, len(msg.Question)),
+		Answer:     rrsToJSON(msg.Answer),
+		Authority:  rrsToJSON(msg.Ns),
+		Additional: rrsToJSON(msg.Extra),
+		ID:         msg.Id,
+	}
+
+	if withWire {
+		mj.Wire = data
+	}
+
+	for _, q := range msg.Question {
+		mj.Question = append(mj.Question, &questionJSON{
+			Name:  q.Name,
+			Type:  dns.Type(q.Qtype).String(),
+			Class: dns.Class(q.Qclass).String(),
+		})
+	}
+
+	if opt := msg.IsEdns0(); opt != nil {
+		mj.EDNS = optToJSON(opt)
+	}
+
+	return mj, nil
+}
+
+// msgFlags returns the names of the header flags set in msg.
+func msgFlags(msg *dns.Msg) (flags []string) {
+	flags = []string{}
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{name: "qr", set: msg.Response},
+		{name: "aa", set: msg.Authoritative},
+		{name: "tc", set: msg.Truncated},
+		{name: "rd", set: msg.RecursionDesired},
+		{name: "ra", set: msg.RecursionAvailable},
+		{name: "z", set: msg.Zero},
+		{name: "ad", set: msg.AuthenticatedData},
+		{name: "cd", set: msg.CheckingDisabled},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+
+	return flags
+}
+
+// rrsToJSON returns the JSON representation of the resource records, except
+// the OPT pseudo-records.
+func rrsToJSON(rrs []dns.RR) (res []*rrJSON) {
+	res = make([]*rrJSON, 0, len(rrs))
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+
+		res = append(res, &rrJSON{
+			Name:  hdr.Name,
+			Type:  dns.Type(hdr.Rrtype).String(),
+			Class: dns.Class(hdr.Class).String(),
+			Data:  strings.TrimPrefix(rr.String(), hdr.String()),
+			TTL:   hdr.Ttl,
+		})
+	}
+
+	return res
+}
+
+// optToJSON returns the JSON representation of the OPT pseudo-record.
+func optToJSON(opt *dns.OPT) (ej *ednsJSON) {
+	ej = &ednsJSON{
+		Options: make([]*ednsOptionJSON, 0, len(opt.Option)),
+		UDPSize: opt.UDPSize(),
+		Version: opt.Version(),
+		DO:      opt.Do(),
+	}
+
+	for _, o := range opt.Option {
+		code := o.Option()
+		ej.Options = append(ej.Options, &ednsOptionJSON{
+			Name:  ednsOptionNames[code],
+			Value: o.String(),
+			Code:  code,
+		})
+	}
+
+	return ej
+}
+
+// findEntry returns the entry with the exact time t and, if client isn't
+// empty, the client with the IP address or ClientID equal to it.  anonFunc is
+// used to also match the anonymized IP address.  e is nil if there is no such
+// entry.
+func (l *queryLog) findEntry(t time.Time, client string, anonFunc aghnet.IPMutFunc) (e *logEntry) {
+	params := newSearchParams()
+	params.from, params.to = t, t.Add(time.Nanosecond)
+	params.limit, params.maxFileScanEntries = detailSearchLimit, 0
+
+	entries, _ := l.search(params)
+	for _, e = range entries {
+		if !e.Time.Equal(t) {
+			continue
+		}
+
+		if client == "" || client == e.ClientID || client == e.IP.String() {
+			return e
+		}
+
+		anonIP := slices.Clone(e.IP)
+		anonFunc(anonIP)
+		if client == anonIP.String() {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// handleEntry is the handler for the GET /control/querylog/entry HTTP API.  It
+// returns the complete request and responses of the entry found by its time
+// and, optionally, client.
+func (l *queryLog) handleEntry(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	t, err := time.Parse(time.RFC3339Nano, q.Get("time"))
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "time: %s", err)
+
+		return
+	}
+
+	var withWire bool
+	if wire := q.Get("wire"); wire != "" {
+		withWire, err = strconv.ParseBool(wire)
+		if err != nil {
+			aghhttp.Error(r, w, http.StatusBadRequest, "wire: %s", err)
+
+			return
+		}
+	}
+
+	anonFunc := l.anonymizer.Load()
+
+	var e *logEntry
+	func() {
+		l.confMu.RLock()
+		defer l.confMu.RUnlock()
+
+		e = l.findEntry(t, q.Get("client"), anonFunc)
+	}()
+
+	if e == nil {
+		aghhttp.Error(r, w, http.StatusNotFound, "entry not found")
+
+		return
+	}
+
+	resp, err := entryToDetailJSON(e, anonFunc, withWire)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "%s", err)
+
+		return
+	}
+
+	aghhttp.WriteJSONResponseOK(w, r, resp)
+}
+
+// entryToDetailJSON returns the detailed JSON representation of e.
+func entryToDetailJSON(
+	e *logEntry,
+	anonFunc aghnet.IPMutFunc,
+	withWire bool,
+) (resp *entryDetailJSON, err error) {
+	ip := slices.Clone(e.IP)
+	anonFunc(ip)
+
+	resp = &entryDetailJSON{
+		Time:     e.Time,
+		Client:   ip.String(),
+		ClientID: e.ClientID,
+		ECS:      e.ReqECS,
+	}
+
+	resp.Request, err = msgToJSON(e.Request, withWire)
+	if err != nil {
+		return nil, fmt.Errorf("unpacking request: %w", err)
+	}
+
+	resp.Answer, err = msgToJSON(e.Answer, withWire)
+	if err != nil {
+		return nil, fmt.Errorf("unpacking answer: %w", err)
+	}
+
+	resp.OrigAnswer, err = msgToJSON(e.OrigAnswer, withWire)
+	if err != nil {
+		return nil, fmt.Errorf("unpacking original answer: %w", err)
+	}
+
+	return resp, nil
+}
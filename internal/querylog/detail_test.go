@@ -0,0 +1,156 @@
+package querylog
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newDetailTestParams returns the parameters of an entry with the EDNS options
+// in the request and all sections in the response.
+func newDetailTestParams(t *testing.T) (params *AddParams) {
+	t.Helper()
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	req.SetEdns0(1232, true)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.IP{1, 2, 3, 0},
+	}, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: "0102030405060708",
+	})
+
+	resp := (&dns.Msg{}).SetReply(req)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IP{1, 2, 3, 4},
+	}}
+	resp.Ns = []dns.RR{&dns.NS{
+		Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600},
+		Ns:  "ns.example.org.",
+	}}
+	resp.Extra = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "ns.example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+		A:   net.IP{1, 2, 3, 5},
+	}}
+	resp.SetEdns0(1232, true)
+	respOpt := resp.IsEdns0()
+	respOpt.Option = append(respOpt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 4)})
+
+	return &AddParams{
+		Question: req,
+		Answer:   resp,
+		Result:   &filtering.Result{},
+		ClientIP: net.IP{2, 2, 2, 2},
+	}
+}
+
+func TestQueryLog_handleEntry(t *testing.T) {
+	l, err := newQueryLog(Config{
+		Anonymizer:    aghnet.NewIPMut(nil),
+		Enabled:       true,
+		FileEnabled:   true,
+		RotationIvl:   timeutil.Day,
+		MemSize:       100,
+		BaseDir:       t.TempDir(),
+		StoreRequests: true,
+	})
+	require.NoError(t, err)
+
+	l.Add(newDetailTestParams(t))
+	addEntry(l, "other.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 2))
+
+	entries, _ := l.search(newSearchParams())
+	require.Len(t, entries, 2)
+
+	entryTime := entries[1].Time
+
+	get := func(t *testing.T, q url.Values) (w *httptest.ResponseRecorder) {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodGet, "/control/querylog/entry?"+q.Encode(), nil)
+		w = httptest.NewRecorder()
+		l.handleEntry(w, r)
+
+		return w
+	}
+
+	check := func(t *testing.T) {
+		t.Helper()
+
+		w := get(t, url.Values{
+			"time":   {entryTime.Format(time.RFC3339Nano)},
+			"client": {"2.2.2.2"},
+			"wire":   {"true"},
+		})
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		resp := &entryDetailJSON{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+
+		require.NotNil(t, resp.Request)
+		require.NotNil(t, resp.Request.EDNS)
+		assert.True(t, resp.Request.EDNS.DO)
+
+		reqOpts := resp.Request.EDNS.Options
+		require.Len(t, reqOpts, 2)
+		assert.Equal(t, "ECS", reqOpts[0].Name)
+		assert.Equal(t, "1.2.3.0/24/0", reqOpts[0].Value)
+		assert.Equal(t, "COOKIE", reqOpts[1].Name)
+
+		ans := resp.Answer
+		require.NotNil(t, ans)
+		assert.NotEmpty(t, ans.Wire)
+		assert.Equal(t, "NOERROR", ans.RCode)
+		assert.Contains(t, ans.Flags, "qr")
+
+		require.Len(t, ans.Answer, 1)
+		assert.Equal(t, "1.2.3.4", ans.Answer[0].Data)
+
+		require.Len(t, ans.Authority, 1)
+		assert.Equal(t, "NS", ans.Authority[0].Type)
+
+		require.Len(t, ans.Additional, 1)
+		assert.Equal(t, "ns.example.org.", ans.Additional[0].Name)
+
+		require.NotNil(t, ans.EDNS)
+		require.Len(t, ans.EDNS.Options, 1)
+		assert.Equal(t, "PADDING", ans.EDNS.Options[0].Name)
+
+		assert.Nil(t, resp.OrigAnswer)
+	}
+
+	t.Run("memory", check)
+
+	require.NoError(t, l.flushLogBuffer())
+
+	t.Run("file", check)
+
+	t.Run("not_found", func(t *testing.T) {
+		w := get(t, url.Values{
+			"time":   {entryTime.Format(time.RFC3339Nano)},
+			"client": {"3.3.3.3"},
+		})
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("bad_time", func(t *testing.T) {
+		w := get(t, url.Values{"time": {"yesterday"}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
@@ -31,6 +31,10 @@ type logEntry struct {
 	Answer     []byte `json:",omitempty"`
 	OrigAnswer []byte `json:",omitempty"`
 
+	// Request is the request in the wire format.  It's only stored if
+	// [Config.StoreRequests] is true.
+	Request []byte `json:"Req,omitempty"`
+
 	IP net.IP `json:"IP"`
 
 	Result filtering.Result
@@ -69,6 +73,15 @@ func (e *logEntry) addResponse(resp *dns.Msg, isOrig bool) {
 	}
 }
 
+// addRequest sets e.Request to the packed req.  Any errors are logged.
+func (e *logEntry) addRequest(req *dns.Msg) {
+	var err error
+	e.Request, err = req.Pack()
+	if err != nil {
+		log.Error("querylog: packing request: %s", err)
+	}
+}
+
 // parseDNSRewriteResultIPs fills logEntry's DNSRewriteResult response records
 // with the IP addresses parsed from the raw strings.
 func (e *logEntry) parseDNSRewriteResultIPs() {
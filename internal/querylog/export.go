@@ -0,0 +1,406 @@
+package querylog
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnstap"
+	"github.com/AdguardTeam/AdGuardHome/internal/version"
+	"github.com/AdguardTeam/golibs/httphdr"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// exportFormat is the format of the exported query log.
+type exportFormat string
+
+// Export formats.
+const (
+	exportFormatCSV    exportFormat = "csv"
+	exportFormatNDJSON exportFormat = "ndjson"
+	exportFormatDNSTap exportFormat = "dnstap"
+)
+
+// contentType returns the MIME type of the exported data.
+func (f exportFormat) contentType() (ct string) {
+	switch f {
+	case exportFormatCSV:
+		return "text/csv"
+	case exportFormatNDJSON:
+		return "application/x-ndjson"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// dnstapIdentity is the identity of the server in the exported dnstap
+// messages.
+const dnstapIdentity = "AdGuard Home"
+
+// entryWriter writes the exported log entries.
+type entryWriter interface {
+	// writeEntry writes a single log entry.
+	writeEntry(e *logEntry) (err error)
+
+	// close writes the remaining data, if any.
+	close() (err error)
+}
+
+// newEntryWriter returns a new entryWriter writing entries in format f into w.
+// anonFunc is used to anonymize the client IP addresses.
+func newEntryWriter(
+	f exportFormat,
+	w io.Writer,
+	anonFunc aghnet.IPMutFunc,
+) (ew entryWriter, err error) {
+	switch f {
+	case exportFormatCSV:
+		return newCSVEntryWriter(w, anonFunc)
+	case exportFormatNDJSON:
+		return &ndjsonEntryWriter{
+			enc:      json.NewEncoder(w),
+			anonFunc: anonFunc,
+		}, nil
+	case exportFormatDNSTap:
+		var dw *dnstap.Writer
+		dw, err = dnstap.NewWriter(w, dnstapIdentity, version.Version())
+		if err != nil {
+			return nil, err
+		}
+
+		return &dnstapEntryWriter{
+			w:        dw,
+			anonFunc: anonFunc,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported format %q", f)
+	}
+}
+
+// csvHeader is the header of the exported CSV data.
+var csvHeader = []string{
+	"time",
+	"client",
+	"client_id",
+	"client_proto",
+	"name",
+	"type",
+	"class",
+	"status",
+	"answer",
+	"upstream",
+	"elapsed_ms",
+	"cached",
+	"answer_dnssec",
+	"reason",
+	"filter_list_id",
+	"rule",
+	"service_name",
+}
+
+// csvEntryWriter is an entryWriter writing CSV records.
+type csvEntryWriter struct {
+	w        *csv.Writer
+	anonFunc aghnet.IPMutFunc
+}
+
+// newCSVEntryWriter returns a new *csvEntryWriter and writes the header.
+func newCSVEntryWriter(w io.Writer, anonFunc aghnet.IPMutFunc) (cw *csvEntryWriter, err error) {
+	cw = &csvEntryWriter{
+		w:        csv.NewWriter(w),
+		anonFunc: anonFunc,
+	}
+
+	err = cw.w.Write(csvHeader)
+	if err != nil {
+		return nil, fmt.Errorf("writing csv header: %w", err)
+	}
+
+	return cw, nil
+}
+
+// type check
+var _ entryWriter = (*csvEntryWriter)(nil)
+
+// writeEntry implements the entryWriter interface for *csvEntryWriter.
+func (cw *csvEntryWriter) writeEntry(e *logEntry) (err error) {
+	ip := slices.Clone(e.IP)
+	cw.anonFunc(ip)
+
+	var status, answer string
+	ad := e.AuthenticatedData
+	msg := &dns.Msg{}
+	if len(e.Answer) > 0 && msg.Unpack(e.Answer) == nil {
+		status = dns.RcodeToString[msg.Rcode]
+		ad = ad || msg.AuthenticatedData
+
+		var vals []string
+		for _, a := range answerToJSON(msg) {
+			vals = append(vals, a.Type+" "+a.Value)
+		}
+
+		answer = strings.Join(vals, "; ")
+	}
+
+	var filterListID, rule string
+	if len(e.Result.Rules) > 0 {
+		r := e.Result.Rules[0]
+		filterListID, rule = strconv.FormatInt(r.FilterListID, 10), r.Text
+	}
+
+	return cw.w.Write([]string{
+		e.Time.Format(time.RFC3339Nano),
+		ip.String(),
+		e.ClientID,
+		string(e.ClientProto),
+		e.QHost,
+		e.QType,
+		e.QClass,
+		status,
+		answer,
+		e.Upstream,
+		strconv.FormatFloat(e.Elapsed.Seconds()*1000, 'f', -1, 64),
+		strconv.FormatBool(e.Cached),
+		strconv.FormatBool(ad),
+		e.Result.Reason.String(),
+		filterListID,
+		rule,
+		e.Result.ServiceName,
+	})
+}
+
+// close implements the entryWriter interface for *csvEntryWriter.
+func (cw *csvEntryWriter) close() (err error) {
+	cw.w.Flush()
+
+	return cw.w.Error()
+}
+
+// ndjsonEntryWriter is an entryWriter writing newline-delimited JSON objects
+// in the same format as the ones returned by the query log HTTP API.
+type ndjsonEntryWriter struct {
+	enc      *json.Encoder
+	anonFunc aghnet.IPMutFunc
+}
+
+// type check
+var _ entryWriter = (*ndjsonEntryWriter)(nil)
+
+// writeEntry implements the entryWriter interface for *ndjsonEntryWriter.
+func (nw *ndjsonEntryWriter) writeEntry(e *logEntry) (err error) {
+	return nw.enc.Encode(entryToJSON(e, nw.anonFunc))
+}
+
+// close implements the entryWriter interface for *ndjsonEntryWriter.
+func (nw *ndjsonEntryWriter) close() (err error) {
+	return nil
+}
+
+// dnstapEntryWriter is an entryWriter writing a dnstap Frame Stream with a
+// client response message per entry.
+type dnstapEntryWriter struct {
+	w        *dnstap.Writer
+	anonFunc aghnet.IPMutFunc
+}
+
+// type check
+var _ entryWriter = (*dnstapEntryWriter)(nil)
+
+// writeEntry implements the entryWriter interface for *dnstapEntryWriter.
+func (dw *dnstapEntryWriter) writeEntry(e *logEntry) (err error) {
+	ip := slices.Clone(e.IP)
+	dw.anonFunc(ip)
+
+	m := &dnstap.Message{
+		QueryTime:       e.Time,
+		ResponseTime:    e.Time.Add(e.Elapsed),
+		QueryMessage:    questionToMsg(e),
+		ResponseMessage: e.Answer,
+		Type:            dnstap.MessageTypeClientResponse,
+		SocketProtocol:  clientProtoToDNSTap(e.ClientProto),
+	}
+
+	if addr, ok := netip.AddrFromSlice(ip); ok {
+		m.QueryAddr = netip.AddrPortFrom(addr.Unmap(), 0)
+	}
+
+	return dw.w.WriteMessage(m)
+}
+
+// close implements the entryWriter interface for *dnstapEntryWriter.
+func (dw *dnstapEntryWriter) close() (err error) {
+	return dw.w.Close()
+}
+
+// questionToMsg returns the packed query restored from the question of e.  It
+// returns nil if the question can't be packed.
+func questionToMsg(e *logEntry) (b []byte) {
+	q := &dns.Msg{
+		Question: []dns.Question{{
+			Name:   dns.Fqdn(e.QHost),
+			Qtype:  dns.StringToType[e.QType],
+			Qclass: dns.StringToClass[e.QClass],
+		}},
+	}
+
+	b, err := q.Pack()
+	if err != nil {
+		log.Debug("querylog: packing question of %q: %s", e.QHost, err)
+
+		return nil
+	}
+
+	return b
+}
+
+// clientProtoToDNSTap returns the dnstap socket protocol for the client
+// protocol.  It returns zero if the protocol can't be determined, since plain
+// DNS and DNSCrypt may be used over both UDP and TCP.
+func clientProtoToDNSTap(cp ClientProto) (sp dnstap.SocketProtocol) {
+	switch cp {
+	case ClientProtoDoH:
+		return dnstap.SocketProtocolDoH
+	case ClientProtoDoT:
+		return dnstap.SocketProtocolDoT
+	case ClientProtoDoQ:
+		return dnstap.SocketProtocolDoQ
+	default:
+		return 0
+	}
+}
+
+// handleExport is the handler for the GET /control/querylog/export HTTP API.
+// It streams all the entries matching the search parameters, from newer to
+// older ones, without loading them into memory.
+func (l *queryLog) handleExport(w http.ResponseWriter, r *http.Request) {
+	params, err := parseSearchParams(r)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "parsing params: %s", err)
+
+		return
+	}
+
+	f := exportFormat(r.URL.Query().Get("format"))
+	switch f {
+	case exportFormatCSV, exportFormatNDJSON, exportFormatDNSTap:
+		// Go on.
+	default:
+		aghhttp.Error(r, w, http.StatusBadRequest, "unsupported format %q", f)
+
+		return
+	}
+
+	h := w.Header()
+	h.Set(httphdr.ContentType, f.contentType())
+	h.Set(httphdr.ContentDisposition, fmt.Sprintf(`attachment; filename="querylog.%s"`, f))
+
+	ew, err := newEntryWriter(f, w, l.anonymizer.Load())
+	if err == nil {
+		err = l.export(params, ew)
+	}
+
+	if err != nil {
+		// Don't respond with an error, since the response has already been
+		// started.
+		log.Error("querylog: exporting: %s", err)
+	}
+}
+
+// export writes all the log entries matching params into ew, first from the
+// memory buffer and then from the files.  Unlike search, it only locks
+// l.confMu to prepare the reading, since the export may take long.
+func (l *queryLog) export(params *searchParams, ew entryWriter) (err error) {
+	params.offset, params.limit, params.maxFileScanEntries = 0, 0, 0
+
+	cache := clientCache{}
+
+	var memEntries []*logEntry
+	var r entryReader
+	var ignored *aghnet.IgnoreEngine
+	func() {
+		l.confMu.RLock()
+		defer l.confMu.RUnlock()
+
+		memEntries, _ = l.searchMemory(params, cache)
+
+		var rErr error
+		clientFinder := quickMatchClientFinder{
+			client: l.client,
+			cache:  cache,
+		}
+
+		filter := params.blockFilter(clientFinder.findClient)
+		r, rErr = l.storage.newEntryReader(params.seekTime(), filter)
+		if rErr != nil {
+			log.Error("querylog: %s", rErr)
+		}
+
+		ignored = l.conf.Ignored
+	}()
+
+	if r != nil {
+		defer func() {
+			if closeErr := r.Close(); closeErr != nil {
+				log.Error("querylog: closing file: %s", closeErr)
+			}
+		}()
+	}
+
+	for _, e := range memEntries {
+		err = ew.writeEntry(e)
+		if err != nil {
+			return fmt.Errorf("writing entry: %w", err)
+		}
+	}
+
+	if r != nil {
+		err = l.exportFiles(r, params, cache, ignored, ew)
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return err
+		}
+	}
+
+	return ew.close()
+}
+
+// exportFiles writes all the log entries from r matching params into ew.
+func (l *queryLog) exportFiles(
+	r entryReader,
+	params *searchParams,
+	cache clientCache,
+	ignored *aghnet.IgnoreEngine,
+	ew entryWriter,
+) (err error) {
+	for {
+		e, ts, rErr := l.readNextEntry(r, params, cache, ignored)
+		if rErr == io.EOF {
+			return nil
+		} else if rErr != nil {
+			log.Error("querylog: reading next entry: %s", rErr)
+
+			continue
+		}
+
+		if ts != 0 && params.isTooOld(time.Unix(0, ts)) {
+			return nil
+		} else if e == nil {
+			continue
+		}
+
+		err = ew.writeEntry(e)
+		if err != nil {
+			return fmt.Errorf("writing entry: %w", err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package querylog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnstap"
+	"github.com/AdguardTeam/golibs/httphdr"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLog_handleExport(t *testing.T) {
+	l, err := newQueryLog(Config{
+		BaseDir:     t.TempDir(),
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		Enabled:     true,
+		FileEnabled: true,
+		Anonymizer:  aghnet.NewIPMut(nil),
+	})
+	require.NoError(t, err)
+	t.Cleanup(l.Close)
+
+	addEntry(l, "file.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	require.NoError(t, l.flushLogBuffer())
+
+	addEntry(l, "memory.example", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+
+	export := func(t *testing.T, query string) (w *httptest.ResponseRecorder) {
+		t.Helper()
+
+		w = httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/control/querylog/export?"+query, nil)
+		l.handleExport(w, r)
+
+		return w
+	}
+
+	t.Run("csv", func(t *testing.T) {
+		w := export(t, "format=csv")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		assert.Equal(t, "text/csv", w.Header().Get(httphdr.ContentType))
+
+		records, rErr := csv.NewReader(w.Body).ReadAll()
+		require.NoError(t, rErr)
+		require.Len(t, records, 3)
+
+		assert.Equal(t, csvHeader, records[0])
+
+		rec := records[1]
+		require.Len(t, rec, len(csvHeader))
+
+		assert.Equal(t, "2.2.2.2", rec[1])
+		assert.Equal(t, "memory.example", rec[4])
+		assert.Equal(t, "NOERROR", rec[7])
+		assert.Equal(t, "A 1.1.1.2", rec[8])
+		assert.Equal(t, "SomeRule", rec[15])
+
+		assert.Equal(t, "file.example", records[2][4])
+	})
+
+	t.Run("ndjson_search", func(t *testing.T) {
+		w := export(t, "format=ndjson&search=file")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var hosts []string
+		s := bufio.NewScanner(w.Body)
+		for s.Scan() {
+			var obj struct {
+				Question struct {
+					Name string `json:"name"`
+				} `json:"question"`
+			}
+
+			require.NoError(t, json.Unmarshal(s.Bytes(), &obj))
+
+			hosts = append(hosts, obj.Question.Name)
+		}
+
+		assert.Equal(t, []string{"file.example"}, hosts)
+	})
+
+	t.Run("dnstap", func(t *testing.T) {
+		w := export(t, "format=dnstap")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		b := w.Body.Bytes()
+
+		// Count the data frames between the start and the stop frames.
+		frames := 0
+		for len(b) >= 4 {
+			l := binary.BigEndian.Uint32(b)
+			if l == 0 {
+				// Control frame.
+				require.GreaterOrEqual(t, len(b), 8)
+
+				cl := binary.BigEndian.Uint32(b[4:])
+				b = b[8+cl:]
+
+				continue
+			}
+
+			frames++
+			b = b[4+l:]
+		}
+
+		assert.Empty(t, b)
+		assert.Equal(t, 2, frames)
+		assert.True(t, bytes.Contains(w.Body.Bytes(), []byte(dnstap.ContentType)))
+	})
+
+	t.Run("bad_format", func(t *testing.T) {
+		w := export(t, "format=xml")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
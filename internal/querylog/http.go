@@ -66,6 +66,10 @@ func (l *queryLog) initWeb() {
 		"/control/querylog/config/update",
 		l.handlePutQueryLogConfig,
 	)
+	l.conf.HTTPRegister(http.MethodGet, "/control/querylog/export", l.handleExport)
+	l.conf.HTTPRegister(http.MethodGet, "/control/querylog/aggregate", l.handleAggregate)
+	l.conf.HTTPRegister(http.MethodGet, "/control/querylog/entry", l.handleEntry)
+	l.conf.HTTPRegister(http.MethodPost, "/control/querylog/purge", l.handlePurge)
 
 	// Deprecated handlers.
 	l.conf.HTTPRegister(http.MethodGet, "/control/querylog_info", l.handleQueryLogInfo)
@@ -269,6 +273,22 @@ func (l *queryLog) handlePutQueryLogConfig(w http.ResponseWriter, r *http.Reques
 	l.conf = &conf
 }
 
+// parseTimeParam parses the optional RFC 3339 time from the query parameter.
+// t is zero if the parameter isn't set.
+func parseTimeParam(q url.Values, name string) (t time.Time, err error) {
+	val := q.Get(name)
+	if val == "" {
+		return time.Time{}, nil
+	}
+
+	t, err = time.Parse(time.RFC3339Nano, val)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return t, nil
+}
+
 // "value" -> value, return TRUE
 func getDoubleQuotesEnclosedValue(s *string) bool {
 	t := *s
@@ -292,7 +312,12 @@ func parseSearchCriterion(q url.Values, name string, ct criterionType) (
 
 	strict := getDoubleQuotesEnclosedValue(&val)
 
-	var asciiVal string
+	sc = searchCriterion{
+		criterionType: ct,
+		value:         val,
+		strict:        strict,
+	}
+
 	switch ct {
 	case ctTerm:
 		// Decode lowercased value from punycode to make EqualFold and
@@ -300,30 +325,23 @@ func parseSearchCriterion(q url.Values, name string, ct criterionType) (
 		//
 		// TODO(e.burkov):  Make it work with parts of IDNAs somehow.
 		loweredVal := strings.ToLower(val)
-		if asciiVal, err = idna.ToASCII(loweredVal); err != nil {
+		if sc.asciiVal, err = idna.ToASCII(loweredVal); err != nil {
 			log.Debug("can't convert %q to ascii: %s", val, err)
-		} else if asciiVal == loweredVal {
+			sc.asciiVal = ""
+		} else if sc.asciiVal == loweredVal {
 			// Purge asciiVal to prevent checking the same value
 			// twice.
-			asciiVal = ""
+			sc.asciiVal = ""
 		}
 	case ctFilteringStatus:
 		if !stringutil.InSlice(filteringStatusValues, val) {
 			return false, sc, fmt.Errorf("invalid value %s", val)
 		}
 	default:
-		return false, sc, fmt.Errorf(
-			"invalid criterion type %v: should be one of %v",
-			ct,
-			[]criterionType{ctTerm, ctFilteringStatus},
-		)
-	}
-
-	sc = searchCriterion{
-		criterionType: ct,
-		value:         val,
-		asciiVal:      asciiVal,
-		strict:        strict,
+		err = sc.parseStructuredValue(val)
+		if err != nil {
+			return false, sc, fmt.Errorf("%s: %w", name, err)
+		}
 	}
 
 	return true, sc, nil
@@ -343,6 +361,20 @@ func parseSearchParams(r *http.Request) (p *searchParams, err error) {
 		}
 	}
 
+	p.from, err = parseTimeParam(q, "from")
+	if err != nil {
+		return nil, err
+	}
+
+	p.to, err = parseTimeParam(q, "to")
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.from.IsZero() && !p.to.IsZero() && !p.from.Before(p.to) {
+		return nil, fmt.Errorf("from: %s is not before to: %s", p.from, p.to)
+	}
+
 	var limit64 int64
 	if limit64, err = strconv.ParseInt(q.Get("limit"), 10, 64); err == nil {
 		p.limit = int(limit64)
@@ -366,6 +398,39 @@ func parseSearchParams(r *http.Request) (p *searchParams, err error) {
 	}, {
 		urlField: "response_status",
 		ct:       ctFilteringStatus,
+	}, {
+		urlField: "qtype",
+		ct:       ctQType,
+	}, {
+		urlField: "rcode",
+		ct:       ctRCode,
+	}, {
+		urlField: "upstream",
+		ct:       ctUpstream,
+	}, {
+		urlField: "client_proto",
+		ct:       ctClientProto,
+	}, {
+		urlField: "reason",
+		ct:       ctReason,
+	}, {
+		urlField: "filter_list_id",
+		ct:       ctFilterListID,
+	}, {
+		urlField: "rule",
+		ct:       ctRule,
+	}, {
+		urlField: "elapsed_min",
+		ct:       ctElapsedMin,
+	}, {
+		urlField: "elapsed_max",
+		ct:       ctElapsedMax,
+	}, {
+		urlField: "cached",
+		ct:       ctCached,
+	}, {
+		urlField: "answer_dnssec",
+		ct:       ctAuthenticatedData,
 	}} {
 		var ok bool
 		var c searchCriterion
@@ -0,0 +1,236 @@
+package querylog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/stringutil"
+	"golang.org/x/net/idna"
+)
+
+// purgeFilter defines the entries removed from the query log on request.  An
+// entry is removed if it matches both the clients and the domains.
+type purgeFilter struct {
+	findClient quickMatchClientFunc
+
+	// clients matches the clients of the removed entries.  If it's nil, the
+	// entries of all clients are matched.
+	clients *clientMatcher
+
+	// domains are the lowercased ASCII question domains of the removed
+	// entries.  If it's nil, all domains are matched.
+	domains *stringutil.Set
+}
+
+// match returns true if e should be removed.
+func (f *purgeFilter) match(e *logEntry) (ok bool) {
+	if f.domains != nil && !f.domains.Has(strings.ToLower(e.QHost)) {
+		return false
+	}
+
+	if f.clients == nil {
+		return true
+	}
+
+	ip := e.IP.String()
+
+	return f.clients.match(e.ClientID, ip, f.findClient(e.ClientID, ip))
+}
+
+// mayMatchBlock returns false if none of the entries of b can be removed.
+func (f *purgeFilter) mayMatchBlock(b *segmentBlock) (ok bool) {
+	if f.domains != nil && !f.mayMatchDomains(b.Domains) {
+		return false
+	}
+
+	if f.clients == nil || b.ClientsOverflow {
+		return true
+	}
+
+	for _, c := range b.Clients {
+		if f.clients.match(c.ClientID, c.IP, f.findClient(c.ClientID, c.IP)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mayMatchDomains returns false if none of f.domains are in domains.
+func (f *purgeFilter) mayMatchDomains(domains bloomFilter) (ok bool) {
+	for _, d := range f.domains.Values() {
+		if domains.has(d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mayMatchSegment returns false if none of the entries of the segment can be
+// removed.  It returns true if the index of the segment can't be read.
+func (f *purgeFilter) mayMatchSegment(seg *segmentInfo) (ok bool) {
+	idx, err := readSegmentIndex(seg.path)
+	if err != nil {
+		log.Debug("querylog: reading index of %q: %s; checking entries", seg.path, err)
+
+		return true
+	}
+
+	for _, b := range idx.Blocks {
+		if f.mayMatchBlock(b) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// purge removes the entries matching f from the memory buffer and all the
+// query log files.  removed is the number of the removed entries.  It doesn't
+// stop on errors and returns all of them joined.
+func (l *queryLog) purge(f *purgeFilter) (removed int, err error) {
+	l.fileFlushLock.Lock()
+	defer l.fileFlushLock.Unlock()
+
+	removed = l.filterBuffer(f.match)
+
+	n, err := l.storage.removeEntries(f)
+
+	return removed + n, err
+}
+
+// removeEntries implements the [entryStorage] interface for *queryLog.  It
+// removes the entries matching f from all the query log files.  It doesn't
+// stop on errors and returns all of them joined.
+func (l *queryLog) removeEntries(f *purgeFilter) (removed int, err error) {
+	l.fileWriteLock.Lock()
+	defer l.fileWriteLock.Unlock()
+
+	var errs []error
+	for _, path := range []string{l.logFile, l.legacyLogFile()} {
+		n, fErr := filterLogFile(path, f.match)
+		if fErr != nil {
+			errs = append(errs, fErr)
+		}
+
+		removed += n
+	}
+
+	segs, err := listSegments(l.logFile)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, s := range segs {
+		if !f.mayMatchSegment(s) {
+			continue
+		}
+
+		n, rErr := rewriteSegment(l.logFile, s, f.match)
+		if rErr != nil {
+			errs = append(errs, fmt.Errorf("segment %q: %w", s.path, rErr))
+		}
+
+		removed += n
+	}
+
+	return removed, errors.Join(errs...)
+}
+
+// purgeReq is the request to the POST /control/querylog/purge HTTP API.
+type purgeReq struct {
+	// Clients are the IP addresses, ClientIDs, and names of the clients.
+	Clients []string `json:"clients"`
+
+	// Domains are the question domains.
+	Domains []string `json:"domains"`
+}
+
+// purgeResp is the response to the POST /control/querylog/purge HTTP API.
+type purgeResp struct {
+	// Removed is the number of the removed entries.
+	Removed int `json:"removed"`
+}
+
+// newPurgeFilter returns a new *purgeFilter for the request.
+func newPurgeFilter(req *purgeReq, findClient quickMatchClientFunc) (f *purgeFilter, err error) {
+	if len(req.Clients) == 0 && len(req.Domains) == 0 {
+		return nil, errors.Error("no clients or domains")
+	}
+
+	f = &purgeFilter{
+		findClient: findClient,
+	}
+
+	if len(req.Clients) > 0 {
+		for i, c := range req.Clients {
+			if c == "" {
+				return nil, fmt.Errorf("clients: empty value at index %d", i)
+			}
+		}
+
+		f.clients = newClientMatcher(req.Clients, nil)
+	}
+
+	if len(req.Domains) > 0 {
+		f.domains = stringutil.NewSet()
+		for i, d := range req.Domains {
+			d = strings.ToLower(strings.TrimSuffix(d, "."))
+			if d == "" {
+				return nil, fmt.Errorf("domains: empty value at index %d", i)
+			}
+
+			var ascii string
+			ascii, err = idna.ToASCII(d)
+			if err != nil {
+				return nil, fmt.Errorf("domains: at index %d: %w", i, err)
+			}
+
+			f.domains.Add(ascii)
+		}
+	}
+
+	return f, nil
+}
+
+// handlePurge is the handler for the POST /control/querylog/purge HTTP API.
+func (l *queryLog) handlePurge(w http.ResponseWriter, r *http.Request) {
+	req := &purgeReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "decoding request: %s", err)
+
+		return
+	}
+
+	clientFinder := quickMatchClientFinder{
+		client: l.client,
+		cache:  clientCache{},
+	}
+
+	f, err := newPurgeFilter(req, clientFinder.findClient)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusUnprocessableEntity, "%s", err)
+
+		return
+	}
+
+	removed, err := l.purge(f)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusInternalServerError, "purging: %s", err)
+
+		return
+	}
+
+	log.Info("querylog: purged %d entries", removed)
+
+	aghhttp.WriteJSONResponseOK(w, r, &purgeResp{
+		Removed: removed,
+	})
+}
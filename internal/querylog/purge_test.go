@@ -0,0 +1,100 @@
+package querylog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLog_purge(t *testing.T) {
+	l, err := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	legacyData, _ := newTestSegmentData(testSegmentStart.Add(-timeutil.Day), 8)
+	err = os.WriteFile(l.legacyLogFile(), legacyData, 0o644)
+	require.NoError(t, err)
+
+	writeTestSegments(t, l, 1, 100)
+
+	addEntry(l, "host1.example", net.IPv4(1, 1, 1, 1), net.IPv4(10, 0, 0, 1))
+	require.NoError(t, l.flushLogBuffer())
+
+	addEntry(l, "host1.example", net.IPv4(1, 1, 1, 1), net.IPv4(10, 0, 0, 1))
+	addEntry(l, "other.example", net.IPv4(1, 1, 1, 1), net.IPv4(10, 0, 0, 1))
+	addEntry(l, "other.example", net.IPv4(1, 1, 1, 1), net.IPv4(10, 0, 0, 2))
+
+	total := len(searchClients(t, l))
+	require.Equal(t, 8+100+1+3, total)
+
+	purge := func(t *testing.T, req *purgeReq) (removed int) {
+		t.Helper()
+
+		b, mErr := json.Marshal(req)
+		require.NoError(t, mErr)
+
+		r := httptest.NewRequest(http.MethodPost, "/control/querylog/purge", bytes.NewReader(b))
+		w := httptest.NewRecorder()
+		l.handlePurge(w, r)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		resp := &purgeResp{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+
+		return resp.Removed
+	}
+
+	t.Run("client_and_domain", func(t *testing.T) {
+		// One entry from each of the legacy file, the segment, the current
+		// file, and the memory buffer.
+		removed := purge(t, &purgeReq{
+			Clients: []string{"10.0.0.1"},
+			Domains: []string{"HOST1.example."},
+		})
+		assert.Equal(t, 4, removed)
+
+		total -= removed
+		assert.Len(t, searchClients(t, l), total)
+	})
+
+	t.Run("client", func(t *testing.T) {
+		removed := purge(t, &purgeReq{
+			Clients: []string{"10.0.0.1"},
+		})
+		assert.Equal(t, 1+24+1, removed)
+
+		total -= removed
+		ips := searchClients(t, l)
+		assert.Len(t, ips, total)
+		assert.NotContains(t, ips, "10.0.0.1")
+	})
+
+	t.Run("domain", func(t *testing.T) {
+		removed := purge(t, &purgeReq{
+			Domains: []string{"host2.example"},
+		})
+		assert.Equal(t, 2, removed)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/control/querylog/purge", strings.NewReader("{}"))
+		w := httptest.NewRecorder()
+		l.handlePurge(w, r)
+
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	})
+}
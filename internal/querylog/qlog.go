@@ -16,8 +16,8 @@ import (
 	"github.com/miekg/dns"
 )
 
-// queryLogFileName is a name of the log file.  ".gz" extension is added later
-// during compression.
+// queryLogFileName is a name of the log file.  The names of the compressed
+// segments start with it, see [segmentName].
 const queryLogFileName = "querylog.json"
 
 // queryLog is a structure that writes and reads the DNS query log.
@@ -34,6 +34,10 @@ type queryLog struct {
 	// be modified.
 	buffer *aghalg.RingBuffer[*logEntry]
 
+	// storage is the persistent storage of the entries.  It's the queryLog
+	// itself, unless another backend is configured.
+	storage entryStorage
+
 	// logFile is the path to the log file.
 	logFile string
 
@@ -44,6 +48,10 @@ type queryLog struct {
 	fileFlushLock sync.Mutex
 	fileWriteLock sync.Mutex
 
+	// remotes are the remote destinations the entries are streamed to.  It's
+	// not modified after the creation.
+	remotes []*remoteSink
+
 	flushPending bool
 }
 
@@ -85,6 +93,10 @@ func (l *queryLog) Start() {
 }
 
 func (l *queryLog) Close() {
+	for _, r := range l.remotes {
+		r.close()
+	}
+
 	l.confMu.RLock()
 	defer l.confMu.RUnlock()
 
@@ -94,6 +106,11 @@ func (l *queryLog) Close() {
 			log.Error("querylog: closing: %s", err)
 		}
 	}
+
+	err := l.storage.closeStorage()
+	if err != nil {
+		log.Error("querylog: closing storage: %s", err)
+	}
 }
 
 func checkInterval(ivl time.Duration) (ok bool) {
@@ -143,18 +160,39 @@ func (l *queryLog) clear() {
 		l.flushPending = false
 	}()
 
-	oldLogFile := l.logFile + ".1"
+	l.storage.clearEntries()
+
+	log.Debug("querylog: cleared")
+}
+
+// clearEntries implements the [entryStorage] interface for *queryLog.  It
+// removes all the query log files and segments.
+func (l *queryLog) clearEntries() {
+	l.fileWriteLock.Lock()
+	defer l.fileWriteLock.Unlock()
+
+	oldLogFile := l.legacyLogFile()
 	err := os.Remove(oldLogFile)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		log.Error("removing old log file %q: %s", oldLogFile, err)
 	}
 
+	segs, err := listSegments(l.logFile)
+	if err != nil {
+		log.Error("listing segments: %s", err)
+	}
+
+	for _, seg := range segs {
+		err = removeSegment(seg.path)
+		if err != nil {
+			log.Error("removing segment: %s", err)
+		}
+	}
+
 	err = os.Remove(l.logFile)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		log.Error("removing log file %q: %s", l.logFile, err)
 	}
-
-	log.Debug("querylog: cleared")
 }
 
 // newLogEntry creates an instance of logEntry from parameters.
@@ -195,14 +233,17 @@ func newLogEntry(params *AddParams) (entry *logEntry) {
 
 // Add implements the [QueryLog] interface for *queryLog.
 func (l *queryLog) Add(params *AddParams) {
-	var isEnabled, fileIsEnabled bool
+	var isEnabled, fileIsEnabled, storeRequests bool
 	var memSize uint
+	var ignored *aghnet.IgnoreEngine
 	func() {
 		l.confMu.RLock()
 		defer l.confMu.RUnlock()
 
 		isEnabled, fileIsEnabled = l.conf.Enabled, l.conf.FileEnabled
+		storeRequests = l.conf.StoreRequests
 		memSize = l.conf.MemSize
+		ignored = l.conf.Ignored
 	}()
 
 	if !isEnabled {
@@ -221,6 +262,15 @@ func (l *queryLog) Add(params *AddParams) {
 	}
 
 	entry := newLogEntry(params)
+	if storeRequests {
+		entry.addRequest(params.Question)
+	}
+
+	if len(l.remotes) > 0 && !ignored.Has(entry.QHost) {
+		for _, r := range l.remotes {
+			r.send(entry)
+		}
+	}
 
 	l.bufferLock.Lock()
 	defer l.bufferLock.Unlock()
@@ -4,11 +4,35 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 )
 
+// qLogFileReader is a single query log file or segment that can be read in the
+// reverse order.
+type qLogFileReader interface {
+	// seekTS sets the position to the record with the specified timestamp.
+	// See [qLogFile.seekTS] and [qLogSegment.seekTS].
+	seekTS(timestamp int64) (pos int64, depth int, err error)
+
+	// SeekStart sets the position to the end of the file, where the newest
+	// record is.
+	SeekStart() (pos int64, err error)
+
+	// ReadNext reads the line at the current position and moves the position
+	// to the previous line.  It returns io.EOF if there is nothing more to
+	// read.
+	ReadNext() (line string, err error)
+
+	// Close frees the underlying resources.
+	Close() (err error)
+}
+
+// type check
+var _ qLogFileReader = (*qLogFile)(nil)
+
 // qLogReader allows reading from multiple query log files in the reverse
 // order.
 //
@@ -16,20 +40,22 @@ import (
 // pointer to a particular query log file, and to a specific position in this
 // file, and it reads lines in reverse order starting from that position.
 type qLogReader struct {
-	// qFiles is an array with the query log files.  The order is from oldest
-	// to newest.
-	qFiles []*qLogFile
+	// qFiles is an array with the query log files and segments.  The order is
+	// from oldest to newest.
+	qFiles []qLogFileReader
 
 	// currentFile is the index of the current file.
 	currentFile int
 }
 
 // newQLogReader initializes a qLogReader instance with the specified files.
-func newQLogReader(files []string) (*qLogReader, error) {
-	qFiles := make([]*qLogFile, 0)
+// The files with the segmentExt extension are read as segments, skipping the
+// blocks rejected by filter, if it's not nil.
+func newQLogReader(files []string, filter blockFilter) (*qLogReader, error) {
+	qFiles := make([]qLogFileReader, 0)
 
 	for _, f := range files {
-		q, err := newQLogFile(f)
+		q, err := newQLogFileReader(f, filter)
 		if err != nil {
 			if errors.Is(err, os.ErrNotExist) {
 				continue
@@ -50,6 +76,15 @@ func newQLogReader(files []string) (*qLogReader, error) {
 	return &qLogReader{qFiles: qFiles, currentFile: len(qFiles) - 1}, nil
 }
 
+// newQLogFileReader returns a reader of the query log file or segment at path.
+func newQLogFileReader(path string, filter blockFilter) (q qLogFileReader, err error) {
+	if strings.HasSuffix(path, segmentExt) {
+		return newQLogSegment(path, filter)
+	}
+
+	return newQLogFile(path)
+}
+
 // seekTS performs binary search of a query log record with the specified
 // timestamp.  If the record is found, it sets qLogReader's position to point
 // to that line, so that the next ReadNext call returned this line.
@@ -65,9 +100,13 @@ func (r *qLogReader) seekTS(timestamp int64) (err error) {
 
 				continue
 			} else if errors.Is(err, errTSTooLate) {
-				// Just seek to the start then.  timestamp is probably between
-				// the end of the previous one and the start of this one.
-				return r.SeekStart()
+				// Just seek to the start of this file then.  timestamp is
+				// probably between the end of this one and the start of the
+				// next one.
+				r.currentFile = i
+				_, err = q.SeekStart()
+
+				return err
 			} else if errors.Is(err, errTSNotFound) {
 				return err
 			} else {
@@ -149,8 +188,8 @@ func (r *qLogReader) Close() error {
 	return closeQFiles(r.qFiles)
 }
 
-// closeQFiles is a helper method to close multiple qLogFile instances.
-func closeQFiles(qFiles []*qLogFile) (err error) {
+// closeQFiles is a helper method to close multiple qLogFileReader instances.
+func closeQFiles(qFiles []qLogFileReader) (err error) {
 	var errs []error
 
 	for _, q := range qFiles {
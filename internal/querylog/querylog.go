@@ -3,6 +3,7 @@ package querylog
 import (
 	"fmt"
 	"net"
+	"net/http"
 	"path/filepath"
 	"sync"
 	"time"
@@ -53,14 +54,36 @@ type Config struct {
 	// FindClient returns client information by their IDs.
 	FindClient func(ids []string) (c *Client, err error)
 
+	// HTTPClient is used to send the entries to the HTTP and Loki remote
+	// destinations.  If it's nil, [http.DefaultClient] is used.
+	HTTPClient *http.Client
+
+	// Remote are the configurations of the remote destinations the entries
+	// are streamed to.
+	Remote []*RemoteConfig
+
 	// BaseDir is the base directory for log files.
 	BaseDir string
 
-	// RotationIvl is the interval for log rotation.  After that period, the old
-	// log file will be renamed, NOT deleted, so the actual log retention time
-	// is twice the interval.
+	// Backend is the type of the persistent storage of the entries.  If empty,
+	// [BackendFile] is used.  The entries of the existing query log files are
+	// imported into the SQLite database once, when it's created.
+	Backend Backend
+
+	// RotationIvl is the interval for log rotation.  The entries are moved
+	// into compressed segments in the meantime, and the segments with the
+	// entries older than twice the interval are removed, so the actual log
+	// retention time is twice the interval.
 	RotationIvl time.Duration
 
+	// Retention are the policies overriding the retention time for some of
+	// the clients.  The first policy matching the client is applied.
+	Retention []*RetentionPolicy
+
+	// MaxSize is the maximum total size of the query log files in bytes.  The
+	// oldest entries are removed when it's exceeded.  Zero means no limit.
+	MaxSize uint64
+
 	// MemSize is the number of entries kept in a memory buffer before they are
 	// flushed to disk.
 	MemSize uint
@@ -74,6 +97,11 @@ type Config struct {
 	// AnonymizeClientIP tells if the query log should anonymize clients' IP
 	// addresses.
 	AnonymizeClientIP bool
+
+	// StoreRequests tells if the query log should store the whole requests in
+	// the wire format, including their EDNS options.  The responses are
+	// always stored as a whole.
+	StoreRequests bool
 }
 
 // AddParams is the parameters for adding an entry.
@@ -169,5 +197,58 @@ func newQueryLog(conf Config) (l *queryLog, err error) {
 		return nil, fmt.Errorf("unsupported interval: %w", err)
 	}
 
+	for i, p := range conf.Retention {
+		err = p.validate()
+		if err != nil {
+			return nil, fmt.Errorf("retention policy at index %d: %w", i, err)
+		}
+	}
+
+	cli := conf.HTTPClient
+	if cli == nil {
+		cli = http.DefaultClient
+	}
+
+	l.remotes, err = newRemoteSinks(conf.Remote, cli, conf.Anonymizer)
+	if err != nil {
+		return nil, fmt.Errorf("remote: %w", err)
+	}
+
+	l.storage, err = l.openStorage()
+	if err != nil {
+		for _, r := range l.remotes {
+			r.close()
+		}
+
+		return nil, fmt.Errorf("opening storage: %w", err)
+	}
+
 	return l, nil
 }
+
+// openStorage returns the persistent storage of the entries configured in
+// l.conf.
+func (l *queryLog) openStorage() (st entryStorage, err error) {
+	err = l.conf.Backend.validate()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	if l.conf.Backend != BackendSQLite {
+		return l, nil
+	}
+
+	files, err := l.logFiles()
+	if err != nil {
+		return nil, fmt.Errorf("listing files: %w", err)
+	}
+
+	sst, err := openSQLiteStorage(filepath.Join(l.conf.BaseDir, sqliteFileName), files)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	return sst, nil
+}
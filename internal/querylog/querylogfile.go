@@ -1,12 +1,15 @@
 package querylog
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghrenameio"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 )
@@ -24,7 +27,7 @@ func (l *queryLog) flushLogBuffer() (err error) {
 		return err
 	}
 
-	return l.flushToFile(b)
+	return l.storage.writeEntries(b)
 }
 
 // encodeEntries returns JSON encoded log entries, logs estimated time, clears
@@ -63,53 +66,99 @@ func (l *queryLog) encodeEntries() (b *bytes.Buffer, err error) {
 	return b, nil
 }
 
-// flushToFile saves the encoded log entries to the query log file.
-func (l *queryLog) flushToFile(b *bytes.Buffer) (err error) {
+// type check
+var _ entryStorage = (*queryLog)(nil)
+
+// writeEntries implements the [entryStorage] interface for *queryLog.  It
+// saves the encoded log entries to the query log file.  The file is moved into
+// a new segment if it becomes large enough.
+func (l *queryLog) writeEntries(b *bytes.Buffer) (err error) {
 	l.fileWriteLock.Lock()
 	defer l.fileWriteLock.Unlock()
 
 	filename := l.logFile
 
+	size, err := appendToFile(filename, b.Bytes())
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	if size < segmentMaxSize {
+		return nil
+	}
+
+	err = l.sealHead()
+	if err != nil {
+		return fmt.Errorf("moving into segment: %w", err)
+	}
+
+	return nil
+}
+
+// appendToFile appends data to the file and returns its resulting size.
+func appendToFile(filename string, data []byte) (size int64, err error) {
 	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
 	if err != nil {
-		return fmt.Errorf("creating file %q: %w", filename, err)
+		return 0, fmt.Errorf("creating file %q: %w", filename, err)
 	}
 
 	defer func() { err = errors.WithDeferred(err, f.Close()) }()
 
-	n, err := f.Write(b.Bytes())
+	n, err := f.Write(data)
 	if err != nil {
-		return fmt.Errorf("writing to file %q: %w", filename, err)
+		return 0, fmt.Errorf("writing to file %q: %w", filename, err)
 	}
 
 	log.Debug("querylog: ok %q: %v bytes written", filename, n)
 
-	return nil
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("getting size of file %q: %w", filename, err)
+	}
+
+	return fi.Size(), nil
 }
 
-func (l *queryLog) rotate() error {
-	from := l.logFile
-	to := l.logFile + ".1"
+// rotate moves the entries of the current query log file into new compressed
+// segments.
+func (l *queryLog) rotate() (err error) {
+	l.fileWriteLock.Lock()
+	defer l.fileWriteLock.Unlock()
 
-	err := os.Rename(from, to)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			log.Debug("querylog: no log to rotate")
+	return l.sealHead()
+}
 
-			return nil
-		}
+// legacyLogFile returns the path to the previous query log file, which was
+// used before the segments were introduced.  It's still read, if exists, and
+// removed after the retention period.
+func (l *queryLog) legacyLogFile() (path string) {
+	return l.logFile + ".1"
+}
 
-		return fmt.Errorf("failed to rename old file: %w", err)
+// logFiles returns the paths to all the query log files and segments from the
+// oldest to the newest.
+func (l *queryLog) logFiles() (files []string, err error) {
+	segs, err := listSegments(l.logFile)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
 	}
 
-	log.Debug("querylog: renamed %s into %s", from, to)
+	files = make([]string, 0, len(segs)+2)
+	files = append(files, l.legacyLogFile())
+	for _, s := range segs {
+		files = append(files, s.path)
+	}
 
-	return nil
+	return append(files, l.logFile), nil
 }
 
-func (l *queryLog) readFileFirstTimeValue() (first time.Time, err error) {
+// readFileFirstTimeValue returns the time of the first entry of the query log
+// file.
+func readFileFirstTimeValue(path string) (first time.Time, err error) {
 	var f *os.File
-	f, err = os.Open(l.logFile)
+	f, err = os.Open(path)
 	if err != nil {
 		return time.Time{}, err
 	}
@@ -129,7 +178,7 @@ func (l *queryLog) readFileFirstTimeValue() (first time.Time, err error) {
 		return time.Time{}, err
 	}
 
-	log.Debug("querylog: the oldest log entry: %s", val)
+	log.Debug("querylog: the oldest log entry in %q: %s", path, val)
 
 	return t, nil
 }
@@ -154,8 +203,8 @@ func (l *queryLog) periodicRotate() {
 	}
 }
 
-// checkAndRotate rotates log files if those are older than the specified
-// rotation interval.
+// checkAndRotate rotates the stored entries and removes the expired ones, see
+// [queryLog.removeOldFiles].
 func (l *queryLog) checkAndRotate() {
 	var rotationIvl time.Duration
 	func() {
@@ -165,14 +214,24 @@ func (l *queryLog) checkAndRotate() {
 		rotationIvl = l.conf.RotationIvl
 	}()
 
-	oldest, err := l.readFileFirstTimeValue()
+	now := time.Now()
+	defer l.removeOldFiles(now)
+
+	l.storage.rotateEntries(now, rotationIvl)
+}
+
+// rotateEntries implements the [entryStorage] interface for *queryLog.  It
+// moves the current log file into new segments if its entries are older than a
+// quarter of the rotation interval, so that the segments don't span too long.
+func (l *queryLog) rotateEntries(now time.Time, rotationIvl time.Duration) {
+	oldest, err := readFileFirstTimeValue(l.logFile)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		log.Error("querylog: reading oldest record for rotation: %s", err)
 
 		return
 	}
 
-	if rotTime, now := oldest.Add(rotationIvl), time.Now(); rotTime.After(now) {
+	if rotTime := oldest.Add(rotationIvl / 4); rotTime.After(now) {
 		log.Debug(
 			"querylog: %s <= %s, not rotating",
 			now.Format(time.RFC3339),
@@ -191,3 +250,90 @@ func (l *queryLog) checkAndRotate() {
 
 	log.Debug("querylog: rotated successfully")
 }
+
+// closeStorage implements the [entryStorage] interface for *queryLog.  The
+// files are only opened when needed, so it does nothing.
+func (l *queryLog) closeStorage() (err error) {
+	return nil
+}
+
+// filterLogFile removes the entries, for which rm returns true, from the query
+// log file.  removed is the number of the removed entries.  The file isn't
+// changed if there are no such entries, and it's removed if there are no other
+// entries.
+func filterLogFile(path string, rm func(e *logEntry) (ok bool)) (removed int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+
+		// Don't wrap the error since it's informative enough as is.
+		return 0, err
+	}
+
+	pf, err := aghrenameio.NewPendingFile(path, 0o644)
+	if err != nil {
+		return 0, errors.WithDeferred(fmt.Errorf("creating temporary file: %w", err), f.Close())
+	}
+
+	removed, kept, err := filterLines(f, pf, rm)
+
+	// Close the file before replacing it, since it's not possible on some
+	// platforms otherwise.
+	err = errors.WithDeferred(err, f.Close())
+	switch {
+	case err != nil:
+		err = fmt.Errorf("filtering %q: %w", path, err)
+
+		return 0, aghrenameio.WithDeferredCleanup(err, pf)
+	case removed == 0:
+		return 0, pf.Cleanup()
+	case kept == 0:
+		// Don't leave an empty file, since it can't be checked for the time of
+		// its entries.
+		return removed, errors.WithDeferred(pf.Cleanup(), os.Remove(path))
+	default:
+		return removed, aghrenameio.WithDeferredCleanup(nil, pf)
+	}
+}
+
+// filterLines copies the lines of the query log from r to w, except the ones
+// with the entries for which rm returns true.  removed and kept are the numbers
+// of the removed and copied entries.
+func filterLines(
+	r io.Reader,
+	w io.Writer,
+	rm func(e *logEntry) (ok bool),
+) (removed, kept int, err error) {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	for {
+		line, rErr := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			e := &logEntry{}
+			decodeLogEntry(e, string(line))
+			if rm(e) {
+				removed++
+			} else {
+				kept++
+				line = bytes.TrimSuffix(line, []byte{'\n'})
+				_, _ = bw.Write(line)
+				_ = bw.WriteByte('\n')
+			}
+		}
+
+		if rErr == io.EOF {
+			break
+		} else if rErr != nil {
+			return 0, 0, fmt.Errorf("reading: %w", rErr)
+		}
+	}
+
+	err = bw.Flush()
+	if err != nil {
+		return 0, 0, fmt.Errorf("writing: %w", err)
+	}
+
+	return removed, kept, nil
+}
@@ -0,0 +1,381 @@
+package querylog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+)
+
+// RemoteType is the type of a remote query log destination.
+type RemoteType string
+
+// Remote query log destination types.
+const (
+	// RemoteTypeSyslog sends every entry as an RFC 5424 syslog message over
+	// UDP, TCP, or TLS.
+	RemoteTypeSyslog RemoteType = "syslog"
+
+	// RemoteTypeHTTP sends batches of entries as JSON arrays in POST requests.
+	RemoteTypeHTTP RemoteType = "http"
+
+	// RemoteTypeLoki sends batches of entries to the push API of Grafana Loki.
+	RemoteTypeLoki RemoteType = "loki"
+)
+
+// RemoteConfig is the configuration of a remote query log destination.  The
+// entries are sent in the same JSON format as the one used by the query log
+// HTTP API.
+type RemoteConfig struct {
+	// Type is the type of the destination.
+	Type RemoteType `yaml:"type"`
+
+	// URL is the address of the destination.  For syslog destinations, it's
+	// "udp://host:port", "tcp://host:port", or "tls://host:port".  For HTTP
+	// and Loki destinations, it's the URL to send POST requests to, for
+	// example "http://loki:3100/loki/api/v1/push".
+	URL string `yaml:"url"`
+
+	// Headers are the additional headers of HTTP and Loki requests, for
+	// example "Authorization".
+	Headers map[string]string `yaml:"headers,omitempty"`
+
+	// Labels are the labels of the Loki stream.  If empty, the "job" label
+	// with the "adguardhome" value is used.
+	Labels map[string]string `yaml:"labels,omitempty"`
+
+	// BatchSize is the maximum number of entries sent at once.  If zero, the
+	// default value is used.
+	BatchSize int `yaml:"batch_size"`
+
+	// BufferSize is the maximum number of entries waiting to be sent.  The
+	// entries added when the buffer is full are dropped.  If zero, the default
+	// value is used.
+	BufferSize int `yaml:"buffer_size"`
+
+	// FlushInterval is the maximum time an entry waits for its batch to be
+	// filled.  If zero, the default value is used.
+	FlushInterval timeutil.Duration `yaml:"flush_interval"`
+
+	// Enabled defines if the destination is used.
+	Enabled bool `yaml:"enabled"`
+}
+
+// Default values of the remote destination parameters.
+const (
+	defaultRemoteBatchSize     = 100
+	defaultRemoteBufferSize    = 10_000
+	defaultRemoteFlushInterval = 5 * time.Second
+)
+
+const (
+	// remoteMaxRetries is the maximum number of retries of sending a batch.
+	remoteMaxRetries = 5
+
+	// remoteRetryMinDelay is the delay before the first retry.  Each next
+	// retry is delayed twice as long.
+	remoteRetryMinDelay = 1 * time.Second
+
+	// remoteTimeout is the timeout of sending a single batch.
+	remoteTimeout = 30 * time.Second
+
+	// remoteDrainTimeout is the timeout of sending the remaining entries when
+	// the sink is closed.
+	remoteDrainTimeout = 10 * time.Second
+)
+
+// validate returns an error if c is invalid.
+func (c *RemoteConfig) validate() (err error) {
+	if c == nil {
+		return errors.Error("no remote configuration")
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("url: %w", err)
+	}
+
+	switch c.Type {
+	case RemoteTypeSyslog:
+		_, err = newSyslogWriter(u)
+	case RemoteTypeHTTP, RemoteTypeLoki:
+		if u.Scheme != "http" && u.Scheme != "https" {
+			err = fmt.Errorf("bad url scheme %q", u.Scheme)
+		}
+	default:
+		err = fmt.Errorf("bad type %q", c.Type)
+	}
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	switch {
+	case c.BatchSize < 0:
+		return fmt.Errorf("negative batch_size %d", c.BatchSize)
+	case c.BufferSize < 0:
+		return fmt.Errorf("negative buffer_size %d", c.BufferSize)
+	case c.FlushInterval.Duration < 0:
+		return fmt.Errorf("negative flush_interval %s", c.FlushInterval)
+	default:
+		return nil
+	}
+}
+
+// remoteRecord is a log entry prepared for sending.
+type remoteRecord struct {
+	// time is the time of the entry.
+	time time.Time
+
+	// data is the entry in the JSON format of the query log HTTP API.
+	data []byte
+}
+
+// remoteWriter sends batches of records to a remote destination.
+type remoteWriter interface {
+	// write sends recs.  If it returns an error, recs are sent again later,
+	// so some of them may be received twice.
+	write(ctx context.Context, recs []*remoteRecord) (err error)
+
+	// close releases the resources of the writer.
+	close() (err error)
+}
+
+// remoteSink asynchronously sends the log entries to a remote destination.
+type remoteSink struct {
+	w            remoteWriter
+	anonymizer   *aghnet.IPMut
+	entries      chan *logEntry
+	done         chan struct{}
+	stopped      chan struct{}
+	url          string
+	dropped      atomic.Uint64
+	batchSize    int
+	flushIvl     time.Duration
+	drainTimeout time.Duration
+}
+
+// newRemoteSinks returns the sinks for the enabled remote destinations.  cli
+// is used for HTTP and Loki destinations.
+func newRemoteSinks(
+	confs []*RemoteConfig,
+	cli *http.Client,
+	anonymizer *aghnet.IPMut,
+) (sinks []*remoteSink, err error) {
+	for i, c := range confs {
+		err = c.validate()
+		if err != nil {
+			return nil, fmt.Errorf("remote at index %d: %w", i, err)
+		}
+
+		if !c.Enabled {
+			continue
+		}
+
+		sinks = append(sinks, newRemoteSink(c, newRemoteWriter(c, cli), anonymizer))
+	}
+
+	return sinks, nil
+}
+
+// newRemoteWriter returns a new remoteWriter for c.  c must be valid.
+func newRemoteWriter(c *RemoteConfig, cli *http.Client) (w remoteWriter) {
+	// The URL has already been validated.
+	u, _ := url.Parse(c.URL)
+
+	switch c.Type {
+	case RemoteTypeSyslog:
+		sw, _ := newSyslogWriter(u)
+
+		return sw
+	case RemoteTypeLoki:
+		return newLokiWriter(u, c.Headers, c.Labels, cli)
+	default:
+		return newHTTPWriter(u, c.Headers, cli)
+	}
+}
+
+// newRemoteSink returns a new *remoteSink and starts sending the entries in a
+// separate goroutine.
+func newRemoteSink(c *RemoteConfig, w remoteWriter, anonymizer *aghnet.IPMut) (s *remoteSink) {
+	s = &remoteSink{
+		w:            w,
+		anonymizer:   anonymizer,
+		entries:      make(chan *logEntry, valueOrDefault(c.BufferSize, defaultRemoteBufferSize)),
+		done:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+		url:          c.URL,
+		batchSize:    valueOrDefault(c.BatchSize, defaultRemoteBatchSize),
+		flushIvl:     valueOrDefault(c.FlushInterval.Duration, defaultRemoteFlushInterval),
+		drainTimeout: remoteDrainTimeout,
+	}
+
+	go s.run()
+
+	return s
+}
+
+// valueOrDefault returns v if it's not zero and def otherwise.
+func valueOrDefault[T int | time.Duration](v, def T) (res T) {
+	if v == 0 {
+		return def
+	}
+
+	return v
+}
+
+// send queues e for sending without blocking.  e is dropped if the buffer is
+// full.  e must not be modified after the call.
+func (s *remoteSink) send(e *logEntry) {
+	select {
+	case s.entries <- e:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// close sends the remaining entries within s.drainTimeout and stops s.
+func (s *remoteSink) close() {
+	close(s.done)
+	<-s.stopped
+
+	err := s.w.close()
+	if err != nil {
+		log.Error("querylog: remote %s: closing: %s", s.url, err)
+	}
+}
+
+// run collects the entries into batches and sends them until s is closed.
+// It's intended to be used as a goroutine.
+func (s *remoteSink) run() {
+	defer close(s.stopped)
+	defer log.OnPanic("querylog: remote " + s.url)
+
+	ticker := time.NewTicker(s.flushIvl)
+	defer ticker.Stop()
+
+	batch := make([]*logEntry, 0, s.batchSize)
+	for {
+		select {
+		case e := <-s.entries:
+			batch = append(batch, e)
+			if len(batch) < s.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-s.done:
+			s.drain(batch)
+
+			return
+		}
+
+		s.flush(context.Background(), batch, true)
+		batch = batch[:0]
+	}
+}
+
+// drain sends batch and the entries remaining in the buffer without retries.
+// The entries not sent within s.drainTimeout are dropped.
+func (s *remoteSink) drain(batch []*logEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.drainTimeout)
+	defer cancel()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			if n := len(batch) + len(s.entries); n > 0 {
+				log.Error("querylog: remote %s: dropping %d entries: %s", s.url, n, err)
+			}
+
+			return
+		}
+
+		select {
+		case e := <-s.entries:
+			batch = append(batch, e)
+			if len(batch) == s.batchSize {
+				s.flush(ctx, batch, false)
+				batch = batch[:0]
+			}
+		default:
+			if len(batch) > 0 {
+				s.flush(ctx, batch, false)
+			}
+
+			return
+		}
+	}
+}
+
+// flush sends batch, retrying on errors with increasing delays if retry is
+// true.  The batch is dropped if all retries fail or s is closed.  ctx limits
+// the time of all the attempts.
+func (s *remoteSink) flush(ctx context.Context, batch []*logEntry, retry bool) {
+	if n := s.dropped.Swap(0); n > 0 {
+		log.Info("querylog: remote %s: dropped %d entries because of full buffer", s.url, n)
+	}
+
+	recs := s.records(batch)
+
+	delay := remoteRetryMinDelay
+	for attempt := 0; ; attempt++ {
+		err := s.write(ctx, recs)
+		if err == nil {
+			return
+		} else if !retry || attempt == remoteMaxRetries {
+			log.Error("querylog: remote %s: dropping %d entries: %s", s.url, len(recs), err)
+
+			return
+		}
+
+		log.Debug("querylog: remote %s: attempt %d: %s", s.url, attempt+1, err)
+
+		select {
+		case <-s.done:
+			retry = false
+		case <-time.After(delay):
+			delay *= 2
+		}
+	}
+}
+
+// write sends recs with a timeout.
+func (s *remoteSink) write(ctx context.Context, recs []*remoteRecord) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, remoteTimeout)
+	defer cancel()
+
+	return s.w.write(ctx, recs)
+}
+
+// records converts the entries into the records to send.  The client IP
+// addresses are anonymized if needed.
+func (s *remoteSink) records(batch []*logEntry) (recs []*remoteRecord) {
+	anonFunc := s.anonymizer.Load()
+
+	recs = make([]*remoteRecord, 0, len(batch))
+	for _, e := range batch {
+		data, err := json.Marshal(entryToJSON(e, anonFunc))
+		if err != nil {
+			log.Error("querylog: remote %s: encoding entry: %s", s.url, err)
+
+			continue
+		}
+
+		recs = append(recs, &remoteRecord{
+			time: e.Time,
+			data: data,
+		})
+	}
+
+	return recs
+}
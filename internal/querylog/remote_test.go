@@ -0,0 +1,256 @@
+package querylog
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newRemoteTestLog returns a new query log streaming the entries to the remote
+// destination described by rc.  The client IP addresses are anonymized and
+// "ignored.example" is ignored.
+func newRemoteTestLog(t *testing.T, rc *RemoteConfig) (l *queryLog) {
+	t.Helper()
+
+	ignored, err := aghnet.NewIgnoreEngine([]string{"ignored.example"})
+	require.NoError(t, err)
+
+	l, err = newQueryLog(Config{
+		Ignored:           ignored,
+		Anonymizer:        aghnet.NewIPMut(AnonymizeIP),
+		BaseDir:           t.TempDir(),
+		RotationIvl:       timeutil.Day,
+		MemSize:           100,
+		Enabled:           true,
+		AnonymizeClientIP: true,
+		Remote:            []*RemoteConfig{rc},
+	})
+	require.NoError(t, err)
+
+	return l
+}
+
+func TestQueryLog_remote_http(t *testing.T) {
+	reqs := make(chan []byte, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer test", r.Header.Get("Authorization"))
+
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		reqs <- body
+	}))
+	t.Cleanup(srv.Close)
+
+	l := newRemoteTestLog(t, &RemoteConfig{
+		Type:      RemoteTypeHTTP,
+		URL:       srv.URL,
+		Headers:   map[string]string{"Authorization": "Bearer test"},
+		BatchSize: 2,
+		Enabled:   true,
+	})
+
+	addEntry(l, "ignored.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	addEntry(l, "first.example", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+	addEntry(l, "second.example", net.IPv4(1, 1, 1, 3), net.IPv4(2, 2, 2, 3))
+
+	var body []byte
+	select {
+	case body = <-reqs:
+	case <-time.After(time.Second):
+		t.Fatal("no request received")
+	}
+
+	var entries []struct {
+		Question struct {
+			Name string `json:"name"`
+		} `json:"question"`
+		Client string `json:"client"`
+	}
+	require.NoError(t, json.Unmarshal(body, &entries))
+	require.Len(t, entries, 2)
+
+	assert.Equal(t, "first.example", entries[0].Question.Name)
+	assert.Equal(t, "2.2.0.0", entries[0].Client)
+	assert.Equal(t, "second.example", entries[1].Question.Name)
+
+	l.Close()
+}
+
+func TestQueryLog_remote_loki(t *testing.T) {
+	reqs := make(chan *lokiPushRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &lokiPushRequest{}
+		err := json.NewDecoder(r.Body).Decode(req)
+		require.NoError(t, err)
+
+		reqs <- req
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+
+	l := newRemoteTestLog(t, &RemoteConfig{
+		Type:    RemoteTypeLoki,
+		URL:     srv.URL + "/loki/api/v1/push",
+		Enabled: true,
+	})
+
+	addEntry(l, "example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+
+	// Closing flushes the remaining entries.
+	l.Close()
+
+	var req *lokiPushRequest
+	select {
+	case req = <-reqs:
+	default:
+		t.Fatal("no request received")
+	}
+
+	require.Len(t, req.Streams, 1)
+
+	s := req.Streams[0]
+	assert.Equal(t, map[string]string{"job": "adguardhome"}, s.Stream)
+
+	require.Len(t, s.Values, 1)
+	assert.Contains(t, s.Values[0][1], `"name":"example.org"`)
+}
+
+func TestQueryLog_remote_syslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	l := newRemoteTestLog(t, &RemoteConfig{
+		Type:    RemoteTypeSyslog,
+		URL:     "udp://" + conn.LocalAddr().String(),
+		Enabled: true,
+	})
+
+	addEntry(l, "example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	l.Close()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	buf := make([]byte, 64*1024)
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+
+	msg := string(buf[:n])
+	assert.True(t, strings.HasPrefix(msg, "<134>1 "), msg)
+	assert.Contains(t, msg, " AdGuardHome - query - {")
+	assert.Contains(t, msg, `"name":"example.org"`)
+}
+
+// blockingRemoteWriter is a remoteWriter that blocks until the context is
+// canceled.
+type blockingRemoteWriter struct {
+	writes atomic.Int32
+}
+
+// type check
+var _ remoteWriter = (*blockingRemoteWriter)(nil)
+
+// write implements the [remoteWriter] interface for *blockingRemoteWriter.
+func (w *blockingRemoteWriter) write(ctx context.Context, _ []*remoteRecord) (err error) {
+	w.writes.Add(1)
+	<-ctx.Done()
+
+	return ctx.Err()
+}
+
+// close implements the [remoteWriter] interface for *blockingRemoteWriter.
+func (w *blockingRemoteWriter) close() (err error) { return nil }
+
+func TestRemoteSink_drain_timeout(t *testing.T) {
+	w := &blockingRemoteWriter{}
+	s := &remoteSink{
+		w:            w,
+		anonymizer:   aghnet.NewIPMut(nil),
+		entries:      make(chan *logEntry, 10),
+		url:          "http://remote.example",
+		batchSize:    1,
+		drainTimeout: 100 * time.Millisecond,
+	}
+
+	for i := 0; i < 10; i++ {
+		s.send(&logEntry{Time: time.Now(), QHost: "example.org"})
+	}
+
+	start := time.Now()
+	s.drain(nil)
+
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, int32(1), w.writes.Load())
+}
+
+func TestRemoteConfig_validate(t *testing.T) {
+	testCases := []struct {
+		conf       *RemoteConfig
+		name       string
+		wantErrMsg string
+	}{{
+		conf: &RemoteConfig{
+			Type: RemoteTypeSyslog,
+			URL:  "tls://syslog.example:6514",
+		},
+		name:       "syslog_tls",
+		wantErrMsg: "",
+	}, {
+		conf: &RemoteConfig{
+			Type: RemoteTypeSyslog,
+			URL:  "http://syslog.example:514",
+		},
+		name:       "syslog_bad_scheme",
+		wantErrMsg: `bad syslog url scheme "http"`,
+	}, {
+		conf: &RemoteConfig{
+			Type: RemoteTypeSyslog,
+			URL:  "udp://syslog.example",
+		},
+		name:       "syslog_no_port",
+		wantErrMsg: "syslog address: address syslog.example: missing port in address",
+	}, {
+		conf: &RemoteConfig{
+			Type: RemoteTypeLoki,
+			URL:  "udp://loki.example",
+		},
+		name:       "loki_bad_scheme",
+		wantErrMsg: `bad url scheme "udp"`,
+	}, {
+		conf: &RemoteConfig{
+			Type: "kafka",
+			URL:  "http://kafka.example",
+		},
+		name:       "bad_type",
+		wantErrMsg: `bad type "kafka"`,
+	}, {
+		conf: &RemoteConfig{
+			Type:      RemoteTypeHTTP,
+			URL:       "https://collector.example/logs",
+			BatchSize: -1,
+		},
+		name:       "negative_batch_size",
+		wantErrMsg: "negative batch_size -1",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.conf.validate())
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package querylog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/httphdr"
+)
+
+// httpWriter is a remoteWriter sending batches of entries as JSON arrays in
+// POST requests.
+type httpWriter struct {
+	cli     *http.Client
+	headers map[string]string
+	url     string
+}
+
+// newHTTPWriter returns a new *httpWriter sending requests to u.
+func newHTTPWriter(u *url.URL, headers map[string]string, cli *http.Client) (w *httpWriter) {
+	return &httpWriter{
+		cli:     cli,
+		headers: headers,
+		url:     u.String(),
+	}
+}
+
+// type check
+var _ remoteWriter = (*httpWriter)(nil)
+
+// write implements the remoteWriter interface for *httpWriter.
+func (w *httpWriter) write(ctx context.Context, recs []*remoteRecord) (err error) {
+	body := &bytes.Buffer{}
+	body.WriteByte('[')
+	for i, rec := range recs {
+		if i > 0 {
+			body.WriteByte(',')
+		}
+
+		body.Write(rec.data)
+	}
+	body.WriteByte(']')
+
+	return postJSON(ctx, w.cli, w.url, w.headers, body)
+}
+
+// close implements the remoteWriter interface for *httpWriter.
+func (w *httpWriter) close() (err error) {
+	return nil
+}
+
+// lokiWriter is a remoteWriter sending batches of entries to the push API of
+// Grafana Loki.
+type lokiWriter struct {
+	cli     *http.Client
+	headers map[string]string
+	labels  map[string]string
+	url     string
+}
+
+// newLokiWriter returns a new *lokiWriter sending requests to u.
+func newLokiWriter(
+	u *url.URL,
+	headers map[string]string,
+	labels map[string]string,
+	cli *http.Client,
+) (w *lokiWriter) {
+	if len(labels) == 0 {
+		labels = map[string]string{"job": "adguardhome"}
+	}
+
+	return &lokiWriter{
+		cli:     cli,
+		headers: headers,
+		labels:  labels,
+		url:     u.String(),
+	}
+}
+
+// lokiPushRequest is the request to the push API of Grafana Loki.
+type lokiPushRequest struct {
+	Streams []*lokiStream `json:"streams"`
+}
+
+// lokiStream is a single stream of the push request.
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+
+	// Values are the pairs of the timestamp in nanoseconds and the log line.
+	Values [][2]string `json:"values"`
+}
+
+// type check
+var _ remoteWriter = (*lokiWriter)(nil)
+
+// write implements the remoteWriter interface for *lokiWriter.
+func (w *lokiWriter) write(ctx context.Context, recs []*remoteRecord) (err error) {
+	s := &lokiStream{
+		Stream: w.labels,
+		Values: make([][2]string, 0, len(recs)),
+	}
+
+	for _, rec := range recs {
+		s.Values = append(s.Values, [2]string{
+			strconv.FormatInt(rec.time.UnixNano(), 10),
+			string(rec.data),
+		})
+	}
+
+	body := &bytes.Buffer{}
+	err = json.NewEncoder(body).Encode(&lokiPushRequest{
+		Streams: []*lokiStream{s},
+	})
+	if err != nil {
+		return fmt.Errorf("encoding: %w", err)
+	}
+
+	return postJSON(ctx, w.cli, w.url, w.headers, body)
+}
+
+// close implements the remoteWriter interface for *lokiWriter.
+func (w *lokiWriter) close() (err error) {
+	return nil
+}
+
+// postJSON sends body in a POST request to u and checks that the response has
+// a successful status.
+func postJSON(
+	ctx context.Context,
+	cli *http.Client,
+	u string,
+	headers map[string]string,
+	body io.Reader,
+) (err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, body)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set(httphdr.ContentType, aghhttp.HdrValApplicationJSON)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := cli.Do(req)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+	defer func() { err = errors.WithDeferred(err, resp.Body.Close()) }()
+
+	// Read the body to reuse the connection.
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("got status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package querylog
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// syslogPriority is the priority of the syslog messages:  the local0 facility
+// and the informational severity.
+const syslogPriority = 16*8 + 6
+
+// syslogTimeFormat is the format of syslog timestamps.  RFC 5424 allows at most
+// six digits of the fractional seconds.
+const syslogTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// syslogWriter is a remoteWriter sending RFC 5424 syslog messages.  The
+// messages are sent over TCP and TLS using the octet-counting framing from RFC
+// 6587.
+type syslogWriter struct {
+	conn     net.Conn
+	tlsConf  *tls.Config
+	network  string
+	addr     string
+	hostname string
+}
+
+// newSyslogWriter returns a new *syslogWriter for u, which must have the
+// "udp", "tcp", or "tls" scheme.
+func newSyslogWriter(u *url.URL) (w *syslogWriter, err error) {
+	w = &syslogWriter{
+		addr:     u.Host,
+		hostname: "-",
+	}
+
+	_, _, err = net.SplitHostPort(u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("syslog address: %w", err)
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		w.network = u.Scheme
+	case "tls":
+		w.network = "tcp"
+		w.tlsConf = &tls.Config{
+			ServerName: u.Hostname(),
+			MinVersion: tls.VersionTLS12,
+		}
+	default:
+		return nil, fmt.Errorf("bad syslog url scheme %q", u.Scheme)
+	}
+
+	if hostname, hErr := os.Hostname(); hErr == nil && hostname != "" {
+		w.hostname = hostname
+	}
+
+	return w, nil
+}
+
+// type check
+var _ remoteWriter = (*syslogWriter)(nil)
+
+// write implements the remoteWriter interface for *syslogWriter.  It
+// reconnects on the next call if an error occurs.
+func (w *syslogWriter) write(ctx context.Context, recs []*remoteRecord) (err error) {
+	if w.conn == nil {
+		w.conn, err = w.dial(ctx)
+		if err != nil {
+			return fmt.Errorf("connecting: %w", err)
+		}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		err = w.conn.SetWriteDeadline(deadline)
+		if err != nil {
+			return w.reset(fmt.Errorf("setting deadline: %w", err))
+		}
+	}
+
+	var buf []byte
+	for _, rec := range recs {
+		buf = w.appendMessage(buf[:0], rec)
+		_, err = w.conn.Write(buf)
+		if err != nil {
+			return w.reset(fmt.Errorf("writing: %w", err))
+		}
+	}
+
+	return nil
+}
+
+// dial connects to the syslog server.
+func (w *syslogWriter) dial(ctx context.Context) (conn net.Conn, err error) {
+	if w.tlsConf != nil {
+		d := &tls.Dialer{Config: w.tlsConf}
+
+		return d.DialContext(ctx, w.network, w.addr)
+	}
+
+	d := &net.Dialer{}
+
+	return d.DialContext(ctx, w.network, w.addr)
+}
+
+// reset closes the current connection, so that the next write reconnects, and
+// returns err with the closing error, if any.
+func (w *syslogWriter) reset(err error) (res error) {
+	err = errors.WithDeferred(err, w.conn.Close())
+	w.conn = nil
+
+	return err
+}
+
+// appendMessage appends the syslog message for rec to b.
+func (w *syslogWriter) appendMessage(b []byte, rec *remoteRecord) (res []byte) {
+	msg := fmt.Appendf(
+		nil,
+		"<%d>1 %s %s AdGuardHome - query - %s",
+		syslogPriority,
+		rec.time.UTC().Format(syslogTimeFormat),
+		w.hostname,
+		rec.data,
+	)
+
+	if w.network == "tcp" {
+		b = strconv.AppendInt(b, int64(len(msg)), 10)
+		b = append(b, ' ')
+	}
+
+	return append(b, msg...)
+}
+
+// close implements the remoteWriter interface for *syslogWriter.
+func (w *syslogWriter) close() (err error) {
+	if w.conn == nil {
+		return nil
+	}
+
+	err = w.conn.Close()
+	w.conn = nil
+
+	return err
+}
@@ -0,0 +1,453 @@
+package querylog
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+)
+
+// RetentionPolicy is the retention time of the entries of some clients, which
+// overrides the one defined by [Config.RotationIvl].
+type RetentionPolicy struct {
+	// Clients are the IP addresses, ClientIDs, and names of the clients the
+	// policy is applied to.
+	Clients []string `yaml:"clients"`
+
+	// Tags are the tags of the persistent clients the policy is applied to.
+	Tags []string `yaml:"tags"`
+
+	// Interval is the time the entries of the clients are kept for.  Unlike
+	// [Config.RotationIvl], it's exact.
+	Interval timeutil.Duration `yaml:"interval"`
+}
+
+// validate returns an error if the policy isn't valid.
+func (p *RetentionPolicy) validate() (err error) {
+	switch {
+	case p == nil:
+		return errors.Error("no value")
+	case len(p.Clients) == 0 && len(p.Tags) == 0:
+		return errors.Error("no clients or tags")
+	case slices.Contains(p.Clients, ""):
+		return errors.Error("empty client")
+	default:
+		// Go on.
+	}
+
+	err = validateIvl(p.Interval.Duration)
+	if err != nil {
+		return fmt.Errorf("interval: %w", err)
+	}
+
+	return nil
+}
+
+// clientMatcher matches the clients of the query log entries by their IP
+// addresses, ClientIDs, names, and tags.
+type clientMatcher struct {
+	// ids are the IP addresses in their canonical form, as well as ClientIDs
+	// and names of the clients.
+	ids []string
+
+	// tags are the tags of the persistent clients.
+	tags []string
+}
+
+// newClientMatcher returns a new *clientMatcher matching the clients with any
+// of ids or tags.  ids are the IP addresses, ClientIDs, and names.
+func newClientMatcher(ids, tags []string) (m *clientMatcher) {
+	m = &clientMatcher{
+		ids:  make([]string, 0, len(ids)),
+		tags: tags,
+	}
+
+	for _, id := range ids {
+		if ip, err := netip.ParseAddr(id); err == nil {
+			id = ip.String()
+		}
+
+		m.ids = append(m.ids, id)
+	}
+
+	return m
+}
+
+// match returns true if the client with the given ClientID, IP address, and
+// information is matched.  c may be nil.
+func (m *clientMatcher) match(clientID, ip string, c *Client) (ok bool) {
+	for _, id := range m.ids {
+		if id == ip || (clientID != "" && strings.EqualFold(id, clientID)) {
+			return true
+		}
+
+		if c != nil && c.Name != "" && strings.EqualFold(id, c.Name) {
+			return true
+		}
+	}
+
+	if c == nil {
+		return false
+	}
+
+	for _, t := range m.tags {
+		if slices.Contains(c.Tags, t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// retentionRule is a retention policy prepared for checking the entries.
+type retentionRule struct {
+	matcher *clientMatcher
+
+	// cutoff is the time in nanoseconds before which the entries of the
+	// matched clients are removed.
+	cutoff int64
+}
+
+// retention checks the entries against the retention policies at some moment.
+type retention struct {
+	findClient quickMatchClientFunc
+
+	// rules are the retention policies in the order of their priority.
+	rules []*retentionRule
+
+	// defaultCutoff is the time in nanoseconds before which the files with the
+	// entries of the clients without policies are removed.
+	defaultCutoff int64
+
+	// latestCutoff is the latest of the cutoffs of rules.
+	latestCutoff int64
+}
+
+// newRetention returns a new *retention for the moment now.
+func newRetention(
+	now time.Time,
+	ivl time.Duration,
+	policies []*RetentionPolicy,
+	findClient quickMatchClientFunc,
+) (r *retention) {
+	r = &retention{
+		findClient:    findClient,
+		rules:         make([]*retentionRule, 0, len(policies)),
+		defaultCutoff: now.Add(-2 * ivl).UnixNano(),
+	}
+
+	for _, p := range policies {
+		cutoff := now.Add(-p.Interval.Duration).UnixNano()
+		r.rules = append(r.rules, &retentionRule{
+			matcher: newClientMatcher(p.Clients, p.Tags),
+			cutoff:  cutoff,
+		})
+
+		r.latestCutoff = max(r.latestCutoff, cutoff)
+	}
+
+	return r
+}
+
+// cutoff returns the cutoff of the policy matching the client, if any.
+func (r *retention) cutoff(clientID, ip string) (cutoff int64, ok bool) {
+	c := r.findClient(clientID, ip)
+	for _, rule := range r.rules {
+		if rule.matcher.match(clientID, ip, c) {
+			return rule.cutoff, true
+		}
+	}
+
+	return 0, false
+}
+
+// isExpired returns true if e should be removed.  defaultExpired tells if the
+// entries of the clients without policies should be removed.
+func (r *retention) isExpired(e *logEntry, defaultExpired bool) (ok bool) {
+	cutoff, ok := r.cutoff(e.ClientID, e.IP.String())
+	if !ok {
+		return defaultExpired
+	}
+
+	return e.Time.UnixNano() < cutoff
+}
+
+// checkSegment returns true in remove if all the entries of the segment are
+// expired, and true in rewrite if only some of them are.
+func (r *retention) checkSegment(seg *segmentInfo) (remove, rewrite bool) {
+	defaultExpired := seg.minTS < r.defaultCutoff
+	if len(r.rules) == 0 {
+		return defaultExpired, false
+	}
+
+	idx, err := readSegmentIndex(seg.path)
+	if err != nil {
+		log.Debug("querylog: reading index of %q: %s; checking entries", seg.path, err)
+
+		return false, true
+	}
+
+	remove = true
+	for _, b := range idx.Blocks {
+		if b.ClientsOverflow {
+			// The clients are unknown, so assume the worst for both cases.
+			rewrite = rewrite || defaultExpired || b.MinTime < r.latestCutoff
+			remove = false
+
+			continue
+		}
+
+		for _, c := range b.Clients {
+			cutoff, ok := r.cutoff(c.ClientID, c.IP)
+			if !ok {
+				rewrite = rewrite || defaultExpired
+				remove = remove && defaultExpired
+
+				continue
+			}
+
+			rewrite = rewrite || c.MinTime < cutoff
+			remove = remove && c.MaxTime < cutoff
+		}
+	}
+
+	return remove, rewrite && !remove
+}
+
+// retentionState returns the retention for the moment now and the maximum
+// size of the query log files.
+func (l *queryLog) retentionState(now time.Time) (r *retention, maxSize uint64) {
+	l.confMu.RLock()
+	defer l.confMu.RUnlock()
+
+	clientFinder := quickMatchClientFinder{
+		client: l.client,
+		cache:  clientCache{},
+	}
+
+	r = newRetention(now, l.conf.RotationIvl, l.conf.Retention, clientFinder.findClient)
+
+	return r, l.conf.MaxSize
+}
+
+// removeOldFiles removes the entries which are out of the retention time and
+// the oldest files exceeding the maximum size of the query log.  Any errors are
+// logged.
+func (l *queryLog) removeOldFiles(now time.Time) {
+	r, maxSize := l.retentionState(now)
+
+	l.fileFlushLock.Lock()
+	defer l.fileFlushLock.Unlock()
+
+	if len(r.rules) > 0 {
+		n := l.filterBuffer(func(e *logEntry) (ok bool) { return r.isExpired(e, false) })
+		log.Debug("querylog: removed %d expired entries from memory", n)
+	}
+
+	l.storage.removeExpired(r, maxSize)
+}
+
+// removeExpired implements the [entryStorage] interface for *queryLog.  It
+// removes the expired entries from the query log files and segments and the
+// oldest files exceeding maxSize.
+func (l *queryLog) removeExpired(r *retention, maxSize uint64) {
+	l.fileWriteLock.Lock()
+	defer l.fileWriteLock.Unlock()
+
+	l.removeOldHead(r)
+	l.removeOldLegacy(r)
+
+	segs, err := listSegments(l.logFile)
+	if err != nil {
+		log.Error("querylog: listing segments: %s", err)
+	}
+
+	for _, s := range segs {
+		remove, rewrite := r.checkSegment(s)
+		switch {
+		case remove:
+			err = removeSegment(s.path)
+			if err == nil {
+				log.Debug("querylog: removed segment %q", s.path)
+			}
+		case rewrite:
+			defaultExpired := s.minTS < r.defaultCutoff
+			var n int
+			n, err = rewriteSegment(l.logFile, s, func(e *logEntry) (ok bool) {
+				return r.isExpired(e, defaultExpired)
+			})
+			if err == nil {
+				log.Debug("querylog: removed %d expired entries from %q", n, s.path)
+			}
+		default:
+			// Go on.
+		}
+
+		if err != nil {
+			log.Error("querylog: applying retention to segment: %s", err)
+		}
+	}
+
+	l.removeExceeding(maxSize)
+}
+
+// removeOldHead removes the expired entries from the current query log file.
+// Only the policies are applied to it, since its entries are never older than
+// the default retention time.  l.fileWriteLock is expected to be locked.
+func (l *queryLog) removeOldHead(r *retention) {
+	if len(r.rules) == 0 {
+		return
+	}
+
+	oldest, err := readFileFirstTimeValue(l.logFile)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Error("querylog: reading oldest record of %q: %s", l.logFile, err)
+		}
+
+		return
+	} else if oldest.UnixNano() >= r.latestCutoff {
+		return
+	}
+
+	n, err := filterLogFile(l.logFile, func(e *logEntry) (ok bool) { return r.isExpired(e, false) })
+	if err != nil {
+		log.Error("querylog: applying retention to %q: %s", l.logFile, err)
+	} else {
+		log.Debug("querylog: removed %d expired entries from %q", n, l.logFile)
+	}
+}
+
+// removeOldLegacy removes the expired entries from the legacy log file, see
+// [queryLog.legacyLogFile].  l.fileWriteLock is expected to be locked.
+func (l *queryLog) removeOldLegacy(r *retention) {
+	legacy := l.legacyLogFile()
+	oldest, err := readFileFirstTimeValue(legacy)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Error("querylog: reading oldest record of %q: %s", legacy, err)
+		}
+
+		return
+	}
+
+	defaultExpired := oldest.UnixNano() < r.defaultCutoff
+	if len(r.rules) == 0 {
+		if defaultExpired {
+			err = os.Remove(legacy)
+		}
+	} else if defaultExpired || oldest.UnixNano() < r.latestCutoff {
+		_, err = filterLogFile(legacy, func(e *logEntry) (ok bool) {
+			return r.isExpired(e, defaultExpired)
+		})
+	}
+
+	if err != nil {
+		log.Error("querylog: applying retention to %q: %s", legacy, err)
+	}
+}
+
+// removeExceeding removes the oldest files of the query log until their total
+// size is within maxSize.  The current query log file is never removed.  If
+// maxSize is zero, it does nothing.  l.fileWriteLock is expected to be locked.
+func (l *queryLog) removeExceeding(maxSize uint64) {
+	if maxSize == 0 {
+		return
+	}
+
+	segs, err := listSegments(l.logFile)
+	if err != nil {
+		log.Error("querylog: listing segments: %s", err)
+
+		return
+	}
+
+	legacy := l.legacyLogFile()
+
+	// candidates are the files which can be removed, from the oldest to the
+	// newest.
+	candidates := make([]string, 0, len(segs)+1)
+	candidates = append(candidates, legacy)
+	for _, s := range segs {
+		candidates = append(candidates, s.path)
+	}
+
+	sizes := make([]uint64, len(candidates))
+	total := fileSize(l.logFile)
+	for i, path := range candidates {
+		sizes[i] = fileSize(path)
+		if path != legacy {
+			sizes[i] += fileSize(path + segmentIdxExt)
+		}
+
+		total += sizes[i]
+	}
+
+	for i, path := range candidates {
+		if total <= maxSize {
+			break
+		} else if sizes[i] == 0 {
+			continue
+		}
+
+		if path == legacy {
+			err = os.Remove(path)
+		} else {
+			err = removeSegment(path)
+		}
+
+		if err != nil {
+			log.Error("querylog: removing %q exceeding max size: %s", path, err)
+
+			continue
+		}
+
+		log.Debug("querylog: removed %q exceeding max size", path)
+		total -= sizes[i]
+	}
+}
+
+// fileSize returns the size of the file or zero if it can't be determined.
+func fileSize(path string) (size uint64) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+
+	return uint64(fi.Size())
+}
+
+// filterBuffer removes the entries for which rm returns true from the memory
+// buffer.  removed is the number of the removed entries.
+func (l *queryLog) filterBuffer(rm func(e *logEntry) (ok bool)) (removed int) {
+	l.bufferLock.Lock()
+	defer l.bufferLock.Unlock()
+
+	var kept []*logEntry
+	l.buffer.Range(func(e *logEntry) (cont bool) {
+		if rm(e) {
+			removed++
+		} else {
+			kept = append(kept, e)
+		}
+
+		return true
+	})
+
+	if removed == 0 {
+		return 0
+	}
+
+	l.buffer.Clear()
+	for _, e := range kept {
+		l.buffer.Append(e)
+	}
+
+	return removed
+}
@@ -0,0 +1,156 @@
+package querylog
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestSegments writes a segment with n test entries for each day since
+// [testSegmentStart].
+func writeTestSegments(t *testing.T, l *queryLog, days, n int) {
+	t.Helper()
+
+	for i := 0; i < days; i++ {
+		start := testSegmentStart.Add(time.Duration(i) * timeutil.Day)
+		data, _ := newTestSegmentData(start, n)
+
+		_, err := writeSegments(l.logFile, bytes.NewReader(data))
+		require.NoError(t, err)
+	}
+}
+
+// searchClients returns the client IP addresses of all entries of the query
+// log from the newest to the oldest.
+func searchClients(t *testing.T, l *queryLog) (ips []string) {
+	t.Helper()
+
+	entries, _ := l.search(newSearchParams())
+	for _, e := range entries {
+		ips = append(ips, e.IP.String())
+	}
+
+	return ips
+}
+
+func TestQueryLog_removeOldFiles_retention(t *testing.T) {
+	l, err := newQueryLog(Config{
+		FindClient: func(ids []string) (c *Client, err error) {
+			if slices.Contains(ids, "10.0.0.2") {
+				return &Client{Name: "guest", Tags: []string{"user_child"}}, nil
+			}
+
+			return nil, nil
+		},
+		Retention: []*RetentionPolicy{{
+			Clients:  []string{"10.0.0.1"},
+			Interval: timeutil.Duration{Duration: 10 * timeutil.Day},
+		}, {
+			Tags:     []string{"user_child"},
+			Interval: timeutil.Duration{Duration: time.Hour},
+		}},
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		BaseDir:     t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	// Each segment contains 3 entries of 10.0.0.1 and 2 entries of 10.0.0.2.
+	writeTestSegments(t, l, 3, 10)
+
+	// The two oldest segments are out of the default retention time.
+	l.removeOldFiles(testSegmentStart.Add(3*timeutil.Day + time.Hour))
+
+	segs, err := listSegments(l.logFile)
+	require.NoError(t, err)
+	require.Len(t, segs, 3)
+
+	ips := searchClients(t, l)
+	require.Len(t, ips, 3+3+8)
+
+	assert.NotContains(t, ips, "10.0.0.2")
+	for _, ip := range ips[8:] {
+		assert.Equal(t, "10.0.0.1", ip)
+	}
+}
+
+func TestQueryLog_removeExceeding(t *testing.T) {
+	l, err := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		BaseDir:     t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	writeTestSegments(t, l, 3, 1_000)
+
+	segs, err := listSegments(l.logFile)
+	require.NoError(t, err)
+	require.Len(t, segs, 3)
+
+	var total uint64
+	for _, s := range segs {
+		total += fileSize(s.path) + fileSize(s.path+segmentIdxExt)
+	}
+
+	l.conf.MaxSize = total - 1
+	l.removeOldFiles(testSegmentStart.Add(time.Hour))
+
+	left, err := listSegments(l.logFile)
+	require.NoError(t, err)
+
+	assert.Equal(t, segs[1:], left)
+}
+
+func TestRetentionPolicy_validate(t *testing.T) {
+	testCases := []struct {
+		policy     *RetentionPolicy
+		name       string
+		wantErrMsg string
+	}{{
+		policy: &RetentionPolicy{
+			Tags:     []string{"device_pc"},
+			Interval: timeutil.Duration{Duration: timeutil.Day},
+		},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		policy:     nil,
+		name:       "nil",
+		wantErrMsg: "no value",
+	}, {
+		policy: &RetentionPolicy{
+			Interval: timeutil.Duration{Duration: timeutil.Day},
+		},
+		name:       "no_clients",
+		wantErrMsg: "no clients or tags",
+	}, {
+		policy: &RetentionPolicy{
+			Clients:  []string{""},
+			Interval: timeutil.Duration{Duration: timeutil.Day},
+		},
+		name:       "empty_client",
+		wantErrMsg: "empty client",
+	}, {
+		policy: &RetentionPolicy{
+			Clients:  []string{"1.2.3.4"},
+			Interval: timeutil.Duration{Duration: time.Minute},
+		},
+		name:       "bad_interval",
+		wantErrMsg: "interval: less than an hour",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, tc.policy.validate())
+		})
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"slices"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 )
@@ -61,6 +62,11 @@ func (l *queryLog) searchMemory(params *searchParams, cache clientCache) (entrie
 	l.buffer.ReverseRange(func(entry *logEntry) (cont bool) {
 		// A shallow clone is enough, since the only thing that this loop
 		// modifies is the client field.
+		if params.isTooOld(entry.Time) {
+			// The rest of the buffer is even older.
+			return false
+		}
+
 		e := entry.shallowClone()
 
 		var err error
@@ -145,32 +151,42 @@ func (l *queryLog) search(params *searchParams) (entries []*logEntry, oldest tim
 	return entries, oldest
 }
 
-// seekRecord changes the current position to the next record older than the
-// provided parameter.
+// seekRecord changes the current position to the record with the provided
+// time or to the next record older than that, if there is no such record.  The
+// record with the provided time itself is filtered out by
+// [searchParams.match].
 func (r *qLogReader) seekRecord(olderThan time.Time) (err error) {
 	if olderThan.IsZero() {
 		return r.SeekStart()
 	}
 
 	err = r.seekTS(olderThan.UnixNano())
-	if err == nil {
-		// Read to the next record, because we only need the one that goes
-		// after it.
-		_, err = r.ReadNext()
+	if errors.Is(err, errTSNotFound) {
+		// The plain files can only be searched for the exact time, so read
+		// them from the start and let [searchParams.match] filter the newer
+		// records out.
+		log.Debug("querylog: no record at %s, reading from the start", olderThan)
+
+		return r.SeekStart()
 	}
 
 	return err
 }
 
-// setQLogReader creates a reader with the specified files and sets the
-// position to the next record older than the provided parameter.
-func (l *queryLog) setQLogReader(olderThan time.Time) (qr *qLogReader, err error) {
-	files := []string{
-		l.logFile + ".1",
-		l.logFile,
+// newEntryReader implements the [entryStorage] interface for *queryLog.  It
+// creates a reader with all the query log files and segments and sets the
+// position to the next record older than the provided parameter.  The blocks of
+// the segments rejected by filter, if it's not nil, are skipped.
+func (l *queryLog) newEntryReader(
+	olderThan time.Time,
+	filter blockFilter,
+) (er entryReader, err error) {
+	files, err := l.logFiles()
+	if err != nil {
+		return nil, fmt.Errorf("listing files: %w", err)
 	}
 
-	r, err := newQLogReader(files)
+	r, err := newQLogReader(files, filter)
 	if err != nil {
 		return nil, fmt.Errorf("opening qlog reader: %s", err)
 	}
@@ -191,13 +207,13 @@ func (l *queryLog) setQLogReader(olderThan time.Time) (qr *qLogReader, err error
 // calls faster so that the UI could handle it and show something quicker.
 // This behavior can be overridden if maxFileScanEntries is set to 0.
 func (l *queryLog) readEntries(
-	r *qLogReader,
+	r entryReader,
 	params *searchParams,
 	cache clientCache,
 	totalLimit int,
 ) (entries []*logEntry, oldestNano int64, total int) {
 	for total < params.maxFileScanEntries || params.maxFileScanEntries <= 0 {
-		ent, ts, rErr := l.readNextEntry(r, params, cache)
+		ent, ts, rErr := l.readNextEntry(r, params, cache, l.conf.Ignored)
 		if rErr != nil {
 			if rErr == io.EOF {
 				oldestNano = 0
@@ -208,6 +224,13 @@ func (l *queryLog) readEntries(
 			log.Error("querylog: reading next entry: %s", rErr)
 		}
 
+		if ts != 0 && params.isTooOld(time.Unix(0, ts)) {
+			// The rest of the entries are even older.
+			oldestNano = 0
+
+			break
+		}
+
 		oldestNano = ts
 		total++
 
@@ -234,7 +257,15 @@ func (l *queryLog) searchFiles(
 	params *searchParams,
 	cache clientCache,
 ) (entries []*logEntry, oldest time.Time, total int) {
-	r, err := l.setQLogReader(params.olderThan)
+	clientFinder := quickMatchClientFinder{
+		client: l.client,
+		cache:  cache,
+	}
+
+	r, err := l.storage.newEntryReader(
+		params.seekTime(),
+		params.blockFilter(clientFinder.findClient),
+	)
 	if err != nil {
 		log.Error("querylog: %s", err)
 	}
@@ -283,12 +314,13 @@ func (f quickMatchClientFinder) findClient(clientID, ip string) (c *Client) {
 
 // readNextEntry reads the next log entry and checks if it matches the search
 // criteria.  It optionally uses the client cache, if provided.  e is nil if
-// the entry doesn't match the search criteria.  ts is the timestamp of the
-// processed entry.
+// the entry doesn't match the search criteria or its host is in ignored.  ts is
+// the timestamp of the processed entry.
 func (l *queryLog) readNextEntry(
-	r *qLogReader,
+	r entryReader,
 	params *searchParams,
 	cache clientCache,
+	ignored *aghnet.IgnoreEngine,
 ) (e *logEntry, ts int64, err error) {
 	var line string
 	line, err = r.ReadNext()
@@ -310,7 +342,7 @@ func (l *queryLog) readNextEntry(
 	e = &logEntry{}
 	decodeLogEntry(e, line)
 
-	if l.isIgnored(e.QHost) {
+	if ignored.Has(e.QHost) {
 		return nil, ts, nil
 	}
 
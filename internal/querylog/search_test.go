@@ -2,9 +2,13 @@ package querylog
 
 import (
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
+	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/AdguardTeam/golibs/timeutil"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
@@ -93,3 +97,191 @@ func TestQueryLog_Search_findClient(t *testing.T) {
 
 	assert.Equal(t, knownClientName, gotClient.Name)
 }
+
+func TestQueryLog_Search_structured(t *testing.T) {
+	l, err := newQueryLog(Config{
+		BaseDir:     t.TempDir(),
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		Enabled:     true,
+		FileEnabled: true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(l.Close)
+
+	add := func(host string, qtype uint16, rcode int, p *AddParams) {
+		q := &dns.Msg{
+			Question: []dns.Question{{
+				Name:   host + ".",
+				Qtype:  qtype,
+				Qclass: dns.ClassINET,
+			}},
+		}
+
+		p.Question, p.ClientIP = q, net.IP{1, 2, 3, 4}
+		p.Answer = (&dns.Msg{}).SetRcode(q, rcode)
+
+		l.Add(p)
+	}
+
+	add("servfail.example", dns.TypeA, dns.RcodeServerFailure, &AddParams{
+		Upstream: "tls://upstream-1.example",
+		Elapsed:  2 * time.Second,
+	})
+	add("aaaa.example", dns.TypeAAAA, dns.RcodeSuccess, &AddParams{
+		Upstream:          "tls://upstream-2.example",
+		ClientProto:       ClientProtoDoH,
+		Elapsed:           10 * time.Millisecond,
+		AuthenticatedData: true,
+	})
+
+	// Write the first entries to disk to check both the quick and the full
+	// matching.
+	require.NoError(t, l.flushLogBuffer())
+
+	add("blocked.example", dns.TypeA, dns.RcodeNameError, &AddParams{
+		Result: &filtering.Result{
+			Rules: []*filtering.ResultRule{{
+				Text:         "||blocked.example^",
+				FilterListID: 42,
+			}},
+			Reason:     filtering.FilteredBlockList,
+			IsFiltered: true,
+		},
+		ClientProto: ClientProtoDoT,
+		Cached:      true,
+	})
+
+	testCases := []struct {
+		name      string
+		query     string
+		wantHosts []string
+	}{{
+		name:      "qtype",
+		query:     "qtype=aaaa",
+		wantHosts: []string{"aaaa.example"},
+	}, {
+		name:      "rcode",
+		query:     "rcode=SERVFAIL",
+		wantHosts: []string{"servfail.example"},
+	}, {
+		name:      "rcode_upstream",
+		query:     "rcode=2&upstream=upstream-1",
+		wantHosts: []string{"servfail.example"},
+	}, {
+		name:      "upstream_strict",
+		query:     `upstream="upstream-2"`,
+		wantHosts: []string{},
+	}, {
+		name:      "client_proto",
+		query:     "client_proto=doh",
+		wantHosts: []string{"aaaa.example"},
+	}, {
+		name:      "client_proto_plain",
+		query:     "client_proto=plain",
+		wantHosts: []string{"servfail.example"},
+	}, {
+		name:      "reason",
+		query:     "reason=FilteredBlackList",
+		wantHosts: []string{"blocked.example"},
+	}, {
+		name:      "filter_list_id",
+		query:     "filter_list_id=42",
+		wantHosts: []string{"blocked.example"},
+	}, {
+		name:      "rule",
+		query:     "rule=blocked",
+		wantHosts: []string{"blocked.example"},
+	}, {
+		name:      "elapsed",
+		query:     "elapsed_min=5ms&elapsed_max=1s",
+		wantHosts: []string{"aaaa.example"},
+	}, {
+		name:      "cached",
+		query:     "cached=true",
+		wantHosts: []string{"blocked.example"},
+	}, {
+		name:      "not_cached",
+		query:     "cached=false",
+		wantHosts: []string{"aaaa.example", "servfail.example"},
+	}, {
+		name:      "answer_dnssec",
+		query:     "answer_dnssec=true",
+		wantHosts: []string{"aaaa.example"},
+	}, {
+		name:      "no_answer_dnssec",
+		query:     "answer_dnssec=false",
+		wantHosts: []string{"blocked.example", "servfail.example"},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/control/querylog?"+tc.query, nil)
+			params, pErr := parseSearchParams(r)
+			require.NoError(t, pErr)
+
+			entries, _ := l.search(params)
+
+			hosts := make([]string, 0, len(entries))
+			for _, e := range entries {
+				hosts = append(hosts, e.QHost)
+			}
+
+			assert.Equal(t, tc.wantHosts, hosts)
+		})
+	}
+}
+
+func TestParseSearchParams_errors(t *testing.T) {
+	testCases := []struct {
+		name       string
+		query      string
+		wantErrMsg string
+	}{{
+		name:       "bad_qtype",
+		query:      "qtype=BAD",
+		wantErrMsg: `qtype: invalid qtype "BAD"`,
+	}, {
+		name:       "extended_rcode",
+		query:      "rcode=BADSIG",
+		wantErrMsg: `rcode: extended rcode "BADSIG" is not supported`,
+	}, {
+		name:       "bad_reason",
+		query:      "reason=Bad",
+		wantErrMsg: `reason: invalid reason "Bad"`,
+	}, {
+		name:       "negative_elapsed",
+		query:      "elapsed_min=-1s",
+		wantErrMsg: "elapsed_min: negative duration -1s",
+	}, {
+		name:  "bad_range",
+		query: "from=2024-01-01T15:00:00Z&to=2024-01-01T14:00:00Z",
+		wantErrMsg: "from: 2024-01-01 15:00:00 +0000 UTC is not before to: " +
+			"2024-01-01 14:00:00 +0000 UTC",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/control/querylog?"+tc.query, nil)
+			_, err := parseSearchParams(r)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestSearchParams_match_timeRange(t *testing.T) {
+	from := time.Date(2024, 1, 1, 14, 0, 0, 0, time.UTC)
+	to := from.Add(time.Hour)
+
+	p := &searchParams{
+		from: from,
+		to:   to,
+	}
+
+	assert.Equal(t, to, p.seekTime())
+
+	assert.False(t, p.match(&logEntry{Time: from.Add(-time.Second)}))
+	assert.True(t, p.match(&logEntry{Time: from}))
+	assert.True(t, p.match(&logEntry{Time: to.Add(-time.Second)}))
+	assert.False(t, p.match(&logEntry{Time: to}))
+}
@@ -2,10 +2,14 @@ package querylog
 
 import (
 	"fmt"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/filtering"
 	"github.com/AdguardTeam/golibs/stringutil"
+	"github.com/miekg/dns"
 )
 
 type criterionType int
@@ -19,6 +23,33 @@ const (
 	//
 	// See (*searchCriterion).ctFilteringStatusCase for details.
 	ctFilteringStatus
+	// ctQType is for searching by the type of the question.
+	ctQType
+	// ctRCode is for searching by the response code of the answer.
+	ctRCode
+	// ctUpstream is for searching by the address of the upstream.
+	ctUpstream
+	// ctClientProto is for searching by the protocol of the client.
+	ctClientProto
+	// ctReason is for searching by the filtering reason.
+	ctReason
+	// ctFilterListID is for searching by the ID of the filter list of any of
+	// the matched rules.
+	ctFilterListID
+	// ctRule is for searching by the text of any of the matched rules.
+	ctRule
+	// ctElapsedMin is for searching for the entries processed for at least
+	// the given duration.
+	ctElapsedMin
+	// ctElapsedMax is for searching for the entries processed for at most the
+	// given duration.
+	ctElapsedMax
+	// ctCached is for searching by whether the response was served from the
+	// cache.
+	ctCached
+	// ctAuthenticatedData is for searching by the DNSSEC AD flag of the
+	// response.
+	ctAuthenticatedData
 )
 
 const (
@@ -52,6 +83,121 @@ type searchCriterion struct {
 	// whole value rather than the part of it.  That is, equality and not
 	// containment.
 	strict bool
+
+	// num is the parsed value of ctRCode, ctReason, and ctFilterListID
+	// criteria.
+	num int64
+
+	// dur is the parsed value of ctElapsedMin and ctElapsedMax criteria.
+	dur time.Duration
+
+	// flag is the parsed value of ctCached and ctAuthenticatedData criteria.
+	flag bool
+}
+
+// parseStructuredValue parses val as the value of the structured criterion,
+// that is, any criterion other than ctTerm and ctFilteringStatus.  It sets the
+// corresponding fields of c.
+func (c *searchCriterion) parseStructuredValue(val string) (err error) {
+	switch c.criterionType {
+	case ctQType:
+		c.value, err = parseQType(val)
+	case ctRCode:
+		c.num, err = parseRCode(val)
+	case ctUpstream, ctRule:
+		// Use the value as is.
+	case ctClientProto:
+		if val == "plain" {
+			val = string(ClientProtoPlain)
+		}
+
+		var cp ClientProto
+		cp, err = NewClientProto(val)
+		c.value = string(cp)
+	case ctReason:
+		var r filtering.Reason
+		r, err = filtering.ParseReason(val)
+		c.num = int64(r)
+	case ctFilterListID:
+		c.num, err = strconv.ParseInt(val, 10, 64)
+	case ctElapsedMin, ctElapsedMax:
+		c.dur, err = time.ParseDuration(val)
+		if err == nil && c.dur < 0 {
+			err = fmt.Errorf("negative duration %s", c.dur)
+		}
+	case ctCached, ctAuthenticatedData:
+		c.flag, err = strconv.ParseBool(val)
+	default:
+		err = fmt.Errorf("invalid criterion type %v", c.criterionType)
+	}
+
+	return err
+}
+
+// parseQType parses the name or the number of the question type and returns
+// its name in the same form as it's stored in the query log.
+func parseQType(s string) (name string, err error) {
+	qt, ok := dns.StringToType[strings.ToUpper(s)]
+	if !ok {
+		var n uint64
+		n, err = strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return "", fmt.Errorf("invalid qtype %q", s)
+		}
+
+		qt = uint16(n)
+	}
+
+	return dns.Type(qt).String(), nil
+}
+
+// parseRCode parses the name or the number of the response code.  Extended
+// response codes aren't supported.
+func parseRCode(s string) (rcode int64, err error) {
+	rc, ok := dns.StringToRcode[strings.ToUpper(s)]
+	if !ok {
+		var n uint64
+		n, err = strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid rcode %q", s)
+		}
+
+		rc = int(n)
+	}
+
+	if rc > maxHeaderRCode {
+		return 0, fmt.Errorf("extended rcode %q is not supported", s)
+	}
+
+	return int64(rc), nil
+}
+
+const (
+	// maxHeaderRCode is the maximum response code which fits into the header
+	// of a DNS message.
+	maxHeaderRCode = 0xF
+
+	// flagsByteIdx is the index of the byte of the packed DNS message header
+	// which contains the AD flag and the response code.
+	flagsByteIdx = 3
+
+	// adFlagMask is the mask of the AD flag in the flags byte.
+	adFlagMask = 0x20
+)
+
+// answerRCode returns the response code of the packed DNS message.  ok is
+// false if ans is too short.
+func answerRCode(ans []byte) (rcode int64, ok bool) {
+	if len(ans) <= flagsByteIdx {
+		return 0, false
+	}
+
+	return int64(ans[flagsByteIdx] & maxHeaderRCode), true
+}
+
+// answerAD returns true if the packed DNS message has the AD flag set.
+func answerAD(ans []byte) (ok bool) {
+	return len(ans) > flagsByteIdx && ans[flagsByteIdx]&adFlagMask != 0
 }
 
 func ctDomainOrClientCaseStrict(
@@ -108,11 +254,67 @@ func (c *searchCriterion) quickMatch(line string, findClient quickMatchClientFun
 		// Go on, as we currently don't do quick matches against
 		// filtering statuses.
 		return true
+	case ctQType:
+		return readJSONValue(line, `"QT":"`) == c.value
+	case ctClientProto:
+		return readJSONValue(line, `"CP":"`) == c.value
+	case ctCached:
+		return strings.Contains(line, `"Cached":true`) == c.flag
+	case ctAuthenticatedData:
+		// Old query logs may keep the AD flag in the answer only, so only
+		// exclude the entries with the flag set.
+		return c.flag || !strings.Contains(line, `"AD":true`)
 	default:
 		return true
 	}
 }
 
+// usesBlockIndex returns true if the criterion can use the index of the segment
+// blocks.  The strict search terms are looked up by the full domain names, and
+// the other ones by their substrings, if they are long enough.
+func (c *searchCriterion) usesBlockIndex() (ok bool) {
+	return c.criterionType == ctTerm && (c.strict || len(c.value) >= trigramLen)
+}
+
+// mayMatchBlock returns false if none of the entries of the segment block can
+// match this search criterion.  c must use the block index, see
+// [searchCriterion.usesBlockIndex].
+func (c *searchCriterion) mayMatchBlock(b *segmentBlock, findClient quickMatchClientFunc) (ok bool) {
+	if c.mayMatchBlockDomains(b) || b.ClientsOverflow {
+		return true
+	}
+
+	matchClient := ctDomainOrClientCaseStrict
+	if !c.strict {
+		matchClient = ctDomainOrClientCaseNonStrict
+	}
+
+	for _, cli := range b.Clients {
+		var name string
+		if found := findClient(cli.ClientID, cli.IP); found != nil {
+			name = found.Name
+		}
+
+		if matchClient(c.value, c.asciiVal, cli.ClientID, name, "", cli.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mayMatchBlockDomains returns false if none of the question hosts of the
+// entries of the segment block can match this search criterion.
+func (c *searchCriterion) mayMatchBlockDomains(b *segmentBlock) (ok bool) {
+	has := b.Domains.has
+	if !c.strict {
+		has = b.Trigrams.mayContain
+	}
+
+	return has(strings.ToLower(c.value)) ||
+		(c.asciiVal != "" && has(strings.ToLower(c.asciiVal)))
+}
+
 // match checks if the log entry matches this search criterion.
 func (c *searchCriterion) match(entry *logEntry) bool {
 	switch c.criterionType {
@@ -120,9 +322,57 @@ func (c *searchCriterion) match(entry *logEntry) bool {
 		return c.ctDomainOrClientCase(entry)
 	case ctFilteringStatus:
 		return c.ctFilteringStatusCase(entry.Result.Reason, entry.Result.IsFiltered)
+	default:
+		return c.matchStructured(entry)
 	}
+}
 
-	return false
+// matchStructured checks if the log entry matches this structured search
+// criterion.
+func (c *searchCriterion) matchStructured(e *logEntry) (ok bool) {
+	switch c.criterionType {
+	case ctQType:
+		return e.QType == c.value
+	case ctRCode:
+		rcode, hasAns := answerRCode(e.Answer)
+
+		return hasAns && rcode == c.num
+	case ctUpstream:
+		return c.matchString(e.Upstream)
+	case ctClientProto:
+		return e.ClientProto == ClientProto(c.value)
+	case ctReason:
+		return e.Result.Reason == filtering.Reason(c.num)
+	case ctFilterListID:
+		return slices.ContainsFunc(e.Result.Rules, func(r *filtering.ResultRule) (found bool) {
+			return r.FilterListID == c.num
+		})
+	case ctRule:
+		return slices.ContainsFunc(e.Result.Rules, func(r *filtering.ResultRule) (found bool) {
+			return c.matchString(r.Text)
+		})
+	case ctElapsedMin:
+		return e.Elapsed >= c.dur
+	case ctElapsedMax:
+		return e.Elapsed <= c.dur
+	case ctCached:
+		return e.Cached == c.flag
+	case ctAuthenticatedData:
+		// Old query logs may still keep the AD flag in the answer.
+		return (e.AuthenticatedData || answerAD(e.Answer)) == c.flag
+	default:
+		return false
+	}
+}
+
+// matchString returns true if s matches the criterion value, either entirely
+// or partially, depending on c.strict.
+func (c *searchCriterion) matchString(s string) (ok bool) {
+	if c.strict {
+		return strings.EqualFold(s, c.value)
+	}
+
+	return stringutil.ContainsFold(s, c.value)
 }
 
 func (c *searchCriterion) ctDomainOrClientCase(e *logEntry) bool {
@@ -176,6 +426,10 @@ func (c *searchCriterion) ctFilteringStatusCase(
 		return !reason.In(
 			filtering.FilteredBlockList,
 			filtering.FilteredBlockedService,
+			filtering.FilteredThreatIOC,
+			filtering.FilteredThreatLookup,
+			filtering.FilteredThreatDNSBL,
+			filtering.FilteredNewDomain,
 			filtering.NotFilteredAllowList,
 		)
 	default:
@@ -194,7 +448,14 @@ func (c *searchCriterion) ctFilteringStatusCase(
 func (c *searchCriterion) isFilteredWithReason(reason filtering.Reason) (matched bool) {
 	switch c.value {
 	case filteringStatusBlocked:
-		return reason.In(filtering.FilteredBlockList, filtering.FilteredBlockedService)
+		return reason.In(
+			filtering.FilteredBlockList,
+			filtering.FilteredBlockedService,
+			filtering.FilteredThreatIOC,
+			filtering.FilteredThreatLookup,
+			filtering.FilteredThreatDNSBL,
+			filtering.FilteredNewDomain,
+		)
 	case filteringStatusBlockedParental:
 		return reason == filtering.FilteredParental
 	case filteringStatusBlockedSafebrowsing:
@@ -8,6 +8,13 @@ type searchParams struct {
 	// parameter value.  If not set, disregard it and return any value.
 	olderThan time.Time
 
+	// from, if not zero, is the earliest time of the entries to return,
+	// inclusive.
+	from time.Time
+
+	// to, if not zero, is the latest time of the entries to return, exclusive.
+	to time.Time
+
 	// searchCriteria is a list of search criteria that we use to get filter
 	// results.
 	searchCriteria []searchCriterion
@@ -34,6 +41,24 @@ func newSearchParams() *searchParams {
 	}
 }
 
+// seekTime returns the time before which the entries should be searched.  It's
+// zero if there is no such limit.
+func (s *searchParams) seekTime() (t time.Time) {
+	t = s.olderThan
+	if !s.to.IsZero() && (t.IsZero() || s.to.Before(t)) {
+		t = s.to
+	}
+
+	return t
+}
+
+// isTooOld returns true if the entry with the given time is older than the
+// requested time range, so that the rest of the entries, which are even older,
+// could be skipped.
+func (s *searchParams) isTooOld(t time.Time) (ok bool) {
+	return !s.from.IsZero() && t.Before(s.from)
+}
+
 // quickMatchClientFunc is a simplified client finder for quick matches.
 type quickMatchClientFunc = func(clientID, ip string) (c *Client)
 
@@ -50,11 +75,48 @@ func (s *searchParams) quickMatch(line string, findClient quickMatchClientFunc)
 	return true
 }
 
+// blockFilter returns the filter of the segment blocks that can't contain the
+// entries matching the search parameters.  f is nil if the index of the blocks
+// can't be used for the search.
+func (s *searchParams) blockFilter(findClient quickMatchClientFunc) (f blockFilter) {
+	var crits []searchCriterion
+	for _, c := range s.searchCriteria {
+		if c.usesBlockIndex() {
+			crits = append(crits, c)
+		}
+	}
+
+	seekTime := s.seekTime()
+	if len(crits) == 0 && seekTime.IsZero() && s.from.IsZero() {
+		return nil
+	}
+
+	return func(b *segmentBlock) (ok bool) {
+		if !seekTime.IsZero() && b.MinTime >= seekTime.UnixNano() {
+			return false
+		} else if !s.from.IsZero() && b.MaxTime < s.from.UnixNano() {
+			return false
+		}
+
+		for _, c := range crits {
+			if !c.mayMatchBlock(b, findClient) {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
 // match - checks if the logEntry matches the searchParams
 func (s *searchParams) match(entry *logEntry) bool {
 	if !s.olderThan.IsZero() && !entry.Time.Before(s.olderThan) {
 		// Ignore entries newer than what was requested
 		return false
+	} else if !s.to.IsZero() && !entry.Time.Before(s.to) {
+		return false
+	} else if s.isTooOld(entry.Time) {
+		return false
 	}
 
 	for _, c := range s.searchCriteria {
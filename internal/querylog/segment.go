@@ -0,0 +1,823 @@
+package querylog
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/google/renameio/v2/maybe"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Segments are the compressed files containing the entries moved from the
+// current query log file.  The name of a segment is the name of the query log
+// file followed by the times of its oldest and newest entries in nanoseconds
+// and the ".zst" extension, for example:
+//
+//	querylog.json.1712345678000000000-1712349999000000000.zst
+//
+// A segment consists of independently compressed zstd frames, called blocks,
+// each containing up to segmentBlockSize bytes of the JSON lines.  The sidecar
+// index file with the additional ".idx" extension describes every block, see
+// [segmentIndex].
+const (
+	// segmentExt is the extension of the segment files.
+	segmentExt = ".zst"
+
+	// segmentIdxExt is the extension added to the name of the segment for its
+	// index file.
+	segmentIdxExt = ".idx"
+
+	// segmentBlockSize is the maximum size of the uncompressed data of a
+	// single block, unless a single entry is larger.
+	segmentBlockSize = 256 * 1024
+
+	// segmentMaxSize is the size of the current query log file after which it
+	// is moved into a new segment.  It's also the approximate maximum size of
+	// the uncompressed data of a single segment.
+	segmentMaxSize = 16 * 1024 * 1024
+
+	// segmentMaxClients is the maximum number of distinct clients in the index
+	// of a single block.
+	segmentMaxClients = 256
+
+	// segmentIndexVersion is the current version of the index format.
+	segmentIndexVersion = 1
+)
+
+// segmentIndex is the sidecar index of a segment.
+type segmentIndex struct {
+	// Blocks are the blocks of the segment, from the oldest to the newest.
+	Blocks []*segmentBlock `json:"blocks"`
+
+	// Size is the size of the segment file.  The index isn't used if it
+	// doesn't match the actual size, since the segment may have been replaced.
+	Size int64 `json:"size"`
+
+	// Version is the version of the index format.
+	Version int `json:"version"`
+}
+
+// segmentBlock describes a single block of a segment.
+type segmentBlock struct {
+	// Domains contains the lowercased question hosts of the entries.
+	Domains bloomFilter `json:"domains"`
+
+	// Trigrams contains the substrings of trigramLen bytes of the lowercased
+	// question hosts of the entries.  It's empty in the older indexes.
+	Trigrams bloomFilter `json:"trigrams,omitempty"`
+
+	// Clients are the distinct clients of the entries.  It's only valid if
+	// ClientsOverflow is false.
+	Clients []*segmentClient `json:"clients"`
+
+	// Offset is the offset of the compressed block within the segment.
+	Offset int64 `json:"offset"`
+
+	// Size is the size of the compressed block.
+	Size int64 `json:"size"`
+
+	// MinTime is the time of the oldest entry in nanoseconds.
+	MinTime int64 `json:"min_time"`
+
+	// MaxTime is the time of the newest entry in nanoseconds.
+	MaxTime int64 `json:"max_time"`
+
+	// Count is the number of entries.
+	Count int `json:"count"`
+
+	// ClientsOverflow is true if there are more than segmentMaxClients
+	// distinct clients within the block, so Clients is incomplete.
+	ClientsOverflow bool `json:"clients_overflow,omitempty"`
+}
+
+// segmentClient is a client in the index of a block.
+type segmentClient struct {
+	ClientID string `json:"cid,omitempty"`
+	IP       string `json:"ip"`
+
+	// MinTime is the time of the oldest entry of the client in nanoseconds.
+	MinTime int64 `json:"min_time"`
+
+	// MaxTime is the time of the newest entry of the client in nanoseconds.
+	MaxTime int64 `json:"max_time"`
+}
+
+// blockFilter returns false if none of the entries within the block b can
+// match the search.
+type blockFilter func(b *segmentBlock) (ok bool)
+
+// segmentName returns the name of the segment of the log file with the given
+// times of the oldest and newest entries.
+func segmentName(logFile string, minTS, maxTS int64) (name string) {
+	return fmt.Sprintf("%s.%d-%d%s", logFile, minTS, maxTS, segmentExt)
+}
+
+// parseSegmentName returns the times of the oldest and newest entries of the
+// segment with the given name or path.  ok is false if name isn't a name of a
+// segment.
+func parseSegmentName(name string) (minTS, maxTS int64, ok bool) {
+	name, found := strings.CutSuffix(filepath.Base(name), segmentExt)
+	if !found {
+		return 0, 0, false
+	}
+
+	minStr, maxStr, found := strings.Cut(name[strings.LastIndexByte(name, '.')+1:], "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	minTS, minErr := strconv.ParseInt(minStr, 10, 64)
+	maxTS, maxErr := strconv.ParseInt(maxStr, 10, 64)
+	if minErr != nil || maxErr != nil {
+		return 0, 0, false
+	}
+
+	return minTS, maxTS, true
+}
+
+// segmentInfo is a segment file found on disk.
+type segmentInfo struct {
+	path  string
+	minTS int64
+	maxTS int64
+}
+
+// listSegments returns the segments of logFile sorted from the oldest to the
+// newest.
+func listSegments(logFile string) (segs []*segmentInfo, err error) {
+	dir := filepath.Dir(logFile)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("reading dir: %w", err)
+	}
+
+	prefix := filepath.Base(logFile) + "."
+	for _, ent := range entries {
+		name := ent.Name()
+		if !strings.HasPrefix(name, prefix) || !ent.Type().IsRegular() {
+			continue
+		}
+
+		minTS, maxTS, ok := parseSegmentName(name)
+		if ok {
+			segs = append(segs, &segmentInfo{
+				path:  filepath.Join(dir, name),
+				minTS: minTS,
+				maxTS: maxTS,
+			})
+		}
+	}
+
+	slices.SortFunc(segs, func(a, b *segmentInfo) (res int) {
+		if res = cmp.Compare(a.minTS, b.minTS); res != 0 {
+			return res
+		}
+
+		return cmp.Compare(a.maxTS, b.maxTS)
+	})
+
+	return segs, nil
+}
+
+// removeSegment removes the segment and its index.
+func removeSegment(path string) (err error) {
+	err = os.Remove(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err = os.Remove(path + segmentIdxExt)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// segmentBuilder moves the lines of a query log file into new segments, each
+// containing up to about segmentMaxSize bytes of the uncompressed data.
+type segmentBuilder struct {
+	enc *zstd.Encoder
+
+	// file is the temporary file of the segment being built.  It's nil if
+	// there is no such segment yet.
+	file *os.File
+
+	// index is the index of the segment being built.
+	index *segmentIndex
+
+	// block describes the block being built.
+	block *segmentBlock
+
+	// domains are the distinct domains of the block being built.
+	domains map[string]struct{}
+
+	// clients are the distinct clients of the block being built.
+	clients map[clientCacheKey]*segmentClient
+
+	// logFile is the path to the query log file.
+	logFile string
+
+	// uncompressed is the data of the block being built.
+	uncompressed []byte
+
+	// compressed is the buffer for the compressed data of the block.
+	compressed []byte
+
+	// paths are the paths to the segments built so far.
+	paths []string
+
+	// offset is the current size of the segment being built.
+	offset int64
+
+	// size is the size of the uncompressed data of the segment being built.
+	size int
+
+	minTS int64
+	maxTS int64
+}
+
+// newSegmentBuilder returns a new properly initialized *segmentBuilder.
+func newSegmentBuilder(logFile string) (b *segmentBuilder, err error) {
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, fmt.Errorf("creating encoder: %w", err)
+	}
+
+	return &segmentBuilder{
+		enc:     enc,
+		domains: map[string]struct{}{},
+		clients: map[clientCacheKey]*segmentClient{},
+		logFile: logFile,
+	}, nil
+}
+
+// add adds a line of the query log file to the segment being built.
+func (b *segmentBuilder) add(line []byte) (err error) {
+	if len(b.uncompressed) > 0 && len(b.uncompressed)+len(line) >= segmentBlockSize {
+		err = b.finishBlock()
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return err
+		}
+	}
+
+	if b.block == nil {
+		b.block = &segmentBlock{}
+	}
+
+	e := &logEntry{}
+	decodeLogEntry(e, string(line))
+
+	var ts int64
+	if !e.Time.IsZero() {
+		ts = e.Time.UnixNano()
+		b.block.MinTime = minNonZero(b.block.MinTime, ts)
+		b.block.MaxTime = max(b.block.MaxTime, ts)
+	}
+
+	b.domains[strings.ToLower(e.QHost)] = struct{}{}
+	b.addClient(e.ClientID, e.IP.String(), ts)
+
+	b.block.Count++
+	b.uncompressed = append(b.uncompressed, line...)
+	b.uncompressed = append(b.uncompressed, '\n')
+
+	return nil
+}
+
+// addClient adds the client of an entry with the given time to the index of
+// the block being built.
+func (b *segmentBuilder) addClient(clientID, ip string, ts int64) {
+	key := clientCacheKey{clientID: clientID, ip: ip}
+	c, ok := b.clients[key]
+	if !ok {
+		if len(b.clients) > segmentMaxClients {
+			return
+		}
+
+		c = &segmentClient{ClientID: clientID, IP: ip}
+		b.clients[key] = c
+	}
+
+	if ts != 0 {
+		c.MinTime = minNonZero(c.MinTime, ts)
+		c.MaxTime = max(c.MaxTime, ts)
+	}
+}
+
+// minNonZero returns the smallest of a and b, ignoring zero values.
+func minNonZero(a, b int64) (res int64) {
+	if a == 0 {
+		return b
+	}
+
+	return min(a, b)
+}
+
+// finishBlock compresses the current block and writes it into the segment
+// being built.  It finishes the segment if it's large enough.
+func (b *segmentBuilder) finishBlock() (err error) {
+	blk := b.block
+	if blk == nil {
+		return nil
+	}
+
+	if b.file == nil {
+		b.file, err = os.CreateTemp(filepath.Dir(b.logFile), filepath.Base(b.logFile)+".*.tmp")
+		if err != nil {
+			return fmt.Errorf("creating segment: %w", err)
+		}
+
+		b.index = &segmentIndex{
+			Version: segmentIndexVersion,
+		}
+	}
+
+	b.compressed = b.enc.EncodeAll(b.uncompressed, b.compressed[:0])
+	_, err = b.file.Write(b.compressed)
+	if err != nil {
+		return fmt.Errorf("writing segment: %w", err)
+	}
+
+	blk.Offset, blk.Size = b.offset, int64(len(b.compressed))
+	b.offset += blk.Size
+	b.size += len(b.uncompressed)
+
+	blk.Domains = newBloomFilter(len(b.domains))
+	for d := range b.domains {
+		blk.Domains.add(d)
+	}
+
+	blk.Trigrams = newTrigramFilter(b.domains)
+
+	if len(b.clients) > segmentMaxClients {
+		blk.ClientsOverflow = true
+	} else {
+		blk.Clients = make([]*segmentClient, 0, len(b.clients))
+		for _, c := range b.clients {
+			blk.Clients = append(blk.Clients, c)
+		}
+
+		slices.SortFunc(blk.Clients, func(a, b *segmentClient) (res int) {
+			if res = strings.Compare(a.IP, b.IP); res != 0 {
+				return res
+			}
+
+			return strings.Compare(a.ClientID, b.ClientID)
+		})
+	}
+
+	b.index.Blocks = append(b.index.Blocks, blk)
+	if blk.MinTime != 0 {
+		b.minTS = minNonZero(b.minTS, blk.MinTime)
+		b.maxTS = max(b.maxTS, blk.MaxTime)
+	}
+
+	b.block = nil
+	b.uncompressed = b.uncompressed[:0]
+	clear(b.domains)
+	clear(b.clients)
+
+	if b.size >= segmentMaxSize {
+		return b.finishSegment()
+	}
+
+	return nil
+}
+
+// finishSegment writes the index of the segment being built and moves the
+// segment to its final place.
+func (b *segmentBuilder) finishSegment() (err error) {
+	if b.file == nil {
+		return nil
+	}
+
+	path := segmentName(b.logFile, b.minTS, b.maxTS)
+
+	b.index.Size = b.offset
+	idx, err := json.Marshal(b.index)
+	if err != nil {
+		return fmt.Errorf("encoding index: %w", err)
+	}
+
+	// Write the index first, since a segment without an index is still
+	// readable, but not the other way around.
+	err = maybe.WriteFile(path+segmentIdxExt, idx, 0o644)
+	if err != nil {
+		return fmt.Errorf("writing index: %w", err)
+	}
+
+	tmpPath := b.file.Name()
+	err = b.file.Close()
+	b.file = nil
+	if err != nil {
+		return errors.WithDeferred(fmt.Errorf("closing segment: %w", err), os.Remove(tmpPath))
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return errors.WithDeferred(fmt.Errorf("renaming segment: %w", err), os.Remove(tmpPath))
+	}
+
+	b.paths = append(b.paths, path)
+	b.index, b.offset, b.size, b.minTS, b.maxTS = nil, 0, 0, 0, 0
+
+	return nil
+}
+
+// close releases the resources of the builder and removes the unfinished
+// segment, if any.
+func (b *segmentBuilder) close() (err error) {
+	err = b.enc.Close()
+	if b.file == nil {
+		return err
+	}
+
+	tmpPath := b.file.Name()
+	err = errors.WithDeferred(err, b.file.Close())
+
+	return errors.WithDeferred(err, os.Remove(tmpPath))
+}
+
+// writeSegments moves the lines of the query log data read from r into new
+// segments next to logFile.  It returns the paths to the new segments.
+func writeSegments(logFile string, r io.Reader) (paths []string, err error) {
+	b, err := newSegmentBuilder(logFile)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+	defer func() { err = errors.WithDeferred(err, b.close()) }()
+
+	br := bufio.NewReader(r)
+	for {
+		line, rErr := br.ReadBytes('\n')
+		line = bytes.TrimSuffix(line, []byte{'\n'})
+		if len(line) > 0 {
+			err = b.add(line)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if rErr == io.EOF {
+			break
+		} else if rErr != nil {
+			return nil, fmt.Errorf("reading: %w", rErr)
+		}
+	}
+
+	err = b.finishBlock()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	err = b.finishSegment()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	return b.paths, nil
+}
+
+// readSegmentIndex reads the index of the segment.
+func readSegmentIndex(path string) (idx *segmentIndex, err error) {
+	data, err := os.ReadFile(path + segmentIdxExt)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	idx = &segmentIndex{}
+	err = json.Unmarshal(data, idx)
+	if err != nil {
+		return nil, fmt.Errorf("decoding index: %w", err)
+	} else if idx.Version != segmentIndexVersion {
+		return nil, fmt.Errorf("unsupported index version %d", idx.Version)
+	}
+
+	return idx, nil
+}
+
+// openSegment opens the segment and reads its index.  If the index can't be
+// read or doesn't match the segment, the whole segment is considered a single
+// block.
+func openSegment(seg *segmentInfo) (f *os.File, idx *segmentIndex, err error) {
+	f, err = os.Open(seg.path)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, errors.WithDeferred(err, f.Close())
+	}
+
+	idx, err = readSegmentIndex(seg.path)
+	if err == nil && idx.Size != 0 && idx.Size != fi.Size() {
+		err = fmt.Errorf("index for size %d, got %d", idx.Size, fi.Size())
+	}
+
+	if err != nil {
+		log.Debug("querylog: reading index of %q: %s; reading as a single block", seg.path, err)
+
+		idx = &segmentIndex{
+			Blocks: []*segmentBlock{{
+				Size:            fi.Size(),
+				MinTime:         seg.minTS,
+				MaxTime:         seg.maxTS,
+				ClientsOverflow: true,
+			}},
+			Size:    fi.Size(),
+			Version: segmentIndexVersion,
+		}
+	}
+
+	return f, idx, nil
+}
+
+// readSegmentBlock reads and decompresses the block of the segment file.
+func readSegmentBlock(f *os.File, b *segmentBlock) (data []byte, err error) {
+	buf := make([]byte, b.Size)
+	_, err = f.ReadAt(buf, b.Offset)
+	if err != nil {
+		return nil, fmt.Errorf("reading: %w", err)
+	}
+
+	data, err = segmentDecoder().DecodeAll(buf, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing: %w", err)
+	}
+
+	return data, nil
+}
+
+// rewriteSegment moves the entries of the segment, except the ones for which
+// rm returns true, into new segments and removes the old one.  removed is the
+// number of the removed entries.  The segment isn't changed if there are no
+// such entries.
+func rewriteSegment(
+	logFile string,
+	seg *segmentInfo,
+	rm func(e *logEntry) (ok bool),
+) (removed int, err error) {
+	b, err := newSegmentBuilder(logFile)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return 0, err
+	}
+	defer func() { err = errors.WithDeferred(err, b.close()) }()
+
+	removed, err = filterSegment(seg, b, rm)
+	if err != nil || removed == 0 {
+		// Don't wrap the error since it's informative enough as is.
+		return 0, err
+	}
+
+	err = b.finishBlock()
+	if err == nil {
+		err = b.finishSegment()
+	}
+
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return 0, err
+	}
+
+	if !slices.Contains(b.paths, seg.path) {
+		err = removeSegment(seg.path)
+	}
+
+	return removed, err
+}
+
+// filterSegment adds the entries of the segment, except the ones for which rm
+// returns true, to b.  removed is the number of the skipped entries.  The
+// segment file is closed on return, so that it can be replaced.
+func filterSegment(
+	seg *segmentInfo,
+	b *segmentBuilder,
+	rm func(e *logEntry) (ok bool),
+) (removed int, err error) {
+	f, idx, err := openSegment(seg)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return 0, err
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	for _, blk := range idx.Blocks {
+		var data []byte
+		data, err = readSegmentBlock(f, blk)
+		if err != nil {
+			return 0, fmt.Errorf("block at offset %d: %w", blk.Offset, err)
+		}
+
+		for len(data) > 0 {
+			var line []byte
+			line, data, _ = bytes.Cut(data, []byte{'\n'})
+			if len(line) == 0 {
+				continue
+			}
+
+			e := &logEntry{}
+			decodeLogEntry(e, string(line))
+			if rm(e) {
+				removed++
+
+				continue
+			}
+
+			err = b.add(line)
+			if err != nil {
+				// Don't wrap the error since it's informative enough as is.
+				return 0, err
+			}
+		}
+	}
+
+	return removed, nil
+}
+
+// segmentDecoder returns the decoder for the blocks of all segments.  It's safe
+// for concurrent use.
+var segmentDecoder = sync.OnceValue(func() (dec *zstd.Decoder) {
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		// Should not happen, since there are no options.
+		panic(fmt.Errorf("creating zstd decoder: %w", err))
+	}
+
+	return dec
+})
+
+// bloomFilter is a simple Bloom filter of strings.
+type bloomFilter []byte
+
+const (
+	// bloomBitsPerElem is the number of bits per element of a Bloom filter,
+	// which gives about one percent of false positives.
+	bloomBitsPerElem = 10
+
+	// bloomHashNum is the number of hash functions of a Bloom filter.
+	bloomHashNum = 7
+)
+
+// newBloomFilter returns a new empty Bloom filter for n elements.
+func newBloomFilter(n int) (f bloomFilter) {
+	return make(bloomFilter, max((n*bloomBitsPerElem+7)/8, 8))
+}
+
+// add adds s to f.
+func (f bloomFilter) add(s string) {
+	h1, h2 := bloomHashes(s)
+	bits := uint64(len(f)) * 8
+	for i := uint64(0); i < bloomHashNum; i++ {
+		bit := (h1 + i*h2) % bits
+		f[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// has returns false if s is definitely not in f.  It always returns true for
+// an empty filter.
+func (f bloomFilter) has(s string) (ok bool) {
+	if len(f) == 0 {
+		return true
+	}
+
+	h1, h2 := bloomHashes(s)
+	bits := uint64(len(f)) * 8
+	for i := uint64(0); i < bloomHashNum; i++ {
+		bit := (h1 + i*h2) % bits
+		if f[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// trigramLen is the length of the substrings of the hosts indexed for the
+// non-strict search.
+const trigramLen = 3
+
+// newTrigramFilter returns a new Bloom filter of the substrings of trigramLen
+// bytes of domains.  It returns an empty filter, which matches everything, if
+// any of domains isn't ASCII, since the case folding of the search may not
+// match the lowercasing of such domains.
+func newTrigramFilter(domains map[string]struct{}) (f bloomFilter) {
+	trigrams := map[string]struct{}{}
+	for d := range domains {
+		if !isASCII(d) {
+			return nil
+		}
+
+		for i := 0; i+trigramLen <= len(d); i++ {
+			trigrams[d[i:i+trigramLen]] = struct{}{}
+		}
+	}
+
+	f = newBloomFilter(len(trigrams))
+	for t := range trigrams {
+		f.add(t)
+	}
+
+	return f
+}
+
+// mayContain returns false if none of the hosts indexed by the trigram filter
+// f contains the lowercased substring sub.  It always returns true if sub is
+// shorter than trigramLen or isn't ASCII, since its case folding may not match
+// the lowercasing of the hosts.
+func (f bloomFilter) mayContain(sub string) (ok bool) {
+	if len(sub) < trigramLen || !isASCII(sub) {
+		return true
+	}
+
+	for i := 0; i+trigramLen <= len(sub); i++ {
+		if !f.has(sub[i : i+trigramLen]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isASCII returns true if s contains only ASCII characters.
+func isASCII(s string) (ok bool) {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
+// bloomHashes returns the two hashes of s used to calculate all hash functions
+// of a Bloom filter.
+func bloomHashes(s string) (h1, h2 uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+
+	sum := h.Sum64()
+
+	return sum & 0xFFFF_FFFF, sum>>32 | 1
+}
+
+// sealHead moves the entries of the current query log file into new segments
+// and removes the file.  l.fileWriteLock is expected to be locked.
+func (l *queryLog) sealHead() (err error) {
+	f, err := os.Open(l.logFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			log.Debug("querylog: no log to rotate")
+
+			return nil
+		}
+
+		return fmt.Errorf("opening log file: %w", err)
+	}
+
+	paths, err := func() (paths []string, err error) {
+		defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+		return writeSegments(l.logFile, f)
+	}()
+	if err != nil {
+		return fmt.Errorf("writing segments: %w", err)
+	}
+
+	// Note that the entries are duplicated if the process stops between
+	// writing the segments and removing the file.
+	err = os.Remove(l.logFile)
+	if err != nil {
+		return fmt.Errorf("removing log file: %w", err)
+	}
+
+	log.Debug("querylog: moved %s into %d segments: %q", l.logFile, len(paths), paths)
+
+	return nil
+}
@@ -0,0 +1,468 @@
+package querylog
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSegmentStart is the time of the first entry of the test segments.
+var testSegmentStart = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newTestSegmentData returns the query log data with n entries starting at
+// start, one per second, and their timestamps.  The domains and the client IP
+// addresses of the entries are cycled.
+func newTestSegmentData(start time.Time, n int) (data []byte, tss []int64) {
+	const format = `{"IP":"10.0.0.%d","T":%q,"QH":"host%d.example","QT":"A","QC":"IN",` +
+		`"CP":"","Result":{},"Elapsed":1000,"Upstream":"upstream"}` + "\n"
+
+	buf := &bytes.Buffer{}
+	tss = make([]int64, 0, n)
+	for i := 0; i < n; i++ {
+		t := start.Add(time.Duration(i) * time.Second)
+		tss = append(tss, t.UnixNano())
+
+		_, _ = fmt.Fprintf(buf, format, i%4, t.Format(time.RFC3339Nano), i%100)
+	}
+
+	return buf.Bytes(), tss
+}
+
+// newTestSegment writes the test segment with n entries and returns its path
+// and the timestamps of the entries.
+func newTestSegment(t *testing.T, n int) (path string, tss []int64) {
+	t.Helper()
+
+	logFile := filepath.Join(t.TempDir(), queryLogFileName)
+	data, tss := newTestSegmentData(testSegmentStart, n)
+
+	paths, err := writeSegments(logFile, bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Len(t, paths, 1)
+
+	return paths[0], tss
+}
+
+// openTestSegment returns the opened segment and registers the required
+// cleanup.
+func openTestSegment(t *testing.T, path string, filter blockFilter) (q *qLogSegment) {
+	t.Helper()
+
+	q, err := newQLogSegment(path, filter)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, q.Close)
+
+	return q
+}
+
+// readAllTimestamps reads the remaining lines of q and returns their
+// timestamps.
+func readAllTimestamps(t *testing.T, q qLogFileReader) (tss []int64) {
+	t.Helper()
+
+	for {
+		line, err := q.ReadNext()
+		if err == io.EOF {
+			return tss
+		}
+
+		require.NoError(t, err)
+
+		tss = append(tss, readQLogTimestamp(line))
+	}
+}
+
+func TestWriteSegments(t *testing.T) {
+	const entriesNum = 10_000
+
+	path, tss := newTestSegment(t, entriesNum)
+
+	minTS, maxTS, ok := parseSegmentName(path)
+	require.True(t, ok)
+
+	assert.Equal(t, tss[0], minTS)
+	assert.Equal(t, tss[len(tss)-1], maxTS)
+
+	idx, err := readSegmentIndex(path)
+	require.NoError(t, err)
+
+	require.Greater(t, len(idx.Blocks), 1)
+
+	var total int
+	for i, b := range idx.Blocks {
+		total += b.Count
+
+		assert.LessOrEqual(t, b.MinTime, b.MaxTime)
+		if i > 0 {
+			assert.Equal(t, idx.Blocks[i-1].MaxTime, tss[total-b.Count-1])
+		}
+
+		assert.True(t, b.Domains.has("host1.example"))
+		assert.False(t, b.ClientsOverflow)
+		assert.Len(t, b.Clients, 4)
+	}
+
+	assert.Equal(t, entriesNum, total)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	orig, _ := newTestSegmentData(testSegmentStart, entriesNum)
+	assert.Less(t, len(data), len(orig)/4)
+
+	t.Run("read", func(t *testing.T) {
+		q := openTestSegment(t, path, nil)
+
+		_, err = q.SeekStart()
+		require.NoError(t, err)
+
+		got := readAllTimestamps(t, q)
+		require.Len(t, got, entriesNum)
+
+		assert.Equal(t, tss[len(tss)-1], got[0])
+		assert.Equal(t, tss[0], got[len(got)-1])
+	})
+
+	t.Run("no_index", func(t *testing.T) {
+		noIdxPath := filepath.Join(t.TempDir(), filepath.Base(path))
+		require.NoError(t, os.WriteFile(noIdxPath, data, 0o644))
+
+		q := openTestSegment(t, noIdxPath, nil)
+
+		_, err = q.SeekStart()
+		require.NoError(t, err)
+
+		assert.Len(t, readAllTimestamps(t, q), entriesNum)
+	})
+
+	t.Run("filter", func(t *testing.T) {
+		var checked int
+		q := openTestSegment(t, path, func(b *segmentBlock) (ok bool) {
+			checked++
+
+			return false
+		})
+
+		_, err = q.SeekStart()
+		require.NoError(t, err)
+
+		assert.Empty(t, readAllTimestamps(t, q))
+		assert.Equal(t, len(idx.Blocks), checked)
+	})
+}
+
+func TestQLogSegment_seekTS(t *testing.T) {
+	const entriesNum = 5_000
+
+	path, tss := newTestSegment(t, entriesNum)
+
+	testCases := []struct {
+		wantErr  error
+		name     string
+		ts       int64
+		wantNext int64
+	}{{
+		wantErr:  nil,
+		name:     "exact",
+		ts:       tss[3000],
+		wantNext: tss[2999],
+	}, {
+		wantErr:  nil,
+		name:     "inexact",
+		ts:       tss[3000] + 1,
+		wantNext: tss[3000],
+	}, {
+		wantErr:  nil,
+		name:     "newer",
+		ts:       tss[entriesNum-1] + 1,
+		wantNext: tss[entriesNum-1],
+	}, {
+		wantErr:  errTSTooEarly,
+		name:     "first",
+		ts:       tss[0],
+		wantNext: 0,
+	}, {
+		wantErr:  errTSTooEarly,
+		name:     "older",
+		ts:       tss[0] - 1,
+		wantNext: 0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := openTestSegment(t, path, nil)
+
+			_, _, err := q.seekTS(tc.ts)
+			require.ErrorIs(t, err, tc.wantErr)
+
+			if tc.wantErr != nil {
+				return
+			}
+
+			line, err := q.ReadNext()
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantNext, readQLogTimestamp(line))
+		})
+	}
+}
+
+func TestSearchCriterion_mayMatchBlock(t *testing.T) {
+	domains := map[string]struct{}{"example.org": {}}
+	b := &segmentBlock{
+		Domains:  newBloomFilter(len(domains)),
+		Trigrams: newTrigramFilter(domains),
+		Clients: []*segmentClient{{
+			ClientID: "cli",
+			IP:       "1.2.3.4",
+		}},
+	}
+	b.Domains.add("example.org")
+
+	findClient := func(clientID, ip string) (c *Client) {
+		if ip == "1.2.3.4" {
+			return &Client{Name: "Laptop"}
+		}
+
+		return nil
+	}
+
+	testCases := []struct {
+		name   string
+		term   string
+		strict bool
+		want   bool
+	}{{
+		name:   "domain",
+		term:   "EXAMPLE.org",
+		strict: true,
+		want:   true,
+	}, {
+		name:   "ip",
+		term:   "1.2.3.4",
+		strict: true,
+		want:   true,
+	}, {
+		name:   "client_id",
+		term:   "cli",
+		strict: true,
+		want:   true,
+	}, {
+		name:   "client_name",
+		term:   "laptop",
+		strict: true,
+		want:   true,
+	}, {
+		name:   "other_domain",
+		term:   "example.net",
+		strict: true,
+		want:   false,
+	}, {
+		name:   "other_ip",
+		term:   "1.2.3.5",
+		strict: true,
+		want:   false,
+	}, {
+		name:   "substring",
+		term:   "AMPLE.o",
+		strict: false,
+		want:   true,
+	}, {
+		name:   "substring_client_name",
+		term:   "lapt",
+		strict: false,
+		want:   true,
+	}, {
+		name:   "substring_ip",
+		term:   "2.3",
+		strict: false,
+		want:   true,
+	}, {
+		name:   "other_substring",
+		term:   "ample.n",
+		strict: false,
+		want:   false,
+	}, {
+		name:   "short_substring",
+		term:   "zz",
+		strict: false,
+		want:   true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &searchCriterion{
+				criterionType: ctTerm,
+				value:         tc.term,
+				strict:        tc.strict,
+			}
+
+			assert.Equal(t, tc.want, c.mayMatchBlock(b, findClient))
+		})
+	}
+
+	t.Run("no_trigrams", func(t *testing.T) {
+		c := &searchCriterion{
+			criterionType: ctTerm,
+			value:         "ample.n",
+		}
+
+		// The indexes of the previous versions have no trigrams.
+		legacy := &segmentBlock{
+			Domains: b.Domains,
+			Clients: b.Clients,
+		}
+
+		assert.True(t, c.mayMatchBlock(legacy, findClient))
+	})
+
+	t.Run("overflow", func(t *testing.T) {
+		c := &searchCriterion{
+			criterionType: ctTerm,
+			value:         "1.2.3.5",
+			strict:        true,
+		}
+
+		overflown := &segmentBlock{
+			Domains:         b.Domains,
+			ClientsOverflow: true,
+		}
+
+		assert.True(t, c.mayMatchBlock(overflown, findClient))
+	})
+}
+
+func TestQueryLog_segments(t *testing.T) {
+	baseDir := t.TempDir()
+
+	l, err := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     baseDir,
+	})
+	require.NoError(t, err)
+
+	// Write the file of the previous versions, which must be read as is.
+	legacyData, _ := newTestSegmentData(testSegmentStart, 10)
+	err = os.WriteFile(filepath.Join(baseDir, queryLogFileName+".1"), legacyData, 0o644)
+	require.NoError(t, err)
+
+	addEntry(l, "first.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	addEntry(l, "second.example", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+	require.NoError(t, l.flushLogBuffer())
+	require.NoError(t, l.rotate())
+
+	addEntry(l, "third.example", net.IPv4(1, 1, 1, 3), net.IPv4(2, 2, 2, 3))
+	require.NoError(t, l.flushLogBuffer())
+	require.NoError(t, l.rotate())
+
+	addEntry(l, "fourth.example", net.IPv4(1, 1, 1, 4), net.IPv4(2, 2, 2, 4))
+	require.NoError(t, l.flushLogBuffer())
+
+	segs, err := listSegments(l.logFile)
+	require.NoError(t, err)
+	require.Len(t, segs, 2)
+
+	search := func(t *testing.T, params *searchParams) (hosts []string) {
+		t.Helper()
+
+		entries, _ := l.search(params)
+		for _, e := range entries {
+			hosts = append(hosts, e.QHost)
+		}
+
+		return hosts
+	}
+
+	t.Run("all", func(t *testing.T) {
+		hosts := search(t, newSearchParams())
+		require.Len(t, hosts, 14)
+
+		assert.Equal(t, []string{
+			"fourth.example",
+			"third.example",
+			"second.example",
+			"first.example",
+			"host9.example",
+		}, hosts[:5])
+	})
+
+	t.Run("older_than", func(t *testing.T) {
+		all, _ := l.search(newSearchParams())
+
+		params := newSearchParams()
+		params.olderThan = all[1].Time
+
+		assert.Equal(t, []string{
+			"second.example",
+			"first.example",
+		}, search(t, params)[:2])
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		params := newSearchParams()
+		params.searchCriteria = []searchCriterion{{
+			criterionType: ctTerm,
+			value:         "second.example",
+			strict:        true,
+		}}
+
+		assert.Equal(t, []string{"second.example"}, search(t, params))
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		l.clear()
+
+		segs, err = listSegments(l.logFile)
+		require.NoError(t, err)
+
+		assert.Empty(t, segs)
+		assert.Empty(t, search(t, newSearchParams()))
+	})
+}
+
+func TestQueryLog_removeOldFiles(t *testing.T) {
+	l, err := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		BaseDir:     t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		start := testSegmentStart.Add(time.Duration(i) * timeutil.Day)
+		data, _ := newTestSegmentData(start, 10)
+
+		_, err = writeSegments(l.logFile, bytes.NewReader(data))
+		require.NoError(t, err)
+	}
+
+	l.removeOldFiles(testSegmentStart.Add(3*timeutil.Day + time.Hour))
+
+	segs, err := listSegments(l.logFile)
+	require.NoError(t, err)
+	require.Len(t, segs, 1)
+
+	assert.Equal(t, testSegmentStart.Add(2*timeutil.Day).UnixNano(), segs[0].minTS)
+
+	_, err = os.Stat(segs[0].path + segmentIdxExt)
+	require.NoError(t, err)
+
+	matches, err := filepath.Glob(l.logFile + ".*" + segmentIdxExt)
+	require.NoError(t, err)
+
+	assert.Len(t, matches, 1)
+}
@@ -0,0 +1,233 @@
+package querylog
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// qLogSegment represents a single query log segment.  Just like [qLogFile], it
+// allows reading from the segment in the reverse order.  The segment and its
+// index are only read when needed, so that the segments out of the searched
+// time range aren't even opened.
+//
+// Please note, that this is a stateful object.  Internally, it contains a
+// pointer to a specific block of the segment and a line within it, and it
+// reads lines in reverse order starting from that position.
+type qLogSegment struct {
+	// file is the segment file.  It's nil until the segment is opened.
+	file *os.File
+
+	// index is the index of the segment.  It's nil until the segment is
+	// opened.
+	index *segmentIndex
+
+	// filter, if not nil, defines the blocks which are skipped.
+	filter blockFilter
+
+	// lines are the lines of the current block.
+	lines []string
+
+	// path is the path to the segment file.
+	path string
+
+	// lock is a mutex to make it thread-safe.
+	lock sync.Mutex
+
+	// minTS is the time of the oldest entry of the segment in nanoseconds.
+	minTS int64
+
+	// maxTS is the time of the newest entry of the segment in nanoseconds.
+	maxTS int64
+
+	// blockIdx is the index of the current block.
+	blockIdx int
+
+	// lineIdx is the number of lines of the current block which haven't been
+	// read yet.
+	lineIdx int
+}
+
+// newQLogSegment initializes a new instance of the qLogSegment.  path must be a
+// valid segment name, see [parseSegmentName].
+func newQLogSegment(path string, filter blockFilter) (q *qLogSegment, err error) {
+	minTS, maxTS, ok := parseSegmentName(path)
+	if !ok {
+		return nil, fmt.Errorf("bad segment name %q", path)
+	}
+
+	return &qLogSegment{
+		filter: filter,
+		path:   path,
+		minTS:  minTS,
+		maxTS:  maxTS,
+	}, nil
+}
+
+// type check
+var _ qLogFileReader = (*qLogSegment)(nil)
+
+// open opens the segment and reads its index, if it's not done yet.  See
+// [openSegment].
+func (q *qLogSegment) open() (err error) {
+	if q.file != nil {
+		return nil
+	}
+
+	f, idx, err := openSegment(&segmentInfo{
+		path:  q.path,
+		minTS: q.minTS,
+		maxTS: q.maxTS,
+	})
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	q.file, q.index = f, idx
+
+	return nil
+}
+
+// seekTS looks up the newest record older than the specified timestamp using
+// the index of the segment.  Unlike [qLogFile.seekTS], it doesn't require the
+// exact match:  the next ReadNext call returns the newest record older than
+// the timestamp.  It returns errTSTooEarly if there is no such record.  pos is
+// the offset of the found block within the segment, and depth is the number of
+// the checked blocks.
+func (q *qLogSegment) seekTS(timestamp int64) (pos int64, depth int, err error) {
+	if q.minTS >= timestamp {
+		return 0, 0, errTSTooEarly
+	} else if q.maxTS < timestamp {
+		pos, err = q.SeekStart()
+
+		return pos, 0, err
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	err = q.open()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	blocks := q.index.Blocks
+	i := len(blocks) - 1
+	for ; i >= 0 && blocks[i].MinTime >= timestamp; i-- {
+		depth++
+	}
+
+	if i < 0 {
+		return 0, depth, errTSTooEarly
+	}
+
+	q.blockIdx, q.lines, q.lineIdx = i, nil, 0
+	b := blocks[i]
+	if q.filter != nil && !q.filter(b) {
+		// The next ReadNext call will go on to the previous blocks.
+		return b.Offset, depth, nil
+	}
+
+	err = q.readBlock(b)
+	if err != nil {
+		return 0, depth, fmt.Errorf("looking up timestamp %d in %q: %w", timestamp, q.path, err)
+	}
+
+	for j := len(q.lines) - 1; j >= 0; j-- {
+		if readQLogTimestamp(q.lines[j]) < timestamp {
+			q.lineIdx = j + 1
+
+			break
+		}
+	}
+
+	return b.Offset, depth, nil
+}
+
+// SeekStart changes the current position to the end of the segment.
+func (q *qLogSegment) SeekStart() (pos int64, err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	err = q.open()
+	if err != nil {
+		return 0, err
+	}
+
+	q.blockIdx, q.lines, q.lineIdx = len(q.index.Blocks), nil, 0
+	if st, stErr := q.file.Stat(); stErr == nil {
+		pos = st.Size()
+	}
+
+	return pos, nil
+}
+
+// ReadNext reads the next line (in the reverse order) from the segment,
+// skipping the blocks rejected by the filter.  The blocks which can't be read
+// are skipped as well.
+//
+// Returns io.EOF if there's nothing more to read.
+func (q *qLogSegment) ReadNext() (line string, err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.index == nil {
+		return "", io.EOF
+	}
+
+	for q.lineIdx == 0 {
+		if q.blockIdx == 0 {
+			return "", io.EOF
+		}
+
+		q.blockIdx--
+		b := q.index.Blocks[q.blockIdx]
+		if q.filter != nil && !q.filter(b) {
+			continue
+		}
+
+		err = q.readBlock(b)
+		if err != nil {
+			log.Error("querylog: reading block at offset %d of %q: %s", b.Offset, q.path, err)
+		}
+	}
+
+	q.lineIdx--
+
+	return q.lines[q.lineIdx], nil
+}
+
+// readBlock reads and decompresses the block and sets the position to its end.
+func (q *qLogSegment) readBlock(b *segmentBlock) (err error) {
+	q.lines, q.lineIdx = nil, 0
+
+	data, err := readSegmentBlock(q.file, b)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	if len(data) > 0 {
+		q.lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		q.lineIdx = len(q.lines)
+	}
+
+	return nil
+}
+
+// Close frees the underlying resources.
+func (q *qLogSegment) Close() (err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.file == nil {
+		return nil
+	}
+
+	return q.file.Close()
+}
@@ -0,0 +1,422 @@
+package querylog
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghsqlite"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// sqliteFileName is the name of the SQLite database of the query log in
+// [Config.BaseDir].
+const sqliteFileName = "querylog.sqlite"
+
+// sqliteSchema is the schema of the SQLite database of the query log.  The
+// querylog table contains a row for each entry with the most useful fields in
+// separate columns, so that the database can be queried directly, and the
+// whole entry JSON-encoded in the entry column.  The time column is the UNIX
+// time of the entry in nanoseconds.
+const sqliteSchema = aghsqlite.MetaSchema + `
+CREATE TABLE IF NOT EXISTS querylog (
+	id           INTEGER PRIMARY KEY AUTOINCREMENT,
+	time         INTEGER NOT NULL,
+	client_ip    TEXT    NOT NULL,
+	client_id    TEXT    NOT NULL,
+	client_proto TEXT    NOT NULL,
+	host         TEXT    NOT NULL,
+	qtype        TEXT    NOT NULL,
+	qclass       TEXT    NOT NULL,
+	upstream     TEXT    NOT NULL,
+	elapsed_ns   INTEGER NOT NULL,
+	cached       INTEGER NOT NULL,
+	filtered     INTEGER NOT NULL,
+	reason       TEXT    NOT NULL,
+	entry        TEXT    NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS querylog_time ON querylog (time);
+CREATE INDEX IF NOT EXISTS querylog_host ON querylog (host);
+CREATE INDEX IF NOT EXISTS querylog_client_ip ON querylog (client_ip);
+`
+
+// sqliteStorage is the [entryStorage] keeping the entries in an SQLite
+// database.
+type sqliteStorage struct {
+	db *sql.DB
+}
+
+// type check
+var _ entryStorage = (*sqliteStorage)(nil)
+
+// openSQLiteStorage opens the SQLite database in the file with the given name,
+// creating it if needed, and imports the entries from the query log files once,
+// see [sqliteStorage.migrate].
+func openSQLiteStorage(filename string, files []string) (st *sqliteStorage, err error) {
+	db, err := aghsqlite.Open(filename, sqliteSchema)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	st = &sqliteStorage{db: db}
+
+	err = st.migrate(files)
+	if err != nil {
+		return nil, errors.WithDeferred(fmt.Errorf("migrating: %w", err), db.Close())
+	}
+
+	return st, nil
+}
+
+// filesMigrationKey is the key of the metadata of the migration of the entries
+// from the query log files.
+const filesMigrationKey = "files_migrated"
+
+// migrate copies all the entries from the query log files and segments, unless
+// it has already been done.  The files themselves are left as is.
+func (st *sqliteStorage) migrate(files []string) (err error) {
+	done, err := aghsqlite.IsDone(st.db, filesMigrationKey)
+	if err != nil {
+		return fmt.Errorf("checking migration: %w", err)
+	} else if done {
+		return nil
+	}
+
+	r, err := newQLogReader(files, nil)
+	if err != nil {
+		return fmt.Errorf("opening qlog reader: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, r.Close()) }()
+
+	err = r.SeekStart()
+	if err != nil {
+		return fmt.Errorf("seeking: %w", err)
+	}
+
+	tx, err := st.db.Begin()
+	if err != nil {
+		return fmt.Errorf("opening transaction: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, aghsqlite.Finish(tx, err == nil)) }()
+
+	n, err := insertEntries(tx, r.ReadNext)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	err = aghsqlite.SetDone(tx, filesMigrationKey, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	log.Info("querylog: migrated %d entries from files", n)
+
+	return nil
+}
+
+// insertEntries inserts the JSON-encoded entries returned by next until it
+// returns io.EOF.  n is the number of the inserted entries.
+func insertEntries(tx *sql.Tx, next func() (line string, err error)) (n int, err error) {
+	stmt, err := tx.Prepare(`INSERT INTO querylog (
+		time, client_ip, client_id, client_proto, host, qtype, qclass,
+		upstream, elapsed_ns, cached, filtered, reason, entry
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return 0, fmt.Errorf("preparing statement: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, stmt.Close()) }()
+
+	for {
+		var line string
+		line, err = next()
+		if errors.Is(err, io.EOF) {
+			return n, nil
+		} else if err != nil {
+			return n, fmt.Errorf("reading entry: %w", err)
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		e := &logEntry{}
+		decodeLogEntry(e, line)
+
+		ip := ""
+		if e.IP != nil {
+			ip = e.IP.String()
+		}
+
+		_, err = stmt.Exec(
+			e.Time.UnixNano(),
+			ip,
+			e.ClientID,
+			e.ClientProto,
+			e.QHost,
+			e.QType,
+			e.QClass,
+			e.Upstream,
+			int64(e.Elapsed),
+			e.Cached,
+			e.Result.IsFiltered,
+			e.Result.Reason.String(),
+			line,
+		)
+		if err != nil {
+			return n, fmt.Errorf("inserting entry: %w", err)
+		}
+
+		n++
+	}
+}
+
+// writeEntries implements the [entryStorage] interface for *sqliteStorage.
+func (st *sqliteStorage) writeEntries(b *bytes.Buffer) (err error) {
+	tx, err := st.db.Begin()
+	if err != nil {
+		return fmt.Errorf("opening transaction: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, aghsqlite.Finish(tx, err == nil)) }()
+
+	n, err := insertEntries(tx, func() (line string, err error) {
+		return b.ReadString('\n')
+	})
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	log.Debug("querylog: %d entries written to database", n)
+
+	return nil
+}
+
+// newEntryReader implements the [entryStorage] interface for *sqliteStorage.
+// filter is ignored, since the entries aren't stored in blocks.
+func (st *sqliteStorage) newEntryReader(
+	olderThan time.Time,
+	_ blockFilter,
+) (r entryReader, err error) {
+	var rows *sql.Rows
+	if olderThan.IsZero() {
+		rows, err = st.db.Query(`SELECT entry FROM querylog ORDER BY time DESC, id DESC`)
+	} else {
+		rows, err = st.db.Query(
+			`SELECT entry FROM querylog WHERE time <= ? ORDER BY time DESC, id DESC`,
+			olderThan.UnixNano(),
+		)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("querying entries: %w", err)
+	}
+
+	return &sqliteEntryReader{rows: rows}, nil
+}
+
+// sqliteEntryReader is the [entryReader] of an [sqliteStorage].
+type sqliteEntryReader struct {
+	rows *sql.Rows
+}
+
+// type check
+var _ entryReader = (*sqliteEntryReader)(nil)
+
+// ReadNext implements the [entryReader] interface for *sqliteEntryReader.
+func (r *sqliteEntryReader) ReadNext() (line string, err error) {
+	if !r.rows.Next() {
+		err = r.rows.Err()
+		if err != nil {
+			return "", fmt.Errorf("reading entries: %w", err)
+		}
+
+		return "", io.EOF
+	}
+
+	err = r.rows.Scan(&line)
+	if err != nil {
+		return "", fmt.Errorf("scanning entry: %w", err)
+	}
+
+	return line, nil
+}
+
+// Close implements the [entryReader] interface for *sqliteEntryReader.
+func (r *sqliteEntryReader) Close() (err error) {
+	return r.rows.Close()
+}
+
+// removeEntries implements the [entryStorage] interface for *sqliteStorage.
+func (st *sqliteStorage) removeEntries(f *purgeFilter) (removed int, err error) {
+	return st.removeMatching(`SELECT id, entry FROM querylog`, f.match)
+}
+
+// removeMatching removes the entries returned by query, which must select
+// their IDs and JSON-encoded entries, for which rm returns true.  removed is
+// the number of the removed entries.
+func (st *sqliteStorage) removeMatching(
+	query string,
+	rm func(e *logEntry) (ok bool),
+	args ...any,
+) (removed int, err error) {
+	ids, err := st.matchingIDs(query, rm, args...)
+	if err != nil || len(ids) == 0 {
+		return 0, err
+	}
+
+	tx, err := st.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("opening transaction: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, aghsqlite.Finish(tx, err == nil)) }()
+
+	stmt, err := tx.Prepare(`DELETE FROM querylog WHERE id = ?`)
+	if err != nil {
+		return 0, fmt.Errorf("preparing statement: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, stmt.Close()) }()
+
+	for _, id := range ids {
+		_, err = stmt.Exec(id)
+		if err != nil {
+			return 0, fmt.Errorf("deleting entry %d: %w", id, err)
+		}
+	}
+
+	return len(ids), nil
+}
+
+// matchingIDs returns the IDs of the entries returned by query, which must
+// select their IDs and JSON-encoded entries, for which rm returns true.
+func (st *sqliteStorage) matchingIDs(
+	query string,
+	rm func(e *logEntry) (ok bool),
+	args ...any,
+) (ids []int64, err error) {
+	rows, err := st.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("querying entries: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, rows.Close()) }()
+
+	for rows.Next() {
+		var id int64
+		var line string
+		err = rows.Scan(&id, &line)
+		if err != nil {
+			return nil, fmt.Errorf("scanning entry: %w", err)
+		}
+
+		e := &logEntry{}
+		decodeLogEntry(e, line)
+		if rm(e) {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, rows.Err()
+}
+
+// removeExpired implements the [entryStorage] interface for *sqliteStorage.
+// The size of the database is estimated as the total size of the encoded
+// entries.
+func (st *sqliteStorage) removeExpired(r *retention, maxSize uint64) {
+	var n int
+	var err error
+	if len(r.rules) == 0 {
+		n, err = st.exec(`DELETE FROM querylog WHERE time < ?`, r.defaultCutoff)
+	} else {
+		n, err = st.removeMatching(
+			`SELECT id, entry FROM querylog WHERE time < ?`,
+			func(e *logEntry) (ok bool) {
+				return r.isExpired(e, e.Time.UnixNano() < r.defaultCutoff)
+			},
+			max(r.defaultCutoff, r.latestCutoff),
+		)
+	}
+
+	if err != nil {
+		log.Error("querylog: applying retention: %s", err)
+	} else {
+		log.Debug("querylog: removed %d expired entries", n)
+	}
+
+	if maxSize == 0 {
+		return
+	}
+
+	n, err = st.removeExceeding(maxSize)
+	if err != nil {
+		log.Error("querylog: removing entries exceeding max size: %s", err)
+	} else if n > 0 {
+		log.Debug("querylog: removed %d entries exceeding max size", n)
+	}
+}
+
+// removeExceeding removes the oldest entries until the total size of the
+// encoded entries is within maxSize.
+func (st *sqliteStorage) removeExceeding(maxSize uint64) (removed int, err error) {
+	var total int64
+	err = st.db.QueryRow(`SELECT COALESCE(SUM(LENGTH(entry)), 0) FROM querylog`).Scan(&total)
+	if err != nil {
+		return 0, fmt.Errorf("counting size: %w", err)
+	} else if uint64(total) <= maxSize {
+		return 0, nil
+	}
+
+	excess := total - int64(maxSize)
+
+	var lastTime int64
+	err = st.db.QueryRow(
+		`SELECT time FROM (
+			SELECT time, SUM(LENGTH(entry)) OVER (ORDER BY time, id) AS size
+			FROM querylog
+		) WHERE size >= ? LIMIT 1`,
+		excess,
+	).Scan(&lastTime)
+	if err != nil {
+		return 0, fmt.Errorf("finding oldest kept entry: %w", err)
+	}
+
+	return st.exec(`DELETE FROM querylog WHERE time <= ?`, lastTime)
+}
+
+// exec executes the query and returns the number of the affected rows.
+func (st *sqliteStorage) exec(query string, args ...any) (n int, err error) {
+	res, err := st.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("counting affected rows: %w", err)
+	}
+
+	return int(affected), nil
+}
+
+// rotateEntries implements the [entryStorage] interface for *sqliteStorage.
+// The entries are never rotated, so it does nothing.
+func (st *sqliteStorage) rotateEntries(_ time.Time, _ time.Duration) {}
+
+// clearEntries implements the [entryStorage] interface for *sqliteStorage.
+func (st *sqliteStorage) clearEntries() {
+	_, err := st.db.Exec(`DELETE FROM querylog`)
+	if err != nil {
+		log.Error("querylog: clearing database: %s", err)
+	}
+}
+
+// closeStorage implements the [entryStorage] interface for *sqliteStorage.
+func (st *sqliteStorage) closeStorage() (err error) {
+	return st.db.Close()
+}
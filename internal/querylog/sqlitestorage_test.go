@@ -0,0 +1,86 @@
+package querylog
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLog_sqlite(t *testing.T) {
+	conf := Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: timeutil.Day,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	}
+
+	fl, err := newQueryLog(conf)
+	require.NoError(t, err)
+
+	writeTestSegments(t, fl, 1, 10)
+
+	addEntry(fl, "host1.example", net.IPv4(1, 1, 1, 1), net.IPv4(10, 0, 0, 1))
+	require.NoError(t, fl.flushLogBuffer())
+
+	conf.Backend = BackendSQLite
+	l, err := newQueryLog(conf)
+	require.NoError(t, err)
+
+	// The entries of the files are imported.
+	require.Len(t, searchClients(t, l), 10+1)
+
+	addEntry(l, "other.example", net.IPv4(1, 1, 1, 1), net.IPv4(10, 0, 0, 5))
+	require.NoError(t, l.flushLogBuffer())
+
+	ips := searchClients(t, l)
+	require.Len(t, ips, 10+2)
+
+	assert.Equal(t, "10.0.0.5", ips[0])
+	assert.Equal(t, "10.0.0.1", ips[1])
+
+	t.Run("purge", func(t *testing.T) {
+		f, fErr := newPurgeFilter(&purgeReq{
+			Clients: []string{"10.0.0.5"},
+		}, func(_, _ string) (c *Client) { return nil })
+		require.NoError(t, fErr)
+
+		removed, pErr := l.purge(f)
+		require.NoError(t, pErr)
+
+		assert.Equal(t, 1, removed)
+		assert.Len(t, searchClients(t, l), 10+1)
+	})
+
+	t.Run("retention", func(t *testing.T) {
+		l.removeOldFiles(testSegmentStart.Add(3 * timeutil.Day))
+
+		assert.Equal(t, []string{"10.0.0.1"}, searchClients(t, l))
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		l.clear()
+
+		assert.Empty(t, searchClients(t, l))
+	})
+
+	l.Close()
+
+	// The entries of the files aren't imported again.
+	l, err = newQueryLog(conf)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.storage.closeStorage)
+
+	assert.Empty(t, searchClients(t, l))
+}
+
+func TestBackend_validate(t *testing.T) {
+	testutil.AssertErrorMsg(t, `backend: unsupported value "bolt"`, Backend("bolt").validate())
+
+	assert.NoError(t, Backend("").validate())
+	assert.NoError(t, BackendSQLite.validate())
+}
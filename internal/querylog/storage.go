@@ -0,0 +1,79 @@
+package querylog
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// Backend is the type of the persistent storage of the query log.
+type Backend string
+
+// Supported Backend values.
+const (
+	// BackendFile stores the query log in the JSON file and its compressed
+	// segments.  It's the default.
+	BackendFile Backend = "file"
+
+	// BackendSQLite stores the query log in an SQLite database, which can
+	// also be queried directly.
+	BackendSQLite Backend = "sqlite"
+)
+
+// validate returns an error if b isn't a supported backend.  An empty b is the
+// default one.
+func (b Backend) validate() (err error) {
+	switch b {
+	case "", BackendFile, BackendSQLite:
+		return nil
+	default:
+		return fmt.Errorf("backend: unsupported value %q", b)
+	}
+}
+
+// entryStorage is the persistent storage of the query log entries.
+type entryStorage interface {
+	// writeEntries stores the JSON-encoded entries, one per line, from the
+	// oldest to the newest.
+	writeEntries(b *bytes.Buffer) (err error)
+
+	// newEntryReader returns a reader of the stored entries from the newest to
+	// the oldest, starting with the one not newer than olderThan, unless it's
+	// zero.  The entries rejected by filter, if it's not nil, may be skipped.
+	// r is nil if there is nothing to read.
+	newEntryReader(olderThan time.Time, filter blockFilter) (r entryReader, err error)
+
+	// removeEntries removes the stored entries matching f.  removed is the
+	// number of the removed entries.
+	removeEntries(f *purgeFilter) (removed int, err error)
+
+	// removeExpired removes the stored entries expired according to r and the
+	// oldest ones exceeding maxSize bytes, unless it's zero.  Any errors are
+	// logged.
+	removeExpired(r *retention, maxSize uint64)
+
+	// rotateEntries rotates the stored entries at the moment now according to
+	// the rotation interval ivl, if the storage needs that.  Any errors are
+	// logged.
+	rotateEntries(now time.Time, ivl time.Duration)
+
+	// clearEntries removes all the stored entries.  Any errors are logged.
+	clearEntries()
+
+	// closeStorage frees the resources of the storage.
+	closeStorage() (err error)
+}
+
+// entryReader reads the JSON-encoded query log entries from the newest to the
+// oldest.
+type entryReader interface {
+	// ReadNext returns the next entry.  It returns io.EOF if there is nothing
+	// more to read.
+	ReadNext() (line string, err error)
+
+	// Close frees the underlying resources.
+	Close() (err error)
+}
+
+// type check
+var _ entryReader = (*qLogReader)(nil)
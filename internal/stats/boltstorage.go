@@ -0,0 +1,371 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"go.etcd.io/bbolt"
+)
+
+// boltStorage is the [unitStorage] keeping the units in a bbolt database.
+type boltStorage struct {
+	// db is the opened database.
+	db *bbolt.DB
+
+	// filename is the name of the database file.
+	filename string
+}
+
+// type check
+var _ unitStorage = (*boltStorage)(nil)
+
+// openBoltStorage opens the bbolt database in the file with the given name.
+func openBoltStorage(filename string) (b *boltStorage, err error) {
+	b = &boltStorage{
+		filename: filename,
+	}
+
+	err = b.open()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// open opens the database from b.filename.
+func (b *boltStorage) open() (err error) {
+	log.Debug("stats: opening database")
+
+	b.db, err = bbolt.Open(b.filename, 0o644, nil)
+	if err != nil {
+		if err.Error() == "invalid argument" {
+			log.Error("AdGuard Home cannot be initialized due to an incompatible file system.\nPlease read the explanation here: https://github.com/AdguardTeam/AdGuardHome/wiki/Getting-Started#limitations")
+		}
+
+		return err
+	}
+
+	log.Debug("stats: database opened")
+
+	return nil
+}
+
+// begin implements the [unitStorage] interface for *boltStorage.
+func (b *boltStorage) begin() (tx unitTx, err error) {
+	btx, err := b.db.Begin(true)
+	if err != nil {
+		return nil, fmt.Errorf("opening transaction: %w", err)
+	}
+
+	return boltTx{tx: btx}, nil
+}
+
+// clear implements the [unitStorage] interface for *boltStorage.  It removes
+// the database file and creates a new one.
+func (b *boltStorage) clear() (err error) {
+	tx, err := b.db.Begin(true)
+	if err != nil {
+		log.Error("stats: opening a transaction: %s", err)
+	} else if err = finishTxn(tx, false); err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	// Active transactions will continue using database, but new ones won't be
+	// created.
+	err = b.db.Close()
+	if err != nil {
+		return fmt.Errorf("closing database: %w", err)
+	}
+
+	// All active transactions are now closed.
+	log.Debug("stats: database closed")
+
+	err = os.Remove(b.filename)
+	if err != nil {
+		log.Error("stats: %s", err)
+	}
+
+	err = b.open()
+	if err != nil {
+		return fmt.Errorf("opening database: %w", err)
+	}
+
+	return nil
+}
+
+// close implements the [unitStorage] interface for *boltStorage.
+func (b *boltStorage) close() (err error) {
+	return b.db.Close()
+}
+
+// boltTx is the [unitTx] of a [boltStorage].  The hourly units are stored in
+// the top-level buckets containing the GOB-encoded unit in a single key, and
+// the units of the other resolutions are stored in the tier buckets as
+// GOB-encoded values.
+type boltTx struct {
+	tx *bbolt.Tx
+}
+
+// type check
+var _ unitTx = boltTx{}
+
+// Names of the database buckets containing the units of the corresponding
+// resolutions.  The hourly units are stored in the top-level buckets for
+// compatibility.
+var (
+	minutesBucketName = []byte("minutes")
+	daysBucketName    = []byte("days")
+	weeksBucketName   = []byte("weeks")
+)
+
+// tierBucketName returns the name of the bucket containing the units of the
+// resolution res, which must not be hour.
+func tierBucketName(res resolution) (name []byte) {
+	switch res {
+	case resolutionMinute:
+		return minutesBucketName
+	case resolutionDay:
+		return daysBucketName
+	default:
+		return weeksBucketName
+	}
+}
+
+// isTierBucket returns true if name is the name of the bucket containing the
+// units of a resolution other than hour.
+func isTierBucket(name []byte) (ok bool) {
+	return bytes.Equal(name, minutesBucketName) ||
+		bytes.Equal(name, daysBucketName) ||
+		bytes.Equal(name, weeksBucketName)
+}
+
+// load implements the [unitTx] interface for boltTx.
+func (t boltTx) load(res resolution, id uint32) (udb *unitDB, err error) {
+	if res == resolutionHour {
+		return loadUnitFromDB(t.tx, id), nil
+	}
+
+	bkt := t.tx.Bucket(tierBucketName(res))
+	if bkt == nil {
+		return nil, nil
+	}
+
+	data := bkt.Get(idToUnitName(id))
+	if data == nil {
+		return nil, nil
+	}
+
+	return decodeUnit(data), nil
+}
+
+// put implements the [unitTx] interface for boltTx.
+func (t boltTx) put(res resolution, id uint32, udb *unitDB) (err error) {
+	if res == resolutionHour {
+		return udb.flushUnitToDB(t.tx, id)
+	}
+
+	bkt, err := t.tx.CreateBucketIfNotExists(tierBucketName(res))
+	if err != nil {
+		return fmt.Errorf("creating bucket: %w", err)
+	}
+
+	data, err := udb.encode()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	err = bkt.Put(idToUnitName(id), data)
+	if err != nil {
+		return fmt.Errorf("putting unit %d: %w", id, err)
+	}
+
+	return nil
+}
+
+// each implements the [unitTx] interface for boltTx.
+func (t boltTx) each(
+	res resolution,
+	first uint32,
+	last uint32,
+	f func(id uint32, udb *unitDB),
+) (err error) {
+	if res == resolutionHour {
+		return t.tx.ForEach(func(name []byte, bkt *bbolt.Bucket) (ferr error) {
+			id, ok := unitNameToID(name)
+			if ok && !isTierBucket(name) && id >= first && id <= last {
+				log.Tracef("Loading unit %d", id)
+
+				if udb := decodeUnit(bkt.Get([]byte{0})); udb != nil {
+					f(id, udb)
+				}
+			}
+
+			return nil
+		})
+	}
+
+	bkt := t.tx.Bucket(tierBucketName(res))
+	if bkt == nil {
+		return nil
+	}
+
+	c := bkt.Cursor()
+	for k, v := c.Seek(idToUnitName(first)); k != nil; k, v = c.Next() {
+		id, ok := unitNameToID(k)
+		if !ok || id > last {
+			break
+		}
+
+		if udb := decodeUnit(v); udb != nil {
+			f(id, udb)
+		}
+	}
+
+	return nil
+}
+
+// deleteBefore implements the [unitTx] interface for boltTx.
+func (t boltTx) deleteBefore(res resolution, firstID uint32) (deleted int, err error) {
+	if res == resolutionHour {
+		return deleteOldUnits(t.tx, firstID), nil
+	}
+
+	bkt := t.tx.Bucket(tierBucketName(res))
+	if bkt == nil {
+		return 0, nil
+	}
+
+	c := bkt.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.First() {
+		id, ok := unitNameToID(k)
+		if ok && id >= firstID {
+			break
+		}
+
+		err = c.Delete()
+		if err != nil {
+			return deleted, fmt.Errorf("deleting unit %d: %w", id, err)
+		}
+
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// finish implements the [unitTx] interface for boltTx.
+func (t boltTx) finish(commit bool) (err error) {
+	return finishTxn(t.tx, commit)
+}
+
+func finishTxn(tx *bbolt.Tx, commit bool) (err error) {
+	if commit {
+		err = errors.Annotate(tx.Commit(), "committing: %w")
+	} else {
+		err = errors.Annotate(tx.Rollback(), "rolling back: %w")
+	}
+
+	return err
+}
+
+// deleteOldUnits deletes the hourly units with IDs less than firstID.  It
+// returns the number of deletions performed.
+func deleteOldUnits(tx *bbolt.Tx, firstID uint32) (deleted int) {
+	log.Debug("stats: deleting old units until id %d", firstID)
+
+	// Collect the names first, since deleting buckets while iterating over
+	// them skips some of them.
+	var names [][]byte
+	err := tx.ForEach(func(name []byte, _ *bbolt.Bucket) (ferr error) {
+		id, ok := unitNameToID(name)
+		if ok && id < firstID && !isTierBucket(name) {
+			names = append(names, bytes.Clone(name))
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Debug("stats: deleting units: %s", err)
+	}
+
+	for _, name := range names {
+		err = tx.DeleteBucket(name)
+		if err != nil {
+			log.Debug("stats: deleting bucket: %s", err)
+
+			continue
+		}
+
+		log.Debug("stats: deleted unit (name %x)", name)
+
+		deleted++
+	}
+
+	return deleted
+}
+
+// bucketNameLen is the length of a bucket, a 64-bit unsigned integer.
+//
+// TODO(a.garipov): Find out why a 64-bit integer is used when IDs seem to
+// always be 32 bits.
+const bucketNameLen = 8
+
+// idToUnitName converts a numerical ID into a database unit name.
+func idToUnitName(id uint32) (name []byte) {
+	n := [bucketNameLen]byte{}
+	binary.BigEndian.PutUint64(n[:], uint64(id))
+
+	return n[:]
+}
+
+// unitNameToID converts a database unit name into a numerical ID.  ok is false
+// if name is not a valid database unit name.
+func unitNameToID(name []byte) (id uint32, ok bool) {
+	if len(name) < bucketNameLen {
+		return 0, false
+	}
+
+	return uint32(binary.BigEndian.Uint64(name)), true
+}
+
+func loadUnitFromDB(tx *bbolt.Tx, id uint32) (udb *unitDB) {
+	bkt := tx.Bucket(idToUnitName(id))
+	if bkt == nil {
+		return nil
+	}
+
+	log.Tracef("Loading unit %d", id)
+
+	return decodeUnit(bkt.Get([]byte{0}))
+}
+
+// flushUnitToDB puts udb to the database at id.
+func (udb *unitDB) flushUnitToDB(tx *bbolt.Tx, id uint32) (err error) {
+	log.Debug("stats: flushing unit with id %d and total of %d", id, udb.NTotal)
+
+	bkt, err := tx.CreateBucketIfNotExists(idToUnitName(id))
+	if err != nil {
+		return fmt.Errorf("creating bucket: %w", err)
+	}
+
+	data, err := udb.encode()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	err = bkt.Put([]byte{0}, data)
+	if err != nil {
+		return fmt.Errorf("putting unit to database: %w", err)
+	}
+
+	return nil
+}
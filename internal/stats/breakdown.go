@@ -0,0 +1,203 @@
+package stats
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/AdguardTeam/golibs/stringutil"
+)
+
+// ClientProto is the protocol of the client's request.
+type ClientProto string
+
+// Supported ClientProto values.
+const (
+	ClientProtoPlain    ClientProto = "plain"
+	ClientProtoDoH      ClientProto = "doh"
+	ClientProtoDoT      ClientProto = "dot"
+	ClientProtoDoQ      ClientProto = "doq"
+	ClientProtoDNSCrypt ClientProto = "dnscrypt"
+)
+
+const (
+	// maxBreakdownValues is the maximum number of values of a single
+	// breakdown stored in a unit.
+	maxBreakdownValues = 100
+
+	// maxProtoClients is the maximum number of clients stored for each
+	// protocol in a unit.
+	maxProtoClients = 1000
+)
+
+// protoClients is a set of the clients that used a protocol for serializing
+// statistics data into the database.
+//
+// NOTE: Do not change the names or types of fields, as this structure is used
+// for GOB encoding.
+type protoClients struct {
+	Proto   string
+	Clients []string
+}
+
+// Breakdown is the number of requests by the values of a property of the
+// requests, such as the question type.
+type Breakdown struct {
+	// Totals is the total number of requests for each value.
+	Totals map[string]uint64 `json:"totals"`
+
+	// Series is the number of requests for each value per time unit.
+	Series map[string][]uint64 `json:"series"`
+}
+
+// newBreakdown returns a new empty *Breakdown.
+func newBreakdown() (b *Breakdown) {
+	return &Breakdown{
+		Totals: map[string]uint64{},
+		Series: map[string][]uint64{},
+	}
+}
+
+// add adds the counts from pairs to the time unit with index i out of size.
+func (b *Breakdown) add(pairs []countPair, i, size int) {
+	for _, cp := range pairs {
+		b.Totals[cp.Name] += cp.Count
+
+		series, ok := b.Series[cp.Name]
+		if !ok {
+			series = make([]uint64, size)
+			b.Series[cp.Name] = series
+		}
+
+		series[i] += cp.Count
+	}
+}
+
+// addBreakdowns adds the values of the properties of the requests from u to
+// the time unit with index i of data.  The breakdowns of data must not be nil.
+func (data *StatsResp) addBreakdowns(u *unitDB, i int) {
+	size := len(data.DNSQueries)
+	data.QueryTypes.add(u.QTypes, i, size)
+	data.ResponseCodes.add(u.RCodes, i, size)
+	data.ClientProtocols.add(u.Protos, i, size)
+
+	data.Cached[i] += u.NCached
+}
+
+// initBreakdowns allocates the breakdowns of data with the size of the time
+// series.
+func (data *StatsResp) initBreakdowns() {
+	data.QueryTypes = newBreakdown()
+	data.ResponseCodes = newBreakdown()
+	data.ClientProtocols = newBreakdown()
+	data.Cached = make([]uint64, len(data.DNSQueries))
+}
+
+// summarizeBreakdowns fills the totals of data, which aren't time series,
+// from units.
+func (data *StatsResp) summarizeBreakdowns(units []*unitDB) {
+	clients := map[string]*stringutil.Set{}
+	for _, u := range units {
+		data.NumCached += u.NCached
+
+		for _, pc := range u.ProtoClients {
+			set, ok := clients[pc.Proto]
+			if !ok {
+				set = stringutil.NewSet()
+				clients[pc.Proto] = set
+			}
+
+			for _, c := range pc.Clients {
+				set.Add(c)
+			}
+		}
+	}
+
+	data.ProtocolClients = make(map[string]uint64, len(clients))
+	for proto, set := range clients {
+		data.ProtocolClients[proto] = uint64(set.Len())
+	}
+
+	if data.NumDNSQueries != 0 {
+		data.CacheHitRatio = float64(data.NumCached) / float64(data.NumDNSQueries)
+	}
+}
+
+// addBreakdowns adds the values of the properties of e to u.
+func (u *unit) addBreakdowns(e *Entry) {
+	if e.QType != "" {
+		u.qTypes[e.QType]++
+	}
+
+	if e.RCode != "" {
+		u.rCodes[e.RCode]++
+	}
+
+	if e.Proto != "" {
+		proto := string(e.Proto)
+		u.protos[proto]++
+
+		set, ok := u.protoClients[proto]
+		if !ok {
+			set = stringutil.NewSet()
+			u.protoClients[proto] = set
+		}
+
+		if set.Len() < maxProtoClients {
+			set.Add(e.Client)
+		}
+	}
+
+	if e.Cached {
+		u.nCached++
+	}
+}
+
+// mergeBreakdowns adds the values of the properties of the requests from udb
+// to u.
+func (u *unit) mergeBreakdowns(udb *unitDB) {
+	addPairs(u.qTypes, udb.QTypes)
+	addPairs(u.rCodes, udb.RCodes)
+	addPairs(u.protos, udb.Protos)
+
+	for _, pc := range udb.ProtoClients {
+		set, ok := u.protoClients[pc.Proto]
+		if !ok {
+			set = stringutil.NewSet()
+			u.protoClients[pc.Proto] = set
+		}
+
+		for _, c := range pc.Clients[:min(len(pc.Clients), maxProtoClients-set.Len())] {
+			set.Add(c)
+		}
+	}
+
+	u.nCached += udb.NCached
+}
+
+// protoClientsToSlice converts the sets of clients by protocol into a slice
+// sorted by protocol.
+func protoClientsToSlice(m map[string]*stringutil.Set) (s []protoClients) {
+	s = make([]protoClients, 0, len(m))
+	for proto, set := range m {
+		clients := set.Values()
+		slices.Sort(clients)
+
+		s = append(s, protoClients{Proto: proto, Clients: clients})
+	}
+
+	slices.SortFunc(s, func(a, b protoClients) (res int) {
+		return cmp.Compare(a.Proto, b.Proto)
+	})
+
+	return s
+}
+
+// protoClientsToMap is the inverse of [protoClientsToSlice].
+func protoClientsToMap(s []protoClients) (m map[string]*stringutil.Set) {
+	m = make(map[string]*stringutil.Set, len(s))
+	for _, pc := range s {
+		m[pc.Proto] = stringutil.NewSet(pc.Clients...)
+	}
+
+	return m
+}
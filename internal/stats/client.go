@@ -0,0 +1,380 @@
+package stats
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/exp/maps"
+)
+
+const (
+	// maxClientStats is the maximum number of clients the statistics of which
+	// are stored in a unit.
+	maxClientStats = maxClients
+
+	// maxClientDomains is the maximum number of top domains stored for each
+	// client in a unit.
+	maxClientDomains = 20
+)
+
+// ClientInfo is the information about a persistent client used to find the
+// statistics of all its IDs.
+type ClientInfo struct {
+	// Name is the unique name of the persistent client.
+	Name string
+
+	// Tags are the tags of the persistent client.
+	Tags []string
+}
+
+// FindClientFunc is the signature of a function that returns the information
+// about the persistent client with the given ID or name.  c is nil if there is
+// no such client.
+type FindClientFunc func(id string) (c *ClientInfo)
+
+// clientStat is the statistics of a single client within a unit.
+type clientStat struct {
+	// domains stores the number of requests for each domain.
+	domains map[string]uint64
+
+	// blockedDomains stores the number of requests for each domain that has
+	// been blocked.
+	blockedDomains map[string]uint64
+
+	// nResult stores the number of requests grouped by their result.
+	nResult []uint64
+
+	// nTotal stores the total number of requests.
+	nTotal uint64
+}
+
+// newClientStat allocates the new *clientStat.
+func newClientStat() (cs *clientStat) {
+	return &clientStat{
+		domains:        map[string]uint64{},
+		blockedDomains: map[string]uint64{},
+		nResult:        make([]uint64, resultLast),
+	}
+}
+
+// clientStatDB is the structure for serializing the statistics of a single
+// client into the database.
+//
+// NOTE: Do not change the names or types of fields, as this structure is used
+// for GOB encoding.
+type clientStatDB struct {
+	// Name is the client's primary ID.
+	Name string
+
+	// Domains is the number of requests for each of the top domain names.
+	Domains []countPair
+
+	// BlockedDomains is the number of requests blocked for each of the top
+	// domain names.
+	BlockedDomains []countPair
+
+	// NResult is the number of requests by the result's kind.
+	NResult []uint64
+
+	// NTotal is the total number of requests.
+	NTotal uint64
+}
+
+// clientStatFor returns the statistics of the client with the given ID,
+// creating it if needed.
+func (u *unit) clientStatFor(id string) (cs *clientStat) {
+	cs, ok := u.clientStats[id]
+	if !ok {
+		cs = newClientStat()
+		u.clientStats[id] = cs
+	}
+
+	return cs
+}
+
+// addClientStat adds the data of e to the statistics of its client.
+func (u *unit) addClientStat(e *Entry) {
+	cs := u.clientStatFor(e.Client)
+	cs.nTotal++
+	cs.nResult[e.Result]++
+	if e.Result == RNotFiltered {
+		cs.domains[e.Domain]++
+	} else {
+		cs.blockedDomains[e.Domain]++
+	}
+}
+
+// merge adds the data from csdb to cs.
+func (cs *clientStat) merge(csdb *clientStatDB) {
+	cs.nTotal += csdb.NTotal
+	for r, n := range csdb.NResult[:min(len(csdb.NResult), len(cs.nResult))] {
+		cs.nResult[r] += n
+	}
+
+	addPairs(cs.domains, csdb.Domains)
+	addPairs(cs.blockedDomains, csdb.BlockedDomains)
+}
+
+// clientStatsToSlice converts the statistics of the clients with the most
+// requests into a slice sorted by the number of requests in descending order.
+func clientStatsToSlice(m map[string]*clientStat) (s []*clientStatDB) {
+	s = make([]*clientStatDB, 0, len(m))
+	for id, cs := range m {
+		s = append(s, &clientStatDB{
+			Name:           id,
+			Domains:        convertMapToSlice(cs.domains, maxClientDomains),
+			BlockedDomains: convertMapToSlice(cs.blockedDomains, maxClientDomains),
+			NResult:        slices.Clone(cs.nResult),
+			NTotal:         cs.nTotal,
+		})
+	}
+
+	slices.SortFunc(s, func(a, b *clientStatDB) (res int) {
+		return compareCountsDesc(a.NTotal, b.NTotal)
+	})
+
+	return s[:min(maxClientStats, len(s))]
+}
+
+// clientStatsToMap is the inverse of [clientStatsToSlice].
+func clientStatsToMap(s []*clientStatDB) (m map[string]*clientStat) {
+	m = make(map[string]*clientStat, len(s))
+	for _, csdb := range s {
+		cs := newClientStat()
+		cs.merge(csdb)
+		m[csdb.Name] = cs
+	}
+
+	return m
+}
+
+// clientTagPrefix is the prefix of the ID in the GET /control/stats/clients/{id}
+// HTTP API selecting the clients by their tag.
+const clientTagPrefix = "tag:"
+
+// clientMatcher matches the client IDs from the statistics against the
+// requested client or tag.
+type clientMatcher struct {
+	// find returns the information about the persistent clients.  It may be
+	// nil.
+	find FindClientFunc
+
+	// matched caches the results of the matching.
+	matched map[string]bool
+
+	// id is the requested ID.
+	id string
+
+	// name is the name of the persistent client with the requested ID or
+	// name, if any.
+	name string
+
+	// tag is the requested tag, if any.
+	tag string
+}
+
+// newClientMatcher returns a new matcher for id, which is either the ID or
+// the name of a client or a tag with [clientTagPrefix].  find may be nil.
+func newClientMatcher(id string, find FindClientFunc) (m *clientMatcher) {
+	m = &clientMatcher{
+		find:    find,
+		matched: map[string]bool{},
+		id:      id,
+	}
+
+	if tag, ok := strings.CutPrefix(id, clientTagPrefix); ok {
+		m.tag = tag
+	} else if find != nil {
+		if c := find(id); c != nil {
+			m.name = c.Name
+		}
+	}
+
+	return m
+}
+
+// match returns true if the client with the given ID from the statistics
+// matches.
+func (m *clientMatcher) match(id string) (ok bool) {
+	ok, cached := m.matched[id]
+	if cached {
+		return ok
+	}
+
+	switch {
+	case m.tag != "":
+		c := m.findClient(id)
+		ok = c != nil && slices.Contains(c.Tags, m.tag)
+	case id == m.id:
+		ok = true
+	case m.name != "":
+		c := m.findClient(id)
+		ok = c != nil && c.Name == m.name
+	default:
+		ok = false
+	}
+
+	m.matched[id] = ok
+
+	return ok
+}
+
+// findClient returns the information about the persistent client with the
+// given ID, if any.
+func (m *clientMatcher) findClient(id string) (c *ClientInfo) {
+	if m.find == nil {
+		return nil
+	}
+
+	return m.find(id)
+}
+
+// clientStatsResp is the response to the GET /control/stats/clients/{id}.
+type clientStatsResp struct {
+	TimeUnits string `json:"time_units"`
+
+	// Clients are the IDs of the matched clients.
+	Clients []string `json:"clients"`
+
+	TopQueried []topAddrs `json:"top_queried_domains"`
+	TopBlocked []topAddrs `json:"top_blocked_domains"`
+
+	DNSQueries []uint64 `json:"dns_queries"`
+
+	BlockedFiltering     []uint64 `json:"blocked_filtering"`
+	ReplacedSafebrowsing []uint64 `json:"replaced_safebrowsing"`
+	ReplacedParental     []uint64 `json:"replaced_parental"`
+
+	NumDNSQueries           uint64 `json:"num_dns_queries"`
+	NumBlockedFiltering     uint64 `json:"num_blocked_filtering"`
+	NumReplacedSafebrowsing uint64 `json:"num_replaced_safebrowsing"`
+	NumReplacedSafesearch   uint64 `json:"num_replaced_safesearch"`
+	NumReplacedParental     uint64 `json:"num_replaced_parental"`
+}
+
+// clientStatsFromBuckets collects and returns the statistics of the clients
+// matched by m from units of the resolution res.  s.confMu is expected to be
+// locked.
+func (s *StatsCtx) clientStatsFromBuckets(
+	units []*unitDB,
+	res resolution,
+	m *clientMatcher,
+) (resp *clientStatsResp) {
+	size := len(units)
+	resp = &clientStatsResp{
+		TimeUnits:            res.timeUnits(),
+		DNSQueries:           make([]uint64, size),
+		BlockedFiltering:     make([]uint64, size),
+		ReplacedSafebrowsing: make([]uint64, size),
+		ReplacedParental:     make([]uint64, size),
+	}
+
+	clients := map[string]struct{}{}
+	domains, blocked := map[string]uint64{}, map[string]uint64{}
+	nResult := make([]uint64, resultLast)
+	for i, u := range units {
+		for _, csdb := range u.ClientStats {
+			if !m.match(csdb.Name) {
+				continue
+			}
+
+			clients[csdb.Name] = struct{}{}
+
+			unitRes := make([]uint64, resultLast)
+			copy(unitRes, csdb.NResult)
+
+			resp.DNSQueries[i] += csdb.NTotal
+			resp.BlockedFiltering[i] += unitRes[RFiltered]
+			resp.ReplacedSafebrowsing[i] += unitRes[RSafeBrowsing]
+			resp.ReplacedParental[i] += unitRes[RParental]
+
+			resp.NumDNSQueries += csdb.NTotal
+			for r, n := range unitRes {
+				nResult[r] += n
+			}
+
+			s.addUnignored(domains, csdb.Domains)
+			s.addUnignored(blocked, csdb.BlockedDomains)
+		}
+	}
+
+	resp.NumBlockedFiltering = nResult[RFiltered]
+	resp.NumReplacedSafebrowsing = nResult[RSafeBrowsing]
+	resp.NumReplacedSafesearch = nResult[RSafeSearch]
+	resp.NumReplacedParental = nResult[RParental]
+
+	resp.Clients = maps.Keys(clients)
+	slices.Sort(resp.Clients)
+
+	resp.TopQueried = convertTopSlice(convertMapToSlice(domains, maxDomains))
+	resp.TopBlocked = convertTopSlice(convertMapToSlice(blocked, maxDomains))
+
+	return resp
+}
+
+// addUnignored adds the counts of the domains from pairs, which aren't
+// ignored, to m.  s.confMu is expected to be locked.
+func (s *StatsCtx) addUnignored(m map[string]uint64, pairs []countPair) {
+	for _, cp := range pairs {
+		if !s.ignored.Has(cp.Name) {
+			m[cp.Name] += cp.Count
+		}
+	}
+}
+
+// clientStatsPath is the path prefix of the GET /control/stats/clients/{id}
+// HTTP API.
+const clientStatsPath = "/control/stats/clients/"
+
+// handleStatsClient is the handler for the GET /control/stats/clients/{id}
+// HTTP API.  {id} is either an IP address, a ClientID, or a name of a client or
+// a tag prefixed with "tag:", in which case the statistics of all the clients
+// with this tag are returned.  It accepts the same query parameters as the GET
+// /control/stats HTTP API.
+func (s *StatsCtx) handleStatsClient(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	id := strings.TrimPrefix(r.URL.Path, clientStatsPath)
+	if id == "" || id == clientTagPrefix || strings.Contains(id, "/") {
+		aghhttp.Error(r, w, http.StatusBadRequest, "bad client id %q", id)
+
+		return
+	}
+
+	rng, res, err := parseRangeParams(r.URL.Query())
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	var resp *clientStatsResp
+	func() {
+		s.confMu.RLock()
+		defer s.confMu.RUnlock()
+
+		var units []*unitDB
+		if s.limit == 0 {
+			res = resolutionHour
+		} else {
+			units, res, err = s.loadRange(rng, res)
+		}
+
+		if err == nil {
+			resp = s.clientStatsFromBuckets(units, res, newClientMatcher(id, s.findClient))
+		}
+	}()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusUnprocessableEntity, "%s", err)
+
+		return
+	}
+
+	log.Debug("stats: prepared client data in %v", time.Since(start))
+
+	aghhttp.WriteJSONResponseOK(w, r, resp)
+}
@@ -0,0 +1,122 @@
+package stats
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsCtx_handleStatsClient(t *testing.T) {
+	const (
+		cliIP       = "1.2.3.4"
+		cliClientID = "phone"
+		otherIP     = "5.6.7.8"
+
+		cliName = "Phone"
+		cliTag  = "device_phone"
+	)
+
+	s, err := New(Config{
+		ShouldCountClient: func([]string) bool { return true },
+		UnitID:            func() (id uint32) { return 0 },
+		Filename:          filepath.Join(t.TempDir(), "stats.db"),
+		Limit:             timeutil.Day,
+		Enabled:           true,
+		FindClient: func(id string) (c *ClientInfo) {
+			switch id {
+			case cliIP, cliClientID, cliName:
+				return &ClientInfo{Name: cliName, Tags: []string{cliTag}}
+			default:
+				return nil
+			}
+		},
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	for _, e := range []*Entry{{
+		Domain: "example.org",
+		Client: cliIP,
+		Result: RNotFiltered,
+	}, {
+		Domain: "ads.example",
+		Client: cliClientID,
+		Result: RFiltered,
+	}, {
+		Domain: "adult.example",
+		Client: cliClientID,
+		Result: RParental,
+	}, {
+		Domain: "example.net",
+		Client: otherIP,
+		Result: RNotFiltered,
+	}} {
+		s.Update(e)
+	}
+
+	get := func(t *testing.T, id string) (resp *clientStatsResp) {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodGet, clientStatsPath+id, nil)
+		w := httptest.NewRecorder()
+		s.handleStatsClient(w, r)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		resp = &clientStatsResp{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+
+		return resp
+	}
+
+	t.Run("ip", func(t *testing.T) {
+		resp := get(t, otherIP)
+
+		assert.Equal(t, []string{otherIP}, resp.Clients)
+		assert.Equal(t, uint64(1), resp.NumDNSQueries)
+		assert.Equal(t, []topAddrs{{"example.net": 1}}, resp.TopQueried)
+		assert.Empty(t, resp.TopBlocked)
+	})
+
+	t.Run("name", func(t *testing.T) {
+		resp := get(t, cliName)
+
+		assert.Equal(t, []string{cliIP, cliClientID}, resp.Clients)
+		assert.Equal(t, timeUnitsHours, resp.TimeUnits)
+		assert.Equal(t, uint64(3), resp.NumDNSQueries)
+		assert.Equal(t, uint64(1), resp.NumBlockedFiltering)
+		assert.Equal(t, uint64(1), resp.NumReplacedParental)
+		assert.Len(t, resp.TopBlocked, 2)
+
+		require.Len(t, resp.DNSQueries, 24)
+		assert.Equal(t, uint64(3), resp.DNSQueries[23])
+	})
+
+	t.Run("tag", func(t *testing.T) {
+		resp := get(t, clientTagPrefix+cliTag)
+
+		assert.Equal(t, []string{cliIP, cliClientID}, resp.Clients)
+		assert.Equal(t, uint64(3), resp.NumDNSQueries)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		resp := get(t, "9.9.9.9")
+
+		assert.Empty(t, resp.Clients)
+		assert.Zero(t, resp.NumDNSQueries)
+	})
+
+	t.Run("bad_id", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, clientStatsPath, nil)
+		w := httptest.NewRecorder()
+		s.handleStatsClient(w, r)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
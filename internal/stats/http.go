@@ -4,7 +4,11 @@ package stats
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
@@ -45,12 +49,88 @@ type StatsResp struct {
 	NumReplacedParental     uint64 `json:"num_replaced_parental"`
 
 	AvgProcessingTime float64 `json:"avg_processing_time"`
+
+	// QueryTypes is the number of requests for each question type.
+	QueryTypes *Breakdown `json:"query_types"`
+
+	// ResponseCodes is the number of responses with each response code.
+	ResponseCodes *Breakdown `json:"response_codes"`
+
+	// ClientProtocols is the number of requests over each protocol.
+	ClientProtocols *Breakdown `json:"client_protocols"`
+
+	// ProtocolClients is the number of unique clients that used each
+	// protocol.
+	ProtocolClients map[string]uint64 `json:"protocol_clients"`
+
+	// Cached is the number of responses served from the cache per time unit.
+	Cached []uint64 `json:"cached"`
+
+	NumCached uint64 `json:"num_cached"`
+
+	// CacheHitRatio is the share of the responses served from the cache.
+	CacheHitRatio float64 `json:"cache_hit_ratio"`
+
+	// ProcessingTime is the distribution of processing time of the requests.
+	ProcessingTime *Latency `json:"processing_time"`
+
+	// UpstreamTime is the distribution of durations of successful queries to
+	// all the upstreams.
+	UpstreamTime *Latency `json:"upstream_time"`
+
+	// UpstreamsTime are the percentiles of durations in seconds of successful
+	// queries to each upstream by their names.
+	UpstreamsTime map[string]map[string]float64 `json:"upstreams_time"`
+
+	// UpstreamErrors is the number of failed exchanges with each upstream,
+	// except the timed out ones.
+	UpstreamErrors *Breakdown `json:"upstream_errors"`
+
+	// UpstreamTimeouts is the number of timed out exchanges with each
+	// upstream.
+	UpstreamTimeouts *Breakdown `json:"upstream_timeouts"`
+
+	// UpstreamErrorRates is the share of failed exchanges, including the timed
+	// out ones, with each upstream.
+	UpstreamErrorRates map[string]float64 `json:"upstream_error_rates"`
+}
+
+// parseRangeParams parses the optional "range" and "resolution" query
+// parameters of the GET /control/stats HTTP API.
+func parseRangeParams(q url.Values) (rng time.Duration, res resolution, err error) {
+	if rngStr := q.Get("range"); rngStr != "" {
+		rng, err = time.ParseDuration(rngStr)
+		if err != nil {
+			return 0, "", fmt.Errorf("range: %w", err)
+		} else if rng <= 0 {
+			return 0, "", fmt.Errorf("range: must be positive, got %s", rng)
+		}
+	}
+
+	if resStr := q.Get("resolution"); resStr != "" {
+		res = resolution(resStr)
+		if !slices.Contains(resolutions, res) {
+			return 0, "", fmt.Errorf("resolution: unsupported value %q", resStr)
+		}
+	}
+
+	return rng, res, nil
 }
 
-// handleStats is the handler for the GET /control/stats HTTP API.
+// handleStats is the handler for the GET /control/stats HTTP API.  The
+// optional "range" query parameter is the period to return the statistics
+// for, and the optional "resolution" parameter is the time unit of the
+// returned time series.
 func (s *StatsCtx) handleStats(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 
+	rng, res, err := parseRangeParams(r.URL.Query())
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
 	var (
 		resp *StatsResp
 		ok   bool
@@ -59,8 +139,13 @@ func (s *StatsCtx) handleStats(w http.ResponseWriter, r *http.Request) {
 		s.confMu.RLock()
 		defer s.confMu.RUnlock()
 
-		resp, ok = s.getData(uint32(s.limit.Hours()))
+		resp, ok, err = s.getRangeData(rng, res)
 	}()
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusUnprocessableEntity, "%s", err)
+
+		return
+	}
 
 	log.Debug("stats: prepared data in %v", time.Since(start))
 
@@ -75,6 +160,132 @@ func (s *StatsCtx) handleStats(w http.ResponseWriter, r *http.Request) {
 	aghhttp.WriteJSONResponseOK(w, r, resp)
 }
 
+// handleStatsRules is the handler for the GET /control/stats/rules HTTP API.
+// The optional "limit" query parameter is the maximum number of top rules to
+// return.
+func (s *StatsCtx) handleStatsRules(w http.ResponseWriter, r *http.Request) {
+	limit := maxRules
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			aghhttp.Error(r, w, http.StatusBadRequest, "bad limit %q", limitStr)
+
+			return
+		}
+	}
+
+	var units []*unitDB
+	func() {
+		s.confMu.RLock()
+		defer s.confMu.RUnlock()
+
+		if hours := uint32(s.limit.Hours()); s.enabled && hours != 0 {
+			units = s.loadPeriod(hours)
+		}
+	}()
+
+	aghhttp.WriteJSONResponseOK(w, r, rulesStatsFromUnits(units, limit))
+}
+
+// deadRulesResp is the response to the GET /control/stats/rules/dead.
+type deadRulesResp struct {
+	// Rules are the rules of the filtering-rule list that never matched a
+	// request during the requested period.
+	Rules []string `json:"rules"`
+
+	// Days is the number of full days actually checked, which may be less
+	// than the requested number if the statistics retention interval is
+	// shorter or if the rule hits have been tracked for a shorter time.
+	Days uint32 `json:"days"`
+}
+
+// handleStatsDeadRules is the handler for the GET /control/stats/rules/dead
+// HTTP API.  The "filter_list_id" query parameter is the ID of the
+// filtering-rule list, zero being the custom rules, and the optional "days"
+// parameter is the period to check, which defaults to the whole statistics
+// retention interval.
+func (s *StatsCtx) handleStatsDeadRules(w http.ResponseWriter, r *http.Request) {
+	if s.filterListRules == nil {
+		aghhttp.Error(r, w, http.StatusNotImplemented, "dead rules are not supported")
+
+		return
+	}
+
+	q := r.URL.Query()
+	listID, err := strconv.ParseInt(q.Get("filter_list_id"), 10, 64)
+	if err != nil {
+		aghhttp.Error(r, w, http.StatusBadRequest, "filter_list_id: %s", err)
+
+		return
+	}
+
+	var days uint64
+	if daysStr := q.Get("days"); daysStr != "" {
+		days, err = strconv.ParseUint(daysStr, 10, 32)
+		if err != nil || days == 0 {
+			aghhttp.Error(r, w, http.StatusBadRequest, "bad days %q", daysStr)
+
+			return
+		}
+	}
+
+	rules, ok := s.filterListRules(listID)
+	if !ok {
+		aghhttp.Error(r, w, http.StatusNotFound, "no filter list with id %d", listID)
+
+		return
+	}
+
+	var (
+		enabled bool
+		hours   uint32
+	)
+	func() {
+		s.confMu.RLock()
+		defer s.confMu.RUnlock()
+
+		hours = uint32(s.limit.Hours())
+		if days != 0 {
+			hours = min(hours, uint32(days)*24)
+		}
+
+		enabled = s.enabled && hours != 0
+	}()
+
+	if !enabled {
+		// Nothing is known about the rule hits, so don't report all the rules
+		// as dead.
+		aghhttp.WriteJSONResponseOK(w, r, &deadRulesResp{Rules: []string{}})
+
+		return
+	}
+
+	aghhttp.WriteJSONResponseOK(w, r, s.deadRulesResp(listID, rules, hours))
+}
+
+// deadRulesResp returns the rules of the filtering-rule list with the given ID
+// that haven't matched a request during the last hours or since the rule hits
+// are known, whichever is shorter.
+func (s *StatsCtx) deadRulesResp(listID int64, rules []string, hours uint32) (resp *deadRulesResp) {
+	curID := s.unitIDGen()
+
+	s.currMu.RLock()
+	defer s.currMu.RUnlock()
+
+	since := max(s.ruleHits.since, uint32(max(int64(curID)-int64(hours)+1, 0)))
+
+	var observed uint32
+	if curID >= since {
+		observed = curID - since + 1
+	}
+
+	return &deadRulesResp{
+		Rules: deadRules(s.ruleHits, since, listID, rules),
+		Days:  observed / 24,
+	}
+}
+
 // configResp is the response to the GET /control/stats_info.
 type configResp struct {
 	IntervalDays uint32 `json:"interval"`
@@ -209,7 +420,17 @@ func (s *StatsCtx) handlePutStatsConfig(w http.ResponseWriter, r *http.Request)
 
 	s.ignored = engine
 	s.limit = ivl
-	s.enabled = reqData.Enabled == aghalg.NBTrue
+
+	enabled := reqData.Enabled == aghalg.NBTrue
+	if enabled && !s.enabled {
+		// The rules haven't been tracked while the statistics were disabled.
+		s.currMu.Lock()
+		defer s.currMu.Unlock()
+
+		s.ruleHits.clear(s.unitIDGen())
+	}
+
+	s.enabled = enabled
 }
 
 // handleStatsReset is the handler for the POST /control/stats_reset HTTP API.
@@ -227,6 +448,9 @@ func (s *StatsCtx) initWeb() {
 	}
 
 	s.httpRegister(http.MethodGet, "/control/stats", s.handleStats)
+	s.httpRegister(http.MethodGet, "/control/stats/rules", s.handleStatsRules)
+	s.httpRegister(http.MethodGet, "/control/stats/rules/dead", s.handleStatsDeadRules)
+	s.httpRegister(http.MethodGet, clientStatsPath, s.handleStatsClient)
 	s.httpRegister(http.MethodPost, "/control/stats_reset", s.handleStatsReset)
 	s.httpRegister(http.MethodGet, "/control/stats/config", s.handleGetStatsConfig)
 	s.httpRegister(http.MethodPut, "/control/stats/config/update", s.handlePutStatsConfig)
@@ -0,0 +1,192 @@
+package stats
+
+import "github.com/AdguardTeam/AdGuardHome/internal/aghalg"
+
+// percentiles are the percentiles of the durations returned in [Latency] by
+// their names.
+var percentiles = []struct {
+	name  string
+	value float64
+}{{
+	name:  "p50",
+	value: 0.5,
+}, {
+	name:  "p90",
+	value: 0.9,
+}, {
+	name:  "p99",
+	value: 0.99,
+}}
+
+// Latency is the distribution of a duration of the requests.
+type Latency struct {
+	// Totals are the percentiles of the duration in seconds by their names,
+	// for example "p90".
+	Totals map[string]float64 `json:"totals"`
+
+	// Series are the percentiles of the duration in seconds per time unit by
+	// their names.
+	Series map[string][]float64 `json:"series"`
+
+	// total is the distribution of the duration for the whole period.
+	total aghalg.Sketch
+
+	// units are the distributions of the duration per time unit.
+	units []aghalg.Sketch
+}
+
+// newLatency returns a new empty *Latency with the size of the time series.
+// [Latency.finish] must be called after adding all the data.
+func newLatency(size int) (l *Latency) {
+	l = &Latency{
+		Totals: map[string]float64{},
+		Series: map[string][]float64{},
+		total:  aghalg.Sketch{},
+		units:  make([]aghalg.Sketch, size),
+	}
+
+	for i := range l.units {
+		l.units[i] = aghalg.Sketch{}
+	}
+
+	return l
+}
+
+// add adds the bins of a sketch to the time unit with index i.
+func (l *Latency) add(bins []aghalg.SketchBin, i int) {
+	l.total.Merge(bins)
+	l.units[i].Merge(bins)
+}
+
+// finish computes the percentiles of l from the added data.
+func (l *Latency) finish() {
+	l.Totals = percentilesOf(l.total)
+
+	for _, p := range percentiles {
+		l.Series[p.name] = make([]float64, len(l.units))
+	}
+
+	for i, sk := range l.units {
+		for name, v := range percentilesOf(sk) {
+			l.Series[name][i] = v
+		}
+	}
+
+	l.total, l.units = nil, nil
+}
+
+// percentilesOf returns the percentiles of the durations of sk in seconds by
+// their names.  All of them are zero if sk is empty.
+func percentilesOf(sk aghalg.Sketch) (ps map[string]float64) {
+	qs := make([]float64, 0, len(percentiles))
+	for _, p := range percentiles {
+		qs = append(qs, p.value)
+	}
+
+	vals := sk.Quantiles(qs...)
+
+	ps = make(map[string]float64, len(percentiles))
+	for i, p := range percentiles {
+		if vals != nil {
+			ps[p.name] = microsecondsToSeconds(vals[i])
+		} else {
+			ps[p.name] = 0
+		}
+	}
+
+	return ps
+}
+
+// initLatency allocates the latencies and the upstream failures of data with
+// the size of the time series.
+func (data *StatsResp) initLatency() {
+	size := len(data.DNSQueries)
+	data.ProcessingTime = newLatency(size)
+	data.UpstreamTime = newLatency(size)
+	data.UpstreamErrors = newBreakdown()
+	data.UpstreamTimeouts = newBreakdown()
+}
+
+// addLatency adds the latencies and the upstream failures from u to the time
+// unit with index i of data.
+func (data *StatsResp) addLatency(u *unitDB, i int) {
+	data.ProcessingTime.add(u.ProcessingTimes, i)
+	data.UpstreamTime.add(u.UpstreamTimes, i)
+
+	size := len(data.DNSQueries)
+	data.UpstreamErrors.add(u.UpstreamsErrors, i, size)
+	data.UpstreamTimeouts.add(u.UpstreamsTimeouts, i, size)
+}
+
+// finishLatency computes the percentiles of the latencies of data.  It must be
+// called after adding the data from all the units.
+func (data *StatsResp) finishLatency() {
+	data.ProcessingTime.finish()
+	data.UpstreamTime.finish()
+}
+
+// summarizeUpstreams fills the percentiles of the durations and the error
+// rates of each upstream from units.
+func (data *StatsResp) summarizeUpstreams(units []*unitDB) {
+	sketches := map[string]aghalg.Sketch{}
+	responses := map[string]uint64{}
+	failures := map[string]uint64{}
+	for _, u := range units {
+		mergeUpstreamSketches(sketches, u.UpstreamsTimes)
+		addPairs(responses, u.UpstreamsResponses)
+		addPairs(failures, u.UpstreamsErrors)
+		addPairs(failures, u.UpstreamsTimeouts)
+	}
+
+	data.UpstreamsTime = make(map[string]map[string]float64, len(sketches))
+	for name, sk := range sketches {
+		data.UpstreamsTime[name] = percentilesOf(sk)
+	}
+
+	data.UpstreamErrorRates = make(map[string]float64, len(failures))
+	for name, n := range failures {
+		data.UpstreamErrorRates[name] = float64(n) / float64(n+responses[name])
+	}
+}
+
+// addLatency adds the durations of e to u.
+func (u *unit) addLatency(e *Entry) {
+	u.processingTimes.Add(uint64(e.ProcessingTime.Microseconds()))
+
+	if e.Upstream == "" {
+		return
+	}
+
+	ut := uint64(e.UpstreamTime.Microseconds())
+	u.upstreamTimes.Add(ut)
+
+	sk, ok := u.upstreamsTimes[e.Upstream]
+	if !ok {
+		if len(u.upstreamsTimes) >= maxUpstreams {
+			return
+		}
+
+		sk = aghalg.Sketch{}
+		u.upstreamsTimes[e.Upstream] = sk
+	}
+
+	sk.Add(ut)
+}
+
+// addUpstreamFailure adds the failed exchange with an upstream to u.
+func (u *unit) addUpstreamFailure(e *UpstreamEntry) {
+	if e.Timeout {
+		u.upstreamsTimeouts[e.Upstream]++
+	} else {
+		u.upstreamsErrors[e.Upstream]++
+	}
+}
+
+// mergeLatency adds the latencies and the upstream failures from udb to u.
+func (u *unit) mergeLatency(udb *unitDB) {
+	u.processingTimes.Merge(udb.ProcessingTimes)
+	u.upstreamTimes.Merge(udb.UpstreamTimes)
+	mergeUpstreamSketches(u.upstreamsTimes, udb.UpstreamsTimes)
+	addPairs(u.upstreamsErrors, udb.UpstreamsErrors)
+	addPairs(u.upstreamsTimeouts, udb.UpstreamsTimeouts)
+}
@@ -0,0 +1,633 @@
+package stats
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/golibs/timeutil"
+)
+
+// resolution is the time resolution of the statistics data.
+type resolution string
+
+// Supported resolution values.
+const (
+	resolutionMinute resolution = "minute"
+	resolutionHour   resolution = "hour"
+	resolutionDay    resolution = "day"
+	resolutionWeek   resolution = "week"
+)
+
+// resolutions are the supported resolutions from the finest to the coarsest.
+var resolutions = []resolution{
+	resolutionMinute,
+	resolutionHour,
+	resolutionDay,
+	resolutionWeek,
+}
+
+// week is the duration of a week.
+const week = 7 * timeutil.Day
+
+// duration returns the duration of a single unit of r.
+func (r resolution) duration() (d time.Duration) {
+	switch r {
+	case resolutionMinute:
+		return time.Minute
+	case resolutionHour:
+		return time.Hour
+	case resolutionDay:
+		return timeutil.Day
+	default:
+		return week
+	}
+}
+
+// timeUnits returns the value of [StatsResp.TimeUnits] for r.
+func (r resolution) timeUnits() (units string) {
+	switch r {
+	case resolutionMinute:
+		return timeUnitsMinutes
+	case resolutionHour:
+		return timeUnitsHours
+	case resolutionDay:
+		return timeUnitsDays
+	default:
+		return timeUnitsWeeks
+	}
+}
+
+// start returns the time of the beginning of the unit of r with the given ID.
+func (r resolution) start(id uint32) (t time.Time) {
+	switch r {
+	case resolutionWeek:
+		// See dayToWeek.
+		return time.Unix((int64(id)*7-3)*int64(timeutil.Day/time.Second), 0)
+	default:
+		return time.Unix(int64(id)*int64(r.duration()/time.Second), 0)
+	}
+}
+
+// hourToDay returns the ID of the daily unit containing the hourly unit with
+// the given ID.
+func hourToDay(hour uint32) (day uint32) {
+	return hour / 24
+}
+
+// dayToWeek returns the ID of the weekly unit containing the daily unit with
+// the given ID.  Weeks start on Monday, and the first day of UNIX time is
+// Thursday.
+func dayToWeek(day uint32) (w uint32) {
+	return (day + 3) / 7
+}
+
+// ceilDiv returns the number of the units of duration unit needed to cover d.
+func ceilDiv(d, unit time.Duration) (n uint32) {
+	return uint32((d + unit - 1) / unit)
+}
+
+// validateTierLimits returns an error if the limits of the statistics tiers are
+// not valid.
+func validateTierLimits(minute, hourly, daily time.Duration) (err error) {
+	switch {
+	case minute < 0:
+		return errors.Error("minute limit: negative")
+	case minute > timeutil.Day:
+		return errors.Error("minute limit: more than a day")
+	case hourly != 0 && hourly < timeutil.Day:
+		return errors.Error("hourly limit: less than a day")
+	case daily != 0 && daily < week:
+		return errors.Error("daily limit: less than a week")
+	case hourly != 0 && daily != 0 && daily < hourly:
+		return errors.Error("daily limit: less than hourly limit")
+	default:
+		return nil
+	}
+}
+
+// hourlyRetention returns the duration for which the hourly units are kept.
+// s.confMu is expected to be locked.
+func (s *StatsCtx) hourlyRetention() (d time.Duration) {
+	if s.hourlyLimit > 0 && s.hourlyLimit < s.limit {
+		return s.hourlyLimit
+	}
+
+	return s.limit
+}
+
+// dailyRetention returns the duration for which the data with the daily
+// resolution is available.  s.confMu is expected to be locked.
+func (s *StatsCtx) dailyRetention() (d time.Duration) {
+	if s.hourlyRetention() < s.limit && s.dailyLimit > 0 && s.dailyLimit < s.limit {
+		return s.dailyLimit
+	}
+
+	return s.limit
+}
+
+// retention returns the duration for which the data with the resolution r is
+// available.  s.confMu is expected to be locked.
+func (s *StatsCtx) retention(r resolution) (d time.Duration) {
+	switch r {
+	case resolutionMinute:
+		return min(s.minuteLimit, s.limit)
+	case resolutionHour:
+		return s.hourlyRetention()
+	case resolutionDay:
+		return s.dailyRetention()
+	default:
+		return s.limit
+	}
+}
+
+// autoResolution returns the finest resolution with the data available for the
+// whole rng.  Like the dashboard, it doesn't use hours for a week or more.
+// s.confMu is expected to be locked.
+func (s *StatsCtx) autoResolution(rng time.Duration) (res resolution) {
+	for _, res = range resolutions {
+		if s.retention(res) < rng {
+			continue
+		}
+
+		if res == resolutionHour && rng >= week {
+			return resolutionDay
+		}
+
+		return res
+	}
+
+	return resolutionWeek
+}
+
+// tierLimits are the numbers of units of each resolution to keep.  Zero means
+// that the units of the resolution aren't stored.
+type tierLimits struct {
+	minutes uint32
+	hours   uint32
+	days    uint32
+	weeks   uint32
+}
+
+// tierLimits returns the numbers of units of each resolution to keep.
+// s.confMu is expected to be locked.
+func (s *StatsCtx) tierLimits() (tl tierLimits) {
+	tl.minutes = uint32(s.retention(resolutionMinute) / time.Minute)
+
+	hourly := s.hourlyRetention()
+	tl.hours = uint32(hourly / time.Hour)
+	if hourly == s.limit {
+		return tl
+	}
+
+	daily := s.dailyRetention()
+	tl.days = ceilDiv(daily, timeutil.Day)
+	if daily == s.limit {
+		return tl
+	}
+
+	// Keep one more week, since the oldest one is usually incomplete.
+	tl.weeks = ceilDiv(s.limit, week) + 1
+
+	return tl
+}
+
+// rollup downsamples the hourly units older than the hourly retention interval
+// into the daily ones, the daily units older than the daily retention interval
+// into the weekly ones, and removes the data older than the retention interval.
+// curHour is the ID of the current hourly unit.  s.confMu is expected to be
+// locked.
+func (s *StatsCtx) rollup(tx unitTx, curHour uint32) (err error) {
+	tl := s.tierLimits()
+	if tl.hours == 0 {
+		return nil
+	}
+
+	firstHour := uint32(0)
+	if curHour >= tl.hours {
+		firstHour = curHour - tl.hours + 1
+	}
+
+	if tl.days == 0 {
+		_, err = tx.deleteBefore(resolutionHour, firstHour)
+
+		return errors.Join(err, deleteTier(tx, resolutionDay), deleteTier(tx, resolutionWeek))
+	}
+
+	err = rollupTier(tx, resolutionHour, resolutionDay, firstHour, hourToDay)
+	if err != nil {
+		return fmt.Errorf("rolling up hours: %w", err)
+	}
+
+	curDay := hourToDay(curHour)
+	firstDay := uint32(0)
+	if curDay >= tl.days {
+		firstDay = curDay - tl.days + 1
+	}
+
+	if tl.weeks == 0 {
+		_, err = tx.deleteBefore(resolutionDay, firstDay)
+
+		return errors.Join(err, deleteTier(tx, resolutionWeek))
+	}
+
+	err = rollupTier(tx, resolutionDay, resolutionWeek, firstDay, dayToWeek)
+	if err != nil {
+		return fmt.Errorf("rolling up days: %w", err)
+	}
+
+	curWeek := dayToWeek(curDay)
+	if curWeek < tl.weeks {
+		return nil
+	}
+
+	_, err = tx.deleteBefore(resolutionWeek, curWeek-tl.weeks+1)
+
+	return err
+}
+
+// rollupTier merges the units of the resolution from with IDs less than first
+// into the units of the coarser resolution to, the IDs of which are returned by
+// toID, and removes them.
+func rollupTier(
+	tx unitTx,
+	from resolution,
+	to resolution,
+	first uint32,
+	toID func(id uint32) (coarseID uint32),
+) (err error) {
+	if first == 0 {
+		return nil
+	}
+
+	var ids []uint32
+	var udbs []*unitDB
+	err = tx.each(from, 0, first-1, func(id uint32, udb *unitDB) {
+		ids = append(ids, id)
+		udbs = append(udbs, udb)
+	})
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+
+	merged := map[uint32]*unit{}
+	for i, id := range ids {
+		coarseID := toID(id)
+		u, ok := merged[coarseID]
+		if !ok {
+			var udb *unitDB
+			udb, err = tx.load(to, coarseID)
+			if err != nil {
+				return fmt.Errorf("loading %s unit %d: %w", to, coarseID, err)
+			}
+
+			u = newUnit(coarseID)
+			u.deserialize(udb)
+			merged[coarseID] = u
+		}
+
+		u.merge(udbs[i])
+
+		log.Debug("stats: rolled up %s unit %d", from, id)
+	}
+
+	_, err = tx.deleteBefore(from, first)
+	if err != nil {
+		return fmt.Errorf("deleting units: %w", err)
+	}
+
+	for id, u := range merged {
+		err = tx.put(to, id, u.serialize())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteTier removes all the units of the resolution res.
+func deleteTier(tx unitTx, res resolution) (err error) {
+	_, err = tx.deleteBefore(res, math.MaxUint32)
+	if err != nil {
+		return fmt.Errorf("deleting %s units: %w", res, err)
+	}
+
+	return nil
+}
+
+// flushMinute puts the previous minute unit u into the database and removes
+// the minute units older than limit minutes before the minute with ID curID.
+// u is expected to be s.flushingMin.  s.confMu and s.currMu are expected to be
+// unlocked.
+func (s *StatsCtx) flushMinute(u *unit, curID, limit uint32) {
+	st := s.storage()
+	if st == nil {
+		s.resetFlushingMin(u)
+
+		return
+	}
+
+	tx, err := st.begin()
+	if err != nil {
+		s.resetFlushingMin(u)
+		log.Error("stats: %s", err)
+
+		return
+	}
+
+	err = flushMinuteToDB(tx, u, curID, limit)
+	if err != nil {
+		log.Error("stats: flushing minute unit: %s", err)
+	}
+
+	// Keep u available for the queries until it's stored, but reset it before
+	// finishing the transaction so that it isn't counted twice, since the
+	// queries also use writable transactions.
+	s.resetFlushingMin(u)
+
+	err = tx.finish(err == nil)
+	if err != nil {
+		log.Error("stats: %s", err)
+	}
+}
+
+// resetFlushingMin sets s.flushingMin to nil if it's still u.
+func (s *StatsCtx) resetFlushingMin(u *unit) {
+	s.currMu.Lock()
+	defer s.currMu.Unlock()
+
+	if s.flushingMin == u {
+		s.flushingMin = nil
+	}
+}
+
+// flushMinuteToDB puts u into the database and removes the minute units older
+// than limit minutes before the minute with ID curID.
+func flushMinuteToDB(tx unitTx, u *unit, curID, limit uint32) (err error) {
+	err = tx.put(resolutionMinute, u.id, u.serialize())
+	if err != nil {
+		return err
+	}
+
+	if curID < limit {
+		return nil
+	}
+
+	_, err = tx.deleteBefore(resolutionMinute, curID-limit+1)
+
+	return err
+}
+
+// bucketSet is a set of consecutive units of a single resolution the stored
+// data is merged into.
+type bucketSet struct {
+	// units are the units of the set ordered by their IDs.
+	units []*unit
+
+	// first is the ID of the first unit.  It's signed, since the set may
+	// start before the beginning of UNIX time in tests.
+	first int64
+}
+
+// newBucketSet returns a set of n units, the last of which has the given ID.
+func newBucketSet(n, last uint32) (bs *bucketSet) {
+	bs = &bucketSet{
+		units: make([]*unit, n),
+		first: int64(last) - int64(n) + 1,
+	}
+
+	for i := range bs.units {
+		bs.units[i] = newUnit(uint32(bs.first + int64(i)))
+	}
+
+	return bs
+}
+
+// contains returns true if the unit with the given ID is in bs.
+func (bs *bucketSet) contains(id uint32) (ok bool) {
+	i := int64(id) - bs.first
+
+	return i >= 0 && i < int64(len(bs.units))
+}
+
+// add merges udb into the unit with the given ID, if it's in bs.
+func (bs *bucketSet) add(id uint32, udb *unitDB) {
+	if bs.contains(id) {
+		bs.units[int64(id)-bs.first].merge(udb)
+	}
+}
+
+// serialize returns the serialized units of bs.
+func (bs *bucketSet) serialize() (units []*unitDB) {
+	units = make([]*unitDB, 0, len(bs.units))
+	for _, u := range bs.units {
+		units = append(units, u.serialize())
+	}
+
+	return units
+}
+
+// loadBuckets returns n units of the resolution res, the last of which
+// contains the current data, merged from the data of all the resolutions.
+// units is nil if the database is closed.  s.confMu is expected to be locked.
+func (s *StatsCtx) loadBuckets(n uint32, res resolution) (units []*unitDB) {
+	if res == resolutionHour {
+		units, _ = s.loadUnits(n)
+
+		return units
+	}
+
+	st := s.storage()
+	if st == nil {
+		return nil
+	}
+
+	// Use writable transaction to ensure any ongoing writable transaction is
+	// taken into account.
+	tx, err := st.begin()
+	if err != nil {
+		log.Error("stats: %s", err)
+
+		return nil
+	}
+	defer func() {
+		if err = tx.finish(false); err != nil {
+			log.Error("stats: %s", err)
+		}
+	}()
+
+	s.currMu.RLock()
+	defer s.currMu.RUnlock()
+
+	var bs *bucketSet
+	if res == resolutionMinute {
+		bs = s.loadMinutes(tx, n)
+	} else {
+		bs = s.loadRollups(tx, n, res)
+	}
+
+	return bs.serialize()
+}
+
+// loadMinutes returns the set of the last n minute units.  s.currMu is
+// expected to be locked.
+func (s *StatsCtx) loadMinutes(tx unitTx, n uint32) (bs *bucketSet) {
+	cur := s.currMin
+
+	var curID uint32
+	if cur != nil {
+		curID = cur.id
+	} else {
+		curID = s.minuteIDGen()
+	}
+
+	bs = newBucketSet(n, curID)
+
+	// The current unit may also be stored in the database, so don't count it
+	// twice.
+	if curID > 0 {
+		err := tx.each(resolutionMinute, uint32(max(bs.first, 0)), curID-1, bs.add)
+		if err != nil {
+			log.Error("stats: loading minute units: %s", err)
+		}
+	}
+
+	if prev := s.flushingMin; prev != nil {
+		bs.add(prev.id, prev.serialize())
+	}
+
+	if cur != nil {
+		bs.add(curID, cur.serialize())
+	}
+
+	return bs
+}
+
+// loadRollups returns the set of the last n units of the resolution res, which
+// must be either day or week, merged from the hourly, daily, and, for weeks,
+// weekly units.  s.currMu is expected to be locked.
+func (s *StatsCtx) loadRollups(tx unitTx, n uint32, res resolution) (bs *bucketSet) {
+	cur := s.curr
+
+	var curHour uint32
+	if cur != nil {
+		curHour = cur.id
+	} else {
+		curHour = s.unitIDGen()
+	}
+
+	fromDay := func(day uint32) (id uint32) { return day }
+	if res == resolutionWeek {
+		fromDay = dayToWeek
+	}
+
+	bs = newBucketSet(n, fromDay(hourToDay(curHour)))
+
+	// The current unit may also be stored in the database, so don't count it
+	// twice.
+	if curHour > 0 {
+		err := tx.each(resolutionHour, 0, curHour-1, func(id uint32, udb *unitDB) {
+			bs.add(fromDay(hourToDay(id)), udb)
+		})
+		if err != nil {
+			log.Error("stats: loading hourly units: %s", err)
+		}
+	}
+
+	err := tx.each(resolutionDay, 0, math.MaxUint32, func(id uint32, udb *unitDB) {
+		bs.add(fromDay(id), udb)
+	})
+	if err != nil {
+		log.Error("stats: loading daily units: %s", err)
+	}
+
+	if res == resolutionWeek {
+		err = tx.each(resolutionWeek, 0, math.MaxUint32, bs.add)
+		if err != nil {
+			log.Error("stats: loading weekly units: %s", err)
+		}
+	}
+
+	if cur != nil {
+		bs.add(fromDay(hourToDay(curHour)), cur.serialize())
+	}
+
+	return bs
+}
+
+// loadPeriod returns the units covering the last hours hours, including the
+// downsampled ones.  s.confMu is expected to be locked.
+func (s *StatsCtx) loadPeriod(hours uint32) (units []*unitDB) {
+	if hours <= uint32(s.hourlyRetention().Hours()) {
+		units, _ = s.loadUnits(hours)
+
+		return units
+	}
+
+	rng := time.Duration(hours) * time.Hour
+	res := s.autoResolution(rng)
+
+	return s.loadBuckets(ceilDiv(rng, res.duration()), res)
+}
+
+// getRangeData returns the statistics data for the last rng with the
+// resolution res.  Either of them may be empty, in which case the appropriate
+// value is chosen.  s.confMu is expected to be locked.
+func (s *StatsCtx) getRangeData(
+	rng time.Duration,
+	res resolution,
+) (resp *StatsResp, ok bool, err error) {
+	if s.limit == 0 {
+		resp, ok = s.getData(0)
+
+		return resp, ok, nil
+	}
+
+	if rng == 0 && res == "" && s.hourlyRetention() == s.limit {
+		resp, ok = s.getData(uint32(s.limit.Hours()))
+
+		return resp, ok, nil
+	}
+
+	units, res, err := s.loadRange(rng, res)
+	if err != nil {
+		return nil, false, err
+	} else if units == nil {
+		return &StatsResp{}, false, nil
+	}
+
+	return s.dataFromBuckets(units, res), true, nil
+}
+
+// loadRange returns the units of the resolution res covering the last rng.
+// Either of them may be empty, in which case the appropriate value is chosen
+// and returned in actual.  units is nil if the database is closed.  s.limit
+// must not be zero.  s.confMu is expected to be locked.
+func (s *StatsCtx) loadRange(
+	rng time.Duration,
+	res resolution,
+) (units []*unitDB, actual resolution, err error) {
+	switch {
+	case rng > s.limit:
+		return nil, "", fmt.Errorf("range: more than the statistics interval %s", s.limit)
+	case rng == 0 && res == "":
+		rng = s.limit
+	case rng == 0:
+		rng = s.retention(res)
+	default:
+		// Go on.
+	}
+
+	if res == "" {
+		res = s.autoResolution(rng)
+	} else if avail := s.retention(res); avail == 0 {
+		return nil, "", fmt.Errorf("resolution %q is not available", res)
+	} else if avail < rng {
+		return nil, "", fmt.Errorf("resolution %q is only available for %s", res, avail)
+	}
+
+	return s.loadBuckets(ceilDiv(rng, res.duration()), res), res, nil
+}
@@ -0,0 +1,280 @@
+package stats
+
+import (
+	"math"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sumTotal returns the total number of requests in units.
+func sumTotal(units []*unitDB) (n uint64) {
+	for _, u := range units {
+		n += u.NTotal
+	}
+
+	return n
+}
+
+// countUnits returns the number of the units of the resolution res in tx.
+func countUnits(t *testing.T, tx unitTx, res resolution) (n int) {
+	t.Helper()
+
+	err := tx.each(res, 0, math.MaxUint32, func(_ uint32, _ *unitDB) { n++ })
+	require.NoError(t, err)
+
+	return n
+}
+
+func TestStatsCtx_rollup(t *testing.T) {
+	for _, b := range []Backend{BackendBolt, BackendSQLite} {
+		t.Run(string(b), func(t *testing.T) {
+			testRollup(t, b)
+		})
+	}
+}
+
+// testRollup checks the downsampling of the units stored with the backend b.
+func testRollup(t *testing.T, b Backend) {
+	const (
+		// curHour is the fifth hour of a day.
+		curHour = 20_000*24 + 5
+
+		limitHours = 30 * 24
+	)
+
+	s, err := New(Config{
+		ShouldCountClient: func([]string) bool { return true },
+		UnitID:            func() (id uint32) { return curHour },
+		Filename:          filepath.Join(t.TempDir(), "stats.db"),
+		Limit:             30 * timeutil.Day,
+		HourlyLimit:       timeutil.Day,
+		DailyLimit:        week,
+		Enabled:           true,
+		Backend:           b,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	s.Update(&Entry{Domain: "example.org", Client: "1.2.3.4", Result: RNotFiltered})
+
+	// Put a single request into each hourly unit within the retention
+	// interval.
+	tx, err := s.storage().begin()
+	require.NoError(t, err)
+
+	for id := uint32(curHour - limitHours + 1); id < curHour; id++ {
+		u := newUnit(id)
+		u.add(&Entry{Domain: "example.org", Client: "1.2.3.4", Result: RFiltered})
+
+		require.NoError(t, tx.put(resolutionHour, id, u.serialize()))
+	}
+
+	require.NoError(t, s.rollup(tx, curHour))
+
+	assert.Equal(t, 23, countUnits(t, tx, resolutionHour))
+	assert.Equal(t, 6, countUnits(t, tx, resolutionDay))
+	assert.Equal(t, 4, countUnits(t, tx, resolutionWeek))
+
+	require.NoError(t, tx.finish(true))
+
+	s.confMu.RLock()
+	defer s.confMu.RUnlock()
+
+	t.Run("weeks", func(t *testing.T) {
+		resp, ok, rangeErr := s.getRangeData(0, "")
+		require.NoError(t, rangeErr)
+		require.True(t, ok)
+
+		assert.Equal(t, timeUnitsWeeks, resp.TimeUnits)
+		assert.Len(t, resp.DNSQueries, 5)
+		assert.Equal(t, uint64(limitHours), resp.NumDNSQueries)
+		assert.Equal(t, uint64(limitHours-1), resp.NumBlockedFiltering)
+	})
+
+	t.Run("days", func(t *testing.T) {
+		resp, ok, rangeErr := s.getRangeData(week, "")
+		require.NoError(t, rangeErr)
+		require.True(t, ok)
+
+		require.Equal(t, timeUnitsDays, resp.TimeUnits)
+		require.Len(t, resp.DNSQueries, 7)
+
+		// The current day only has six hours.
+		assert.Equal(t, uint64(6), resp.DNSQueries[6])
+		assert.Equal(t, uint64(24), resp.DNSQueries[0])
+		assert.Equal(t, uint64(6*24+6), resp.NumDNSQueries)
+	})
+
+	t.Run("hours", func(t *testing.T) {
+		resp, ok, rangeErr := s.getRangeData(3*time.Hour, "")
+		require.NoError(t, rangeErr)
+		require.True(t, ok)
+
+		assert.Equal(t, timeUnitsHours, resp.TimeUnits)
+		assert.Equal(t, []uint64{1, 1, 1}, resp.DNSQueries)
+	})
+
+	t.Run("top_clients", func(t *testing.T) {
+		units := s.loadPeriod(limitHours)
+		assert.Equal(t, uint64(limitHours), sumTotal(units))
+	})
+
+	t.Run("unavailable", func(t *testing.T) {
+		_, _, rangeErr := s.getRangeData(2*week, resolutionDay)
+		testutil.AssertErrorMsg(t, `resolution "day" is only available for 168h0m0s`, rangeErr)
+
+		_, _, rangeErr = s.getRangeData(0, resolutionMinute)
+		testutil.AssertErrorMsg(t, `resolution "minute" is not available`, rangeErr)
+
+		_, _, rangeErr = s.getRangeData(31*timeutil.Day, "")
+		testutil.AssertErrorMsg(t, "range: more than the statistics interval 720h0m0s", rangeErr)
+	})
+}
+
+func TestStatsCtx_minutes(t *testing.T) {
+	var curMinute uint32 = 1_000_000
+	s, err := New(Config{
+		ShouldCountClient: func([]string) bool { return true },
+		UnitID:            func() (id uint32) { return atomic.LoadUint32(&curMinute) / 60 },
+		MinuteUnitID:      func() (id uint32) { return atomic.LoadUint32(&curMinute) },
+		Filename:          filepath.Join(t.TempDir(), "stats.db"),
+		Limit:             timeutil.Day,
+		MinuteLimit:       time.Hour,
+		Enabled:           true,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	for i := 1; i <= 3; i++ {
+		for j := 0; j < i; j++ {
+			s.Update(&Entry{Domain: "example.org", Client: "1.2.3.4", Result: RNotFiltered})
+		}
+
+		atomic.AddUint32(&curMinute, 1)
+		_, _ = s.flush()
+	}
+
+	s.Update(&Entry{Domain: "example.org", Client: "1.2.3.4", Result: RFiltered})
+
+	s.confMu.RLock()
+	defer s.confMu.RUnlock()
+
+	resp, ok, err := s.getRangeData(5*time.Minute, "")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	assert.Equal(t, timeUnitsMinutes, resp.TimeUnits)
+	assert.Equal(t, []uint64{0, 1, 2, 3, 1}, resp.DNSQueries)
+	assert.Equal(t, []uint64{0, 0, 0, 0, 1}, resp.BlockedFiltering)
+	assert.Equal(t, uint64(7), resp.NumDNSQueries)
+
+	// The default resolution of the whole interval is kept.
+	resp, ok, err = s.getRangeData(0, "")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	assert.Equal(t, timeUnitsHours, resp.TimeUnits)
+	assert.Len(t, resp.DNSQueries, 24)
+}
+
+func TestStatsCtx_flushMinute(t *testing.T) {
+	var curMinute uint32 = 1_000_000
+	s, err := New(Config{
+		ShouldCountClient: func([]string) bool { return true },
+		UnitID:            func() (id uint32) { return atomic.LoadUint32(&curMinute) / 60 },
+		MinuteUnitID:      func() (id uint32) { return atomic.LoadUint32(&curMinute) },
+		Filename:          filepath.Join(t.TempDir(), "stats.db"),
+		Limit:             timeutil.Day,
+		MinuteLimit:       time.Hour,
+		Enabled:           true,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	s.Update(&Entry{Domain: "example.org", Client: "1.2.3.4", Result: RNotFiltered})
+
+	// Swap the minute unit the same way flush does, but don't write it yet.
+	s.currMu.Lock()
+	prev := s.currMin
+	s.currMin, s.flushingMin = newUnit(curMinute+1), prev
+	s.currMu.Unlock()
+
+	assertQueries := func(t *testing.T) {
+		t.Helper()
+
+		s.confMu.RLock()
+		defer s.confMu.RUnlock()
+
+		resp, ok, rangeErr := s.getRangeData(2*time.Minute, resolutionMinute)
+		require.NoError(t, rangeErr)
+		require.True(t, ok)
+
+		assert.Equal(t, []uint64{1, 0}, resp.DNSQueries)
+	}
+
+	t.Run("flushing", assertQueries)
+
+	s.flushMinute(prev, curMinute+1, 60)
+
+	t.Run("flushed", assertQueries)
+
+	assert.Nil(t, s.flushingMin)
+}
+
+func TestParseRangeParams(t *testing.T) {
+	testCases := []struct {
+		query      url.Values
+		name       string
+		wantRes    resolution
+		wantErrMsg string
+		wantRange  time.Duration
+	}{{
+		query:      url.Values{"range": {"3h"}, "resolution": {"minute"}},
+		name:       "valid",
+		wantRes:    resolutionMinute,
+		wantErrMsg: "",
+		wantRange:  3 * time.Hour,
+	}, {
+		query:      url.Values{},
+		name:       "empty",
+		wantRes:    "",
+		wantErrMsg: "",
+		wantRange:  0,
+	}, {
+		query:      url.Values{"range": {"-1h"}},
+		name:       "negative_range",
+		wantRes:    "",
+		wantErrMsg: "range: must be positive, got -1h0m0s",
+		wantRange:  0,
+	}, {
+		query:      url.Values{"range": {"week"}},
+		name:       "bad_range",
+		wantRes:    "",
+		wantErrMsg: `range: time: invalid duration "week"`,
+		wantRange:  0,
+	}, {
+		query:      url.Values{"resolution": {"month"}},
+		name:       "bad_resolution",
+		wantRes:    "",
+		wantErrMsg: `resolution: unsupported value "month"`,
+		wantRange:  0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rng, res, err := parseRangeParams(tc.query)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.wantRange, rng)
+			assert.Equal(t, tc.wantRes, res)
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package stats
+
+import (
+	"cmp"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghrenameio"
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// ruleHitsSaveInterval is the minimum time between two saves of the rule hits.
+const ruleHitsSaveInterval = 10 * time.Minute
+
+// ruleHit is the last hour a filtering rule has matched a request in.
+type ruleHit struct {
+	rule Rule
+
+	// last is the ID of the hour unit of the last hit.
+	last uint32
+}
+
+// ruleHitTracker tracks the last hour each filtering rule has matched a request
+// in to find the rules that never match.  Unlike the units, it isn't truncated
+// to the top rules, but it's bounded by the number of distinct rules.  It isn't
+// safe for concurrent use.
+type ruleHitTracker struct {
+	// hits are the elements of order by their rules.
+	hits map[Rule]*list.Element
+
+	// order contains the *ruleHit values from the most recently hit rule to
+	// the least recently hit one.
+	order *list.List
+
+	// lastSave is the last time the hits have been saved.
+	lastSave time.Time
+
+	// filename is the path to the file the hits are stored in.  If empty,
+	// they're only stored in memory.
+	filename string
+
+	// maxSize is the maximum number of tracked rules.  When it's reached, the
+	// rule hit the longest time ago is forgotten.
+	maxSize int
+
+	// since is the ID of the first hour unit, since which all the hits are
+	// known.  It's moved forward when the tracking is restarted or when the
+	// rules are forgotten.
+	since uint32
+
+	// dirty is true if there are changes not saved yet.
+	dirty bool
+}
+
+// newRuleHitTracker returns a new tracker with the hits loaded from filename,
+// if any.  curID is the ID of the current hour unit, since which the hits are
+// tracked if there is no file.
+func newRuleHitTracker(filename string, maxSize int, curID uint32) (t *ruleHitTracker, err error) {
+	t = &ruleHitTracker{
+		hits:     map[Rule]*list.Element{},
+		order:    list.New(),
+		filename: filename,
+		maxSize:  maxSize,
+		since:    curID,
+		dirty:    true,
+	}
+
+	err = t.load()
+	if err != nil {
+		return nil, fmt.Errorf("loading %q: %w", filename, err)
+	}
+
+	return t, nil
+}
+
+// add records the hits of the rules in the hour unit with the given ID.
+func (t *ruleHitTracker) add(rules []Rule, id uint32) {
+	for _, r := range rules {
+		t.dirty = true
+
+		if el, ok := t.hits[r]; ok {
+			el.Value.(*ruleHit).last = id
+			t.order.MoveToFront(el)
+
+			continue
+		}
+
+		if t.order.Len() >= t.maxSize {
+			t.remove(t.order.Back())
+		}
+
+		t.hits[r] = t.order.PushFront(&ruleHit{rule: r, last: id})
+	}
+}
+
+// remove forgets the rule hit of el and moves t.since past it.
+func (t *ruleHitTracker) remove(el *list.Element) {
+	h := t.order.Remove(el).(*ruleHit)
+	delete(t.hits, h.rule)
+	t.since = max(t.since, h.last+1)
+}
+
+// prune forgets the rules, which haven't been hit since the hour unit with the
+// given ID.
+func (t *ruleHitTracker) prune(before uint32) {
+	for el := t.order.Back(); el != nil && el.Value.(*ruleHit).last < before; el = t.order.Back() {
+		t.remove(el)
+		t.dirty = true
+	}
+
+	if t.since < before {
+		t.since, t.dirty = before, true
+	}
+}
+
+// lastHit returns the ID of the hour unit r has last been hit in.  ok is false
+// if it hasn't been hit since t.since.
+func (t *ruleHitTracker) lastHit(r Rule) (id uint32, ok bool) {
+	el, ok := t.hits[r]
+	if !ok {
+		return 0, false
+	}
+
+	return el.Value.(*ruleHit).last, true
+}
+
+// clear forgets all the hits and restarts the tracking from the hour unit with
+// the given ID.
+func (t *ruleHitTracker) clear(id uint32) {
+	clear(t.hits)
+	t.order.Init()
+	t.since, t.dirty = id, true
+}
+
+// ruleHitsFile is the data stored in the file of a *ruleHitTracker.
+type ruleHitsFile struct {
+	// Hits are the rule hits from the most recently hit rule to the least
+	// recently hit one.
+	Hits []*ruleHitJSON `json:"hits"`
+
+	// Since is the ID of the first hour unit, since which all the hits are
+	// known.
+	Since uint32 `json:"since"`
+}
+
+// ruleHitJSON is the JSON representation of a single rule hit.
+type ruleHitJSON struct {
+	Text         string `json:"rule"`
+	FilterListID int64  `json:"filter_list_id"`
+	Last         uint32 `json:"last"`
+}
+
+// load loads the hits from the file of t, if it exists.
+func (t *ruleHitTracker) load() (err error) {
+	if t.filename == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(t.filename)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	f := &ruleHitsFile{}
+	err = json.Unmarshal(data, f)
+	if err != nil {
+		return fmt.Errorf("decoding: %w", err)
+	}
+
+	t.since, t.dirty = f.Since, false
+
+	// Restore the order of forgetting the rules.
+	slices.SortStableFunc(f.Hits, func(a, b *ruleHitJSON) (res int) {
+		return cmp.Compare(b.Last, a.Last)
+	})
+
+	for _, h := range f.Hits {
+		r := Rule{Text: h.Text, FilterListID: h.FilterListID}
+		if _, ok := t.hits[r]; ok {
+			continue
+		}
+
+		if t.order.Len() >= t.maxSize {
+			t.since, t.dirty = max(t.since, h.Last+1), true
+
+			continue
+		}
+
+		t.hits[r] = t.order.PushBack(&ruleHit{rule: r, last: h.Last})
+	}
+
+	return nil
+}
+
+// snapshot returns the data to save and resets t.dirty.  f is nil if there is
+// nothing to save or if the last save was less than [ruleHitsSaveInterval]
+// before now, unless force is true.
+func (t *ruleHitTracker) snapshot(now time.Time, force bool) (f *ruleHitsFile) {
+	if t.filename == "" || !t.dirty || (!force && now.Sub(t.lastSave) < ruleHitsSaveInterval) {
+		return nil
+	}
+
+	t.dirty, t.lastSave = false, now
+
+	f = &ruleHitsFile{
+		Hits:  make([]*ruleHitJSON, 0, t.order.Len()),
+		Since: t.since,
+	}
+
+	for el := t.order.Front(); el != nil; el = el.Next() {
+		h := el.Value.(*ruleHit)
+		f.Hits = append(f.Hits, &ruleHitJSON{
+			Text:         h.rule.Text,
+			FilterListID: h.rule.FilterListID,
+			Last:         h.last,
+		})
+	}
+
+	return f
+}
+
+// writeRuleHits atomically writes f into the file at path.
+func writeRuleHits(path string, f *ruleHitsFile) (err error) {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("encoding: %w", err)
+	}
+
+	pf, err := aghrenameio.NewPendingFile(path, 0o644)
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+	defer func() { err = aghrenameio.WithDeferredCleanup(err, pf) }()
+
+	_, err = pf.Write(data)
+	if err != nil {
+		return fmt.Errorf("writing: %w", err)
+	}
+
+	return nil
+}
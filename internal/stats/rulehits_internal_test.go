@@ -0,0 +1,65 @@
+package stats
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleHitTracker(t *testing.T) {
+	var (
+		ruleA = Rule{Text: "||a.example^", FilterListID: 1}
+		ruleB = Rule{Text: "||b.example^", FilterListID: 1}
+		ruleC = Rule{Text: "||c.example^", FilterListID: 2}
+	)
+
+	filename := filepath.Join(t.TempDir(), "rulehits.json")
+	tr, err := newRuleHitTracker(filename, 2, 10)
+	require.NoError(t, err)
+
+	tr.add([]Rule{ruleA}, 10)
+	tr.add([]Rule{ruleB}, 11)
+	tr.add([]Rule{ruleA}, 12)
+
+	assert.Equal(t, uint32(10), tr.since)
+
+	// ruleB is hit the longest time ago, so it's forgotten.
+	tr.add([]Rule{ruleC}, 13)
+
+	_, ok := tr.lastHit(ruleB)
+	assert.False(t, ok)
+
+	assert.Equal(t, uint32(12), tr.since)
+
+	f := tr.snapshot(time.Now(), true)
+	require.NotNil(t, f)
+
+	require.NoError(t, writeRuleHits(filename, f))
+
+	tr, err = newRuleHitTracker(filename, 2, 20)
+	require.NoError(t, err)
+
+	assert.Equal(t, uint32(12), tr.since)
+
+	last, ok := tr.lastHit(ruleA)
+	require.True(t, ok)
+
+	assert.Equal(t, uint32(12), last)
+
+	tr.prune(13)
+
+	_, ok = tr.lastHit(ruleA)
+	assert.False(t, ok)
+
+	assert.Equal(t, uint32(13), tr.since)
+
+	tr.clear(20)
+
+	_, ok = tr.lastHit(ruleC)
+	assert.False(t, ok)
+
+	assert.Equal(t, uint32(20), tr.since)
+}
@@ -0,0 +1,228 @@
+package stats
+
+import (
+	"slices"
+	"strings"
+)
+
+// Rule identifies a filtering rule that matched a request.
+type Rule struct {
+	// Text is the text of the rule.
+	Text string
+
+	// FilterListID is the ID of the filtering-rule list containing the rule.
+	FilterListID int64
+}
+
+// FilterListRulesFunc is the signature of a function that returns the texts of
+// the rules of the filtering-rule list with the given ID.  ok is false if
+// there is no such list.
+type FilterListRulesFunc func(id int64) (rules []string, ok bool)
+
+// ruleCount is a single rule-number pair for serializing statistics data into
+// the database.
+//
+// NOTE: Do not change the names or types of fields, as this structure is used
+// for GOB encoding.
+type ruleCount struct {
+	Text         string
+	FilterListID int64
+	Count        uint64
+}
+
+// listCount is a single filtering-rule list ID-number pair for serializing
+// statistics data into the database.
+//
+// NOTE: Do not change the names or types of fields, as this structure is used
+// for GOB encoding.
+type listCount struct {
+	FilterListID int64
+	Count        uint64
+}
+
+// ruleHitsToSlice converts the rule hit counters into a slice sorted by count
+// in descending order and truncated to max elements.
+func ruleHitsToSlice(m map[Rule]uint64, max int) (s []ruleCount) {
+	s = make([]ruleCount, 0, len(m))
+	for r, n := range m {
+		s = append(s, ruleCount{
+			Text:         r.Text,
+			FilterListID: r.FilterListID,
+			Count:        n,
+		})
+	}
+
+	slices.SortFunc(s, func(a, b ruleCount) (res int) {
+		return compareCountsDesc(a.Count, b.Count)
+	})
+
+	return s[:min(max, len(s))]
+}
+
+// ruleHitsToMap is the inverse of [ruleHitsToSlice].
+func ruleHitsToMap(s []ruleCount) (m map[Rule]uint64) {
+	m = make(map[Rule]uint64, len(s))
+	for _, rc := range s {
+		m[Rule{Text: rc.Text, FilterListID: rc.FilterListID}] = rc.Count
+	}
+
+	return m
+}
+
+// listsToSlice converts the filtering-rule list counters into a slice sorted by
+// count in descending order.
+func listsToSlice(m map[int64]uint64) (s []listCount) {
+	s = make([]listCount, 0, len(m))
+	for id, n := range m {
+		s = append(s, listCount{FilterListID: id, Count: n})
+	}
+
+	slices.SortFunc(s, func(a, b listCount) (res int) {
+		return compareCountsDesc(a.Count, b.Count)
+	})
+
+	return s
+}
+
+// listsToMap is the inverse of [listsToSlice].
+func listsToMap(s []listCount) (m map[int64]uint64) {
+	m = make(map[int64]uint64, len(s))
+	for _, lc := range s {
+		m[lc.FilterListID] = lc.Count
+	}
+
+	return m
+}
+
+// compareCountsDesc is a comparison function for sorting counters in
+// descending order.
+func compareCountsDesc(x, y uint64) (res int) {
+	switch {
+	case x > y:
+		return -1
+	case x < y:
+		return +1
+	default:
+		return 0
+	}
+}
+
+// addRules adds the rule hits from e to u.  Each list is counted once per
+// blocked request.
+func (u *unit) addRules(e *Entry) {
+	isBlocked := e.Result != RNotFiltered
+	for i, r := range e.Rules {
+		u.ruleHits[r]++
+
+		if !isBlocked {
+			continue
+		}
+
+		isCounted := slices.ContainsFunc(e.Rules[:i], func(prev Rule) (ok bool) {
+			return prev.FilterListID == r.FilterListID
+		})
+		if !isCounted {
+			u.listsBlocked[r.FilterListID]++
+		}
+	}
+}
+
+// ruleStat is the statistics of a single filtering rule.
+type ruleStat struct {
+	Text         string `json:"rule"`
+	FilterListID int64  `json:"filter_list_id"`
+	Count        uint64 `json:"count"`
+}
+
+// listStat is the statistics of a single filtering-rule list.
+type listStat struct {
+	FilterListID int64   `json:"filter_list_id"`
+	Blocked      uint64  `json:"blocked"`
+	BlockedShare float64 `json:"blocked_share"`
+}
+
+// rulesStatsResp is the response to the GET /control/stats/rules.
+type rulesStatsResp struct {
+	TopRules    []*ruleStat `json:"top_rules"`
+	FilterLists []*listStat `json:"filter_lists"`
+}
+
+// rulesStatsFromUnits collects the top limit rules and the statistics of the
+// filtering-rule lists from units.
+func rulesStatsFromUnits(units []*unitDB, limit int) (resp *rulesStatsResp) {
+	hits := sumRuleHits(units)
+
+	counts := ruleHitsToSlice(hits, limit)
+
+	resp = &rulesStatsResp{
+		TopRules:    make([]*ruleStat, 0, len(counts)),
+		FilterLists: []*listStat{},
+	}
+
+	for _, rc := range counts {
+		resp.TopRules = append(resp.TopRules, &ruleStat{
+			Text:         rc.Text,
+			FilterListID: rc.FilterListID,
+			Count:        rc.Count,
+		})
+	}
+
+	var totalBlocked uint64
+	blocked := map[int64]uint64{}
+	for _, u := range units {
+		for r := RFiltered; r < resultLast; r++ {
+			totalBlocked += u.NResult[r]
+		}
+
+		for _, lc := range u.ListsBlocked {
+			blocked[lc.FilterListID] += lc.Count
+		}
+	}
+
+	for _, lc := range listsToSlice(blocked) {
+		ls := &listStat{
+			FilterListID: lc.FilterListID,
+			Blocked:      lc.Count,
+		}
+
+		if totalBlocked != 0 {
+			ls.BlockedShare = float64(lc.Count) / float64(totalBlocked)
+		}
+
+		resp.FilterLists = append(resp.FilterLists, ls)
+	}
+
+	return resp
+}
+
+// sumRuleHits returns the total number of hits of each rule in units.
+func sumRuleHits(units []*unitDB) (hits map[Rule]uint64) {
+	hits = map[Rule]uint64{}
+	for _, u := range units {
+		for _, rc := range u.RuleHits {
+			hits[Rule{Text: rc.Text, FilterListID: rc.FilterListID}] += rc.Count
+		}
+	}
+
+	return hits
+}
+
+// deadRules returns the rules from rules of the filtering-rule list with the
+// given ID that haven't matched a request since the hour unit with the given ID
+// according to hits.  Empty lines and comments are skipped.
+func deadRules(hits *ruleHitTracker, since uint32, listID int64, rules []string) (dead []string) {
+	dead = []string{}
+	for _, text := range rules {
+		text = strings.TrimSpace(text)
+		if text == "" || text[0] == '!' || text[0] == '#' {
+			continue
+		}
+
+		last, ok := hits.lastHit(Rule{Text: text, FilterListID: listID})
+		if !ok || last < since {
+			dead = append(dead, text)
+		}
+	}
+
+	return dead
+}
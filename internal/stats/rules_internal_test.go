@@ -0,0 +1,227 @@
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/AdguardTeam/golibs/timeutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsCtx_rules(t *testing.T) {
+	const (
+		ruleBlocked = "||blocked.example^"
+		ruleAllowed = "@@||allowed.example^"
+		ruleDead    = "||dead.example^"
+
+		listID      = 1
+		otherListID = 2
+	)
+
+	// startID is the ID of the hour unit the rules are matched in.
+	const startID = 100
+
+	var curID atomic.Uint32
+	curID.Store(startID)
+
+	handlers := map[string]http.HandlerFunc{}
+	s, err := New(Config{
+		UnitID:            curID.Load,
+		ShouldCountClient: func([]string) bool { return true },
+		FilterListRules: func(id int64) (rules []string, ok bool) {
+			if id != listID {
+				return nil, false
+			}
+
+			return []string{"! Comment", ruleBlocked, ruleAllowed, ruleDead, ""}, true
+		},
+		HTTPRegister: func(_, url string, handler http.HandlerFunc) {
+			handlers[url] = handler
+		},
+		Filename: filepath.Join(t.TempDir(), "stats.db"),
+		Limit:    7 * timeutil.Day,
+		Enabled:  true,
+	})
+	require.NoError(t, err)
+
+	s.Start()
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	entries := []*Entry{{
+		Domain: "blocked.example",
+		Client: "1.2.3.4",
+		Result: RFiltered,
+		Rules: []Rule{{
+			Text:         ruleBlocked,
+			FilterListID: listID,
+		}},
+	}, {
+		Domain: "blocked.example",
+		Client: "1.2.3.4",
+		Result: RFiltered,
+		Rules: []Rule{{
+			Text:         ruleBlocked,
+			FilterListID: listID,
+		}},
+	}, {
+		Domain: "other.example",
+		Client: "1.2.3.4",
+		Result: RFiltered,
+		Rules: []Rule{{
+			Text:         "||other.example^",
+			FilterListID: otherListID,
+		}},
+	}, {
+		Domain: "allowed.example",
+		Client: "1.2.3.4",
+		Result: RNotFiltered,
+		Rules: []Rule{{
+			Text:         ruleAllowed,
+			FilterListID: listID,
+		}},
+	}}
+
+	for _, e := range entries {
+		s.Update(e)
+	}
+
+	t.Run("top", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		handlers["/control/stats/rules"](rw, httptest.NewRequest(
+			http.MethodGet,
+			"/control/stats/rules?limit=1",
+			nil,
+		))
+		require.Equal(t, http.StatusOK, rw.Code)
+
+		resp := &rulesStatsResp{}
+		err = json.Unmarshal(rw.Body.Bytes(), resp)
+		require.NoError(t, err)
+
+		assert.Equal(t, []*ruleStat{{
+			Text:         ruleBlocked,
+			FilterListID: listID,
+			Count:        2,
+		}}, resp.TopRules)
+
+		require.Len(t, resp.FilterLists, 2)
+
+		assert.Equal(t, &listStat{
+			FilterListID: listID,
+			Blocked:      2,
+			BlockedShare: 2.0 / 3.0,
+		}, resp.FilterLists[0])
+	})
+
+	// Two days have passed since the rules were matched.
+	curID.Store(startID + 48)
+
+	t.Run("dead", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		handlers["/control/stats/rules/dead"](rw, httptest.NewRequest(
+			http.MethodGet,
+			"/control/stats/rules/dead?filter_list_id=1&days=30",
+			nil,
+		))
+		require.Equal(t, http.StatusOK, rw.Code)
+
+		resp := &deadRulesResp{}
+		err = json.Unmarshal(rw.Body.Bytes(), resp)
+		require.NoError(t, err)
+
+		// The rules have only been tracked for two days.
+		assert.Equal(t, &deadRulesResp{
+			Rules: []string{ruleDead},
+			Days:  2,
+		}, resp)
+	})
+
+	t.Run("dead_after_reset", func(t *testing.T) {
+		handlers["/control/stats_reset"](httptest.NewRecorder(), httptest.NewRequest(
+			http.MethodPost,
+			"/control/stats_reset",
+			nil,
+		))
+
+		rw := httptest.NewRecorder()
+		handlers["/control/stats/rules/dead"](rw, httptest.NewRequest(
+			http.MethodGet,
+			"/control/stats/rules/dead?filter_list_id=1",
+			nil,
+		))
+		require.Equal(t, http.StatusOK, rw.Code)
+
+		resp := &deadRulesResp{}
+		err = json.Unmarshal(rw.Body.Bytes(), resp)
+		require.NoError(t, err)
+
+		assert.Equal(t, &deadRulesResp{
+			Rules: []string{ruleBlocked, ruleAllowed, ruleDead},
+			Days:  0,
+		}, resp)
+	})
+
+	t.Run("dead_no_list", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		handlers["/control/stats/rules/dead"](rw, httptest.NewRequest(
+			http.MethodGet,
+			"/control/stats/rules/dead?filter_list_id=3",
+			nil,
+		))
+
+		assert.Equal(t, http.StatusNotFound, rw.Code)
+	})
+}
+
+func TestUnit_serializeRules(t *testing.T) {
+	u := newUnit(0)
+	u.add(&Entry{
+		Domain: "blocked.example",
+		Client: "1.2.3.4",
+		Result: RFiltered,
+		Rules: []Rule{{
+			Text:         "||blocked.example^",
+			FilterListID: 1,
+		}, {
+			Text:         "0.0.0.0 blocked.example",
+			FilterListID: 1,
+		}},
+	})
+
+	got := newUnit(0)
+	got.deserialize(u.serialize())
+
+	assert.Equal(t, u.ruleHits, got.ruleHits)
+	assert.Equal(t, map[int64]uint64{1: 1}, got.listsBlocked)
+}
+
+func TestUnit_serializeRules_truncate(t *testing.T) {
+	u := newUnit(0)
+	for i := 0; i <= maxRules; i++ {
+		u.add(&Entry{
+			Domain: "blocked.example",
+			Client: "1.2.3.4",
+			Result: RFiltered,
+			Rules: []Rule{{
+				Text:         fmt.Sprintf("||blocked-%d.example^", i),
+				FilterListID: 1,
+			}},
+		})
+	}
+
+	// Make the last rule the top one.
+	top := Rule{Text: fmt.Sprintf("||blocked-%d.example^", maxRules), FilterListID: 1}
+	u.ruleHits[top]++
+
+	udb := u.serialize()
+	require.Len(t, udb.RuleHits, maxRules)
+
+	assert.Equal(t, ruleCount{Text: top.Text, FilterListID: 1, Count: 2}, udb.RuleHits[0])
+}
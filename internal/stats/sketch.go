@@ -0,0 +1,60 @@
+package stats
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
+)
+
+// upstreamSketch is the sketch of the durations of an upstream's responses for
+// serializing statistics data into the database.
+//
+// NOTE: Do not change the names or types of fields, as this structure is used
+// for GOB encoding.
+type upstreamSketch struct {
+	Name string
+	Bins []aghalg.SketchBin
+}
+
+// upstreamSketchesToSlice converts the sketches of the upstreams into a slice
+// sorted by the name of the upstream.
+func upstreamSketchesToSlice(m map[string]aghalg.Sketch) (s []upstreamSketch) {
+	s = make([]upstreamSketch, 0, len(m))
+	for name, sk := range m {
+		s = append(s, upstreamSketch{Name: name, Bins: sk.Bins()})
+	}
+
+	slices.SortFunc(s, func(a, b upstreamSketch) (res int) {
+		return cmp.Compare(a.Name, b.Name)
+	})
+
+	return s
+}
+
+// upstreamSketchesToMap is the inverse of [upstreamSketchesToSlice].
+func upstreamSketchesToMap(s []upstreamSketch) (m map[string]aghalg.Sketch) {
+	m = make(map[string]aghalg.Sketch, len(s))
+	mergeUpstreamSketches(m, s)
+
+	return m
+}
+
+// mergeUpstreamSketches adds the sketches of the upstreams from s to m.  The
+// sketches of new upstreams aren't added if m already has [maxUpstreams] of
+// them.
+func mergeUpstreamSketches(m map[string]aghalg.Sketch, s []upstreamSketch) {
+	for _, us := range s {
+		sk, ok := m[us.Name]
+		if !ok {
+			if len(m) >= maxUpstreams {
+				continue
+			}
+
+			sk = aghalg.Sketch{}
+			m[us.Name] = sk
+		}
+
+		sk.Merge(us.Bins)
+	}
+}
@@ -0,0 +1,338 @@
+package stats
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"os"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghsqlite"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/log"
+	"go.etcd.io/bbolt"
+)
+
+// sqliteSchema is the schema of the SQLite database of the statistics.  The
+// units table contains a row for each unit with its totals and the whole unit
+// GOB-encoded, and the unit_counts table contains the numbers of requests by
+// the values of the unit's dimensions, such as domains and clients, so that the
+// database can be queried directly.  The start column is the UNIX time of the
+// beginning of the unit in seconds.
+const sqliteSchema = aghsqlite.MetaSchema + `
+CREATE TABLE IF NOT EXISTS units (
+	resolution       TEXT    NOT NULL,
+	id               INTEGER NOT NULL,
+	start            INTEGER NOT NULL,
+	num_total        INTEGER NOT NULL,
+	num_filtered     INTEGER NOT NULL,
+	num_safebrowsing INTEGER NOT NULL,
+	num_safesearch   INTEGER NOT NULL,
+	num_parental     INTEGER NOT NULL,
+	num_cached       INTEGER NOT NULL,
+	avg_time_us      INTEGER NOT NULL,
+	data             BLOB    NOT NULL,
+	PRIMARY KEY (resolution, id)
+);
+
+CREATE INDEX IF NOT EXISTS units_start ON units (start);
+
+CREATE TABLE IF NOT EXISTS unit_counts (
+	resolution TEXT    NOT NULL,
+	unit_id    INTEGER NOT NULL,
+	kind       TEXT    NOT NULL,
+	name       TEXT    NOT NULL,
+	count      INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS unit_counts_unit ON unit_counts (resolution, unit_id);
+CREATE INDEX IF NOT EXISTS unit_counts_kind_name ON unit_counts (kind, name);
+`
+
+// sqliteStorage is the [unitStorage] keeping the units in an SQLite database.
+type sqliteStorage struct {
+	db *sql.DB
+}
+
+// type check
+var _ unitStorage = (*sqliteStorage)(nil)
+
+// openSQLiteStorage opens the SQLite database in the file with the given name,
+// creating it if needed.
+func openSQLiteStorage(filename string) (st *sqliteStorage, err error) {
+	log.Debug("stats: opening sqlite database")
+
+	db, err := aghsqlite.Open(filename, sqliteSchema)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	log.Debug("stats: sqlite database opened")
+
+	return &sqliteStorage{db: db}, nil
+}
+
+// begin implements the [unitStorage] interface for *sqliteStorage.
+func (st *sqliteStorage) begin() (tx unitTx, err error) {
+	stx, err := st.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("opening transaction: %w", err)
+	}
+
+	return sqliteTx{tx: stx}, nil
+}
+
+// clear implements the [unitStorage] interface for *sqliteStorage.  Unlike
+// [boltStorage.clear], it keeps the database file and its metadata.
+func (st *sqliteStorage) clear() (err error) {
+	_, err = st.db.Exec(`DELETE FROM unit_counts; DELETE FROM units;`)
+	if err != nil {
+		return fmt.Errorf("deleting units: %w", err)
+	}
+
+	return nil
+}
+
+// close implements the [unitStorage] interface for *sqliteStorage.
+func (st *sqliteStorage) close() (err error) {
+	return st.db.Close()
+}
+
+// boltMigrationKey is the key of the metadata of the migration of the data from
+// the bbolt database.
+const boltMigrationKey = "bolt_migrated"
+
+// migrate copies all the units from the bbolt database in the file with the
+// given name, unless it has already been done or the file doesn't exist.  The
+// bbolt database itself is left as is.
+func (st *sqliteStorage) migrate(boltFilename string) (err error) {
+	done, err := aghsqlite.IsDone(st.db, boltMigrationKey)
+	if err != nil {
+		return fmt.Errorf("checking migration: %w", err)
+	} else if done {
+		return nil
+	}
+
+	_, err = os.Stat(boltFilename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	bdb, err := bbolt.Open(boltFilename, 0o644, &bbolt.Options{
+		Timeout:  time.Second,
+		ReadOnly: true,
+	})
+	if err != nil {
+		return fmt.Errorf("opening bbolt database: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, bdb.Close()) }()
+
+	stx, err := st.db.Begin()
+	if err != nil {
+		return fmt.Errorf("opening transaction: %w", err)
+	}
+
+	tx := sqliteTx{tx: stx}
+	defer func() { err = errors.WithDeferred(err, tx.finish(err == nil)) }()
+
+	n := 0
+	err = bdb.View(func(btx *bbolt.Tx) (verr error) {
+		for _, res := range resolutions {
+			verr = boltTx{tx: btx}.each(res, 0, math.MaxUint32, func(id uint32, udb *unitDB) {
+				if verr == nil {
+					verr = tx.put(res, id, udb)
+					n++
+				}
+			})
+			if verr != nil {
+				return fmt.Errorf("copying %s units: %w", res, verr)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	err = aghsqlite.SetDone(stx, boltMigrationKey, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	log.Info("stats: migrated %d units from %q", n, boltFilename)
+
+	return nil
+}
+
+// sqliteTx is the [unitTx] of an [sqliteStorage].
+type sqliteTx struct {
+	tx *sql.Tx
+}
+
+// type check
+var _ unitTx = sqliteTx{}
+
+// load implements the [unitTx] interface for sqliteTx.
+func (t sqliteTx) load(res resolution, id uint32) (udb *unitDB, err error) {
+	var data []byte
+	err = t.tx.QueryRow(
+		`SELECT data FROM units WHERE resolution = ? AND id = ?`,
+		res,
+		id,
+	).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("loading %s unit %d: %w", res, id, err)
+	}
+
+	return decodeUnit(data), nil
+}
+
+// put implements the [unitTx] interface for sqliteTx.
+func (t sqliteTx) put(res resolution, id uint32, udb *unitDB) (err error) {
+	data, err := udb.encode()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	_, err = t.tx.Exec(
+		`DELETE FROM unit_counts WHERE resolution = ? AND unit_id = ?`,
+		res,
+		id,
+	)
+	if err != nil {
+		return fmt.Errorf("deleting counts of %s unit %d: %w", res, id, err)
+	}
+
+	nResult := make([]uint64, resultLast)
+	copy(nResult, udb.NResult)
+
+	_, err = t.tx.Exec(
+		`INSERT OR REPLACE INTO units (
+			resolution, id, start, num_total, num_filtered, num_safebrowsing,
+			num_safesearch, num_parental, num_cached, avg_time_us, data
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		res,
+		id,
+		res.start(id).Unix(),
+		int64(udb.NTotal),
+		int64(nResult[RFiltered]),
+		int64(nResult[RSafeBrowsing]),
+		int64(nResult[RSafeSearch]),
+		int64(nResult[RParental]),
+		int64(udb.NCached),
+		udb.TimeAvg,
+		data,
+	)
+	if err != nil {
+		return fmt.Errorf("putting %s unit %d: %w", res, id, err)
+	}
+
+	return t.putCounts(res, id, udb)
+}
+
+// putCounts puts the numbers of requests by the values of the dimensions of
+// udb into the unit_counts table.
+func (t sqliteTx) putCounts(res resolution, id uint32, udb *unitDB) (err error) {
+	stmt, err := t.tx.Prepare(`INSERT INTO unit_counts (
+		resolution, unit_id, kind, name, count
+	) VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("preparing statement: %w", err)
+	}
+	defer func() { err = errors.WithDeferred(err, stmt.Close()) }()
+
+	for _, kc := range []struct {
+		kind  string
+		pairs []countPair
+	}{
+		{kind: "domain", pairs: udb.Domains},
+		{kind: "blocked_domain", pairs: udb.BlockedDomains},
+		{kind: "client", pairs: udb.Clients},
+		{kind: "upstream_responses", pairs: udb.UpstreamsResponses},
+		{kind: "upstream_time_us", pairs: udb.UpstreamsTimeSum},
+		{kind: "qtype", pairs: udb.QTypes},
+		{kind: "rcode", pairs: udb.RCodes},
+		{kind: "proto", pairs: udb.Protos},
+	} {
+		for _, cp := range kc.pairs {
+			_, err = stmt.Exec(res, id, kc.kind, cp.Name, int64(cp.Count))
+			if err != nil {
+				return fmt.Errorf("putting %s counts of %s unit %d: %w", kc.kind, res, id, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// each implements the [unitTx] interface for sqliteTx.
+func (t sqliteTx) each(
+	res resolution,
+	first uint32,
+	last uint32,
+	f func(id uint32, udb *unitDB),
+) (err error) {
+	rows, err := t.tx.Query(
+		`SELECT id, data FROM units
+		WHERE resolution = ? AND id BETWEEN ? AND ?
+		ORDER BY id`,
+		res,
+		first,
+		last,
+	)
+	if err != nil {
+		return fmt.Errorf("querying %s units: %w", res, err)
+	}
+	defer func() { err = errors.WithDeferred(err, rows.Close()) }()
+
+	for rows.Next() {
+		var id uint32
+		var data []byte
+		err = rows.Scan(&id, &data)
+		if err != nil {
+			return fmt.Errorf("scanning %s unit: %w", res, err)
+		}
+
+		if udb := decodeUnit(data); udb != nil {
+			f(id, udb)
+		}
+	}
+
+	return rows.Err()
+}
+
+// deleteBefore implements the [unitTx] interface for sqliteTx.
+func (t sqliteTx) deleteBefore(res resolution, firstID uint32) (deleted int, err error) {
+	_, err = t.tx.Exec(
+		`DELETE FROM unit_counts WHERE resolution = ? AND unit_id < ?`,
+		res,
+		firstID,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("deleting counts of %s units: %w", res, err)
+	}
+
+	result, err := t.tx.Exec(`DELETE FROM units WHERE resolution = ? AND id < ?`, res, firstID)
+	if err != nil {
+		return 0, fmt.Errorf("deleting %s units: %w", res, err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("counting deleted %s units: %w", res, err)
+	}
+
+	return int(n), nil
+}
+
+// finish implements the [unitTx] interface for sqliteTx.
+func (t sqliteTx) finish(commit bool) (err error) {
+	return aghsqlite.Finish(t.tx, commit)
+}
@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"io"
 	"net/netip"
-	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,7 +15,6 @@ import (
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/golibs/timeutil"
-	"go.etcd.io/bbolt"
 )
 
 // checkInterval returns true if days is valid to be used as statistics
@@ -47,6 +45,11 @@ type Config struct {
 	// nil, the default function is used, see newUnitID.
 	UnitID UnitIDGenFunc
 
+	// MinuteUnitID is the function to generate the identifier for current
+	// minute unit.  If nil, the default function is used, see
+	// newMinuteUnitID.
+	MinuteUnitID UnitIDGenFunc
+
 	// ConfigModified will be called each time the configuration changed via web
 	// interface.
 	ConfigModified func()
@@ -54,6 +57,15 @@ type Config struct {
 	// ShouldCountClient returns client's ignore setting.
 	ShouldCountClient func([]string) bool
 
+	// FilterListRules returns the rules of a filtering-rule list to find the
+	// ones that never match.  If nil, the dead rules aren't reported.
+	FilterListRules FilterListRulesFunc
+
+	// FindClient returns the information about the persistent clients to
+	// match the statistics of all their IDs and tags.  If nil, the statistics
+	// of the clients are only found by their exact IDs.
+	FindClient FindClientFunc
+
 	// HTTPRegister is the function that registers handlers for the stats
 	// endpoints.
 	HTTPRegister aghhttp.RegisterFunc
@@ -65,9 +77,39 @@ type Config struct {
 	// Filename is the name of the database file.
 	Filename string
 
+	// RuleHitsFilename is the name of the file the last hour each filtering
+	// rule has matched a request in is stored in.  If empty, it's only stored
+	// in memory.
+	RuleHitsFilename string
+
+	// MigrateFilename is the name of the bbolt database file to import the
+	// statistics from once, if Backend is [BackendSQLite].  If empty or the
+	// file doesn't exist, nothing is imported.
+	MigrateFilename string
+
+	// Backend is the type of the database.  If empty, [BackendBolt] is used.
+	Backend Backend
+
 	// Limit is an upper limit for collecting statistics.
 	Limit time.Duration
 
+	// MinuteLimit is the duration for which the statistics with the minute
+	// resolution are kept.  It must not be more than a day.  If zero, the
+	// statistics with the minute resolution aren't collected.
+	MinuteLimit time.Duration
+
+	// HourlyLimit is the duration for which the statistics with the hour
+	// resolution are kept, after which they are downsampled into the daily
+	// ones.  It must be zero or at least a day.  If zero or not less than
+	// Limit, the hourly statistics are kept for the whole Limit.
+	HourlyLimit time.Duration
+
+	// DailyLimit is the duration for which the daily statistics are kept,
+	// after which they are downsampled into the weekly ones.  It must be zero
+	// or at least a week.  If zero or not less than Limit, the daily
+	// statistics are kept for the whole Limit.
+	DailyLimit time.Duration
+
 	// Enabled tells if the statistics are enabled.
 	Enabled bool
 }
@@ -82,6 +124,10 @@ type Interface interface {
 	// Update collects the incoming statistics data.
 	Update(e *Entry)
 
+	// UpdateUpstream collects the data about a failed exchange with an
+	// upstream.
+	UpdateUpstream(e *UpstreamEntry)
+
 	// GetTopClientIP returns at most limit IP addresses corresponding to the
 	// clients with the most number of requests.
 	TopClientsIP(limit uint) []netip.Addr
@@ -100,14 +146,27 @@ type StatsCtx struct {
 	currMu *sync.RWMutex
 	// curr is the actual statistics collection result.
 	curr *unit
+	// currMin is the actual statistics collection result for the current
+	// minute.  It's nil if the statistics with the minute resolution aren't
+	// collected.
+	currMin *unit
 
-	// db is the opened statistics database, if any.
-	db atomic.Pointer[bbolt.DB]
+	// flushingMin is the previous minute unit, which is being written to the
+	// database, if any.  It's protected by currMu.
+	flushingMin *unit
+
+	// db is the opened statistics storage, if any.  Use [StatsCtx.storage] to
+	// get it.
+	db atomic.Pointer[unitStorage]
 
 	// unitIDGen is the function that generates an identifier for the current
 	// unit.  It's here for only testing purposes.
 	unitIDGen UnitIDGenFunc
 
+	// minuteIDGen is the function that generates an identifier for the
+	// current minute unit.  It's here for only testing purposes.
+	minuteIDGen UnitIDGenFunc
+
 	// httpRegister is used to set HTTP handlers.
 	httpRegister aghhttp.RegisterFunc
 
@@ -115,7 +174,8 @@ type StatsCtx struct {
 	// interface.
 	configModified func()
 
-	// confMu protects ignored, limit, and enabled.
+	// confMu protects ignored, limit, minuteLimit, hourlyLimit, dailyLimit,
+	// and enabled.
 	confMu *sync.RWMutex
 
 	// ignored contains the list of host names, which should not be counted,
@@ -125,12 +185,32 @@ type StatsCtx struct {
 	// shouldCountClient returns client's ignore setting.
 	shouldCountClient func([]string) bool
 
-	// filename is the name of database file.
-	filename string
+	// filterListRules returns the rules of a filtering-rule list.  It may be
+	// nil.
+	filterListRules FilterListRulesFunc
+
+	// findClient returns the information about the persistent clients.  It
+	// may be nil.
+	findClient FindClientFunc
+
+	// ruleHits tracks the last hour each filtering rule has matched a request
+	// in to find the rules that never match.  It's protected by currMu.
+	ruleHits *ruleHitTracker
 
 	// limit is an upper limit for collecting statistics.
 	limit time.Duration
 
+	// minuteLimit is the duration for which the minute units are kept.
+	minuteLimit time.Duration
+
+	// hourlyLimit is the duration after which the hourly units are
+	// downsampled into the daily ones.
+	hourlyLimit time.Duration
+
+	// dailyLimit is the duration after which the daily units are downsampled
+	// into the weekly ones.
+	dailyLimit time.Duration
+
 	// enabled tells if the statistics are enabled.
 	enabled bool
 }
@@ -145,6 +225,18 @@ func New(conf Config) (s *StatsCtx, err error) {
 		return nil, fmt.Errorf("unsupported interval: %w", err)
 	}
 
+	err = validateTierLimits(conf.MinuteLimit, conf.HourlyLimit, conf.DailyLimit)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	err = conf.Backend.validate()
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
 	if conf.ShouldCountClient == nil {
 		return nil, errors.Error("should count client is unspecified")
 	}
@@ -153,12 +245,16 @@ func New(conf Config) (s *StatsCtx, err error) {
 		currMu:         &sync.RWMutex{},
 		httpRegister:   conf.HTTPRegister,
 		configModified: conf.ConfigModified,
-		filename:       conf.Filename,
 
 		confMu:            &sync.RWMutex{},
 		ignored:           conf.Ignored,
 		shouldCountClient: conf.ShouldCountClient,
+		filterListRules:   conf.FilterListRules,
+		findClient:        conf.FindClient,
 		limit:             conf.Limit,
+		minuteLimit:       conf.MinuteLimit,
+		hourlyLimit:       conf.HourlyLimit,
+		dailyLimit:        conf.DailyLimit,
 		enabled:           conf.Enabled,
 	}
 
@@ -166,25 +262,51 @@ func New(conf Config) (s *StatsCtx, err error) {
 		s.unitIDGen = conf.UnitID
 	}
 
+	if s.minuteIDGen = newMinuteUnitID; conf.MinuteUnitID != nil {
+		s.minuteIDGen = conf.MinuteUnitID
+	}
+
+	s.ruleHits, err = newRuleHitTracker(conf.RuleHitsFilename, maxRuleHits, s.unitIDGen())
+	if err != nil {
+		return nil, fmt.Errorf("rule hits: %w", err)
+	}
+
 	// TODO(e.burkov):  Move the code below to the Start method.
 
-	err = s.openDB()
+	st, err := openStorage(&conf)
 	if err != nil {
 		return nil, fmt.Errorf("opening database: %w", err)
 	}
 
-	var udb *unitDB
+	s.db.Store(&st)
+
+	var udb, minUDB *unitDB
 	id := s.unitIDGen()
 
-	tx, err := s.db.Load().Begin(true)
+	tx, err := st.begin()
 	if err != nil {
-		return nil, fmt.Errorf("stats: opening a transaction: %w", err)
+		return nil, fmt.Errorf("stats: %w", err)
 	}
 
-	deleted := deleteOldUnits(tx, id-uint32(s.limit.Hours())-1)
-	udb = loadUnitFromDB(tx, id)
+	rollupErr := s.rollup(tx, id)
+	if rollupErr != nil {
+		log.Error("stats: %s", rollupErr)
+	}
+
+	udb, err = tx.load(resolutionHour, id)
+	if err != nil {
+		log.Error("stats: %s", err)
+	}
+
+	minID := s.minuteIDGen()
+	if s.minuteLimit > 0 {
+		minUDB, err = tx.load(resolutionMinute, minID)
+		if err != nil {
+			log.Error("stats: %s", err)
+		}
+	}
 
-	err = finishTxn(tx, deleted > 0)
+	err = tx.finish(rollupErr == nil)
 	if err != nil {
 		log.Error("stats: %s", err)
 	}
@@ -192,6 +314,11 @@ func New(conf Config) (s *StatsCtx, err error) {
 	s.curr = newUnit(id)
 	s.curr.deserialize(udb)
 
+	if s.minuteLimit > 0 {
+		s.currMin = newUnit(minID)
+		s.currMin.deserialize(minUDB)
+	}
+
 	log.Debug("stats: initialized")
 
 	return s, nil
@@ -216,6 +343,15 @@ func withRecovered(orig *error) {
 	*orig = errors.WithDeferred(*orig, err)
 }
 
+// storage returns the opened statistics storage.  st is nil if it's closed.
+func (s *StatsCtx) storage() (st unitStorage) {
+	if p := s.db.Load(); p != nil {
+		return *p
+	}
+
+	return nil
+}
+
 // type check
 var _ Interface = (*StatsCtx)(nil)
 
@@ -230,12 +366,16 @@ func (s *StatsCtx) Start() {
 func (s *StatsCtx) Close() (err error) {
 	defer func() { err = errors.Annotate(err, "stats: closing: %w") }()
 
-	db := s.db.Swap(nil)
-	if db == nil {
+	defer func() { err = errors.WithDeferred(err, s.saveRuleHits(true)) }()
+
+	p := s.db.Swap(nil)
+	if p == nil {
 		return nil
 	}
+
+	st := *p
 	defer func() {
-		cerr := db.Close()
+		cerr := st.close()
 		if cerr == nil {
 			log.Debug("stats: database closed")
 		}
@@ -243,18 +383,31 @@ func (s *StatsCtx) Close() (err error) {
 		err = errors.WithDeferred(err, cerr)
 	}()
 
-	tx, err := db.Begin(true)
+	tx, err := st.begin()
 	if err != nil {
-		return fmt.Errorf("opening transaction: %w", err)
+		// Don't wrap the error since it's informative enough as is.
+		return err
 	}
-	defer func() { err = errors.WithDeferred(err, finishTxn(tx, err == nil)) }()
+	defer func() { err = errors.WithDeferred(err, tx.finish(err == nil)) }()
 
 	s.currMu.RLock()
 	defer s.currMu.RUnlock()
 
-	udb := s.curr.serialize()
+	if s.flushingMin != nil {
+		err = tx.put(resolutionMinute, s.flushingMin.id, s.flushingMin.serialize())
+		if err != nil {
+			return fmt.Errorf("flushing previous minute unit: %w", err)
+		}
+	}
 
-	return udb.flushUnitToDB(tx, s.curr.id)
+	if s.currMin != nil {
+		err = flushMinuteToDB(tx, s.currMin, s.currMin.id, uint32(s.minuteLimit/time.Minute))
+		if err != nil {
+			return fmt.Errorf("flushing minute unit: %w", err)
+		}
+	}
+
+	return tx.put(resolutionHour, s.curr.id, s.curr.serialize())
 }
 
 // Update implements the [Interface] interface for *StatsCtx.  e must not be
@@ -284,6 +437,44 @@ func (s *StatsCtx) Update(e *Entry) {
 	}
 
 	s.curr.add(e)
+
+	if s.currMin != nil {
+		s.currMin.add(e)
+	}
+
+	s.ruleHits.add(e.Rules, s.curr.id)
+}
+
+// UpdateUpstream implements the [Interface] interface for *StatsCtx.  e is
+// ignored if the statistics are disabled.
+func (s *StatsCtx) UpdateUpstream(e *UpstreamEntry) {
+	s.confMu.RLock()
+	defer s.confMu.RUnlock()
+
+	if !s.enabled || s.limit == 0 {
+		return
+	}
+
+	if e.Upstream == "" {
+		log.Debug("stats: updating upstream: upstream is empty")
+
+		return
+	}
+
+	s.currMu.Lock()
+	defer s.currMu.Unlock()
+
+	if s.curr == nil {
+		log.Error("stats: current unit is nil")
+
+		return
+	}
+
+	s.curr.addUpstreamFailure(e)
+
+	if s.currMin != nil {
+		s.currMin.addUpstreamFailure(e)
+	}
 }
 
 // WriteDiskConfig implements the [Interface] interface for *StatsCtx.
@@ -293,6 +484,9 @@ func (s *StatsCtx) WriteDiskConfig(dc *Config) {
 
 	dc.Ignored = s.ignored
 	dc.Limit = s.limit
+	dc.MinuteLimit = s.minuteLimit
+	dc.HourlyLimit = s.hourlyLimit
+	dc.DailyLimit = s.dailyLimit
 	dc.Enabled = s.enabled
 }
 
@@ -306,7 +500,7 @@ func (s *StatsCtx) TopClientsIP(maxCount uint) (ips []netip.Addr) {
 		return nil
 	}
 
-	units, _ := s.loadUnits(limit)
+	units := s.loadPeriod(limit)
 	if units == nil {
 		return nil
 	}
@@ -331,68 +525,19 @@ func (s *StatsCtx) TopClientsIP(maxCount uint) (ips []netip.Addr) {
 	return ips
 }
 
-// deleteOldUnits walks the buckets available to tx and deletes old units.  It
-// returns the number of deletions performed.
-func deleteOldUnits(tx *bbolt.Tx, firstID uint32) (deleted int) {
-	log.Debug("stats: deleting old units until id %d", firstID)
-
-	// TODO(a.garipov): See if this is actually necessary.  Looks like a rather
-	// bizarre solution.
-	const errStop errors.Error = "stop iteration"
-
-	walk := func(name []byte, _ *bbolt.Bucket) (err error) {
-		nameID, ok := unitNameToID(name)
-		if ok && nameID >= firstID {
-			return errStop
-		}
-
-		err = tx.DeleteBucket(name)
-		if err != nil {
-			log.Debug("stats: deleting bucket: %s", err)
-
-			return nil
-		}
-
-		log.Debug("stats: deleted unit %d (name %x)", nameID, name)
-
-		deleted++
-
-		return nil
-	}
-
-	err := tx.ForEach(walk)
-	if err != nil && !errors.Is(err, errStop) {
-		log.Debug("stats: deleting units: %s", err)
-	}
-
-	return deleted
-}
+func (s *StatsCtx) flush() (cont bool, sleepFor time.Duration) {
+	id, minID := s.unitIDGen(), s.minuteIDGen()
 
-// openDB returns an error if the database can't be opened from the specified
-// file.  It's safe for concurrent use.
-func (s *StatsCtx) openDB() (err error) {
-	log.Debug("stats: opening database")
+	var prevMin *unit
+	var minLimit uint32
 
-	var db *bbolt.DB
-	db, err = bbolt.Open(s.filename, 0o644, nil)
-	if err != nil {
-		if err.Error() == "invalid argument" {
-			log.Error("AdGuard Home cannot be initialized due to an incompatible file system.\nPlease read the explanation here: https://github.com/AdguardTeam/AdGuardHome/wiki/Getting-Started#limitations")
+	// Write the previous minute unit after the locks are released, since that
+	// happens every minute.
+	defer func() {
+		if prevMin != nil {
+			s.flushMinute(prevMin, minID, minLimit)
 		}
-
-		return err
-	}
-
-	// Use defer to unlock the mutex as soon as possible.
-	defer log.Debug("stats: database opened")
-
-	s.db.Store(db)
-
-	return nil
-}
-
-func (s *StatsCtx) flush() (cont bool, sleepFor time.Duration) {
-	id := s.unitIDGen()
+	}()
 
 	s.confMu.Lock()
 	defer s.confMu.Unlock()
@@ -405,53 +550,55 @@ func (s *StatsCtx) flush() (cont bool, sleepFor time.Duration) {
 		return false, 0
 	}
 
+	if s.currMin != nil && s.currMin.id != minID {
+		prevMin, minLimit = s.currMin, uint32(s.minuteLimit/time.Minute)
+		s.currMin, s.flushingMin = newUnit(minID), prevMin
+	}
+
 	limit := uint32(s.limit.Hours())
 	if limit == 0 || ptr.id == id {
 		return true, time.Second
 	}
 
-	return s.flushDB(id, limit, ptr)
+	return s.flushDB(id, ptr)
 }
 
 // flushDB flushes the unit to the database.  confMu and currMu are expected to
 // be locked.
-func (s *StatsCtx) flushDB(id, limit uint32, ptr *unit) (cont bool, sleepFor time.Duration) {
-	db := s.db.Load()
-	if db == nil {
+func (s *StatsCtx) flushDB(id uint32, ptr *unit) (cont bool, sleepFor time.Duration) {
+	st := s.storage()
+	if st == nil {
 		return true, 0
 	}
 
 	isCommitable := true
-	tx, err := db.Begin(true)
+	tx, err := st.begin()
 	if err != nil {
-		log.Error("stats: opening transaction: %s", err)
+		log.Error("stats: %s", err)
 
 		return true, 0
 	}
 	defer func() {
-		if err = finishTxn(tx, isCommitable); err != nil {
+		if err = tx.finish(isCommitable); err != nil {
 			log.Error("stats: %s", err)
 		}
 	}()
 
 	s.curr = newUnit(id)
+	if limit := uint32(s.limit.Hours()); id >= limit {
+		s.ruleHits.prune(id - limit + 1)
+	}
 
-	flushErr := ptr.serialize().flushUnitToDB(tx, ptr.id)
+	flushErr := tx.put(resolutionHour, ptr.id, ptr.serialize())
 	if flushErr != nil {
 		log.Error("stats: flushing unit: %s", flushErr)
 		isCommitable = false
 	}
 
-	delErr := tx.DeleteBucket(idToUnitName(id - limit))
-	if delErr != nil {
-		// TODO(e.burkov):  Improve the algorithm of deleting the oldest bucket
-		// to avoid the error.
-		if errors.Is(delErr, bbolt.ErrBucketNotFound) {
-			log.Debug("stats: warning: deleting unit: %s", delErr)
-		} else {
-			isCommitable = false
-			log.Error("stats: deleting unit: %s", delErr)
-		}
+	rollupErr := s.rollup(tx, id)
+	if rollupErr != nil {
+		isCommitable = false
+		log.Error("stats: %s", rollupErr)
 	}
 
 	return true, 0
@@ -465,11 +612,40 @@ func (s *StatsCtx) flushDB(id, limit uint32, ptr *unit) (cont bool, sleepFor tim
 func (s *StatsCtx) periodicFlush() {
 	for cont, sleepFor := true, time.Duration(0); cont; time.Sleep(sleepFor) {
 		cont, sleepFor = s.flush()
+
+		err := s.saveRuleHits(false)
+		if err != nil {
+			log.Error("stats: %s", err)
+		}
 	}
 
 	log.Debug("periodic flushing finished")
 }
 
+// saveRuleHits writes the rule hits into their file, if there are changes and
+// the last save was long enough ago, unless force is true.  The file is written
+// without locking currMu.
+func (s *StatsCtx) saveRuleHits(force bool) (err error) {
+	s.currMu.Lock()
+	f := s.ruleHits.snapshot(time.Now(), force)
+	s.currMu.Unlock()
+
+	if f == nil {
+		return nil
+	}
+
+	err = writeRuleHits(s.ruleHits.filename, f)
+	if err != nil {
+		s.currMu.Lock()
+		s.ruleHits.dirty = true
+		s.currMu.Unlock()
+
+		return fmt.Errorf("saving rule hits: %w", err)
+	}
+
+	return nil
+}
+
 // setLimit sets the limit.  s.lock is expected to be locked.
 //
 // TODO(s.chzhen):  Remove it when migration to the new API is over.
@@ -494,36 +670,16 @@ func (s *StatsCtx) setLimit(limit time.Duration) {
 func (s *StatsCtx) clear() (err error) {
 	defer func() { err = errors.Annotate(err, "clearing: %w") }()
 
-	db := s.db.Swap(nil)
-	if db != nil {
-		var tx *bbolt.Tx
-		tx, err = db.Begin(true)
+	p := s.db.Swap(nil)
+	if p != nil {
+		st := *p
+		err = st.clear()
 		if err != nil {
-			log.Error("stats: opening a transaction: %s", err)
-		} else if err = finishTxn(tx, false); err != nil {
-			// Don't wrap the error since it's informative enough as is.
+			// Don't store the storage back, since it may be closed.
 			return err
 		}
 
-		// Active transactions will continue using database, but new ones won't
-		// be created.
-		err = db.Close()
-		if err != nil {
-			return fmt.Errorf("closing database: %w", err)
-		}
-
-		// All active transactions are now closed.
-		log.Debug("stats: database closed")
-	}
-
-	err = os.Remove(s.filename)
-	if err != nil {
-		log.Error("stats: %s", err)
-	}
-
-	err = s.openDB()
-	if err != nil {
-		log.Error("stats: opening database: %s", err)
+		s.db.Store(p)
 	}
 
 	// Use defer to unlock the mutex as soon as possible.
@@ -533,22 +689,27 @@ func (s *StatsCtx) clear() (err error) {
 	defer s.currMu.Unlock()
 
 	s.curr = newUnit(s.unitIDGen())
+	if s.currMin != nil {
+		s.currMin = newUnit(s.minuteIDGen())
+	}
+
+	s.ruleHits.clear(s.curr.id)
 
 	return nil
 }
 
 // loadUnits returns stored units from the database and current unit ID.
 func (s *StatsCtx) loadUnits(limit uint32) (units []*unitDB, curID uint32) {
-	db := s.db.Load()
-	if db == nil {
+	st := s.storage()
+	if st == nil {
 		return nil, 0
 	}
 
 	// Use writable transaction to ensure any ongoing writable transaction is
 	// taken into account.
-	tx, err := db.Begin(true)
+	tx, err := st.begin()
 	if err != nil {
-		log.Error("stats: opening transaction: %s", err)
+		log.Error("stats: %s", err)
 
 		return nil, 0
 	}
@@ -568,14 +729,18 @@ func (s *StatsCtx) loadUnits(limit uint32) (units []*unitDB, curID uint32) {
 	units = make([]*unitDB, 0, limit)
 	firstID := curID - limit + 1
 	for i := firstID; i != curID; i++ {
-		u := loadUnitFromDB(tx, i)
+		u, lerr := tx.load(resolutionHour, i)
+		if lerr != nil {
+			log.Error("stats: %s", lerr)
+		}
+
 		if u == nil {
 			u = &unitDB{NResult: make([]uint64, resultLast)}
 		}
 		units = append(units, u)
 	}
 
-	err = finishTxn(tx, false)
+	err = tx.finish(false)
 	if err != nil {
 		log.Error("stats: %s", err)
 	}
@@ -74,6 +74,7 @@ func TestStats(t *testing.T) {
 	t.Run("data", func(t *testing.T) {
 		const reqDomain = "domain"
 		const respUpstream = "upstream"
+		const otherUpstream = "other"
 
 		entries := []*stats.Entry{{
 			Domain:         reqDomain,
@@ -82,6 +83,9 @@ func TestStats(t *testing.T) {
 			ProcessingTime: time.Microsecond * 123456,
 			Upstream:       respUpstream,
 			UpstreamTime:   time.Microsecond * 222222,
+			QType:          "A",
+			RCode:          "NOERROR",
+			Proto:          stats.ClientProtoDoH,
 		}, {
 			Domain:         reqDomain,
 			Client:         cliIPStr,
@@ -89,8 +93,21 @@ func TestStats(t *testing.T) {
 			ProcessingTime: time.Microsecond * 123456,
 			Upstream:       respUpstream,
 			UpstreamTime:   time.Microsecond * 222222,
+			QType:          "A",
+			RCode:          "NOERROR",
+			Proto:          stats.ClientProtoPlain,
+			Cached:         true,
 		}}
 
+		lastTwo := []uint64{
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+		}
+		lastOne := []uint64{
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+			0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+		}
+
 		wantData := &stats.StatsResp{
 			TimeUnits:             "hours",
 			TopQueried:            []map[string]uint64{0: {reqDomain: 1}},
@@ -120,16 +137,55 @@ func TestStats(t *testing.T) {
 			NumReplacedSafesearch:   0,
 			NumReplacedParental:     0,
 			AvgProcessingTime:       0.123456,
+			QueryTypes: &stats.Breakdown{
+				Totals: map[string]uint64{"A": 2},
+				Series: map[string][]uint64{"A": lastTwo},
+			},
+			ResponseCodes: &stats.Breakdown{
+				Totals: map[string]uint64{"NOERROR": 2},
+				Series: map[string][]uint64{"NOERROR": lastTwo},
+			},
+			ClientProtocols: &stats.Breakdown{
+				Totals: map[string]uint64{"doh": 1, "plain": 1},
+				Series: map[string][]uint64{"doh": lastOne, "plain": lastOne},
+			},
+			ProtocolClients: map[string]uint64{"doh": 1, "plain": 1},
+			Cached:          lastOne,
+			NumCached:       1,
+			CacheHitRatio:   0.5,
+			UpstreamErrors: &stats.Breakdown{
+				Totals: map[string]uint64{otherUpstream: 1},
+				Series: map[string][]uint64{otherUpstream: lastOne},
+			},
+			UpstreamTimeouts: &stats.Breakdown{
+				Totals: map[string]uint64{respUpstream: 1},
+				Series: map[string][]uint64{respUpstream: lastOne},
+			},
+			UpstreamErrorRates: map[string]float64{
+				respUpstream:  1.0 / 3,
+				otherUpstream: 1,
+			},
 		}
 
 		for _, e := range entries {
 			s.Update(e)
 		}
 
+		s.UpdateUpstream(&stats.UpstreamEntry{Upstream: respUpstream, Timeout: true})
+		s.UpdateUpstream(&stats.UpstreamEntry{Upstream: otherUpstream})
+
 		data := &stats.StatsResp{}
 		req := httptest.NewRequest(http.MethodGet, "/control/stats", nil)
 		assertSuccessAndUnmarshal(t, data, handlers["/control/stats"], req)
 
+		// The percentiles are approximate, so check them separately.
+		assertLatency(t, 0.123456, data.ProcessingTime)
+		assertLatency(t, 0.222222, data.UpstreamTime)
+		require.Contains(t, data.UpstreamsTime, respUpstream)
+		assert.InEpsilon(t, 0.222222, data.UpstreamsTime[respUpstream]["p50"], 0.02)
+
+		data.ProcessingTime, data.UpstreamTime, data.UpstreamsTime = nil, nil, nil
+
 		assert.Equal(t, wantData, data)
 	})
 
@@ -145,6 +201,15 @@ func TestStats(t *testing.T) {
 		assertSuccessAndUnmarshal(t, nil, handlers["/control/stats_reset"], req)
 
 		_24zeroes := [24]uint64{}
+		_24floatZeroes := [24]float64{}
+		emptyLatency := &stats.Latency{
+			Totals: map[string]float64{"p50": 0, "p90": 0, "p99": 0},
+			Series: map[string][]float64{
+				"p50": _24floatZeroes[:],
+				"p90": _24floatZeroes[:],
+				"p99": _24floatZeroes[:],
+			},
+		}
 		emptyData := &stats.StatsResp{
 			TimeUnits:             "hours",
 			TopQueried:            []map[string]uint64{},
@@ -156,6 +221,32 @@ func TestStats(t *testing.T) {
 			BlockedFiltering:      _24zeroes[:],
 			ReplacedSafebrowsing:  _24zeroes[:],
 			ReplacedParental:      _24zeroes[:],
+			QueryTypes: &stats.Breakdown{
+				Totals: map[string]uint64{},
+				Series: map[string][]uint64{},
+			},
+			ResponseCodes: &stats.Breakdown{
+				Totals: map[string]uint64{},
+				Series: map[string][]uint64{},
+			},
+			ClientProtocols: &stats.Breakdown{
+				Totals: map[string]uint64{},
+				Series: map[string][]uint64{},
+			},
+			ProtocolClients: map[string]uint64{},
+			Cached:          _24zeroes[:],
+			ProcessingTime:  emptyLatency,
+			UpstreamTime:    emptyLatency,
+			UpstreamsTime:   map[string]map[string]float64{},
+			UpstreamErrors: &stats.Breakdown{
+				Totals: map[string]uint64{},
+				Series: map[string][]uint64{},
+			},
+			UpstreamTimeouts: &stats.Breakdown{
+				Totals: map[string]uint64{},
+				Series: map[string][]uint64{},
+			},
+			UpstreamErrorRates: map[string]float64{},
 		}
 
 		req = httptest.NewRequest(http.MethodGet, "/control/stats", nil)
@@ -166,6 +257,24 @@ func TestStats(t *testing.T) {
 	})
 }
 
+// assertLatency asserts that all the percentiles of l are approximately want
+// and that all of them are in the last time unit.
+func assertLatency(t *testing.T, want float64, l *stats.Latency) {
+	t.Helper()
+
+	require.NotNil(t, l)
+	require.Len(t, l.Totals, 3)
+
+	for name, v := range l.Totals {
+		assert.InEpsilon(t, want, v, 0.02, name)
+
+		series := l.Series[name]
+		require.NotEmpty(t, series, name)
+
+		assert.Equal(t, v, series[len(series)-1], name)
+	}
+}
+
 func TestLargeNumbers(t *testing.T) {
 	var curHour uint32 = 1
 	handlers := map[string]http.Handler{}
@@ -0,0 +1,94 @@
+package stats
+
+import (
+	"fmt"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// Backend is the type of the persistent storage of the statistics.
+type Backend string
+
+// Supported Backend values.
+const (
+	// BackendBolt stores the statistics in a bbolt database.  It's the
+	// default.
+	BackendBolt Backend = "bolt"
+
+	// BackendSQLite stores the statistics in an SQLite database, which can
+	// also be queried directly.
+	BackendSQLite Backend = "sqlite"
+)
+
+// validate returns an error if b isn't a supported backend.  An empty b is the
+// default one.
+func (b Backend) validate() (err error) {
+	switch b {
+	case "", BackendBolt, BackendSQLite:
+		return nil
+	default:
+		return fmt.Errorf("backend: unsupported value %q", b)
+	}
+}
+
+// unitStorage is the persistent storage of the statistics units.
+type unitStorage interface {
+	// begin starts a new writable transaction.
+	begin() (tx unitTx, err error)
+
+	// clear removes all the stored units.
+	clear() (err error)
+
+	// close closes the storage.
+	close() (err error)
+}
+
+// unitTx is a transaction of a [unitStorage].  The units are identified by
+// their resolutions and IDs.
+type unitTx interface {
+	// load returns the unit with the given resolution and ID.  udb is nil if
+	// there is no such unit.
+	load(res resolution, id uint32) (udb *unitDB, err error)
+
+	// put stores udb as the unit with the given resolution and ID, replacing
+	// the existing one, if any.
+	put(res resolution, id uint32, udb *unitDB) (err error)
+
+	// each calls f for each unit of the resolution res with the ID within
+	// [first, last] in the ascending order of IDs.  f must not use tx.
+	each(res resolution, first, last uint32, f func(id uint32, udb *unitDB)) (err error)
+
+	// deleteBefore removes the units of the resolution res with IDs less than
+	// firstID and returns the number of the removed ones.
+	deleteBefore(res resolution, firstID uint32) (deleted int, err error)
+
+	// finish commits the transaction if commit is true and rolls it back
+	// otherwise.
+	finish(commit bool) (err error)
+}
+
+// openStorage opens the storage of the statistics specified by conf.
+func openStorage(conf *Config) (st unitStorage, err error) {
+	if conf.Backend != BackendSQLite {
+		return openBoltStorage(conf.Filename)
+	}
+
+	sst, err := openSQLiteStorage(conf.Filename)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	if conf.MigrateFilename == "" {
+		return sst, nil
+	}
+
+	err = sst.migrate(conf.MigrateFilename)
+	if err != nil {
+		err = fmt.Errorf("migrating from %q: %w", conf.MigrateFilename, err)
+
+		return nil, errors.WithDeferred(err, sst.close())
+	}
+
+	return sst, nil
+}
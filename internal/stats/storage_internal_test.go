@@ -0,0 +1,76 @@
+package stats
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenStorage_migrate(t *testing.T) {
+	dir := t.TempDir()
+	boltFilename := filepath.Join(dir, "stats.db")
+
+	bst, err := openBoltStorage(boltFilename)
+	require.NoError(t, err)
+
+	btx, err := bst.begin()
+	require.NoError(t, err)
+
+	u := newUnit(100)
+	u.add(&Entry{Domain: "example.org", Client: "1.2.3.4", Result: RFiltered})
+	require.NoError(t, btx.put(resolutionHour, u.id, u.serialize()))
+	require.NoError(t, btx.put(resolutionDay, 4, u.serialize()))
+	require.NoError(t, btx.put(resolutionWeek, 1, u.serialize()))
+
+	require.NoError(t, btx.finish(true))
+	require.NoError(t, bst.close())
+
+	conf := &Config{
+		Filename:        filepath.Join(dir, "stats.sqlite"),
+		MigrateFilename: boltFilename,
+		Backend:         BackendSQLite,
+	}
+
+	st, err := openStorage(conf)
+	require.NoError(t, err)
+
+	tx, err := st.begin()
+	require.NoError(t, err)
+
+	udb, err := tx.load(resolutionHour, 100)
+	require.NoError(t, err)
+	require.NotNil(t, udb)
+
+	assert.Equal(t, uint64(1), udb.NTotal)
+	assert.Equal(t, []countPair{{Name: "example.org", Count: 1}}, udb.BlockedDomains)
+
+	assert.Equal(t, 1, countUnits(t, tx, resolutionDay))
+	assert.Equal(t, 1, countUnits(t, tx, resolutionWeek))
+
+	require.NoError(t, tx.finish(false))
+
+	// The data must not be imported again after clearing.
+	require.NoError(t, st.clear())
+	require.NoError(t, st.close())
+
+	st, err = openStorage(conf)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, st.close)
+
+	tx, err = st.begin()
+	require.NoError(t, err)
+
+	assert.Equal(t, 0, countUnits(t, tx, resolutionHour))
+
+	require.NoError(t, tx.finish(false))
+}
+
+func TestBackend_validate(t *testing.T) {
+	testutil.AssertErrorMsg(t, `backend: unsupported value "mysql"`, Backend("mysql").validate())
+
+	assert.NoError(t, Backend("").validate())
+	assert.NoError(t, BackendSQLite.validate())
+}
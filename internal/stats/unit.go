@@ -2,16 +2,16 @@ package stats
 
 import (
 	"bytes"
-	"encoding/binary"
 	"encoding/gob"
 	"fmt"
 	"slices"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/log"
-	"go.etcd.io/bbolt"
+	"github.com/AdguardTeam/golibs/stringutil"
 	"golang.org/x/exp/maps"
 )
 
@@ -24,6 +24,15 @@ const (
 
 	// maxUpstreams is the max number of top upstreams to return.
 	maxUpstreams = 100
+
+	// maxRules is the max number of top filtering rules to store in a unit and
+	// to return.
+	maxRules = 100
+
+	// maxRuleHits is the max number of filtering rules to remember the last
+	// hit of.  When it's reached, the rules matched the longest time ago are
+	// forgotten.
+	maxRuleHits = 100_000
 )
 
 // UnitIDGenFunc is the signature of a function that generates a unique ID for
@@ -32,8 +41,10 @@ type UnitIDGenFunc func() (id uint32)
 
 // Supported values of [StatsResp.TimeUnits].
 const (
-	timeUnitsHours = "hours"
-	timeUnitsDays  = "days"
+	timeUnitsMinutes = "minutes"
+	timeUnitsHours   = "hours"
+	timeUnitsDays    = "days"
+	timeUnitsWeeks   = "weeks"
 )
 
 // Result is the resulting code of processing the DNS request.
@@ -74,6 +85,34 @@ type Entry struct {
 
 	// UpstreamTime is the duration of the successful request to the upstream.
 	UpstreamTime time.Duration
+
+	// Rules are the filtering rules that matched the request, if any.
+	Rules []Rule
+
+	// QType is the name of the question type, for example "AAAA".  It's not
+	// counted if empty.
+	QType string
+
+	// RCode is the name of the response code, for example "NXDOMAIN".  It's
+	// not counted if empty, for example if there is no response.
+	RCode string
+
+	// Proto is the protocol of the client's request.  It's not counted if
+	// empty.
+	Proto ClientProto
+
+	// Cached is true if the response has been served from the cache.
+	Cached bool
+}
+
+// UpstreamEntry is a statistics data entry of a failed exchange with an
+// upstream.
+type UpstreamEntry struct {
+	// Upstream is the address of the upstream DNS server.
+	Upstream string
+
+	// Timeout is true if the exchange has failed because of a timeout.
+	Timeout bool
 }
 
 // validate returns an error if entry is not valid.
@@ -111,6 +150,48 @@ type unit struct {
 	// microseconds to each upstream.
 	upstreamsTimeSum map[string]uint64
 
+	// ruleHits stores the number of requests matched by each filtering rule.
+	ruleHits map[Rule]uint64
+
+	// listsBlocked stores the number of requests blocked by each
+	// filtering-rule list.
+	listsBlocked map[int64]uint64
+
+	// clientStats stores the statistics of each client.
+	clientStats map[string]*clientStat
+
+	// qTypes stores the number of requests for each question type.
+	qTypes map[string]uint64
+
+	// rCodes stores the number of responses with each response code.
+	rCodes map[string]uint64
+
+	// protos stores the number of requests over each protocol.
+	protos map[string]uint64
+
+	// protoClients stores the clients that used each protocol.
+	protoClients map[string]*stringutil.Set
+
+	// processingTimes stores the distribution of processing time of the
+	// requests.
+	processingTimes aghalg.Sketch
+
+	// upstreamTimes stores the distribution of durations of successful queries
+	// to all the upstreams.
+	upstreamTimes aghalg.Sketch
+
+	// upstreamsTimes stores the distribution of durations of successful
+	// queries to each upstream.
+	upstreamsTimes map[string]aghalg.Sketch
+
+	// upstreamsErrors stores the number of failed exchanges with each
+	// upstream, except the timed out ones.
+	upstreamsErrors map[string]uint64
+
+	// upstreamsTimeouts stores the number of timed out exchanges with each
+	// upstream.
+	upstreamsTimeouts map[string]uint64
+
 	// nResult stores the number of requests grouped by it's result.
 	nResult []uint64
 
@@ -127,6 +208,9 @@ type unit struct {
 	// timeSum stores the sum of processing time in microseconds of each request
 	// written by the unit.
 	timeSum uint64
+
+	// nCached stores the number of responses served from the cache.
+	nCached uint64
 }
 
 // newUnit allocates the new *unit.
@@ -137,6 +221,18 @@ func newUnit(id uint32) (u *unit) {
 		clients:            map[string]uint64{},
 		upstreamsResponses: map[string]uint64{},
 		upstreamsTimeSum:   map[string]uint64{},
+		ruleHits:           map[Rule]uint64{},
+		listsBlocked:       map[int64]uint64{},
+		clientStats:        map[string]*clientStat{},
+		qTypes:             map[string]uint64{},
+		rCodes:             map[string]uint64{},
+		protos:             map[string]uint64{},
+		protoClients:       map[string]*stringutil.Set{},
+		processingTimes:    aghalg.Sketch{},
+		upstreamTimes:      aghalg.Sketch{},
+		upstreamsTimes:     map[string]aghalg.Sketch{},
+		upstreamsErrors:    map[string]uint64{},
+		upstreamsTimeouts:  map[string]uint64{},
 		nResult:            make([]uint64, resultLast),
 		id:                 id,
 	}
@@ -173,12 +269,58 @@ type unitDB struct {
 	// responses from each upstream.
 	UpstreamsTimeSum []countPair
 
+	// RuleHits is the number of requests matched by each of the top filtering
+	// rules.  The rules that never match are found by [StatsCtx.ruleHits]
+	// instead, since it's truncated.
+	RuleHits []ruleCount
+
+	// ListsBlocked is the number of requests blocked by each filtering-rule
+	// list.
+	ListsBlocked []listCount
+
+	// ClientStats are the statistics of the clients with the most requests.
+	ClientStats []*clientStatDB
+
+	// QTypes is the number of requests for each question type.
+	QTypes []countPair
+
+	// RCodes is the number of responses with each response code.
+	RCodes []countPair
+
+	// Protos is the number of requests over each protocol.
+	Protos []countPair
+
+	// ProtoClients are the clients that used each protocol.
+	ProtoClients []protoClients
+
+	// ProcessingTimes is the distribution of processing time of the requests.
+	ProcessingTimes []aghalg.SketchBin
+
+	// UpstreamTimes is the distribution of durations of successful queries to
+	// all the upstreams.
+	UpstreamTimes []aghalg.SketchBin
+
+	// UpstreamsTimes are the distributions of durations of successful queries
+	// to each upstream.
+	UpstreamsTimes []upstreamSketch
+
+	// UpstreamsErrors is the number of failed exchanges with each upstream,
+	// except the timed out ones.
+	UpstreamsErrors []countPair
+
+	// UpstreamsTimeouts is the number of timed out exchanges with each
+	// upstream.
+	UpstreamsTimeouts []countPair
+
 	// NTotal is the total number of requests.
 	NTotal uint64
 
 	// TimeAvg is the average of processing times in microseconds of all the
 	// requests in the unit.
 	TimeAvg uint32
+
+	// NCached is the number of responses served from the cache.
+	NCached uint64
 }
 
 // newUnitID is the default UnitIDGenFunc that generates the unique id hourly.
@@ -188,38 +330,12 @@ func newUnitID() (id uint32) {
 	return uint32(time.Now().Unix() / secsInHour)
 }
 
-func finishTxn(tx *bbolt.Tx, commit bool) (err error) {
-	if commit {
-		err = errors.Annotate(tx.Commit(), "committing: %w")
-	} else {
-		err = errors.Annotate(tx.Rollback(), "rolling back: %w")
-	}
-
-	return err
-}
-
-// bucketNameLen is the length of a bucket, a 64-bit unsigned integer.
-//
-// TODO(a.garipov): Find out why a 64-bit integer is used when IDs seem to
-// always be 32 bits.
-const bucketNameLen = 8
+// newMinuteUnitID is the default UnitIDGenFunc that generates the unique id of
+// the minute unit.
+func newMinuteUnitID() (id uint32) {
+	const secsInMinute = int64(time.Minute / time.Second)
 
-// idToUnitName converts a numerical ID into a database unit name.
-func idToUnitName(id uint32) (name []byte) {
-	n := [bucketNameLen]byte{}
-	binary.BigEndian.PutUint64(n[:], uint64(id))
-
-	return n[:]
-}
-
-// unitNameToID converts a database unit name into a numerical ID.  ok is false
-// if name is not a valid database unit name.
-func unitNameToID(name []byte) (id uint32, ok bool) {
-	if len(name) < bucketNameLen {
-		return 0, false
-	}
-
-	return uint32(binary.BigEndian.Uint64(name)), true
+	return uint32(time.Now().Unix() / secsInMinute)
 }
 
 // compareCount used to sort countPair by Count in descending order.
@@ -273,23 +389,28 @@ func (u *unit) serialize() (udb *unitDB) {
 		Clients:            convertMapToSlice(u.clients, maxClients),
 		UpstreamsResponses: convertMapToSlice(u.upstreamsResponses, maxUpstreams),
 		UpstreamsTimeSum:   convertMapToSlice(u.upstreamsTimeSum, maxUpstreams),
+		RuleHits:           ruleHitsToSlice(u.ruleHits, maxRules),
+		ListsBlocked:       listsToSlice(u.listsBlocked),
+		ClientStats:        clientStatsToSlice(u.clientStats),
+		QTypes:             convertMapToSlice(u.qTypes, maxBreakdownValues),
+		RCodes:             convertMapToSlice(u.rCodes, maxBreakdownValues),
+		Protos:             convertMapToSlice(u.protos, maxBreakdownValues),
+		ProtoClients:       protoClientsToSlice(u.protoClients),
+		ProcessingTimes:    u.processingTimes.Bins(),
+		UpstreamTimes:      u.upstreamTimes.Bins(),
+		UpstreamsTimes:     upstreamSketchesToSlice(u.upstreamsTimes),
+		UpstreamsErrors:    convertMapToSlice(u.upstreamsErrors, maxUpstreams),
+		UpstreamsTimeouts:  convertMapToSlice(u.upstreamsTimeouts, maxUpstreams),
 		TimeAvg:            timeAvg,
+		NCached:            u.nCached,
 	}
 }
 
-func loadUnitFromDB(tx *bbolt.Tx, id uint32) (udb *unitDB) {
-	bkt := tx.Bucket(idToUnitName(id))
-	if bkt == nil {
-		return nil
-	}
-
-	log.Tracef("Loading unit %d", id)
-
-	var buf bytes.Buffer
-	buf.Write(bkt.Get([]byte{0}))
+// decodeUnit decodes the GOB-encoded unit data.  Any errors are logged, and
+// udb is nil in that case.
+func decodeUnit(data []byte) (udb *unitDB) {
 	udb = &unitDB{}
-
-	err := gob.NewDecoder(&buf).Decode(udb)
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(udb)
 	if err != nil {
 		log.Error("gob Decode: %s", err)
 
@@ -299,6 +420,17 @@ func loadUnitFromDB(tx *bbolt.Tx, id uint32) (udb *unitDB) {
 	return udb
 }
 
+// encode returns the GOB-encoded udb.
+func (udb *unitDB) encode() (data []byte, err error) {
+	buf := &bytes.Buffer{}
+	err = gob.NewEncoder(buf).Encode(udb)
+	if err != nil {
+		return nil, fmt.Errorf("encoding unit: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
 // deserialize assigns the appropriate values from udb to u.  u must not be nil.
 // It's safe for concurrent use.
 func (u *unit) deserialize(udb *unitDB) {
@@ -314,6 +446,21 @@ func (u *unit) deserialize(udb *unitDB) {
 	u.clients = convertSliceToMap(udb.Clients)
 	u.upstreamsResponses = convertSliceToMap(udb.UpstreamsResponses)
 	u.upstreamsTimeSum = convertSliceToMap(udb.UpstreamsTimeSum)
+	u.ruleHits = ruleHitsToMap(udb.RuleHits)
+	u.listsBlocked = listsToMap(udb.ListsBlocked)
+	u.clientStats = clientStatsToMap(udb.ClientStats)
+	u.qTypes = convertSliceToMap(udb.QTypes)
+	u.rCodes = convertSliceToMap(udb.RCodes)
+	u.protos = convertSliceToMap(udb.Protos)
+	u.protoClients = protoClientsToMap(udb.ProtoClients)
+	u.processingTimes = aghalg.Sketch{}
+	u.processingTimes.Merge(udb.ProcessingTimes)
+	u.upstreamTimes = aghalg.Sketch{}
+	u.upstreamTimes.Merge(udb.UpstreamTimes)
+	u.upstreamsTimes = upstreamSketchesToMap(udb.UpstreamsTimes)
+	u.upstreamsErrors = convertSliceToMap(udb.UpstreamsErrors)
+	u.upstreamsTimeouts = convertSliceToMap(udb.UpstreamsTimeouts)
+	u.nCached = udb.NCached
 	u.timeSum = uint64(udb.TimeAvg) * udb.NTotal
 }
 
@@ -336,29 +483,53 @@ func (u *unit) add(e *Entry) {
 		ut := uint64(e.UpstreamTime.Microseconds())
 		u.upstreamsTimeSum[e.Upstream] += ut
 	}
+
+	u.addRules(e)
+	u.addClientStat(e)
+	u.addBreakdowns(e)
+	u.addLatency(e)
 }
 
-// flushUnitToDB puts udb to the database at id.
-func (udb *unitDB) flushUnitToDB(tx *bbolt.Tx, id uint32) (err error) {
-	log.Debug("stats: flushing unit with id %d and total of %d", id, udb.NTotal)
+// merge adds the data from udb to u.  u must not be nil.
+func (u *unit) merge(udb *unitDB) {
+	if udb == nil {
+		return
+	}
 
-	bkt, err := tx.CreateBucketIfNotExists(idToUnitName(id))
-	if err != nil {
-		return fmt.Errorf("creating bucket: %w", err)
+	u.nTotal += udb.NTotal
+	for r, n := range udb.NResult[:min(len(udb.NResult), len(u.nResult))] {
+		u.nResult[r] += n
 	}
 
-	buf := &bytes.Buffer{}
-	err = gob.NewEncoder(buf).Encode(udb)
-	if err != nil {
-		return fmt.Errorf("encoding unit: %w", err)
+	addPairs(u.domains, udb.Domains)
+	addPairs(u.blockedDomains, udb.BlockedDomains)
+	addPairs(u.clients, udb.Clients)
+	addPairs(u.upstreamsResponses, udb.UpstreamsResponses)
+	addPairs(u.upstreamsTimeSum, udb.UpstreamsTimeSum)
+
+	for _, rc := range udb.RuleHits {
+		u.ruleHits[Rule{Text: rc.Text, FilterListID: rc.FilterListID}] += rc.Count
 	}
 
-	err = bkt.Put([]byte{0}, buf.Bytes())
-	if err != nil {
-		return fmt.Errorf("putting unit to database: %w", err)
+	for _, lc := range udb.ListsBlocked {
+		u.listsBlocked[lc.FilterListID] += lc.Count
+	}
+
+	for _, csdb := range udb.ClientStats {
+		u.clientStatFor(csdb.Name).merge(csdb)
 	}
 
-	return nil
+	u.mergeBreakdowns(udb)
+	u.mergeLatency(udb)
+
+	u.timeSum += uint64(udb.TimeAvg) * udb.NTotal
+}
+
+// addPairs adds the counts from pairs to m.
+func addPairs(m map[string]uint64, pairs []countPair) {
+	for _, cp := range pairs {
+		m[cp.Name] += cp.Count
+	}
 }
 
 func convertTopSlice(a []countPair) (m []map[string]uint64) {
@@ -410,7 +581,7 @@ func topsCollector(units []*unitDB, max int, ignored *aghnet.IgnoreEngine, pg pa
 //     for all units.
 func (s *StatsCtx) getData(limit uint32) (resp *StatsResp, ok bool) {
 	if limit == 0 {
-		return &StatsResp{
+		resp = &StatsResp{
 			TimeUnits: "days",
 
 			TopBlocked:            []topAddrs{},
@@ -423,7 +594,23 @@ func (s *StatsCtx) getData(limit uint32) (resp *StatsResp, ok bool) {
 			DNSQueries:           []uint64{},
 			ReplacedParental:     []uint64{},
 			ReplacedSafebrowsing: []uint64{},
-		}, true
+
+			QueryTypes:      newBreakdown(),
+			ResponseCodes:   newBreakdown(),
+			ClientProtocols: newBreakdown(),
+			ProtocolClients: map[string]uint64{},
+			Cached:          []uint64{},
+
+			ProcessingTime:     newLatency(0),
+			UpstreamTime:       newLatency(0),
+			UpstreamsTime:      map[string]map[string]float64{},
+			UpstreamErrors:     newBreakdown(),
+			UpstreamTimeouts:   newBreakdown(),
+			UpstreamErrorRates: map[string]float64{},
+		}
+		resp.finishLatency()
+
+		return resp, true
 	}
 
 	units, curID := s.loadUnits(limit)
@@ -436,6 +623,45 @@ func (s *StatsCtx) getData(limit uint32) (resp *StatsResp, ok bool) {
 
 // dataFromUnits collects and returns the statistics data.
 func (s *StatsCtx) dataFromUnits(units []*unitDB, curID uint32) (resp *StatsResp) {
+	resp = s.summarize(units)
+	s.fillCollectedStats(resp, units, curID)
+	resp.finishLatency()
+
+	return resp
+}
+
+// dataFromBuckets collects and returns the statistics data from units of the
+// resolution res, each of which is a single point of the time series.
+func (s *StatsCtx) dataFromBuckets(units []*unitDB, res resolution) (resp *StatsResp) {
+	resp = s.summarize(units)
+	resp.TimeUnits = res.timeUnits()
+
+	size := len(units)
+	resp.DNSQueries = make([]uint64, size)
+	resp.BlockedFiltering = make([]uint64, size)
+	resp.ReplacedSafebrowsing = make([]uint64, size)
+	resp.ReplacedParental = make([]uint64, size)
+
+	resp.initBreakdowns()
+	resp.initLatency()
+
+	for i, u := range units {
+		resp.DNSQueries[i] = u.NTotal
+		resp.BlockedFiltering[i] = u.NResult[RFiltered]
+		resp.ReplacedSafebrowsing[i] = u.NResult[RSafeBrowsing]
+		resp.ReplacedParental[i] = u.NResult[RParental]
+		resp.addBreakdowns(u, i)
+		resp.addLatency(u, i)
+	}
+
+	resp.finishLatency()
+
+	return resp
+}
+
+// summarize returns the statistics data with the top and total counters of
+// units filled.
+func (s *StatsCtx) summarize(units []*unitDB) (resp *StatsResp) {
 	topUpstreamsResponses, topUpstreamsAvgTime := topUpstreamsPairs(units)
 
 	resp = &StatsResp{
@@ -446,8 +672,6 @@ func (s *StatsCtx) dataFromUnits(units []*unitDB, curID uint32) (resp *StatsResp
 		TopClients:            topsCollector(units, maxClients, nil, topClientPairs(s)),
 	}
 
-	s.fillCollectedStats(resp, units, curID)
-
 	// Total counters:
 	sum := unitDB{
 		NResult: make([]uint64, resultLast),
@@ -475,6 +699,9 @@ func (s *StatsCtx) dataFromUnits(units []*unitDB, curID uint32) (resp *StatsResp
 		resp.AvgProcessingTime = microsecondsToSeconds(float64(sum.TimeAvg / timeN))
 	}
 
+	resp.summarizeBreakdowns(units)
+	resp.summarizeUpstreams(units)
+
 	return resp
 }
 
@@ -493,6 +720,8 @@ func (s *StatsCtx) fillCollectedStats(data *StatsResp, units []*unitDB, curID ui
 	data.BlockedFiltering = make([]uint64, size)
 	data.ReplacedSafebrowsing = make([]uint64, size)
 	data.ReplacedParental = make([]uint64, size)
+	data.initBreakdowns()
+	data.initLatency()
 
 	if data.TimeUnits == timeUnitsDays {
 		s.fillCollectedStatsDaily(data, units, curID, size)
@@ -505,6 +734,8 @@ func (s *StatsCtx) fillCollectedStats(data *StatsResp, units []*unitDB, curID ui
 		data.BlockedFiltering[i] += u.NResult[RFiltered]
 		data.ReplacedSafebrowsing[i] += u.NResult[RSafeBrowsing]
 		data.ReplacedParental[i] += u.NResult[RParental]
+		data.addBreakdowns(u, i)
+		data.addLatency(u, i)
 	}
 }
 
@@ -533,6 +764,8 @@ func (s *StatsCtx) fillCollectedStatsDaily(
 		data.BlockedFiltering[day] += u.NResult[RFiltered]
 		data.ReplacedSafebrowsing[day] += u.NResult[RSafeBrowsing]
 		data.ReplacedParental[day] += u.NResult[RParental]
+		data.addBreakdowns(u, day)
+		data.addLatency(u, day)
 	}
 }
 
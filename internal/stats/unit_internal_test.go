@@ -2,7 +2,10 @@ package stats
 
 import (
 	"testing"
+	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghalg"
+	"github.com/AdguardTeam/golibs/stringutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -24,6 +27,18 @@ func TestUnit_Deserialize(t *testing.T) {
 			timeSum:            0,
 			upstreamsResponses: map[string]uint64{},
 			upstreamsTimeSum:   map[string]uint64{},
+			ruleHits:           map[Rule]uint64{},
+			listsBlocked:       map[int64]uint64{},
+			clientStats:        map[string]*clientStat{},
+			qTypes:             map[string]uint64{},
+			rCodes:             map[string]uint64{},
+			protos:             map[string]uint64{},
+			protoClients:       map[string]*stringutil.Set{},
+			processingTimes:    aghalg.Sketch{},
+			upstreamTimes:      aghalg.Sketch{},
+			upstreamsTimes:     map[string]aghalg.Sketch{},
+			upstreamsErrors:    map[string]uint64{},
+			upstreamsTimeouts:  map[string]uint64{},
 		},
 		db: &unitDB{
 			NResult:            []uint64{0, 0, 0, 0, 0, 0},
@@ -57,6 +72,26 @@ func TestUnit_Deserialize(t *testing.T) {
 			upstreamsTimeSum: map[string]uint64{
 				"1.2.3.4": 246912,
 			},
+			ruleHits:     map[Rule]uint64{},
+			listsBlocked: map[int64]uint64{},
+			clientStats:  map[string]*clientStat{},
+			qTypes:       map[string]uint64{},
+			rCodes:       map[string]uint64{},
+			protos:       map[string]uint64{},
+			protoClients: map[string]*stringutil.Set{},
+			processingTimes: aghalg.Sketch{
+				293: 2,
+			},
+			upstreamTimes: aghalg.Sketch{
+				293: 2,
+			},
+			upstreamsTimes: map[string]aghalg.Sketch{
+				"1.2.3.4": {293: 2},
+			},
+			upstreamsErrors: map[string]uint64{
+				"1.2.3.4": 1,
+			},
+			upstreamsTimeouts: map[string]uint64{},
 		},
 		db: &unitDB{
 			NResult: []uint64{0, 1, 1, 0, 0, 0},
@@ -77,6 +112,21 @@ func TestUnit_Deserialize(t *testing.T) {
 			UpstreamsTimeSum: []countPair{{
 				"1.2.3.4", 246912,
 			}},
+			ProcessingTimes: []aghalg.SketchBin{{
+				Index: 293,
+				Count: 2,
+			}},
+			UpstreamTimes: []aghalg.SketchBin{{
+				Index: 293,
+				Count: 2,
+			}},
+			UpstreamsTimes: []upstreamSketch{{
+				Name: "1.2.3.4",
+				Bins: []aghalg.SketchBin{{Index: 293, Count: 2}},
+			}},
+			UpstreamsErrors: []countPair{{
+				"1.2.3.4", 1,
+			}},
 		},
 	}}
 
@@ -175,3 +225,96 @@ func TestTopUpstreamsPairs(t *testing.T) {
 		})
 	}
 }
+
+func TestUnit_breakdowns(t *testing.T) {
+	u := newUnit(0)
+	for _, e := range []*Entry{{
+		Client: "1.2.3.4",
+		QType:  "A",
+		RCode:  "NOERROR",
+		Proto:  ClientProtoDoT,
+		Cached: true,
+	}, {
+		Client: "1.2.3.4",
+		QType:  "AAAA",
+		RCode:  "NXDOMAIN",
+		Proto:  ClientProtoDoT,
+	}, {
+		Client: "5.6.7.8",
+		QType:  "A",
+		Proto:  ClientProtoPlain,
+	}} {
+		u.add(e)
+	}
+
+	udb := u.serialize()
+	assert.Equal(t, []countPair{{"A", 2}, {"AAAA", 1}}, udb.QTypes)
+	assert.ElementsMatch(t, []countPair{{"NOERROR", 1}, {"NXDOMAIN", 1}}, udb.RCodes)
+	assert.Equal(t, []countPair{{"dot", 2}, {"plain", 1}}, udb.Protos)
+	assert.Equal(t, []protoClients{{
+		Proto:   "dot",
+		Clients: []string{"1.2.3.4"},
+	}, {
+		Proto:   "plain",
+		Clients: []string{"5.6.7.8"},
+	}}, udb.ProtoClients)
+	assert.Equal(t, uint64(1), udb.NCached)
+
+	merged := newUnit(1)
+	merged.merge(udb)
+	merged.merge(udb)
+
+	assert.Equal(t, map[string]uint64{"A": 4, "AAAA": 2}, merged.qTypes)
+	assert.Equal(t, uint64(2), merged.nCached)
+	assert.Equal(t, 1, merged.protoClients["dot"].Len())
+}
+
+func TestUnit_latency(t *testing.T) {
+	u := newUnit(0)
+	for _, e := range []*Entry{{
+		Client:         "1.2.3.4",
+		Upstream:       "1.1.1.1",
+		ProcessingTime: 10 * time.Millisecond,
+		UpstreamTime:   8 * time.Millisecond,
+	}, {
+		Client:         "1.2.3.4",
+		Upstream:       "8.8.8.8",
+		ProcessingTime: 100 * time.Millisecond,
+		UpstreamTime:   90 * time.Millisecond,
+	}, {
+		Client:         "1.2.3.4",
+		ProcessingTime: time.Millisecond,
+	}} {
+		u.add(e)
+	}
+
+	u.addUpstreamFailure(&UpstreamEntry{Upstream: "1.1.1.1"})
+	u.addUpstreamFailure(&UpstreamEntry{Upstream: "8.8.8.8", Timeout: true})
+	u.addUpstreamFailure(&UpstreamEntry{Upstream: "8.8.8.8", Timeout: true})
+
+	udb := u.serialize()
+	assert.Equal(t, []countPair{{"1.1.1.1", 1}}, udb.UpstreamsErrors)
+	assert.Equal(t, []countPair{{"8.8.8.8", 2}}, udb.UpstreamsTimeouts)
+	require.Len(t, udb.UpstreamsTimes, 2)
+	assert.Equal(t, "1.1.1.1", udb.UpstreamsTimes[0].Name)
+
+	merged := newUnit(1)
+	merged.merge(udb)
+	merged.merge(udb)
+
+	assert.Equal(t, map[string]uint64{"8.8.8.8": 4}, merged.upstreamsTimeouts)
+
+	data := &StatsResp{}
+	data.summarizeUpstreams([]*unitDB{merged.serialize()})
+
+	assert.Equal(t, map[string]float64{
+		"1.1.1.1": 2.0 / 4,
+		"8.8.8.8": 4.0 / 6,
+	}, data.UpstreamErrorRates)
+	require.Contains(t, data.UpstreamsTime, "8.8.8.8")
+	assert.InEpsilon(t, 0.09, data.UpstreamsTime["8.8.8.8"]["p99"], aghalg.SketchRelAcc)
+
+	p := percentilesOf(merged.processingTimes)
+	assert.InEpsilon(t, 0.01, p["p50"], aghalg.SketchRelAcc)
+	assert.InEpsilon(t, 0.1, p["p99"], aghalg.SketchRelAcc)
+}